@@ -42,22 +42,32 @@ type ConsumerInfo struct {
 	NumPending     int            `json:"num_pending"`
 	NumRedelivered int            `json:"num_redelivered"`
 	NumWaiting     int            `json:"num_waiting"`
+	AckStalled     bool           `json:"ack_pending_stalled,omitempty"`
+	Paused         bool           `json:"paused,omitempty"`
 }
 
 type ConsumerConfig struct {
-	Durable         string        `json:"durable_name,omitempty"`
-	DeliverSubject  string        `json:"deliver_subject,omitempty"`
-	DeliverPolicy   DeliverPolicy `json:"deliver_policy"`
-	OptStartSeq     uint64        `json:"opt_start_seq,omitempty"`
-	OptStartTime    *time.Time    `json:"opt_start_time,omitempty"`
-	AckPolicy       AckPolicy     `json:"ack_policy"`
-	AckWait         time.Duration `json:"ack_wait,omitempty"`
-	MaxDeliver      int           `json:"max_deliver,omitempty"`
-	FilterSubject   string        `json:"filter_subject,omitempty"`
-	ReplayPolicy    ReplayPolicy  `json:"replay_policy"`
-	RateLimit       uint64        `json:"rate_limit_bps,omitempty"` // Bits per sec
-	SampleFrequency string        `json:"sample_freq,omitempty"`
-	MaxWaiting      int           `json:"max_waiting,omitempty"`
+	Durable           string          `json:"durable_name,omitempty"`
+	Description       string          `json:"description,omitempty"`
+	DeliverSubject    string          `json:"deliver_subject,omitempty"`
+	DeliverPolicy     DeliverPolicy   `json:"deliver_policy"`
+	OptStartSeq       uint64          `json:"opt_start_seq,omitempty"`
+	OptStartTime      *time.Time      `json:"opt_start_time,omitempty"`
+	AckPolicy         AckPolicy       `json:"ack_policy"`
+	AckWait           time.Duration   `json:"ack_wait,omitempty"`
+	MaxDeliver        int             `json:"max_deliver,omitempty"`
+	MaxAckPending     int             `json:"max_ack_pending,omitempty"`
+	FilterSubject     string          `json:"filter_subject,omitempty"`
+	FilterSubjects    []string        `json:"filter_subjects,omitempty"`
+	ReplayPolicy      ReplayPolicy    `json:"replay_policy"`
+	RateLimit         uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
+	SampleFrequency   string          `json:"sample_freq,omitempty"`
+	MaxWaiting        int             `json:"max_waiting,omitempty"`
+	DeadLetter        string          `json:"dead_letter,omitempty"`
+	BackOff           []time.Duration `json:"backoff,omitempty"`
+	FlowControl       bool            `json:"flow_control,omitempty"`
+	Heartbeat         time.Duration   `json:"idle_heartbeat,omitempty"`
+	InactiveThreshold time.Duration   `json:"inactive_threshold,omitempty"`
 }
 
 type CreateConsumerRequest struct {
@@ -159,6 +169,36 @@ var (
 	AckTerm = []byte("+TERM")
 )
 
+// Headers set on messages sent to the dead letter subject of a consumer.
+const (
+	JSDeadLetterStream     = "Nats-Dead-Letter-Stream"
+	JSDeadLetterConsumer   = "Nats-Dead-Letter-Consumer"
+	JSDeadLetterSubject    = "Nats-Dead-Letter-Subject"
+	JSDeadLetterSequence   = "Nats-Dead-Letter-Sequence"
+	JSDeadLetterDeliveries = "Nats-Dead-Letter-Deliveries"
+	JSDeadLetterReason     = "Nats-Dead-Letter-Reason"
+)
+
+// Headers set on idle heartbeats sent to push consumers.
+const (
+	JSLastConsumerSeq = "Nats-Last-Consumer"
+	JSLastStreamSeq   = "Nats-Last-Stream"
+	// JSConsumerStalled holds the reply subject of a flow control request that has not been answered.
+	JSConsumerStalled = "Nats-Consumer-Stalled"
+)
+
+// Status messages sent to push consumers.
+const (
+	jsFlowControlHdr   = "NATS/1.0 100 FlowControl Request\r\n\r\n"
+	jsIdleHeartbeatHdr = "NATS/1.0 100 Idle Heartbeat\r\n"
+)
+
+// Reasons for a message to be sent to the dead letter subject.
+const (
+	JSDeadLetterMaxDeliveries = "max_deliveries"
+	JSDeadLetterTerminated    = "terminated"
+)
+
 // Consumer is a jetstream consumer.
 type Consumer struct {
 	mu                sync.Mutex
@@ -174,29 +214,54 @@ type Consumer struct {
 	rlimit            *rate.Limiter
 	reqSub            *subscription
 	ackSub            *subscription
+	fcSub             *subscription
+	fcPre             string
+	fcReply           string
+	fcSent            int
+	hbtmr             *time.Timer
 	ackReplyT         string
 	nextMsgSubj       string
 	pending           map[uint64]int64
 	ptmr              *time.Timer
+	rdh               ttlIndex
 	rdq               []uint64
 	rdc               map[uint64]uint64
 	maxdc             uint64
+	dlp               map[uint64]pendingDeadLetter
+	dltmr             *time.Timer
+	maxp              int
+	maxpStalled       bool
 	waiting           *waitQueue
 	config            ConsumerConfig
 	store             ConsumerStore
 	active            bool
+	paused            bool
 	replay            bool
 	filterWC          bool
+	filters           []string
+	schedules         bool
 	dtmr              *time.Timer
 	dthresh           time.Duration
+	itmr              *time.Timer
+	lastActive        time.Time
 	fch               chan struct{}
 	qch               chan struct{}
 	inch              chan bool
 	sfreq             int32
 	ackEventT         string
 	deliveryExcEventT string
+	maxAckPendingT    string
 	created           time.Time
 	closed            bool
+	node              RaftNode
+}
+
+// pendingDeadLetter is a message that we could not store through our dead letter stream yet.
+type pendingDeadLetter struct {
+	sseq   uint64
+	dseq   uint64
+	dcount uint64
+	reason string
 }
 
 const (
@@ -205,9 +270,18 @@ const (
 	// JsDeleteWaitTimeDefault is the default amount of time we will wait for non-durable
 	// observables to be in an inactive state before deleting them.
 	JsDeleteWaitTimeDefault = 5 * time.Second
+	// JsFlowControlWindow is the amount of data we will deliver to a push consumer with
+	// flow control before we wait for the client to respond to a flow control request.
+	JsFlowControlWindow = 256 * 1024
 )
 
 func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
+	return mset.addConsumer(config, _EMPTY_, nil)
+}
+
+// addConsumer will add the consumer. When clustered the name is assigned by the
+// meta leader and the consumer will replicate its state through the group's node.
+func (mset *Stream) addConsumer(config *ConsumerConfig, oname string, node RaftNode) (*Consumer, error) {
 	if config == nil {
 		return nil, fmt.Errorf("consumer config required")
 	}
@@ -221,50 +295,46 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		if mset.deliveryFormsCycle(config.DeliverSubject) {
 			return nil, fmt.Errorf("consumer deliver subject forms a cycle")
 		}
-		if config.MaxWaiting != 0 {
-			return nil, fmt.Errorf("consumer in push mode can not set max waiting")
-		}
-	} else {
-		// Pull mode / work queue mode require explicit ack.
-		if config.AckPolicy != AckExplicit {
-			return nil, fmt.Errorf("consumer in pull mode requires explicit ack policy")
+	}
+	if err := checkConsumerCfg(config); err != nil {
+		return nil, err
+	}
+
+	// A dead letter stream or subject can be captured by another stream, but not by this one.
+	if config.DeadLetter != _EMPTY_ {
+		if !IsValidLiteralSubject(config.DeadLetter) {
+			return nil, fmt.Errorf("consumer dead letter subject is not a valid literal subject")
 		}
-		// They are also required to be durable since otherwise we will not know when to
-		// clean them up.
-		if config.Durable == _EMPTY_ {
-			return nil, fmt.Errorf("consumer in pull mode requires a durable name")
+		if config.DeadLetter == mset.config.Name {
+			return nil, fmt.Errorf("consumer dead letter stream can not be the consumer's stream")
 		}
-		if config.RateLimit > 0 {
-			return nil, fmt.Errorf("consumer in pull mode can not have rate limit set")
+		if mset.deliveryFormsCycle(config.DeadLetter) {
+			return nil, fmt.Errorf("consumer dead letter subject forms a cycle")
 		}
-		if config.MaxWaiting < 0 {
-			return nil, fmt.Errorf("consumer max waiting needs to be positive")
+		if config.AckPolicy == AckNone {
+			return nil, fmt.Errorf("consumer with dead letter subject requires an ack policy")
 		}
-		// Set to default if not specified.
-		if config.MaxWaiting == 0 {
-			config.MaxWaiting = JSWaitQueueDefaultMax
-		}
-	}
-
-	// Setup proper default for ack wait if we are in explicit ack mode.
-	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
-		config.AckWait = JsAckWaitDefault
-	}
-	// Setup default of -1, meaning no limit for MaxDeliver.
-	if config.MaxDeliver == 0 {
-		config.MaxDeliver = -1
 	}
 
 	// Make sure any partition subject is also a literal.
-	if config.FilterSubject != "" {
+	if config.FilterSubject != _EMPTY_ && len(config.FilterSubjects) > 0 {
+		return nil, fmt.Errorf("consumer can not have both filter subject and filter subjects")
+	}
+	filters := config.filters()
+	for i, filter := range filters {
 		// Make sure this is a valid partition of the interest subjects.
-		if !mset.validSubject(config.FilterSubject) {
+		if !mset.validSubject(filter) {
 			return nil, fmt.Errorf("consumer filter subject is not a valid subset of the interest subjects")
 		}
-		if config.AckPolicy == AckAll {
-			return nil, fmt.Errorf("consumer with filter subject can not have an ack policy of ack all")
+		for _, other := range filters[:i] {
+			if SubjectsCollide(filter, other) {
+				return nil, fmt.Errorf("consumer filter subjects can not overlap")
+			}
 		}
 	}
+	if len(filters) > 0 && config.AckPolicy == AckAll {
+		return nil, fmt.Errorf("consumer with filter subject can not have an ack policy of ack all")
+	}
 
 	// Check on start position conflicts.
 	switch config.DeliverPolicy {
@@ -305,18 +375,18 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		}
 	}
 
-	sampleFreq := 0
-	if config.SampleFrequency != "" {
-		s := strings.TrimSuffix(config.SampleFrequency, "%")
-		sampleFreq, err = strconv.Atoi(s)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse consumer sampling configuration: %v", err)
-		}
-	}
+	sampleFreq, _ := parseSampleFrequency(config.SampleFrequency)
 
 	// Hold mset lock here.
 	mset.mu.Lock()
 
+	// Check max ack pending against the account limits, this needs to happen before
+	// we compare to an existing durable since it can set the default.
+	if err := checkMaxAckPending(config, mset.jsa.maxAckPending()); err != nil {
+		mset.mu.Unlock()
+		return nil, err
+	}
+
 	// If this one is durable and already exists, we let that be ok as long as the configs match.
 	if isDurableConsumer(config) {
 		if eo, ok := mset.consumers[config.Durable]; ok {
@@ -361,10 +431,10 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		}
 
 		if len(mset.consumers) > 0 {
-			if config.FilterSubject == _EMPTY_ {
+			if len(filters) == 0 {
 				mset.mu.Unlock()
 				return nil, fmt.Errorf("multiple non-filtered observables not allowed on workqueue stream")
-			} else if !mset.partitionUnique(config.FilterSubject) {
+			} else if !mset.partitionUnique(filters) {
 				// We have a partition but it is not unique amongst the others.
 				mset.mu.Unlock()
 				return nil, fmt.Errorf("filtered consumer not unique on workqueue stream")
@@ -385,7 +455,9 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		fch:     make(chan struct{}),
 		sfreq:   int32(sampleFreq),
 		maxdc:   uint64(config.MaxDeliver),
+		maxp:    config.MaxAckPending,
 		created: time.Now().UTC(),
+		node:    node,
 	}
 	if isDurableConsumer(config) {
 		if len(config.Durable) > JSMaxNameLen {
@@ -396,6 +468,8 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		if o.isPullMode() {
 			o.waiting = newWaitQueue(config.MaxWaiting)
 		}
+	} else if oname != _EMPTY_ {
+		o.name = oname
 	} else {
 		for {
 			o.name = createConsumerName()
@@ -406,32 +480,22 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 	}
 
 	// Check if we have a rate limit set.
-	if config.RateLimit != 0 {
-		// TODO(dlc) - Make sane values or error if not sane?
-		// We are configured in bits per sec so adjust to bytes.
-		rl := rate.Limit(config.RateLimit / 8)
-		// Burst should be set to maximum msg size for this account, etc.
-		var burst int
-		if mset.config.MaxMsgSize > 0 {
-			burst = int(mset.config.MaxMsgSize)
-		} else if mset.jsa.account.limits.mpay > 0 {
-			burst = int(mset.jsa.account.limits.mpay)
-		} else {
-			s := mset.jsa.account.srv
-			burst = int(s.getOpts().MaxPayload)
-		}
-		o.rlimit = rate.NewLimiter(rl, burst)
-	}
+	o.rlimit = mset.rateLimiter(config.RateLimit)
 
 	// Check if we have  filtered subject that is a wildcard.
-	if config.FilterSubject != _EMPTY_ && !subjectIsLiteral(config.FilterSubject) {
-		o.filterWC = true
+	o.filters = filters
+	for _, filter := range filters {
+		if !subjectIsLiteral(filter) {
+			o.filterWC = true
+		}
 	}
 
 	// already under lock, mset.Name() would deadlock
 	o.stream = mset.config.Name
+	o.schedules = mset.config.AllowMsgSchedules
 	o.ackEventT = JSMetricConsumerAckPre + "." + o.stream + "." + o.name
 	o.deliveryExcEventT = JSAdvisoryConsumerMaxDeliveryExceedPre + "." + o.stream + "." + o.name
+	o.maxAckPendingT = JSAdvisoryConsumerMaxAckPendingPre + "." + o.stream + "." + o.name
 
 	store, err := mset.store.ConsumerStore(o.name, config)
 	if err != nil {
@@ -490,6 +554,18 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		o.ackSub = sub
 	}
 
+	// Setup the internal sub for the replies to our flow control requests.
+	if config.FlowControl {
+		o.fcPre = fmt.Sprintf(jsFlowControlT, mn, o.name)
+		if sub, err := mset.subscribeInternal(o.fcPre+".*", o.processFlowControl); err != nil {
+			mset.mu.Unlock()
+			o.deleteWithoutAdvisory()
+			return nil, err
+		} else {
+			o.fcSub = sub
+		}
+	}
+
 	// Setup the internal sub for next message requests.
 	if !o.isPushMode() {
 		o.nextMsgSubj = fmt.Sprintf(JSApiRequestNextT, mn, o.name)
@@ -506,12 +582,18 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 
 	// If push mode, register for notifications on interest.
 	if o.isPushMode() {
+		if config.Heartbeat > 0 {
+			o.mu.Lock()
+			o.hbtmr = time.AfterFunc(config.Heartbeat, o.sendIdleHeartbeat)
+			o.mu.Unlock()
+		}
 		o.dthresh = JsDeleteWaitTimeDefault
 		o.inch = make(chan bool, 4)
 		a.sl.RegisterNotification(config.DeliverSubject, o.inch)
 		o.active = o.hasDeliveryInterest(<-o.inch)
 		// Check if we are not durable that the delivery subject has interest.
-		if !o.isDurable() && !o.active {
+		// When clustered the interest may not have propagated to this server yet.
+		if !o.isDurable() && !o.active && node == nil {
 			o.deleteWithoutAdvisory()
 			return nil, fmt.Errorf("consumer requires interest for delivery subject when ephemeral")
 		}
@@ -522,12 +604,19 @@ func (mset *Stream) AddConsumer(config *ConsumerConfig) (*Consumer, error) {
 		o.replay = true
 	}
 
+	o.mu.Lock()
+	o.resetInactiveTimer()
+	o.mu.Unlock()
+
 	// Now start up Go routine to deliver msgs.
 	go o.loopAndDeliverMsgs(s, a)
 	// Startup our state update loop.
 	go o.updateStateLoop()
 
-	o.sendCreateAdvisory()
+	// When clustered the meta leader will send this.
+	if node == nil {
+		o.sendCreateAdvisory()
+	}
 
 	return o, nil
 }
@@ -589,6 +678,30 @@ func (o *Consumer) sendCreateAdvisory() {
 	o.sendAdvisory(subj, j)
 }
 
+func (o *Consumer) sendUpdateAdvisory() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e := JSConsumerActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Action:   ModifyEvent,
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerUpdatedPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
 // Created returns created time.
 func (o *Consumer) Created() time.Time {
 	o.mu.Lock()
@@ -650,51 +763,507 @@ func (o *Consumer) updateDeliveryInterest(localInterest bool) {
 	}
 	shouldSignal := interest && !o.active
 	o.active = interest
+	o.lastActive = time.Now()
+	// A new subscriber will not know about a flow control request we sent before.
+	if shouldSignal {
+		o.fcReply, o.fcSent = _EMPTY_, 0
+	}
 
 	// Stop and clear the delete timer always.
 	stopAndClearTimer(&o.dtmr)
 
 	// If we do not have interest anymore and we are not durable start
 	// a timer to delete us. We wait for a bit in case of server reconnect.
-	if !o.isDurable() && !interest {
-		o.dtmr = time.AfterFunc(o.dthresh, func() { o.Delete() })
+	if !o.isDurable() && !interest && o.isLeader() {
+		o.dtmr = time.AfterFunc(o.dthresh, o.deleteNotActive)
+	}
+	o.mu.Unlock()
+
+	if shouldSignal {
+		mset.signalConsumers()
+	}
+}
+
+// deleteNotActive is called when an ephemeral consumer has had no interest for a while.
+func (o *Consumer) deleteNotActive() {
+	o.mu.Lock()
+	if o.mset == nil || o.active {
+		o.mu.Unlock()
+		return
+	}
+	o.mu.Unlock()
+	o.deleteAsLeader()
+}
+
+// Will start or stop the timer that checks for inactivity based on our config.
+// Lock should be held.
+func (o *Consumer) resetInactiveTimer() {
+	stopAndClearTimer(&o.itmr)
+	if o.config.InactiveThreshold > 0 && o.isLeader() {
+		o.lastActive = time.Now()
+		o.itmr = time.AfterFunc(o.config.InactiveThreshold, o.checkInactive)
+	}
+}
+
+// checkInactive is called by our inactivity timer. If we have not seen pull requests,
+// acks or interest for our push delivery subject within the inactive threshold we
+// delete the consumer. Paused consumers are not considered inactive.
+func (o *Consumer) checkInactive() {
+	o.mu.Lock()
+	thresh := o.config.InactiveThreshold
+	if o.mset == nil || o.itmr == nil || thresh <= 0 || !o.isLeader() {
+		o.mu.Unlock()
+		return
+	}
+	if o.paused || (o.isPushMode() && o.active) {
+		o.lastActive = time.Now()
+	}
+	if next := thresh - time.Since(o.lastActive); next > 0 {
+		o.itmr.Reset(next)
+		o.mu.Unlock()
+		return
+	}
+	o.itmr = nil
+
+	e := JSConsumerInactiveAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerInactiveAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:            o.stream,
+		Consumer:          o.name,
+		InactiveThreshold: thresh,
+		LastActive:        o.lastActive.UTC(),
+	}
+	if j, err := json.MarshalIndent(e, "", "  "); err == nil {
+		o.sendAdvisory(JSAdvisoryConsumerInactivePre+"."+o.stream+"."+o.name, j)
+	}
+	o.mu.Unlock()
+
+	o.deleteAsLeader()
+}
+
+// Will delete the consumer if we are the leader. When clustered the meta leader
+// needs to remove us so we forward the delete request to it.
+func (o *Consumer) deleteAsLeader() {
+	o.mu.Lock()
+	mset, node := o.mset, o.node
+	if mset == nil {
+		o.mu.Unlock()
+		return
+	}
+	if node == nil {
+		o.mu.Unlock()
+		o.Delete()
+		return
+	}
+	if !node.Leader() {
+		o.mu.Unlock()
+		return
+	}
+	acc, stream, name := o.acc, o.stream, o.name
+	o.mu.Unlock()
+
+	// When clustered we need the meta leader to remove us. The request is processed
+	// here since we may be the meta leader, and will be forwarded otherwise.
+	if s := acc.srv; s != nil {
+		c := s.createInternalJetStreamClient()
+		c.acc = acc
+		s.jsConsumerDeleteRequest(nil, c, fmt.Sprintf(JSApiConsumerDeleteT, stream, name), _EMPTY_, nil)
+	}
+}
+
+// Config returns the consumer's configuration.
+func (o *Consumer) Config() ConsumerConfig {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.config
+}
+
+// This is a config change for the delivery subject for a
+// push based consumer.
+func (o *Consumer) updateDeliverSubject(newDeliver string) {
+	// Update the config and the dsubj
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed || o.isPullMode() {
+		return
+	}
+
+	o.acc.sl.ClearNotification(o.dsubj, o.inch)
+	o.dsubj, o.config.DeliverSubject = newDeliver, newDeliver
+	// When we register new one it will deliver to update state loop.
+	o.acc.sl.RegisterNotification(newDeliver, o.inch)
+}
+
+// Check that configs are equal but allow delivery subjects to be different.
+func configsEqualSansDelivery(a, b ConsumerConfig) bool {
+	// These were copied in so can set Delivery here.
+	a.DeliverSubject, b.DeliverSubject = _EMPTY_, _EMPTY_
+	return reflect.DeepEqual(a, b)
+}
+
+// Process the reply to a flow control request, which lets us resume delivery.
+func (o *Consumer) processFlowControl(_ *subscription, _ *client, subject, _ string, _ []byte) {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil || subject != o.fcReply {
+		o.mu.Unlock()
+		return
+	}
+	o.fcReply, o.fcSent = _EMPTY_, 0
+	o.mu.Unlock()
+
+	mset.signalConsumers()
+}
+
+// Will send a flow control request to the push consumer, delivery is stalled
+// until the client responds.
+// Lock should be held.
+func (o *Consumer) sendFlowControl() {
+	if o.mset == nil || o.mset.sendq == nil {
+		return
+	}
+	o.fcReply = fmt.Sprintf("%s.%d", o.fcPre, o.dseq)
+	dsubj, reply, sendq := o.dsubj, o.fcReply, o.mset.sendq
+	o.mu.Unlock()
+	sendq <- &jsPubMsg{dsubj, dsubj, reply, []byte(jsFlowControlHdr), nil, nil, 0}
+	o.mu.Lock()
+}
+
+// Returns true if we are waiting on a response to a flow control request.
+// Lock should be held.
+func (o *Consumer) isStalled() bool {
+	return o.fcReply != _EMPTY_
+}
+
+// Will send an idle heartbeat to the push consumer with our last delivered
+// sequences and any flow control request that is still outstanding.
+func (o *Consumer) sendIdleHeartbeat() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.mset == nil || o.hbtmr == nil {
+		return
+	}
+	if o.isLeader() && o.active && o.mset.sendq != nil {
+		hdr := fmt.Sprintf("%s%s: %d\r\n%s: %d\r\n", jsIdleHeartbeatHdr, JSLastConsumerSeq, o.dseq-1, JSLastStreamSeq, o.sseq-1)
+		if o.isStalled() {
+			hdr += fmt.Sprintf("%s: %s\r\n", JSConsumerStalled, o.fcReply)
+		}
+		dsubj, sendq := o.dsubj, o.mset.sendq
+		o.mu.Unlock()
+		sendq <- &jsPubMsg{dsubj, dsubj, _EMPTY_, []byte(hdr + _CRLF_), nil, nil, 0}
+		o.mu.Lock()
+	}
+	if o.hbtmr != nil {
+		o.hbtmr.Reset(o.config.Heartbeat)
+	}
+}
+
+// Parses the sampling configuration, e.g. "50%", returning 0 if not set.
+func parseSampleFrequency(freq string) (int, error) {
+	if freq == _EMPTY_ {
+		return 0, nil
+	}
+	sampleFreq, err := strconv.Atoi(strings.TrimSuffix(freq, "%"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse consumer sampling configuration: %v", err)
+	}
+	return sampleFreq, nil
+}
+
+// Returns a rate limiter for the rate limit in bits per second, nil if not set.
+// Lock should be held.
+func (mset *Stream) rateLimiter(bps uint64) *rate.Limiter {
+	if bps == 0 {
+		return nil
+	}
+	// TODO(dlc) - Make sane values or error if not sane?
+	// We are configured in bits per sec so adjust to bytes.
+	rl := rate.Limit(bps / 8)
+	// Burst should be set to maximum msg size for this account, etc.
+	var burst int
+	if mset.config.MaxMsgSize > 0 {
+		burst = int(mset.config.MaxMsgSize)
+	} else if mset.jsa.account.limits.mpay > 0 {
+		burst = int(mset.jsa.account.limits.mpay)
+	} else {
+		s := mset.jsa.account.srv
+		burst = int(s.getOpts().MaxPayload)
+	}
+	return rate.NewLimiter(rl, burst)
+}
+
+// Will check max ack pending against the account limit, which is also used
+// as the default when the consumer does not set one.
+func checkMaxAckPending(config *ConsumerConfig, limit int) error {
+	if config.MaxAckPending < 0 {
+		return fmt.Errorf("consumer max ack pending needs to be positive")
+	}
+	if config.AckPolicy == AckNone {
+		if config.MaxAckPending > 0 {
+			return fmt.Errorf("consumer with max ack pending requires an ack policy")
+		}
+		return nil
+	}
+	if limit > 0 {
+		if config.MaxAckPending == 0 {
+			config.MaxAckPending = limit
+		} else if config.MaxAckPending > limit {
+			return fmt.Errorf("consumer max ack pending exceeds account limit of %d", limit)
+		}
+	}
+	return nil
+}
+
+// Will check the parts of a consumer config that do not depend on the stream, and
+// will set the defaults for those. This is used when adding and updating consumers.
+func checkConsumerCfg(config *ConsumerConfig) error {
+	if config.DeliverSubject != _EMPTY_ {
+		if config.MaxWaiting != 0 {
+			return fmt.Errorf("consumer in push mode can not set max waiting")
+		}
+	} else {
+		// Pull mode / work queue mode require explicit ack.
+		if config.AckPolicy != AckExplicit {
+			return fmt.Errorf("consumer in pull mode requires explicit ack policy")
+		}
+		// They are also required to be durable since otherwise we will not know when to
+		// clean them up.
+		if config.Durable == _EMPTY_ {
+			return fmt.Errorf("consumer in pull mode requires a durable name")
+		}
+		if config.RateLimit > 0 {
+			return fmt.Errorf("consumer in pull mode can not have rate limit set")
+		}
+		if config.FlowControl {
+			return fmt.Errorf("consumer in pull mode can not have flow control set")
+		}
+		if config.Heartbeat > 0 {
+			return fmt.Errorf("consumer in pull mode can not have idle heartbeat set")
+		}
+		if config.MaxWaiting < 0 {
+			return fmt.Errorf("consumer max waiting needs to be positive")
+		}
+		// Set to default if not specified.
+		if config.MaxWaiting == 0 {
+			config.MaxWaiting = JSWaitQueueDefaultMax
+		}
+	}
+
+	if config.Heartbeat < 0 {
+		return fmt.Errorf("consumer idle heartbeat needs to be positive")
+	}
+	if config.InactiveThreshold < 0 {
+		return fmt.Errorf("consumer inactive threshold needs to be positive")
+	}
+	if config.AckWait < 0 {
+		return fmt.Errorf("consumer ack wait needs to be positive")
+	}
+
+	// The backoff schedule replaces the ack wait, starting with the first delivery.
+	// An ack wait that is not set will report the first backoff value.
+	if len(config.BackOff) > 0 {
+		if config.AckPolicy == AckNone {
+			return fmt.Errorf("consumer with backoff requires an ack policy")
+		}
+		for _, d := range config.BackOff {
+			if d <= 0 {
+				return fmt.Errorf("consumer backoff values need to be positive")
+			}
+		}
+		if config.AckWait == 0 {
+			config.AckWait = config.BackOff[0]
+		}
+	}
+
+	// Setup proper default for ack wait if we are in explicit ack mode.
+	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
+		config.AckWait = JsAckWaitDefault
+	}
+	// Setup default of -1, meaning no limit for MaxDeliver.
+	if config.MaxDeliver == 0 {
+		config.MaxDeliver = -1
+	}
+
+	_, err := parseSampleFrequency(config.SampleFrequency)
+	return err
+}
+
+// Will check that the update of a consumer config only changes the fields that
+// can be updated in place, and will set the defaults for those.
+func checkConsumerCfgUpdate(old, cfg *ConsumerConfig, maxAckPending int) error {
+	if err := checkConsumerCfg(cfg); err != nil {
+		return err
+	}
+	if err := checkMaxAckPending(cfg, maxAckPending); err != nil {
+		return err
+	}
+
+	// Everything else has to stay the same.
+	ncfg := *cfg
+	ncfg.Description, ncfg.AckWait, ncfg.BackOff = old.Description, old.AckWait, old.BackOff
+	ncfg.MaxDeliver, ncfg.RateLimit, ncfg.MaxWaiting = old.MaxDeliver, old.RateLimit, old.MaxWaiting
+	ncfg.SampleFrequency, ncfg.MaxAckPending = old.SampleFrequency, old.MaxAckPending
+	ncfg.InactiveThreshold = old.InactiveThreshold
+
+	va, vb := reflect.ValueOf(old).Elem(), reflect.ValueOf(&ncfg).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			field := strings.Split(va.Type().Field(i).Tag.Get("json"), ",")[0]
+			return fmt.Errorf("consumer %s can not be updated", strings.Replace(field, "_", " ", -1))
+		}
+	}
+	return nil
+}
+
+// Update will update the config of the consumer in place, keeping its state.
+// Only the description, ack wait, backoff, max deliver, max ack pending, rate
+// limit, sample frequency, max waiting and inactive threshold can be changed.
+func (o *Consumer) Update(config *ConsumerConfig) error {
+	if config == nil {
+		return fmt.Errorf("consumer config required")
 	}
+	o.mu.Lock()
+	mset, ocfg := o.mset, o.config
 	o.mu.Unlock()
 
-	if shouldSignal {
-		mset.signalConsumers()
-	}
+	if mset == nil {
+		return fmt.Errorf("consumer not valid")
+	}
+	mset.mu.RLock()
+	maxAckPending := mset.jsa.maxAckPending()
+	mset.mu.RUnlock()
+
+	cfg := *config
+	if err := checkConsumerCfgUpdate(&ocfg, &cfg, maxAckPending); err != nil {
+		return err
+	}
+	sampleFreq, _ := parseSampleFrequency(cfg.SampleFrequency)
+
+	mset.mu.RLock()
+	rlimit := mset.rateLimiter(cfg.RateLimit)
+	mset.mu.RUnlock()
+
+	o.mu.Lock()
+	if o.mset == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("consumer not valid")
+	}
+	o.config = cfg
+	o.maxdc = uint64(cfg.MaxDeliver)
+	o.sfreq = int32(sampleFreq)
+	o.rlimit = rlimit
+	o.maxp = cfg.MaxAckPending
+	if o.isPullMode() && cfg.MaxWaiting != ocfg.MaxWaiting {
+		o.waiting = o.waiting.resize(cfg.MaxWaiting)
+	}
+	// Redelivery depends on the ack wait and backoff so track pending again.
+	if len(o.pending) > 0 && o.isLeader() {
+		o.trackAllPending()
+	}
+	if cfg.InactiveThreshold != ocfg.InactiveThreshold {
+		o.resetInactiveTimer()
+	}
+	store, ok := o.store.(*consumerFileStore)
+	clustered := o.node != nil
+	o.mu.Unlock()
+
+	if ok {
+		if err := store.updateConfig(cfg); err != nil {
+			return err
+		}
+	}
+	// A raised max ack pending may allow us to deliver again.
+	if cfg.MaxAckPending != ocfg.MaxAckPending {
+		mset.signalConsumers()
+	}
+	// When clustered the meta leader will send this.
+	if !clustered {
+		o.sendUpdateAdvisory()
+	}
+	return nil
+}
+
+// Pause will stop the consumer from delivering messages, including redeliveries,
+// until it is resumed. Acks are still processed while paused.
+func (o *Consumer) Pause() error {
+	return o.setPaused(true)
+}
+
+// Resume will let a paused consumer deliver messages again.
+func (o *Consumer) Resume() error {
+	return o.setPaused(false)
 }
 
-// Config returns the consumer's configuration.
-func (o *Consumer) Config() ConsumerConfig {
+func (o *Consumer) setPaused(paused bool) error {
 	o.mu.Lock()
-	defer o.mu.Unlock()
-	return o.config
+	mset := o.mset
+	if mset == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("consumer not valid")
+	}
+	o.paused = paused
+	o.mu.Unlock()
+
+	// This will also replicate the paused state when clustered.
+	o.writeState()
+	mset.signalConsumers()
+	return nil
 }
 
-// This is a config change for the delivery subject for a
-// push based consumer.
-func (o *Consumer) updateDeliverSubject(newDeliver string) {
-	// Update the config and the dsubj
+// Seek will move the consumer to the given stream sequence, which is adjusted to
+// be within the stream. All pending acks and redeliveries are dropped and messages
+// from the new position will be delivered as new, starting again with a consumer
+// sequence of 1.
+func (o *Consumer) Seek(seq uint64) error {
 	o.mu.Lock()
-	defer o.mu.Unlock()
-
-	if o.closed || o.isPullMode() {
-		return
+	mset := o.mset
+	if mset == nil {
+		o.mu.Unlock()
+		return fmt.Errorf("consumer not valid")
+	}
+	// Acks on these streams remove messages, so we could skip messages that were never acked.
+	if mset.config.Retention != LimitsPolicy {
+		o.mu.Unlock()
+		return fmt.Errorf("consumer seek requires a stream with limits retention")
+	}
+	state := mset.store.State()
+	if seq < state.FirstSeq {
+		seq = state.FirstSeq
+	} else if seq > state.LastSeq+1 {
+		seq = state.LastSeq + 1
+	}
+	if seq == 0 {
+		seq = 1
+	}
+	o.sseq, o.asflr = seq, seq-1
+	o.dseq, o.adflr = 1, 0
+	o.pending, o.rdc, o.rdq, o.rdh = nil, nil, nil, ttlIndex{}
+	if o.ptmr != nil {
+		o.ptmr.Stop()
 	}
+	o.maxpStalled = false
+	// Persist and replicate our new state.
+	o.writeStateLocked(true)
+	o.mu.Unlock()
 
-	o.acc.sl.ClearNotification(o.dsubj, o.inch)
-	o.dsubj, o.config.DeliverSubject = newDeliver, newDeliver
-	// When we register new one it will deliver to update state loop.
-	o.acc.sl.RegisterNotification(newDeliver, o.inch)
+	mset.signalConsumers()
+	return nil
 }
 
-// Check that configs are equal but allow delivery subjects to be different.
-func configsEqualSansDelivery(a, b ConsumerConfig) bool {
-	// These were copied in so can set Delivery here.
-	a.DeliverSubject, b.DeliverSubject = _EMPTY_, _EMPTY_
-	return a == b
+// SeekTime will move the consumer to the first message at or after the given time.
+func (o *Consumer) SeekTime(t time.Time) error {
+	o.mu.Lock()
+	mset := o.mset
+	o.mu.Unlock()
+	if mset == nil {
+		return fmt.Errorf("consumer not valid")
+	}
+	return o.Seek(mset.store.GetSeqFromTime(t))
 }
 
 // Helper to send a reply to an ack.
@@ -706,6 +1275,15 @@ func (o *Consumer) sendAckReply(subj string) {
 
 // Process a message for the ack reply subject delivered with a message.
 func (o *Consumer) processAck(_ *subscription, _ *client, subject, reply string, msg []byte) {
+	// When clustered only the leader processes acks.
+	o.mu.Lock()
+	isLeader := o.isLeader()
+	o.lastActive = time.Now()
+	o.mu.Unlock()
+	if !isLeader {
+		return
+	}
+
 	sseq, dseq, dcount, _ := o.ReplyInfo(subject)
 
 	var skipAckReply bool
@@ -717,8 +1295,8 @@ func (o *Consumer) processAck(_ *subscription, _ *client, subject, reply string,
 		o.ackMsg(sseq, dseq, dcount)
 		o.processNextMsgReq(nil, nil, subject, reply, msg)
 		skipAckReply = true
-	case bytes.Equal(msg, AckNak):
-		o.processNak(sseq, dseq)
+	case isNak(msg):
+		o.processNak(sseq, dseq, nakDelay(msg[len(AckNak):]))
 	case bytes.Equal(msg, AckProgress):
 		o.progressUpdate(sseq)
 	case bytes.Equal(msg, AckTerm):
@@ -736,14 +1314,47 @@ func (o *Consumer) progressUpdate(seq uint64) {
 	o.mu.Lock()
 	if len(o.pending) > 0 {
 		if _, ok := o.pending[seq]; ok {
-			o.pending[seq] = time.Now().UnixNano()
+			now := time.Now().UnixNano()
+			o.pending[seq] = now
+			o.trackRedelivery(seq, now+int64(o.ackWaitFor(seq)))
 		}
 	}
 	o.mu.Unlock()
 }
 
-// Process a NAK.
-func (o *Consumer) processNak(sseq, dseq uint64) {
+// Will check for a NAK, which can be followed by a space and its options.
+func isNak(msg []byte) bool {
+	if !bytes.HasPrefix(msg, AckNak) {
+		return false
+	}
+	return len(msg) == len(AckNak) || msg[len(AckNak)] == ' '
+}
+
+// Will parse the optional delay of a NAK, e.g. -NAK {"delay":"5s"}.
+// The delay can be a duration string or in nanoseconds.
+func nakDelay(b []byte) time.Duration {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return 0
+	}
+	var nak struct {
+		Delay json.RawMessage `json:"delay"`
+	}
+	if err := json.Unmarshal(b, &nak); err != nil || len(nak.Delay) == 0 {
+		return 0
+	}
+	var delay time.Duration
+	var ds string
+	if err := json.Unmarshal(nak.Delay, &ds); err == nil {
+		delay, _ = time.ParseDuration(ds)
+	} else {
+		json.Unmarshal(nak.Delay, &delay)
+	}
+	return delay
+}
+
+// Process a NAK, with an optional delay for the redelivery.
+func (o *Consumer) processNak(sseq, dseq uint64, delay time.Duration) {
 	var mset *Stream
 	o.mu.Lock()
 	// Check for out of range.
@@ -759,7 +1370,18 @@ func (o *Consumer) processNak(sseq, dseq uint64) {
 		}
 	}
 	// If already queued up also ignore.
-	if !o.onRedeliverQueue(sseq) {
+	if o.onRedeliverQueue(sseq) {
+		o.mu.Unlock()
+		return
+	}
+	if delay > 0 {
+		if _, ok := o.pending[sseq]; ok {
+			// Move the delivered time so the ack wait runs out after the delay.
+			due := time.Now().UnixNano() + int64(delay)
+			o.pending[sseq] = due - int64(o.ackWaitFor(sseq))
+			o.trackRedelivery(sseq, due)
+		}
+	} else {
 		o.rdq = append(o.rdq, sseq)
 		mset = o.mset
 	}
@@ -771,8 +1393,17 @@ func (o *Consumer) processNak(sseq, dseq uint64) {
 
 // Process a TERM
 func (o *Consumer) processTerm(sseq, dseq, dcount uint64) {
+	// Do this before the ack since that can remove the message.
+	o.mu.Lock()
+	_, ok := o.pending[sseq]
+	// If we could not store the dead letter we keep the message pending and retry.
+	stored := !ok || o.deadLetter(sseq, dseq, dcount, JSDeadLetterTerminated)
+	o.mu.Unlock()
+
 	// Treat like an ack to suppress redelivery.
-	o.processAckMsg(sseq, dseq, dcount, false)
+	if stored {
+		o.processAckMsg(sseq, dseq, dcount, false)
+	}
 
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -804,12 +1435,55 @@ func (o *Consumer) processTerm(sseq, dseq, dcount uint64) {
 // Allows bursts to be treated in same time frame.
 const ackWaitDelay = time.Millisecond
 
-// ackWait returns how long to wait to fire the pending timer.
-func (o *Consumer) ackWait(next time.Duration) time.Duration {
-	if next > 0 {
-		return next + ackWaitDelay
+// ackWaitFor returns how long to wait for an ack of the message. With a backoff
+// schedule this depends on how many times the message has been delivered.
+// Lock should be held.
+func (o *Consumer) ackWaitFor(seq uint64) time.Duration {
+	n := len(o.config.BackOff)
+	if n == 0 {
+		return o.config.AckWait
+	}
+	if dc := o.rdc[seq]; dc < uint64(n) {
+		return o.config.BackOff[dc]
+	}
+	return o.config.BackOff[n-1]
+}
+
+// Will track when the message is due for redelivery unless acked.
+// Lock should be held.
+func (o *Consumer) trackRedelivery(seq uint64, due int64) {
+	next := o.rdh.next()
+	o.rdh.add(seq, due)
+	if next == 0 || due < next || o.ptmr == nil {
+		o.resetPendingTimer()
+	}
+}
+
+// Will track the redelivery of all pending messages. Used when we restore
+// or inherit pending state.
+// Lock should be held.
+func (o *Consumer) trackAllPending() {
+	o.rdh = ttlIndex{}
+	for seq, ts := range o.pending {
+		o.rdh.add(seq, ts+int64(o.ackWaitFor(seq)))
+	}
+	o.resetPendingTimer()
+}
+
+// Will set the pending timer to fire when the next message is due for redelivery.
+// Lock should be held.
+func (o *Consumer) resetPendingTimer() {
+	next := o.rdh.next()
+	if next == 0 {
+		stopAndClearTimer(&o.ptmr)
+		return
+	}
+	fire := time.Duration(next-time.Now().UnixNano()) + ackWaitDelay
+	if o.ptmr == nil {
+		o.ptmr = time.AfterFunc(fire, o.checkPending)
+	} else {
+		o.ptmr.Reset(fire)
 	}
-	return o.config.AckWait + ackWaitDelay
 }
 
 // This will restore the state from disk.
@@ -826,37 +1500,55 @@ func (o *Consumer) readStoredState() error {
 		o.asflr = state.AckFloor.StreamSeq
 		o.pending = state.Pending
 		o.rdc = state.Redelivered
+		o.paused = state.Paused
 	}
 
 	// Setup tracking timer if we have restored pending.
 	if len(o.pending) > 0 && o.ptmr == nil {
 		o.mu.Lock()
-		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+		o.trackAllPending()
 		o.mu.Unlock()
 	}
 	return err
 }
 
+// Return our current state.
+// Lock should be held.
+func (o *Consumer) stateLocked() *ConsumerState {
+	return &ConsumerState{
+		Delivered: SequencePair{
+			ConsumerSeq: o.dseq,
+			StreamSeq:   o.sseq,
+		},
+		AckFloor: SequencePair{
+			ConsumerSeq: o.adflr,
+			StreamSeq:   o.asflr,
+		},
+		Pending:     o.pending,
+		Redelivered: o.rdc,
+		Paused:      o.paused,
+	}
+}
+
 // Update our state to the store.
 func (o *Consumer) writeState() {
 	o.mu.Lock()
+	o.writeStateLocked(false)
+	o.mu.Unlock()
+}
+
+// Update our state to the store. Reset is set when our sequences
+// were moved back so the group will not ignore our state.
+// Lock should be held.
+func (o *Consumer) writeStateLocked(reset bool) {
 	if o.store != nil {
-		state := &ConsumerState{
-			Delivered: SequencePair{
-				ConsumerSeq: o.dseq,
-				StreamSeq:   o.sseq,
-			},
-			AckFloor: SequencePair{
-				ConsumerSeq: o.adflr,
-				StreamSeq:   o.asflr,
-			},
-			Pending:     o.pending,
-			Redelivered: o.rdc,
-		}
 		// FIXME(dlc) - Hold onto any errors.
-		o.store.Update(state)
+		o.store.Update(o.stateLocked())
+	}
+	// When clustered the leader replicates its state to the group.
+	if o.node != nil && o.node.Leader() {
+		o.node.Propose(o.encodeStateLocked(reset))
 	}
-	o.mu.Unlock()
 }
 
 func (o *Consumer) updateStateLoop() {
@@ -900,6 +1592,8 @@ func (o *Consumer) Info() *ConsumerInfo {
 		},
 		NumPending:     len(o.pending),
 		NumRedelivered: len(o.rdc),
+		AckStalled:     o.maxAckPendingReached(),
+		Paused:         o.paused,
 	}
 	// If we are a pull mode consumer, report on number of waiting requests.
 	if o.isPullMode() {
@@ -1014,9 +1708,18 @@ func (o *Consumer) processAckMsg(sseq, dseq, dcount uint64, doSample bool) {
 	}
 	o.updateStore()
 
+	// If we were stalled on max ack pending we can deliver again.
+	unstalled := o.maxpStalled && !o.maxAckPendingReached()
+	if unstalled {
+		o.maxpStalled = false
+	}
 	mset := o.mset
 	o.mu.Unlock()
 
+	if unstalled && mset != nil {
+		mset.signalConsumers()
+	}
+
 	// Let the owning stream know if we are interest or workqueue retention based.
 	if mset != nil && mset.config.Retention != LimitsPolicy {
 		if sagap > 1 {
@@ -1093,8 +1796,10 @@ func newWaitQueue(max int) *waitQueue {
 }
 
 var (
-	errWaitQueueFull = errors.New("wait queue is full")
-	errWaitQueueNil  = errors.New("wait queue is nil")
+	errMaxAckPending  = errors.New("max ack pending reached")
+	errConsumerPaused = errors.New("consumer is paused")
+	errWaitQueueFull  = errors.New("wait queue is full")
+	errWaitQueueNil   = errors.New("wait queue is nil")
 )
 
 // Adds in a new request.
@@ -1117,6 +1822,17 @@ func (wq *waitQueue) add(req *waitingRequest) error {
 	return nil
 }
 
+// Returns a new queue with at most max items, keeping as many of the
+// current requests as will fit in order.
+func (wq *waitQueue) resize(max int) *waitQueue {
+	nwq := newWaitQueue(max)
+	for i, n := wq.rp, wq.len(); n > 0 && !nwq.isFull(); n-- {
+		nwq.add(wq.reqs[i])
+		i = (i + 1) % cap(wq.reqs)
+	}
+	return nwq
+}
+
 func (wq *waitQueue) isFull() bool {
 	return wq.rp == wq.wp
 }
@@ -1166,10 +1882,11 @@ func (wq *waitQueue) pop() *waitingRequest {
 func (o *Consumer) processNextMsgReq(_ *subscription, c *client, _, reply string, msg []byte) {
 	o.mu.Lock()
 	mset := o.mset
-	if mset == nil || o.isPushMode() {
+	if mset == nil || o.isPushMode() || !o.isLeader() {
 		o.mu.Unlock()
 		return
 	}
+	o.lastActive = time.Now()
 
 	sendErr := func(status int, description string) {
 		sendq := mset.sendq
@@ -1212,7 +1929,14 @@ func (o *Consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 			wr.n--
 		} else {
 			if wr.noWait {
-				sendErr(404, "No Messages")
+				switch err {
+				case errMaxAckPending:
+					sendErr(409, "Exceeded MaxAckPending")
+				case errConsumerPaused:
+					sendErr(409, "Consumer Paused")
+				default:
+					sendErr(404, "No Messages")
+				}
 				return
 			}
 			o.waiting.add(&wr)
@@ -1255,14 +1979,172 @@ func (o *Consumer) notifyDeliveryExceeded(sseq, dcount uint64) {
 	o.sendAdvisory(o.deliveryExcEventT, j)
 }
 
-// Check to see if the candidate subject matches a filter if its present.
+// Returns true if the number of messages pending an ack is at our limit.
+// Lock should be held.
+func (o *Consumer) maxAckPendingReached() bool {
+	return o.maxp > 0 && len(o.pending) >= o.maxp
+}
+
+// Will send a max ack pending advisory when we first stall on the limit.
+// Lock should be held.
+func (o *Consumer) notifyMaxAckPending() {
+	if o.maxpStalled {
+		return
+	}
+	o.maxpStalled = true
+
+	e := JSConsumerMaxAckPendingAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerMaxAckPendingAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:        o.stream,
+		Consumer:      o.name,
+		MaxAckPending: o.maxp,
+		NumPending:    len(o.pending),
+	}
+
+	j, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.maxAckPendingT, j)
+}
+
+// Will store a copy of the message through our dead letter stream if we have one.
+// The original headers are kept, apart from the ones that were already processed
+// when the message was stored, and the origin of the message is added. Returns false
+// if the store failed, in which case we keep the message and retry after our ack wait.
+// Lock should be held.
+func (o *Consumer) deadLetter(sseq, dseq, dcount uint64, reason string) bool {
+	if o.config.DeadLetter == _EMPTY_ || o.mset == nil || o.mset.store == nil {
+		return true
+	}
+	subj, hdr, msg, _, err := o.mset.store.LoadMsg(sseq)
+	if err != nil {
+		return true
+	}
+	hdr = removeScheduleHeaders(hdr)
+	for _, key := range []string{JSMessageTTL, JSMsgRollup, JSStreamSource} {
+		hdr = removeHeader(key, hdr)
+	}
+	hdr = setHeader(JSDeadLetterStream, o.stream, hdr)
+	hdr = setHeader(JSDeadLetterConsumer, o.name, hdr)
+	hdr = setHeader(JSDeadLetterSubject, subj, hdr)
+	hdr = setHeader(JSDeadLetterSequence, strconv.FormatUint(sseq, 10), hdr)
+	hdr = setHeader(JSDeadLetterDeliveries, strconv.FormatUint(dcount, 10), hdr)
+	hdr = setHeader(JSDeadLetterReason, reason, hdr)
+
+	acc, mset, dl := o.acc, o.mset, o.config.DeadLetter
+	o.mu.Unlock()
+	dlset, err := deadLetterStream(acc, mset, dl)
+	if err == nil {
+		err = dlset.storeDirect(dl, hdr, msg)
+	}
+	o.mu.Lock()
+
+	if err == nil {
+		delete(o.dlp, sseq)
+		return true
+	}
+	if _, ok := o.dlp[sseq]; !ok {
+		if s := acc.srv; s != nil {
+			s.Warnf("JetStream failed to store a dead letter on account: %q stream: %q consumer: %q - %v", acc.Name, o.stream, o.name, err)
+		}
+		if o.dlp == nil {
+			o.dlp = make(map[uint64]pendingDeadLetter)
+		}
+		o.dlp[sseq] = pendingDeadLetter{sseq, dseq, dcount, reason}
+	}
+	if o.dltmr == nil && !o.closed {
+		o.dltmr = time.AfterFunc(o.config.AckWait, o.retryDeadLetters)
+	}
+	return false
+}
+
+// Will retry to store the dead letters that failed before. Once stored the messages
+// are removed from pending, with terminated messages being treated like an ack.
+func (o *Consumer) retryDeadLetters() {
+	o.mu.Lock()
+	o.dltmr = nil
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	pdls := make([]pendingDeadLetter, 0, len(o.dlp))
+	for _, pdl := range o.dlp {
+		pdls = append(pdls, pdl)
+	}
+	sort.Slice(pdls, func(i, j int) bool { return pdls[i].sseq < pdls[j].sseq })
+
+	var acks []pendingDeadLetter
+	for _, pdl := range pdls {
+		// Could have been acked in the meantime.
+		if _, ok := o.pending[pdl.sseq]; !ok {
+			delete(o.dlp, pdl.sseq)
+			continue
+		}
+		if !o.deadLetter(pdl.sseq, pdl.dseq, pdl.dcount, pdl.reason) {
+			continue
+		}
+		if pdl.reason == JSDeadLetterTerminated {
+			acks = append(acks, pdl)
+		} else {
+			delete(o.pending, pdl.sseq)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, pdl := range acks {
+		o.processAckMsg(pdl.sseq, pdl.dseq, pdl.dcount, false)
+	}
+}
+
+// Returns the stream for our dead letters, which is the stream with that name
+// or otherwise the stream that captures the dead letter subject.
+func deadLetterStream(acc *Account, mset *Stream, dl string) (*Stream, error) {
+	if dlset, err := acc.LookupStream(dl); err == nil {
+		return dlset, nil
+	}
+	for _, dlset := range acc.Streams() {
+		if dlset != mset && dlset.deliveryFormsCycle(dl) {
+			return dlset, nil
+		}
+	}
+	return nil, fmt.Errorf("no stream for dead letter %q", dl)
+}
+
+// Returns the filter subjects for the consumer, if any.
+func (cfg *ConsumerConfig) filters() []string {
+	if cfg.FilterSubject != _EMPTY_ {
+		return []string{cfg.FilterSubject}
+	}
+	return cfg.FilterSubjects
+}
+
+// Returns true if the consumer only delivers messages matching its filter subjects.
+func (o *Consumer) isFiltered() bool {
+	return len(o.filters) > 0
+}
+
+// Check to see if the candidate subject matches any filter if present.
 func (o *Consumer) isFilteredMatch(subj string) bool {
-	if !o.filterWC {
-		return subj == o.config.FilterSubject
+	for _, filter := range o.filters {
+		if !o.filterWC {
+			if subj == filter {
+				return true
+			}
+			continue
+		}
+		// If we are here we have a wildcard filter subject.
+		// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
+		if subjectIsSubsetMatch(subj, filter) {
+			return true
+		}
 	}
-	// If we are here we have a wildcard filter subject.
-	// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
-	return subjectIsSubsetMatch(subj, o.config.FilterSubject)
+	return false
 }
 
 // Get next available message from underlying store.
@@ -1272,19 +2154,37 @@ func (o *Consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dcoun
 	if o.mset == nil {
 		return _EMPTY_, nil, nil, 0, 0, 0, fmt.Errorf("consumer not valid")
 	}
+	if o.paused {
+		return _EMPTY_, nil, nil, 0, 0, 0, errConsumerPaused
+	}
 	for {
 		seq, dcount := o.sseq, uint64(1)
+		// Redeliveries are already pending, but new messages need to wait for acks.
+		if o.maxAckPendingReached() {
+			if len(o.rdq) == 0 {
+				o.notifyMaxAckPending()
+				return _EMPTY_, nil, nil, 0, 0, 0, errMaxAckPending
+			}
+		} else {
+			o.maxpStalled = false
+		}
 		if len(o.rdq) > 0 {
 			seq = o.rdq[0]
 			o.rdq = append(o.rdq[:0], o.rdq[1:]...)
+			// Dead letters we could not store yet are retried on their own.
+			if _, ok := o.dlp[seq]; ok {
+				continue
+			}
 			dcount = o.incDeliveryCount(seq)
 			if o.maxdc > 0 && dcount > o.maxdc {
 				// Only send once
 				if dcount == o.maxdc+1 {
 					o.notifyDeliveryExceeded(seq, dcount-1)
 				}
-				// Make sure to remove from pending.
-				delete(o.pending, seq)
+				// Make sure to remove from pending, once stored as a dead letter if needed.
+				if o.deadLetter(seq, 0, o.maxdc, JSDeadLetterMaxDeliveries) {
+					delete(o.pending, seq)
+				}
 				continue
 			}
 		}
@@ -1292,7 +2192,12 @@ func (o *Consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dcoun
 		if err == nil {
 			if dcount == 1 { // First delivery.
 				o.sseq++
-				if o.config.FilterSubject != _EMPTY_ && !o.isFilteredMatch(subj) {
+				if o.isFiltered() && !o.isFilteredMatch(subj) {
+					continue
+				}
+				// Held messages are stored again once they are due. Streams that do not
+				// allow schedules do not hold these, e.g. from a mirror, so deliver as is.
+				if o.schedules && isScheduledMsg(hdr) {
 					continue
 				}
 			}
@@ -1309,6 +2214,13 @@ func (o *Consumer) getNextMsg() (subj string, hdr, msg []byte, seq uint64, dcoun
 	}
 }
 
+// Will update if held messages need to be skipped after our stream config changed.
+func (o *Consumer) setAllowMsgSchedules(allow bool) {
+	o.mu.Lock()
+	o.schedules = allow
+	o.mu.Unlock()
+}
+
 // forceExpireFirstWaiting will force expire the first waiting.
 // Lock should be held.
 func (o *Consumer) forceExpireFirstWaiting() *waitingRequest {
@@ -1396,8 +2308,13 @@ func (o *Consumer) loopAndDeliverMsgs(s *Server, a *Account) {
 		}
 		mset = o.mset
 
-		// If we are in push mode and not active let's stop sending.
-		if o.isPushMode() && !o.active {
+		// When clustered only the leader delivers.
+		if !o.isLeader() {
+			goto waitForMsgs
+		}
+
+		// If we are in push mode and not active or waiting on flow control let's stop sending.
+		if o.isPushMode() && (!o.active || o.isStalled()) {
 			goto waitForMsgs
 		}
 
@@ -1410,7 +2327,7 @@ func (o *Consumer) loopAndDeliverMsgs(s *Server, a *Account) {
 
 		// On error either wait or return.
 		if err != nil {
-			if err == ErrStoreMsgNotFound || err == ErrStoreEOF {
+			if err == ErrStoreMsgNotFound || err == ErrStoreEOF || err == errMaxAckPending || err == errConsumerPaused {
 				goto waitForMsgs
 			} else {
 				o.mu.Unlock()
@@ -1482,13 +2399,18 @@ func (o *Consumer) ackReply(sseq, dseq, dcount uint64, ts int64) string {
 // Will return if the message was delivered or not.
 func (o *Consumer) deliverCurrentMsg(subj string, hdr, msg []byte, seq uint64, ts int64) bool {
 	o.mu.Lock()
+	// Followers do not deliver, so no need to signal them.
+	if !o.isLeader() {
+		o.mu.Unlock()
+		return true
+	}
 	if seq != o.sseq {
 		o.mu.Unlock()
 		return false
 	}
 
-	// If we are in push mode and not active let's stop sending.
-	if o.isPushMode() && !o.active {
+	// If we are in push mode and not active or waiting on flow control let's stop sending.
+	if o.isPushMode() && (!o.active || o.isStalled()) {
 		o.mu.Unlock()
 		return false
 	}
@@ -1499,12 +2421,23 @@ func (o *Consumer) deliverCurrentMsg(subj string, hdr, msg []byte, seq uint64, t
 		return false
 	}
 
+	// If we are paused or have too many messages pending an ack let's stop sending.
+	if o.paused {
+		o.mu.Unlock()
+		return false
+	}
+	if o.maxAckPendingReached() {
+		o.notifyMaxAckPending()
+		o.mu.Unlock()
+		return false
+	}
+
 	// Bump store sequence here.
 	o.sseq++
 
 	// If we are partitioned and we do not match, do not consider this a failure.
 	// Go ahead and return true.
-	if o.config.FilterSubject != _EMPTY_ && !o.isFilteredMatch(subj) {
+	if o.isFiltered() && !o.isFilteredMatch(subj) {
 		o.mu.Unlock()
 		return true
 	}
@@ -1559,6 +2492,17 @@ func (o *Consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dcount u
 
 	o.dseq++
 
+	// Since we just sent a message we are not idle.
+	if o.hbtmr != nil {
+		o.hbtmr.Reset(o.config.Heartbeat)
+	}
+	if o.config.FlowControl && dsubj == o.dsubj {
+		o.fcSent += len(hdr) + len(msg)
+		if o.fcSent >= JsFlowControlWindow && !o.isStalled() {
+			o.sendFlowControl()
+		}
+	}
+
 	o.updateStore()
 }
 
@@ -1568,10 +2512,9 @@ func (o *Consumer) trackPending(seq uint64) {
 	if o.pending == nil {
 		o.pending = make(map[uint64]int64)
 	}
-	if o.ptmr == nil {
-		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
-	}
-	o.pending[seq] = time.Now().UnixNano()
+	now := time.Now().UnixNano()
+	o.pending[seq] = now
+	o.trackRedelivery(seq, now+int64(o.ackWaitFor(seq)))
 }
 
 // didNotDeliver is called when a delivery for a consumer message failed.
@@ -1636,45 +2579,32 @@ func (o *Consumer) checkPending() {
 		o.mu.Unlock()
 		return
 	}
-	ttl := int64(o.config.AckWait)
-	next := int64(o.ackWait(0))
+	// Only the leader tracks redeliveries.
+	if !o.isLeader() {
+		stopAndClearTimer(&o.ptmr)
+		o.mu.Unlock()
+		return
+	}
 	now := time.Now().UnixNano()
 	shouldSignal := false
 
-	// Since we can update timestamps, we have to review all pending.
-	// We may want to unlock here or warn if list is big.
-	// We also need to sort after.
+	// Only look at messages that are due. Entries for messages that have been
+	// acked or have a newer deadline, e.g. from a progress update, are skipped.
 	var expired []uint64
-	for seq, ts := range o.pending {
-		elapsed := now - ts
-		if elapsed >= ttl {
-			if !o.onRedeliverQueue(seq) {
-				expired = append(expired, seq)
-				shouldSignal = true
-			}
-		} else if ttl-elapsed < next {
-			// Update when we should fire next.
-			next = ttl - elapsed
+	for _, seq := range o.rdh.expired(now) {
+		ts, ok := o.pending[seq]
+		if !ok || ts+int64(o.ackWaitFor(seq)) > now || o.onRedeliverQueue(seq) {
+			continue
 		}
+		expired = append(expired, seq)
+		shouldSignal = true
 	}
 
 	if len(expired) > 0 {
 		sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
 		o.rdq = append(o.rdq, expired...)
-		// Now we should update the timestamp here since we are redelivering.
-		// We will use an incrementing time to preserve order for any other redelivery.
-		off := now - o.pending[expired[0]]
-		for _, seq := range expired {
-			o.pending[seq] += off
-		}
-	}
-
-	if len(o.pending) > 0 {
-		o.ptmr.Reset(o.ackWait(time.Duration(next)))
-	} else {
-		o.ptmr.Stop()
-		o.ptmr = nil
 	}
+	o.resetPendingTimer()
 	o.mu.Unlock()
 
 	if shouldSignal {
@@ -1712,24 +2642,26 @@ func (o *Consumer) NextSeq() uint64 {
 }
 
 // This will select the store seq to start with based on the
-// partition subject.
+// partition subjects. With multiple filter subjects we start with
+// the oldest of the last messages for each of them.
 func (o *Consumer) selectSubjectLast() {
 	stats := o.mset.store.State()
 	if stats.LastSeq == 0 {
 		o.sseq = stats.LastSeq
 		return
 	}
-	// FIXME(dlc) - this is linear and can be optimized by store layer.
-	for seq := stats.LastSeq; seq >= stats.FirstSeq; seq-- {
-		subj, _, _, _, err := o.mset.store.LoadMsg(seq)
-		if err == ErrStoreMsgNotFound {
-			continue
-		}
-		if o.isFilteredMatch(subj) {
-			o.sseq = seq
-			return
+	// Start with the most recent message for any of our filters.
+	var lseq uint64
+	for _, filter := range o.filters {
+		for _, ss := range o.mset.store.SubjectsState(filter) {
+			if ss.Last > lseq {
+				lseq = ss.Last
+			}
 		}
 	}
+	if lseq > 0 {
+		o.sseq = lseq
+	}
 }
 
 // Will select the starting sequence.
@@ -1741,7 +2673,7 @@ func (o *Consumer) selectStartingSeqNo() {
 		} else if o.config.DeliverPolicy == DeliverLast {
 			o.sseq = stats.LastSeq
 			// If we are partitioned here we may need to walk backwards.
-			if o.config.FilterSubject != _EMPTY_ {
+			if o.isFiltered() {
 				o.selectSubjectLast()
 			}
 		} else if o.config.OptStartTime != nil {
@@ -1832,23 +2764,37 @@ func (o *Consumer) hasNoLocalInterest() bool {
 // This is when the underlying stream has been purged.
 func (o *Consumer) purge(sseq uint64) {
 	o.mu.Lock()
-	o.sseq = sseq
-	o.asflr = sseq - 1
-	o.adflr = o.dseq - 1
-	if len(o.pending) > 0 {
-		o.pending = nil
-		if o.ptmr != nil {
-			o.ptmr.Stop()
-			// Do not nil this out here. This allows checkPending to fire
-			// and still be ok and not panic.
+	// A partial purge may leave us past the new first sequence.
+	if sseq > o.sseq {
+		o.sseq = sseq
+	}
+	if sseq > o.asflr+1 {
+		o.asflr = sseq - 1
+	}
+	// Remove any pending below the new first sequence.
+	for seq := range o.pending {
+		if seq < sseq {
+			delete(o.pending, seq)
+		}
+	}
+	if len(o.pending) == 0 {
+		o.adflr = o.dseq - 1
+		if o.pending != nil {
+			o.pending = nil
+			o.rdh = ttlIndex{}
+			if o.ptmr != nil {
+				o.ptmr.Stop()
+				// Do not nil this out here. This allows checkPending to fire
+				// and still be ok and not panic.
+			}
 		}
 	}
 	// We need to remove all those being queued for redelivery under o.rdq
 	if len(o.rdq) > 0 {
 		var newRDQ []uint64
-		for _, sseq := range o.rdq {
-			if sseq >= o.sseq {
-				newRDQ = append(newRDQ, sseq)
+		for _, seq := range o.rdq {
+			if seq >= sseq {
+				newRDQ = append(newRDQ, seq)
 			}
 		}
 		// Replace with new list. Most of the time this will be nil.
@@ -1889,7 +2835,8 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	}
 	o.closed = true
 
-	if dflag && advisory {
+	// When clustered the meta leader will send this.
+	if dflag && advisory && o.node == nil {
 		o.sendDeleteAdvisoryLocked()
 	}
 
@@ -1902,10 +2849,15 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	o.active = false
 	ackSub := o.ackSub
 	reqSub := o.reqSub
+	fcSub := o.fcSub
 	o.ackSub = nil
 	o.reqSub = nil
+	o.fcSub = nil
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
+	stopAndClearTimer(&o.itmr)
+	stopAndClearTimer(&o.hbtmr)
+	stopAndClearTimer(&o.dltmr)
 	delivery := o.config.DeliverSubject
 	o.waiting = nil
 	o.mu.Unlock()
@@ -1924,6 +2876,7 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	}
 	mset.unsubscribe(ackSub)
 	mset.unsubscribe(reqSub)
+	mset.unsubscribe(fcSub)
 	delete(mset.consumers, o.name)
 	rp := mset.config.Retention
 	mset.mu.Unlock()
@@ -18,6 +18,10 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -38,6 +42,7 @@ import (
 	"time"
 
 	"github.com/minio/highwayhash"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type FileStoreConfig struct {
@@ -49,6 +54,32 @@ type FileStoreConfig struct {
 	ReadCacheExpire time.Duration
 	// SyncInterval is how often we sync to disk in the background.
 	SyncInterval time.Duration
+	// Cipher is the cipher used to encrypt data at rest when a Key is present.
+	Cipher StoreCipher
+	// Key is the server encryption key. If set, message blocks, their index
+	// files and consumer state will be encrypted at rest.
+	Key []byte
+}
+
+// StoreCipher is the cipher used to encrypt a file store at rest.
+type StoreCipher int
+
+const (
+	// ChaCha is ChaCha20-Poly1305.
+	ChaCha StoreCipher = iota
+	// AES is AES-GCM.
+	AES
+)
+
+func (cipher StoreCipher) String() string {
+	switch cipher {
+	case ChaCha:
+		return "ChaCha20-Poly1305"
+	case AES:
+		return "AES-GCM"
+	default:
+		return "Unknown StoreCipher"
+	}
 }
 
 // FileStreamInfo allows us to remember created time.
@@ -69,11 +100,15 @@ type fileStore struct {
 	state    StreamState
 	scb      func(int64)
 	ageChk   *time.Timer
+	ttls     ttlIndex
+	ttlChk   *time.Timer
+	sched    schedIndex
 	syncTmr  *time.Timer
 	cfg      FileStreamInfo
 	fcfg     FileStoreConfig
 	lmb      *msgBlock
 	blks     []*msgBlock
+	fss      subjectIndex
 	hh       hash.Hash64
 	wmb      *bytes.Buffer
 	fch      chan struct{}
@@ -107,6 +142,16 @@ type msgBlock struct {
 	dch    chan struct{}
 	qch    chan struct{}
 	lchk   [8]byte
+	kfn    string
+	sc     StoreCipher
+	bek    cipher.AEAD
+	aek    cipher.AEAD
+	woff   int64
+	cmp    StoreCompression
+	rawsz  uint64
+	cbytes uint64
+	gone   bool
+	hdrIdx bool
 }
 
 type cache struct {
@@ -134,6 +179,10 @@ const (
 	magic = uint8(22)
 	// Version
 	version = uint8(1)
+	// Version of the consumer state, which adds flags to the first version.
+	consumerStateVersion = uint8(2)
+	// Version of the block index, which adds flags to the first version.
+	indexVersion = uint8(2)
 	// hdrLen
 	hdrLen = 2
 	// This is where we keep the streams.
@@ -146,10 +195,14 @@ const (
 	blkScan = "%d.blk"
 	// used to scan index file names.
 	indexScan = "%d.idx"
+	// used to scan encryption key file names.
+	keyScan = "%d.key"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
 	consumerState = "o.dat"
+	// Encryption key file for a consumer.
+	consumerKey = "o.key"
 	// This is where we keep state on templates.
 	tmplsDir = "templates"
 	// Maximum size of a write buffer we may consider for re-use.
@@ -196,6 +249,9 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.Cipher != ChaCha && fcfg.Cipher != AES {
+		return nil, fmt.Errorf("unknown store cipher")
+	}
 
 	// Check the directory
 	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
@@ -278,6 +334,7 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 		return err
 	}
 	// Limits checks and enforcement.
+	fs.enforcePerSubjectLimits()
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
 	// Do age timers.
@@ -334,9 +391,15 @@ const msgHdrSize = 22
 const checksumSize = 8
 
 // This is the max room needed for index header.
-const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
+const indexHdrSize = 8*binary.MaxVarintLen64 + hdrLen + checksumSize
+
+// Flags for the block index.
+const (
+	// The block has messages for our header indexes, e.g. with their own TTL.
+	blkHdrIdxFlag = 1 << iota
+)
 
-func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
+func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, error) {
 	var le = binary.LittleEndian
 
 	mb := &msgBlock{index: index, expire: fs.fcfg.ReadCacheExpire}
@@ -344,42 +407,111 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
 	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = path.Join(mdir, fi.Name())
 	mb.ifn = path.Join(mdir, fmt.Sprintf(indexScan, index))
+	mb.kfn = path.Join(mdir, fmt.Sprintf(keyScan, index))
 
 	if mb.hh == nil {
 		key := sha256.Sum256(fs.hashKeyForBlock(index))
 		mb.hh, _ = highwayhash.New64(key[:])
 	}
 
+	// Check for encryption. Plaintext blocks will be converted if we are encrypting.
+	if _, err := os.Stat(mb.kfn); err == nil {
+		// Finish converting this block if we crashed after writing the key file.
+		if _, err := os.Stat(mb.encryptedBlockFile()); err == nil {
+			if err := mb.finishConvertToEncrypted(); err != nil {
+				return nil, fmt.Errorf("could not encrypt message block [%d]: %v", index, err)
+			}
+		}
+		sc, seed, err := fs.loadEncryptionSeed(mb.kfn, fs.cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := mb.setupEncryption(sc, seed); err != nil {
+			return nil, err
+		}
+	} else if fs.isEncrypted() {
+		if err := fs.convertToEncrypted(mb); err != nil {
+			return nil, fmt.Errorf("could not encrypt message block [%d]: %v", index, err)
+		}
+	}
+
 	// Open up the message file, but we will try to recover from the index file.
 	// We will check that the last checksums match.
 	file, err := os.Open(mb.mfn)
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	defer file.Close()
 
+	// Check if this block has been compressed or encrypted. If so we need to load it to look inside.
+	var raw []byte
+	var size int64
+	var loaded bool
+	if fi, err := file.Stat(); err == nil {
+		size = fi.Size()
+	}
+	var chdr [cmpHdrSize]byte
+	if n, _ := file.ReadAt(chdr[:], 0); n == cmpHdrSize {
+		if alg, rawsz, ok := compressionHeader(chdr[:]); ok {
+			mb.cmp, mb.rawsz = alg, rawsz
+		}
+	}
+	if mb.cmp != NoCompression || mb.bek != nil {
+		if mb.cmp == NoCompression {
+			raw, err = mb.recoverFrames()
+		} else {
+			raw, err = mb.loadBlock()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not load message block [%d]: %v", index, err)
+		}
+		loaded = true
+	}
+	// Helper to read from the block at the given offset.
+	readAt := func(buf []byte, off int64) error {
+		if loaded {
+			if off < 0 || off+int64(len(buf)) > int64(len(raw)) {
+				return io.EOF
+			}
+			copy(buf, raw[off:])
+			return nil
+		}
+		_, err := file.ReadAt(buf, off)
+		return err
+	}
+	if mb.cmp != NoCompression {
+		// Charge relative to our size on disk once our accounting is known.
+		fsize := size
+		defer func() { mb.setCompressedCharge(uint64(fsize)) }()
+	}
+	if loaded {
+		size = int64(len(raw))
+	}
+
 	// Read our index file. Use this as source of truth if possible.
 	if err := mb.readIndexInfo(); err == nil {
 		// Quick sanity check here.
 		// Note this only checks that the message blk file is not newer then this file.
 		var lchk [8]byte
-		file.ReadAt(lchk[:], fi.Size()-8)
+		readAt(lchk[:], size-8)
 		if bytes.Equal(lchk[:], mb.lchk[:]) {
 			fs.blks = append(fs.blks, mb)
-			return mb
+			return mb, nil
 		}
 		// Fall back on the data file itself. We will keep the delete map if present.
 		mb.msgs = 0
 		mb.bytes = 0
 		mb.first.seq = 0
 	}
+	// We do not know if we have messages for our header indexes, so we will check.
+	mb.hdrIdx = true
 
 	// Use data file itself to rebuild.
 	var hdr [msgHdrSize]byte
 	var offset int64
 
 	for {
-		if _, err := file.ReadAt(hdr[:], offset); err != nil {
+		if err := readAt(hdr[:], offset); err != nil {
 			// FIXME(dlc) - If this is not EOF we probably should try to fix.
 			break
 		}
@@ -406,7 +538,7 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
 	mb.writeIndexInfo()
 	fs.blks = append(fs.blks, mb)
 	fs.lmb = mb
-	return mb
+	return mb, nil
 }
 
 func (fs *fileStore) recoverMsgs() error {
@@ -430,7 +562,11 @@ func (fs *fileStore) recoverMsgs() error {
 	for _, fi := range fis {
 		var index uint64
 		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
-			if mb := fs.recoverMsgBlock(fi, index); mb != nil {
+			mb, err := fs.recoverMsgBlock(fi, index)
+			if err != nil {
+				return err
+			}
+			if mb != nil {
 				if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
 					fs.state.FirstSeq = mb.first.seq
 					fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
@@ -449,7 +585,12 @@ func (fs *fileStore) recoverMsgs() error {
 	if len(fs.blks) > 0 {
 		sort.Slice(fs.blks, func(i, j int) bool { return fs.blks[i].index < fs.blks[j].index })
 		fs.lmb = fs.blks[len(fs.blks)-1]
-		err = fs.enableLastMsgBlockForWriting()
+		// We can not append to a compressed block.
+		if fs.lmb.cmp != NoCompression {
+			_, err = fs.newMsgBlockForWrite()
+		} else {
+			err = fs.enableLastMsgBlockForWriting()
+		}
 	} else {
 		_, err = fs.newMsgBlockForWrite()
 	}
@@ -458,7 +599,17 @@ func (fs *fileStore) recoverMsgs() error {
 		return err
 	}
 
+	// Compress any sealed blocks if needed, e.g. from a restored snapshot.
+	if alg := fs.cfg.Compression; alg != NoCompression {
+		for _, mb := range fs.blks {
+			if mb != fs.lmb {
+				mb.compress(alg)
+			}
+		}
+	}
+
 	// Limits checks and enforcement.
+	fs.enforcePerSubjectLimits()
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
 
@@ -467,6 +618,13 @@ func (fs *fileStore) recoverMsgs() error {
 		fs.startAgeChk()
 		fs.expireMsgsLocked()
 	}
+	// Same for messages with their own TTL, and track any held messages.
+	if (fs.cfg.AllowMsgTTL || fs.cfg.AllowMsgSchedules) && fs.state.Msgs > 0 {
+		fs.buildHeaderIndexes()
+		fs.mu.Unlock()
+		fs.expireTTLMsgs()
+		fs.mu.Lock()
+	}
 	return nil
 }
 
@@ -508,7 +666,7 @@ func (fs *fileStore) GetSeqFromTime(t time.Time) uint64 {
 func (fs *fileStore) StorageBytesUpdate(cb func(int64)) {
 	fs.mu.Lock()
 	fs.scb = cb
-	bsz := fs.state.Bytes
+	bsz := fs.chargedBytes()
 	fs.mu.Unlock()
 	if cb != nil && bsz > 0 {
 		cb(int64(bsz))
@@ -518,7 +676,519 @@ func (fs *fileStore) StorageBytesUpdate(cb func(int64)) {
 // Helper to get hash key for specific message block.
 // Lock should be held
 func (fs *fileStore) hashKeyForBlock(index uint64) []byte {
-	return []byte(fmt.Sprintf("%s-%d", fs.cfg.Name, index))
+	return blockHashKey(fs.cfg.Name, index)
+}
+
+// Returns the hash key for a message block of the given stream.
+func blockHashKey(stream string, index uint64) []byte {
+	return []byte(fmt.Sprintf("%s-%d", stream, index))
+}
+
+// Returns the checksum we keep next to meta data, keyed by name.
+func metaChecksum(name string, meta []byte) string {
+	key := sha256.Sum256([]byte(name))
+	hh, _ := highwayhash.New64(key[:])
+	hh.Write(meta)
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// Encryption at rest.
+//
+// Each message block and consumer state file has its own random seed. The seed is
+// sealed with a key encryption key derived from the server key and stored next to
+// the data it protects. Message blocks are written as frames sealed with an AEAD keyed
+// from the seed, one for each write to the block. A frame is the length of the sealed
+// contents followed by the nonce and the sealed contents, with the offset of the frame
+// used as additional data so frames can not be moved. Index files and consumer state
+// are sealed with an AEAD keyed from the seed as well.
+
+const (
+	// Size of our random seeds.
+	seedSize = 32
+	// Contexts for deriving the block and AEAD keys from a seed.
+	bekContext = "blk"
+	aekContext = "aek"
+	// Size of the length of an encrypted block frame.
+	frameHdrSize = 4
+)
+
+var (
+	errNoEncryptionKey = errors.New("encrypted store but no encryption key configured")
+	errBadKeyFile      = errors.New("malformed or corrupt encryption key file")
+	errBadCipherText   = errors.New("malformed or corrupt encrypted data")
+)
+
+// Derive a key for the given context from the given secret.
+func deriveKey(secret []byte, context string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(context))
+	return mac.Sum(nil)
+}
+
+// Will return an AEAD for the given cipher and key.
+func genAEAD(sc StoreCipher, key []byte) (cipher.AEAD, error) {
+	switch sc {
+	case ChaCha:
+		return chacha20poly1305.New(key)
+	case AES:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("unknown store cipher")
+}
+
+// Seal the buffer with a random nonce which is prepended.
+func sealWithNonce(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	nonce := make([]byte, ns, ns+len(buf)+aek.Overhead())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aek.Seal(nonce, nonce, buf, nil), nil
+}
+
+// Open a buffer sealed with sealWithNonce.
+func openWithNonce(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	if len(buf) < ns+aek.Overhead() {
+		return nil, errBadCipherText
+	}
+	return aek.Open(nil, buf[:ns], buf[ns:], nil)
+}
+
+// Returns true if we are configured to encrypt at rest.
+func (fs *fileStore) isEncrypted() bool {
+	return len(fs.fcfg.Key) > 0
+}
+
+// Generate a new random seed and write it sealed to the key file.
+func (fs *fileStore) genEncryptionSeed(kfn, context string) (StoreCipher, []byte, error) {
+	sc, seed, buf, err := fs.genEncryptionKey(context)
+	if err != nil {
+		return sc, nil, err
+	}
+	if err := ioutil.WriteFile(kfn, buf, 0644); err != nil {
+		return sc, nil, err
+	}
+	return sc, seed, nil
+}
+
+// Generate a new random seed and the contents of its key file.
+// The key file is written as magic, version, cipher followed by the sealed seed.
+func (fs *fileStore) genEncryptionKey(context string) (StoreCipher, []byte, []byte, error) {
+	sc := fs.fcfg.Cipher
+	kek, err := genAEAD(sc, deriveKey(fs.fcfg.Key, context))
+	if err != nil {
+		return sc, nil, nil, err
+	}
+	seed := make([]byte, seedSize)
+	if _, err := crand.Read(seed); err != nil {
+		return sc, nil, nil, err
+	}
+	sseed, err := sealWithNonce(kek, seed)
+	if err != nil {
+		return sc, nil, nil, err
+	}
+	return sc, seed, append([]byte{magic, version, byte(sc)}, sseed...), nil
+}
+
+// Load and open the seed from the key file.
+func (fs *fileStore) loadEncryptionSeed(kfn, context string) (StoreCipher, []byte, error) {
+	buf, err := ioutil.ReadFile(kfn)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := checkHeader(buf); err != nil || len(buf) < hdrLen+1 {
+		return 0, nil, errBadKeyFile
+	}
+	if !fs.isEncrypted() {
+		return 0, nil, errNoEncryptionKey
+	}
+	sc := StoreCipher(buf[hdrLen])
+	kek, err := genAEAD(sc, deriveKey(fs.fcfg.Key, context))
+	if err != nil {
+		return sc, nil, err
+	}
+	seed, err := openWithNonce(kek, buf[hdrLen+1:])
+	if err != nil {
+		return sc, nil, fmt.Errorf("could not decrypt key file [%q]: %v", kfn, err)
+	}
+	return sc, seed, nil
+}
+
+// Setup the block and index keys from the seed.
+// Lock should be held.
+func (mb *msgBlock) setupEncryption(sc StoreCipher, seed []byte) error {
+	bek, err := genAEAD(sc, deriveKey(seed, bekContext))
+	if err != nil {
+		return err
+	}
+	aek, err := genAEAD(sc, deriveKey(seed, aekContext))
+	if err != nil {
+		return err
+	}
+	mb.sc, mb.bek, mb.aek = sc, bek, aek
+	return nil
+}
+
+// Will seal the buffer as a frame to be written at the offset.
+func (mb *msgBlock) sealFrame(buf []byte, off int64) ([]byte, error) {
+	ns := mb.bek.NonceSize()
+	frame := make([]byte, frameHdrSize+ns, frameHdrSize+ns+len(buf)+mb.bek.Overhead())
+	nonce := frame[frameHdrSize:]
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], uint64(off))
+	frame = mb.bek.Seal(frame, nonce, buf, ad[:])
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)-frameHdrSize))
+	return frame, nil
+}
+
+// Will open all the frames in the buffer and return the contents, along with
+// where the last complete frame ends. A partial frame at the end, e.g. from a
+// failed write, is ignored.
+func (mb *msgBlock) openFrames(buf []byte) ([]byte, int, error) {
+	var le = binary.LittleEndian
+	var raw []byte
+	var ad [8]byte
+
+	ns := mb.bek.NonceSize()
+	off := 0
+	for off+frameHdrSize <= len(buf) {
+		start := off + frameHdrSize
+		end := start + int(le.Uint32(buf[off:]))
+		if end-start < ns+mb.bek.Overhead() || end > len(buf) {
+			break
+		}
+		le.PutUint64(ad[:], uint64(off))
+		var err error
+		if raw, err = mb.bek.Open(raw, buf[start:start+ns], buf[start+ns:end], ad[:]); err != nil {
+			return nil, 0, errBadCipherText
+		}
+		off = end
+	}
+	return raw, off, nil
+}
+
+// Will read in the whole block file, decrypting and decompressing if needed.
+func (mb *msgBlock) loadBlock() ([]byte, error) {
+	buf, err := ioutil.ReadFile(mb.mfn)
+	if err != nil {
+		return nil, err
+	}
+	if alg, rawsz, ok := compressionHeader(buf); ok {
+		return mb.decompressBlock(buf[cmpHdrSize:], alg, rawsz)
+	}
+	if mb.bek != nil {
+		raw, _, err := mb.openFrames(buf)
+		return raw, err
+	}
+	return buf, nil
+}
+
+// Will load an encrypted block on recovery. A partial frame at the end, e.g. from
+// a crash during a write, is removed so new frames are appended after the last
+// complete one and can be opened again.
+func (mb *msgBlock) recoverFrames() ([]byte, error) {
+	buf, err := ioutil.ReadFile(mb.mfn)
+	if err != nil {
+		return nil, err
+	}
+	raw, n, err := mb.openFrames(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < len(buf) {
+		if err := os.Truncate(mb.mfn, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// Will append the buffer to the block file, encrypting if needed.
+// When encrypting we keep the offset of the end of the block for appends.
+// Filestore lock should be held.
+func (mb *msgBlock) writeBlock(buf []byte) (int, error) {
+	if mb.bek == nil {
+		return mb.mfd.Write(buf)
+	}
+	if mb.woff == 0 {
+		fi, err := mb.mfd.Stat()
+		if err != nil {
+			return 0, err
+		}
+		mb.woff = fi.Size()
+	}
+	frame, err := mb.sealFrame(buf, mb.woff)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := mb.mfd.Write(frame); err != nil || n != len(frame) {
+		// Remove any partial frame so we can keep appending.
+		mb.mfd.Truncate(mb.woff)
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return 0, err
+	}
+	mb.woff += int64(len(frame))
+	return len(buf), nil
+}
+
+// Will return the plaintext contents of the block with the given index,
+// decrypting and decompressing as needed.
+func (fs *fileStore) readMsgBlock(index uint64) ([]byte, error) {
+	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
+	mb := &msgBlock{
+		index: index,
+		mfn:   path.Join(mdir, fmt.Sprintf(blkScan, index)),
+		kfn:   path.Join(mdir, fmt.Sprintf(keyScan, index)),
+	}
+	if _, err := os.Stat(mb.kfn); err == nil {
+		sc, seed, err := fs.loadEncryptionSeed(mb.kfn, fs.cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := mb.setupEncryption(sc, seed); err != nil {
+			return nil, err
+		}
+	}
+	return mb.loadBlock()
+}
+
+// Convert a plaintext block, e.g. from a restored snapshot, to an encrypted one.
+// We write the encrypted block before the key file and replace the plaintext block
+// last, so if we crash in between, recovery can finish this with the key file.
+// The index file will be rebuilt.
+// Lock should be held.
+func (fs *fileStore) convertToEncrypted(mb *msgBlock) error {
+	buf, err := mb.loadBlock()
+	if err != nil {
+		return err
+	}
+	sc, seed, kbuf, err := fs.genEncryptionKey(fs.cfg.Name)
+	if err != nil {
+		return err
+	}
+	if err := mb.setupEncryption(sc, seed); err != nil {
+		return err
+	}
+	if buf, err = mb.sealFrame(buf, 0); err != nil {
+		return err
+	}
+	tmp := mb.encryptedBlockFile()
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(mb.kfn, kbuf, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return mb.finishConvertToEncrypted()
+}
+
+// Will replace the plaintext block with the encrypted one written by convertToEncrypted.
+func (mb *msgBlock) finishConvertToEncrypted() error {
+	if err := os.Rename(mb.encryptedBlockFile(), mb.mfn); err != nil {
+		return err
+	}
+	os.Remove(mb.ifn)
+	return nil
+}
+
+// Where convertToEncrypted writes the encrypted block before it replaces the plaintext one.
+func (mb *msgBlock) encryptedBlockFile() string {
+	return path.Join(path.Dir(path.Dir(mb.mfn)), fmt.Sprintf(blkScan, mb.index)+".enc")
+}
+
+// Compression of sealed message blocks.
+//
+// A compressed block file starts with a zero record length, which can not occur in a
+// normal block, followed by magic, version, the algorithm and the uncompressed size.
+// For encrypted blocks the compressed contents are sealed as a single frame. Compressed
+// blocks are charged against account usage relative to their size on disk.
+
+const (
+	// Size of the compressed block file header.
+	cmpHdrSize = 4 + hdrLen + 1 + 8
+)
+
+// Will return the algorithm and uncompressed size if this is a compressed block file.
+func compressionHeader(buf []byte) (StoreCompression, uint64, bool) {
+	if len(buf) < cmpHdrSize || binary.LittleEndian.Uint32(buf) != 0 || checkHeader(buf[4:]) != nil {
+		return NoCompression, 0, false
+	}
+	alg := StoreCompression(buf[4+hdrLen])
+	if alg == NoCompression {
+		return NoCompression, 0, false
+	}
+	return alg, binary.LittleEndian.Uint64(buf[4+hdrLen+1:]), true
+}
+
+// Will decompress, and decrypt if needed, the contents of a compressed block file.
+func (mb *msgBlock) decompressBlock(buf []byte, alg StoreCompression, rawsz uint64) ([]byte, error) {
+	if mb.bek != nil {
+		var err error
+		if buf, _, err = mb.openFrames(buf); err != nil {
+			return nil, err
+		}
+	}
+	switch alg {
+	case GzipCompression:
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		raw := bytes.NewBuffer(make([]byte, 0, rawsz))
+		if _, err := io.Copy(raw, zr); err != nil {
+			return nil, err
+		}
+		return raw.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression")
+}
+
+// Will return the contents for a compressed block file, encrypted if needed.
+func (mb *msgBlock) compressBlock(raw []byte, alg StoreCompression) ([]byte, error) {
+	var b bytes.Buffer
+	var hdr [cmpHdrSize]byte
+	hdr[4], hdr[5], hdr[6] = magic, version, byte(alg)
+	binary.LittleEndian.PutUint64(hdr[4+hdrLen+1:], uint64(len(raw)))
+	b.Write(hdr[:])
+
+	switch alg {
+	case GzipCompression:
+		zw := gzip.NewWriter(&b)
+		if _, err := zw.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression")
+	}
+
+	buf := b.Bytes()
+	if mb.bek != nil {
+		frame, err := mb.sealFrame(buf[cmpHdrSize:], 0)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf[:cmpHdrSize], frame...)
+	}
+	return buf, nil
+}
+
+// Will replace the block file contents.
+// Lock should be held.
+func (mb *msgBlock) replaceBlockFile(buf []byte) error {
+	tmp := path.Join(path.Dir(path.Dir(mb.mfn)), fmt.Sprintf(blkScan, mb.index)+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Compress a sealed message block in place. Blocks that do not compress are left as is.
+func (fs *fileStore) compressMsgBlock(mb *msgBlock, alg StoreCompression) {
+	delta, err := mb.compress(alg)
+	if err != nil || delta == 0 {
+		return
+	}
+	fs.mu.RLock()
+	cb := fs.scb
+	fs.mu.RUnlock()
+	if cb != nil {
+		cb(-delta)
+	}
+}
+
+// Compress this block and return the reduction in bytes charged.
+func (mb *msgBlock) compress(alg StoreCompression) (int64, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.gone || mb.cmp != NoCompression || mb.bytes == 0 {
+		return 0, nil
+	}
+	raw, err := mb.loadBlock()
+	if err != nil || len(raw) == 0 {
+		return 0, err
+	}
+	buf, err := mb.compressBlock(raw, alg)
+	if err != nil || len(buf) >= len(raw) {
+		return 0, err
+	}
+	if err := mb.replaceBlockFile(buf); err != nil {
+		return 0, err
+	}
+	mb.cmp, mb.rawsz = alg, uint64(len(raw))
+	mb.setCompressedCharge(uint64(len(buf)))
+	return int64(mb.bytes) - int64(mb.cbytes), nil
+}
+
+// Set the bytes we charge for this compressed block relative to its size on disk.
+// Lock should be held.
+func (mb *msgBlock) setCompressedCharge(sz uint64) {
+	if mb.rawsz == 0 {
+		mb.cbytes = mb.bytes
+		return
+	}
+	mb.cbytes = sz * mb.bytes / mb.rawsz
+	if mb.cbytes > mb.bytes {
+		mb.cbytes = mb.bytes
+	}
+}
+
+// Returns the bytes currently charged for this block.
+// Lock should be held.
+func (mb *msgBlock) chargedBytes() uint64 {
+	if mb.cmp != NoCompression {
+		return mb.cbytes
+	}
+	return mb.bytes
+}
+
+// Release the charge for a removed message of the given size and return it.
+// This is called before the block accounting is updated.
+// Lock should be held.
+func (mb *msgBlock) releaseCharge(sz uint64) uint64 {
+	if mb.cmp == NoCompression {
+		return sz
+	}
+	// Last one releases what is left.
+	if mb.msgs <= 1 || sz >= mb.bytes {
+		c := mb.cbytes
+		mb.cbytes = 0
+		return c
+	}
+	c := sz * mb.cbytes / mb.bytes
+	mb.cbytes -= c
+	return c
+}
+
+// Returns the bytes currently charged for all of our blocks.
+// Lock should be held.
+func (fs *fileStore) chargedBytes() uint64 {
+	var total uint64
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		total += mb.chargedBytes()
+		mb.mu.RUnlock()
+	}
+	return total
 }
 
 // This rolls to a new append msg block.
@@ -526,10 +1196,14 @@ func (fs *fileStore) hashKeyForBlock(index uint64) []byte {
 func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	index := uint64(1)
 
-	if fs.lmb != nil {
-		index = fs.lmb.index + 1
+	if lmb := fs.lmb; lmb != nil {
+		index = lmb.index + 1
 		fs.flushPendingWrites()
 		fs.closeLastMsgBlock(false)
+		// This block is now sealed, so compress if configured.
+		if alg := fs.cfg.Compression; alg != NoCompression {
+			go fs.compressMsgBlock(lmb, alg)
+		}
 	}
 
 	mb := &msgBlock{index: index, expire: fs.fcfg.ReadCacheExpire}
@@ -558,6 +1232,18 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 		return nil, fmt.Errorf("could not create hash: %v", err)
 	}
 
+	// Generate our encryption keys if needed.
+	mb.kfn = path.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+	if fs.isEncrypted() {
+		sc, seed, err := fs.genEncryptionSeed(mb.kfn, fs.cfg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not create encryption key: %v", err)
+		}
+		if err := mb.setupEncryption(sc, seed); err != nil {
+			return nil, fmt.Errorf("could not create encryption key: %v", err)
+		}
+	}
+
 	return mb, nil
 }
 
@@ -597,6 +1283,10 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 			fs.mu.Unlock()
 			return 0, 0, ErrMaxBytes
 		}
+		if fs.cfg.MaxMsgsPer > 0 && fs.numSubjectMsgs(subj) >= uint64(fs.cfg.MaxMsgsPer) {
+			fs.mu.Unlock()
+			return 0, 0, ErrMaxMsgsPerSubject
+		}
 	}
 
 	seq := fs.state.LastSeq + 1
@@ -618,9 +1308,20 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 	fs.state.LastSeq = seq
 	fs.state.LastTime = time.Unix(0, ts).UTC()
 
+	if fs.fss != nil {
+		fs.fss.add(subj, seq)
+	}
+
+	// Track the message if it is held until due or has its own TTL.
+	// Mark the block so we know to check it for these on recovery.
+	if fs.trackMsgSchedule(seq, ts, hdr) || fs.trackMsgTTL(seq, ts, hdr) {
+		fs.lmb.setHdrIdx()
+	}
+
 	// Limits checks and enforcement.
 	// If they do any deletions they will update the
 	// byte count on their own, so no need to compensate.
+	fs.enforcePerSubjectLimit(subj)
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
 
@@ -659,6 +1360,24 @@ func (fs *fileStore) SkipMsg() uint64 {
 	return seq
 }
 
+// SkipMsgs will use the next num sequence numbers but not store anything.
+func (fs *fileStore) SkipMsgs(num uint64) {
+	if num == 0 {
+		return
+	}
+	// Grab time.
+	now := time.Now().UTC()
+
+	fs.mu.Lock()
+	fs.state.LastSeq += num
+	fs.state.LastTime = now
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq = fs.state.LastSeq + 1
+		fs.state.FirstTime = now
+	}
+	fs.mu.Unlock()
+}
+
 // Will check the msg limit and drop firstSeq msg if needed.
 // Lock should be held.
 func (fs *fileStore) enforceMsgLimit() {
@@ -681,6 +1400,56 @@ func (fs *fileStore) enforceBytesLimit() {
 	}
 }
 
+// Returns the number of messages we have for the subject.
+// Will build our per-subject index if needed.
+// Lock should be held.
+func (fs *fileStore) numSubjectMsgs(subj string) uint64 {
+	if fs.fss == nil {
+		fs.buildSubjectIndex()
+	}
+	return fs.fss.numMsgs(subj)
+}
+
+// Will check the per subject msg limit and drop the oldest msgs for the subject if needed.
+// Lock should be held.
+func (fs *fileStore) enforcePerSubjectLimit(subj string) {
+	if fs.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	for nmsgs := fs.numSubjectMsgs(subj); nmsgs > uint64(fs.cfg.MaxMsgsPer); nmsgs = fs.fss.numMsgs(subj) {
+		if removed, _ := fs.deleteMsgLocked(fs.fss.firstSeq(subj)); !removed {
+			return
+		}
+	}
+}
+
+// Will check the per subject msg limit for all subjects.
+// Lock should be held.
+func (fs *fileStore) enforcePerSubjectLimits() {
+	if fs.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	if fs.fss == nil {
+		fs.buildSubjectIndex()
+	}
+	var subjs []string
+	for subj, ss := range fs.fss {
+		if uint64(len(ss.seqs)) > uint64(fs.cfg.MaxMsgsPer) {
+			subjs = append(subjs, subj)
+		}
+	}
+	for _, subj := range subjs {
+		fs.enforcePerSubjectLimit(subj)
+	}
+}
+
+// Lock should be held but will be released during actual remove.
+func (fs *fileStore) deleteMsgLocked(seq uint64) (bool, error) {
+	fs.mu.Unlock()
+	defer fs.mu.Lock()
+	return fs.removeMsg(seq, false)
+}
+
 // Lock should be held but will be released during actual remove.
 func (fs *fileStore) deleteFirstMsgLocked() (bool, error) {
 	fs.mu.Unlock()
@@ -829,7 +1598,7 @@ func (fs *fileStore) deleteMsgFromBlock(mb *msgBlock, seq uint64, sm *fileStored
 	// Make sure the seq still exists.
 	if mb.cache == nil {
 		// Rare condition but can happen. We will load with lock held at this point.
-		buf, err := ioutil.ReadFile(mb.mfn)
+		buf, err := mb.loadBlock()
 		if err == nil {
 			err = mb.indexCacheBuf(buf)
 		}
@@ -863,8 +1632,14 @@ func (fs *fileStore) deleteMsgFromBlock(mb *msgBlock, seq uint64, sm *fileStored
 	// Global stats
 	fs.state.Msgs--
 	fs.state.Bytes -= msz
+	if fs.fss != nil {
+		fs.fss.remove(sm.subj, seq)
+	}
+	fs.ttls.remove(seq)
+	fs.sched.remove(seq)
 
 	// Now local mb updates.
+	charge := mb.releaseCharge(msz)
 	mb.msgs--
 	mb.bytes -= msz
 	atomic.AddUint64(&mb.cgenid, 1)
@@ -921,7 +1696,7 @@ func (fs *fileStore) deleteMsgFromBlock(mb *msgBlock, seq uint64, sm *fileStored
 	fs.mu.Unlock()
 
 	if fs.scb != nil {
-		delta := int64(msz)
+		delta := int64(charge)
 		fs.scb(-delta)
 	}
 
@@ -1011,8 +1786,150 @@ func (fs *fileStore) expireMsgs() {
 	}
 }
 
+// Will track the message for expiration if it has its own TTL, returning true if so.
+// Lock should be held.
+func (fs *fileStore) trackMsgTTL(seq uint64, ts int64, hdr []byte) bool {
+	if !fs.cfg.AllowMsgTTL || len(hdr) == 0 {
+		return false
+	}
+	ttl, err := getMessageTTL(hdr)
+	if err != nil || ttl <= 0 {
+		return false
+	}
+	expires := ts + int64(ttl)
+	fs.ttls.add(seq, expires)
+	// Only need to adjust the timer if we are now the next to expire.
+	if fs.ttls.next() == expires {
+		fs.resetTTLChk()
+	}
+	return true
+}
+
+// Will track the message if it is held until due, returning true if so.
+// Lock should be held.
+func (fs *fileStore) trackMsgSchedule(seq uint64, ts int64, hdr []byte) bool {
+	if !fs.cfg.AllowMsgSchedules || len(hdr) == 0 {
+		return false
+	}
+	due, err := getMessageSchedule(hdr, ts)
+	if err != nil || due == 0 {
+		return false
+	}
+	fs.sched.add(seq, due)
+	return true
+}
+
+// DueMsgs returns the sequences of held messages that are due by now.
+// These are only returned once, see ResetDueMsgs.
+func (fs *fileStore) DueMsgs(now int64) []uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.sched.expired(now)
+}
+
+// ResetDueMsgs will have DueMsgs return the held messages that are due again.
+func (fs *fileStore) ResetDueMsgs() {
+	fs.mu.Lock()
+	fs.sched.reset()
+	fs.mu.Unlock()
+}
+
+// ScheduledState returns the number of held messages and when the next one is due.
+func (fs *fileStore) ScheduledState() (uint64, int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.sched.state()
+}
+
+// Will rebuild the indexes for messages with their own TTL or that are held on recovery.
+// We only need to check the blocks that are marked as having these messages.
+// Lock should be held.
+func (fs *fileStore) buildHeaderIndexes() {
+	fs.ttls, fs.sched = ttlIndex{}, schedIndex{}
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		first, last, hdrIdx := mb.first.seq, mb.last.seq, mb.hdrIdx
+		mb.mu.RUnlock()
+
+		if !hdrIdx {
+			continue
+		}
+		var tracked bool
+		for seq := first; seq > 0 && seq <= last; seq++ {
+			if sm, _ := mb.fetchMsg(seq); sm != nil && len(sm.hdr) > 0 {
+				if fs.trackMsgSchedule(seq, sm.ts, sm.hdr) || fs.trackMsgTTL(seq, sm.ts, sm.hdr) {
+					tracked = true
+				}
+			}
+		}
+		// Clear the mark if we no longer have any so we skip this block next time.
+		if !tracked {
+			mb.mu.Lock()
+			mb.hdrIdx = false
+			mb.mu.Unlock()
+			mb.writeIndexInfo()
+		}
+	}
+}
+
+// Will mark the block as having messages for our header indexes.
+// This is persisted with our index info.
+func (mb *msgBlock) setHdrIdx() {
+	mb.mu.Lock()
+	mb.hdrIdx = true
+	mb.mu.Unlock()
+}
+
+// Will reset the timer for messages with their own TTL.
+// Lock should be held.
+func (fs *fileStore) resetTTLChk() {
+	next := fs.ttls.next()
+	if next == 0 || fs.closed {
+		if fs.ttlChk != nil {
+			fs.ttlChk.Stop()
+			fs.ttlChk = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - time.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if fs.ttlChk != nil {
+		fs.ttlChk.Reset(fireIn)
+	} else {
+		fs.ttlChk = time.AfterFunc(fireIn, fs.expireTTLMsgs)
+	}
+}
+
+// Will expire msgs whose own TTL has passed.
+func (fs *fileStore) expireTTLMsgs() {
+	fs.mu.Lock()
+	seqs := fs.ttls.expired(time.Now().UnixNano())
+	fs.mu.Unlock()
+
+	var retry []uint64
+	var expired uint64
+	for _, seq := range seqs {
+		if removed, err := fs.removeMsg(seq, false); err == ErrStoreSnapshotInProgress {
+			retry = append(retry, seq)
+		} else if removed {
+			expired++
+		}
+	}
+
+	fs.mu.Lock()
+	fs.state.Expired += expired
+	// We can not remove while a snapshot is in progress, so try again shortly.
+	for _, seq := range retry {
+		fs.ttls.add(seq, time.Now().Add(time.Second).UnixNano())
+	}
+	fs.resetTTLChk()
+	fs.mu.Unlock()
+}
+
 // Check all the checksums for a message block.
-func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
+func checkMsgBlockFile(fp io.Reader, hh hash.Hash) []uint64 {
 	var le = binary.LittleEndian
 	var hdr [msgHdrSize]byte
 	var bad []uint64
@@ -1024,10 +1941,12 @@ func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
 			break
 		}
 		rl := le.Uint32(hdr[0:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit // clear header bit
 		seq := le.Uint64(hdr[4:])
 		slen := le.Uint16(hdr[20:])
 		dlen := int(rl) - msgHdrSize
-		if dlen < 0 || int(slen) > dlen || dlen > int(rl) {
+		if dlen < 8 || int(slen) > dlen-8 || dlen > int(rl) || (hasHeaders && int(slen)+4 > dlen-8) {
 			bad = append(bad, seq)
 			break
 		}
@@ -1039,7 +1958,11 @@ func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
 		hh.Reset()
 		hh.Write(hdr[4:20])
 		hh.Write(data[:slen])
-		hh.Write(data[slen : dlen-8])
+		if hasHeaders {
+			hh.Write(data[slen+4 : dlen-8])
+		} else {
+			hh.Write(data[slen : dlen-8])
+		}
 		checksum := hh.Sum(nil)
 		if !bytes.Equal(checksum, data[len(data)-8:]) {
 			bad = append(bad, seq)
@@ -1064,14 +1987,13 @@ func (fs *fileStore) checkMsgs() []uint64 {
 	for _, fi := range fis {
 		var index uint64
 		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
-			if fp, err := os.Open(path.Join(mdir, fi.Name())); err != nil {
+			buf, err := fs.readMsgBlock(index)
+			if err != nil {
 				continue
-			} else {
-				key := sha256.Sum256(fs.hashKeyForBlock(index))
-				hh, _ := highwayhash.New64(key[:])
-				bad = append(bad, checkMsgBlockFile(fp, hh)...)
-				fp.Close()
 			}
+			key := sha256.Sum256(fs.hashKeyForBlock(index))
+			hh, _ := highwayhash.New64(key[:])
+			bad = append(bad, checkMsgBlockFile(bytes.NewReader(buf), hh)...)
 		}
 	}
 	return bad
@@ -1143,6 +2065,12 @@ func (mb *msgBlock) updateAccounting(seq uint64, ts int64, rl uint64) {
 	mb.mu.Unlock()
 }
 
+// Returns true if seq can be appended to this block without a gap.
+func (mb *msgBlock) isNextSeq(seq uint64) bool {
+	lseq := atomic.LoadUint64(&mb.last.seq)
+	return lseq == 0 || seq == lseq+1
+}
+
 // Lock should be held.
 func (fs *fileStore) writeMsgRecord(seq uint64, subj string, mhdr, msg []byte) (uint64, int64, error) {
 	var err error
@@ -1153,8 +2081,10 @@ func (fs *fileStore) writeMsgRecord(seq uint64, subj string, mhdr, msg []byte) (
 		return 0, 0, ErrMsgTooLarge
 	}
 	// Grab our current last message block.
+	// Our cache index assumes sequences within a block are contiguous,
+	// so if we skipped past the block's last sequence start a new one.
 	mb := fs.lmb
-	if mb == nil || mb.numBytes()+rl > fs.fcfg.BlockSize {
+	if mb == nil || mb.numBytes()+rl > fs.fcfg.BlockSize || !mb.isNextSeq(seq) {
 		if mb, err = fs.newMsgBlockForWrite(); err != nil {
 			return 0, 0, err
 		}
@@ -1169,6 +2099,18 @@ func (fs *fileStore) writeMsgRecord(seq uint64, subj string, mhdr, msg []byte) (
 	// Update accounting.
 	mb.updateAccounting(seq, ts, rl)
 
+	// Write to underlying buffer.
+	mb.mu.Lock()
+	checksum := encodeMsgRecord(fs.wmb, mb.hh, seq, ts, subj, mhdr, msg)
+	// Grab last checksum
+	copy(mb.lchk[0:], checksum)
+	mb.mu.Unlock()
+
+	return rl, ts, nil
+}
+
+// Will write a message record in our block format to the buffer and return its checksum.
+func encodeMsgRecord(w *bytes.Buffer, hh hash.Hash64, seq uint64, ts int64, subj string, mhdr, msg []byte) []byte {
 	// Formats
 	// Format with no header
 	// total_len(4) sequence(8) timestamp(8) subj_len(2) subj msg hash(8)
@@ -1179,7 +2121,7 @@ func (fs *fileStore) writeMsgRecord(seq uint64, subj string, mhdr, msg []byte) (
 	var le = binary.LittleEndian
 	var hdr [msgHdrSize]byte
 
-	l := uint32(rl)
+	l := uint32(fileStoreMsgSize(subj, mhdr, msg))
 	hasHeaders := len(mhdr) > 0
 	if hasHeaders {
 		l |= hbit
@@ -1190,35 +2132,29 @@ func (fs *fileStore) writeMsgRecord(seq uint64, subj string, mhdr, msg []byte) (
 	le.PutUint64(hdr[12:], uint64(ts))
 	le.PutUint16(hdr[20:], uint16(len(subj)))
 
-	// Now write to underlying buffer.
-	fs.wmb.Write(hdr[:])
-	fs.wmb.WriteString(subj)
+	w.Write(hdr[:])
+	w.WriteString(subj)
 	if hasHeaders {
 		var hlen [4]byte
 		le.PutUint32(hlen[0:], uint32(len(mhdr)))
-		fs.wmb.Write(hlen[:])
-		fs.wmb.Write(mhdr)
+		w.Write(hlen[:])
+		w.Write(mhdr)
 	}
-	fs.wmb.Write(msg)
+	w.Write(msg)
 
 	// Calculate hash.
-	mb.mu.Lock()
-	mb.hh.Reset()
-	mb.hh.Write(hdr[4:20])
-	mb.hh.Write([]byte(subj))
+	hh.Reset()
+	hh.Write(hdr[4:20])
+	hh.Write([]byte(subj))
 	if hasHeaders {
-		mb.hh.Write(mhdr)
+		hh.Write(mhdr)
 	}
-	mb.hh.Write(msg)
-	checksum := mb.hh.Sum(nil)
-	// Grab last checksum
-	copy(mb.lchk[0:], checksum)
-	mb.mu.Unlock()
+	hh.Write(msg)
+	checksum := hh.Sum(nil)
 
 	// Write to msg record.
-	fs.wmb.Write(checksum)
-
-	return rl, ts, nil
+	w.Write(checksum)
+	return checksum
 }
 
 // Will rewrite the message in the underlying store.
@@ -1273,11 +2209,46 @@ func (fs *fileStore) eraseMsg(mb *msgBlock, sm *fileStoredMsg) error {
 	// Write to msg record.
 	wmb.Write(checksum)
 
+	buf := wmb.Bytes()
+
+	// Compressed and encrypted blocks need to be rewritten as a whole.
+	if mb.cmp != NoCompression || mb.bek != nil {
+		raw, err := mb.loadBlock()
+		if err != nil {
+			return err
+		}
+		if sm.off+int64(len(buf)) > int64(len(raw)) {
+			return fmt.Errorf("bad stored message")
+		}
+		copy(raw[sm.off:], buf)
+		if mb.cmp != NoCompression {
+			buf, err = mb.compressBlock(raw, mb.cmp)
+		} else {
+			buf, err = mb.sealFrame(raw, 0)
+		}
+		if err != nil {
+			return err
+		}
+		if err := mb.replaceBlockFile(buf); err != nil {
+			return err
+		}
+		// Make sure we append to the new block file.
+		if mb.mfd != nil {
+			mb.mfd.Close()
+			if mb.mfd, err = os.OpenFile(mb.mfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644); err != nil {
+				mb.mfd = nil
+				return err
+			}
+		}
+		mb.woff = 0
+		return nil
+	}
+
 	mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, 0644)
 	if err != nil {
 		return err
 	}
-	_, err = mfd.WriteAt(wmb.Bytes(), sm.off)
+	_, err = mfd.WriteAt(buf, sm.off)
 
 	mfd.Sync()
 	mfd.Close()
@@ -1455,7 +2426,6 @@ func (mb *msgBlock) indexCacheBuf(buf []byte) error {
 // Will load msgs from disk.
 func (mb *msgBlock) loadMsgs() error {
 	mb.mu.RLock()
-	mfn := mb.mfn
 	hasCache := mb.cache != nil
 	mb.mu.RUnlock()
 
@@ -1465,7 +2435,7 @@ func (mb *msgBlock) loadMsgs() error {
 	}
 
 	// Load in the whole block.
-	buf, err := ioutil.ReadFile(mfn)
+	buf, err := mb.loadBlock()
 	if err != nil {
 		return err
 	}
@@ -1535,7 +2505,8 @@ func (mb *msgBlock) cacheLookupLocked(seq uint64) (*fileStoredMsg, error) {
 		return nil, errNoCache
 	}
 
-	if seq < mb.cache.fseq || (seq-mb.cache.fseq) >= uint64(len(mb.cache.idx)) {
+	// Messages removed from the front of the block are still in the cache.
+	if seq < mb.first.seq || seq < mb.cache.fseq || (seq-mb.cache.fseq) >= uint64(len(mb.cache.idx)) {
 		return nil, ErrStoreMsgNotFound
 	}
 
@@ -1641,32 +2612,104 @@ func msgFromBuf(buf []byte, hh hash.Hash64) (string, []byte, []byte, uint64, int
 			return _EMPTY_, nil, nil, 0, 0, errBadMsg
 		}
 	}
-	seq := le.Uint64(hdr[4:])
-	ts := int64(le.Uint64(hdr[12:]))
-	// FIXME(dlc) - We need to not allow appends to the underlying buffer, so we will
-	// fix the capacity. This will cause a copy though in stream:internalSendLoop when
-	// we append CRLF but this was causing a race. Need to rethink more to avoid this copy.
-	end := dlen - 8
-	var mhdr, msg []byte
-	if hasHeaders {
-		hl := le.Uint32(data[slen:])
-		bi := slen + 4
-		li := bi + int(hl)
-		mhdr = data[bi:li:li]
-		msg = data[li:end:end]
-	} else {
-		msg = data[slen:end:end]
-	}
-	return string(data[:slen]), mhdr, msg, seq, ts, nil
+	seq := le.Uint64(hdr[4:])
+	ts := int64(le.Uint64(hdr[12:]))
+	// FIXME(dlc) - We need to not allow appends to the underlying buffer, so we will
+	// fix the capacity. This will cause a copy though in stream:internalSendLoop when
+	// we append CRLF but this was causing a race. Need to rethink more to avoid this copy.
+	end := dlen - 8
+	var mhdr, msg []byte
+	if hasHeaders {
+		hl := le.Uint32(data[slen:])
+		bi := slen + 4
+		li := bi + int(hl)
+		mhdr = data[bi:li:li]
+		msg = data[li:end:end]
+	} else {
+		msg = data[slen:end:end]
+	}
+	return string(data[:slen]), mhdr, msg, seq, ts, nil
+}
+
+// LoadMsg will lookup the message by sequence number and return it if found.
+func (fs *fileStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
+	sm, err := fs.msgForSeq(seq)
+	if sm != nil {
+		return sm.subj, sm.hdr, sm.msg, sm.ts, nil
+	}
+	return "", nil, nil, 0, err
+}
+
+// LoadLastMsg will lookup the last message we have for the subject and return it if found.
+func (fs *fileStore) LoadLastMsg(subj string) (uint64, []byte, []byte, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return 0, nil, nil, 0, ErrStoreClosed
+	}
+	// Our per-subject index is built on first use.
+	if fs.fss == nil {
+		fs.buildSubjectIndex()
+	}
+	seq := fs.fss.lastSeq(subj)
+	if sm := fs.fetchMsgLocked(seq); sm != nil && sm.subj == subj {
+		return seq, sm.hdr, sm.msg, sm.ts, nil
+	}
+	return 0, nil, nil, 0, ErrStoreMsgNotFound
+}
+
+// SubjectsState returns the state for each subject that matches the filter.
+func (fs *fileStore) SubjectsState(filter string) map[string]SubjectState {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return nil
+	}
+	if fs.fss == nil {
+		fs.buildSubjectIndex()
+	}
+	return fs.fss.filtered(filter)
+}
+
+// Will build our per-subject index from the messages we have.
+// Lock should be held.
+func (fs *fileStore) buildSubjectIndex() {
+	fs.flushPendingWrites()
+
+	fss := make(subjectIndex)
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		first, last := mb.first.seq, mb.last.seq
+		mb.mu.RUnlock()
+
+		for seq := first; seq > 0 && seq <= last; seq++ {
+			if sm, _ := mb.fetchMsg(seq); sm != nil {
+				fss.add(sm.subj, seq)
+			}
+		}
+	}
+	fs.fss = fss
 }
 
-// LoadMsg will lookup the message by sequence number and return it if found.
-func (fs *fileStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
-	sm, err := fs.msgForSeq(seq)
-	if sm != nil {
-		return sm.subj, sm.hdr, sm.msg, sm.ts, nil
+// Will fetch the message for the sequence if we have it.
+// Lock should be held.
+func (fs *fileStore) fetchMsgLocked(seq uint64) *fileStoredMsg {
+	if seq < fs.state.FirstSeq || seq > fs.state.LastSeq {
+		return nil
 	}
-	return "", nil, nil, 0, err
+	for _, mb := range fs.blks {
+		if seq <= atomic.LoadUint64(&mb.last.seq) {
+			// What we are looking for may be staged in the write buffer.
+			if mb == fs.lmb {
+				fs.flushPendingWrites()
+			}
+			sm, _ := mb.fetchMsg(seq)
+			return sm
+		}
+	}
+	return nil
 }
 
 // State returns the current state of the stream.
@@ -1702,7 +2745,8 @@ func (fs *fileStore) flushPendingWrites() error {
 	}
 	// Append new data to the message block file.
 	for lbb := fs.wmb.Len(); lbb > 0; lbb = fs.wmb.Len() {
-		n, err := fs.wmb.WriteTo(mb.mfd)
+		buf := fs.wmb.Bytes()
+		n, err := mb.writeBlock(buf)
 		if err != nil {
 			mb.mu.Lock()
 			mb.removeIndex()
@@ -1711,10 +2755,10 @@ func (fs *fileStore) flushPendingWrites() error {
 		}
 
 		// Update the cache if needed.
-		mb.checkUpdateCache(fs.wmb.Bytes()[:n])
+		mb.checkUpdateCache(buf[:n])
 
-		if int(n) != lbb {
-			fs.wmb.Truncate(int(n))
+		if n != lbb {
+			fs.wmb.Next(n)
 		} else if lbb <= maxBufReuse {
 			fs.wmb.Reset()
 		} else {
@@ -1727,14 +2771,53 @@ func (fs *fileStore) flushPendingWrites() error {
 
 // Write index info to the appropriate file.
 func (mb *msgBlock) writeIndexInfo() error {
-	// HEADER: magic version msgs bytes fseq fts lseq lts checksum
+	mb.mu.Lock()
+	buf := mb.indexInfo()
+
+	var err error
+	if mb.aek != nil {
+		if buf, err = sealWithNonce(mb.aek, buf); err != nil {
+			mb.mu.Unlock()
+			return err
+		}
+	}
+	if mb.ifd == nil {
+		ifd, err := os.OpenFile(mb.ifn, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			mb.mu.Unlock()
+			return err
+		}
+		mb.ifd = ifd
+	}
+	// TODO(dlc) - don't hold lock here.
+	n, err := mb.ifd.WriteAt(buf, 0)
+	if err == nil {
+		mb.liwsz = int64(n)
+		// Sealed contents can not have any trailing data.
+		if mb.aek != nil {
+			err = mb.ifd.Truncate(mb.liwsz)
+		}
+	}
+	mb.mu.Unlock()
+
+	return err
+}
+
+// Will return our index info in plaintext.
+// Lock should be held.
+func (mb *msgBlock) indexInfo() []byte {
+	// HEADER: magic version msgs bytes fseq fts lseq lts dmap flags checksum
 	var hdr [indexHdrSize]byte
 
 	// Write header
 	hdr[0] = magic
-	hdr[1] = version
+	hdr[1] = indexVersion
+
+	var flags uint64
+	if mb.hdrIdx {
+		flags |= blkHdrIdxFlag
+	}
 
-	mb.mu.Lock()
 	n := hdrLen
 	n += binary.PutUvarint(hdr[n:], mb.msgs)
 	n += binary.PutUvarint(hdr[n:], mb.bytes)
@@ -1743,29 +2826,14 @@ func (mb *msgBlock) writeIndexInfo() error {
 	n += binary.PutUvarint(hdr[n:], mb.last.seq)
 	n += binary.PutVarint(hdr[n:], mb.last.ts)
 	n += binary.PutUvarint(hdr[n:], uint64(len(mb.dmap)))
+	n += binary.PutUvarint(hdr[n:], flags)
 	buf := append(hdr[:n], mb.lchk[:]...)
 
 	// Append a delete map if needed
 	if len(mb.dmap) > 0 {
 		buf = append(buf, mb.genDeleteMap()...)
 	}
-	var err error
-	if mb.ifd == nil {
-		ifd, err := os.OpenFile(mb.ifn, os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			mb.mu.Unlock()
-			return err
-		}
-		mb.ifd = ifd
-	}
-	// TODO(dlc) - don't hold lock here.
-	n, err = mb.ifd.WriteAt(buf, 0)
-	if err == nil {
-		mb.liwsz = int64(n)
-	}
-	mb.mu.Unlock()
-
-	return err
+	return buf
 }
 
 func (mb *msgBlock) readIndexInfo() error {
@@ -1774,7 +2842,14 @@ func (mb *msgBlock) readIndexInfo() error {
 		return err
 	}
 
-	if err := checkHeader(buf); err != nil {
+	if mb.aek != nil {
+		if buf, err = openWithNonce(mb.aek, buf); err != nil {
+			defer os.Remove(mb.ifn)
+			return fmt.Errorf("bad index file")
+		}
+	}
+
+	if len(buf) < hdrLen || buf[0] != magic || (buf[1] != version && buf[1] != indexVersion) {
 		defer os.Remove(mb.ifn)
 		return fmt.Errorf("bad index file")
 	}
@@ -1815,6 +2890,13 @@ func (mb *msgBlock) readIndexInfo() error {
 	mb.last.ts = readTimeStamp()
 	dmapLen := readCount()
 
+	// Flags were added with the index version. Without them we do
+	// not know if we have messages for our header indexes.
+	mb.hdrIdx = true
+	if buf[1] == indexVersion {
+		mb.hdrIdx = readCount()&blkHdrIdxFlag != 0
+	}
+
 	// Checksum
 	copy(mb.lchk[0:], buf[bi:bi+checksumSize])
 	bi += checksumSize
@@ -1903,6 +2985,245 @@ func (fs *fileStore) dmapEntries() int {
 // Purge will remove all messages from this store.
 // Will return the number of purged messages.
 func (fs *fileStore) Purge() uint64 {
+	return fs.purge(0)
+}
+
+// PurgeEx will remove the messages matching the subject filter, below seq if set,
+// keeping the last keep matching messages if set.
+// Will return the number of purged messages.
+func (fs *fileStore) PurgeEx(subject string, seq, keep uint64) (uint64, error) {
+	if seq > 0 && keep > 0 {
+		return 0, ErrPurgeArgMismatch
+	}
+	if isPurgeAll(subject) && keep == 0 {
+		if seq == 0 {
+			return fs.Purge(), nil
+		}
+		return fs.Compact(seq)
+	}
+
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	first, last := fs.state.FirstSeq, fs.state.LastSeq
+	// For a literal subject we can bound our scan with the per-subject index.
+	if subjectIsLiteral(subject) {
+		if fs.fss == nil {
+			fs.buildSubjectIndex()
+		}
+		ss := fs.fss.filtered(subject)[subject]
+		first, last = ss.First, ss.Last
+	}
+	seqs := purgeExSeqs(subject, seq, keep, first, last, func(seq uint64) (string, bool) {
+		if sm := fs.fetchMsgLocked(seq); sm != nil {
+			return sm.subj, true
+		}
+		return _EMPTY_, false
+	})
+	fs.mu.Unlock()
+
+	var purged uint64
+	for _, seq := range seqs {
+		removed, err := fs.removeMsg(seq, false)
+		if err != nil {
+			return purged, err
+		}
+		if removed {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Compact will remove all messages up to but not including seq.
+// If seq is past our last sequence we will be empty and start at seq.
+// Blocks below seq are removed whole, and only the block holding seq is rewritten.
+// Will return the number of purged messages.
+func (fs *fileStore) Compact(seq uint64) (uint64, error) {
+	if seq == 0 {
+		return fs.Purge(), nil
+	}
+
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	if fs.sips > 0 {
+		fs.mu.Unlock()
+		return 0, ErrStoreSnapshotInProgress
+	}
+	if seq > fs.state.LastSeq {
+		fs.mu.Unlock()
+		return fs.purge(seq), nil
+	}
+	// The block holding seq could be the one we are writing to.
+	fs.flushPendingWrites()
+
+	var purged, bytes, charge uint64
+	var err error
+	for len(fs.blks) > 0 {
+		mb := fs.blks[0]
+		mb.mu.Lock()
+		if mb.first.seq >= seq {
+			mb.mu.Unlock()
+			break
+		}
+		var msgs, sz, released uint64
+		if mb.last.seq < seq {
+			msgs, sz, released, err = fs.removeMsgsFromBlock(mb)
+		} else {
+			msgs, sz, released, err = fs.compactMsgBlock(mb, seq)
+		}
+		purged, bytes, charge = purged+msgs, bytes+sz, charge+released
+		removed := err == nil && mb.isEmpty()
+		if removed {
+			fs.removeMsgBlock(mb)
+		}
+		mb.mu.Unlock()
+		// Once we have a block that remains we are done.
+		if !removed {
+			mb.writeIndexInfo()
+			break
+		}
+	}
+	fs.state.Msgs -= purged
+	fs.state.Bytes -= bytes
+	fs.ttls.compact(seq)
+	fs.sched.compact(seq)
+	fs.selectNextFirst()
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && charge > 0 {
+		cb(-int64(charge))
+	}
+	return purged, err
+}
+
+// Will remove all of the messages in the block from our accounting and leave it empty.
+// We only need to read the messages if we have to update the per-subject index.
+// Returns the number of messages, their size and the bytes released from our charge.
+// Both locks should be held.
+func (fs *fileStore) removeMsgsFromBlock(mb *msgBlock) (uint64, uint64, uint64, error) {
+	if fs.fss != nil {
+		if err := mb.loadCacheLocked(); err != nil {
+			return 0, 0, 0, err
+		}
+		for seq := mb.first.seq; seq <= mb.last.seq; seq++ {
+			if sm, _ := mb.cacheLookupLocked(seq); sm != nil {
+				fs.fss.remove(sm.subj, seq)
+			}
+		}
+	}
+	msgs, bytes, charge := mb.msgs, mb.bytes, mb.chargedBytes()
+	mb.msgs, mb.bytes, mb.cbytes, mb.dmap = 0, 0, 0, nil
+	mb.first.seq, mb.first.ts = mb.last.seq+1, 0
+	return msgs, bytes, charge, nil
+}
+
+// Will remove the messages before seq from the block and rewrite the block
+// file to only hold the messages that remain.
+// Returns the number of messages, their size and the bytes released from our charge.
+// Both locks should be held.
+func (fs *fileStore) compactMsgBlock(mb *msgBlock, seq uint64) (uint64, uint64, uint64, error) {
+	if err := mb.loadCacheLocked(); err != nil {
+		return 0, 0, 0, err
+	}
+	var msgs, bytes uint64
+	for cseq := mb.first.seq; cseq < seq; cseq++ {
+		if _, ok := mb.dmap[cseq]; ok {
+			delete(mb.dmap, cseq)
+			continue
+		}
+		sm, _ := mb.cacheLookupLocked(cseq)
+		if sm == nil {
+			continue
+		}
+		msgs++
+		bytes += fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+		if fs.fss != nil {
+			fs.fss.remove(sm.subj, cseq)
+		}
+	}
+	// Skip over any deleted messages for our new first.
+	fseq := seq
+	for ; fseq <= mb.last.seq; fseq++ {
+		if _, ok := mb.dmap[fseq]; !ok {
+			break
+		}
+		delete(mb.dmap, fseq)
+	}
+	charge := mb.chargedBytes()
+	mb.msgs -= msgs
+	mb.bytes -= bytes
+	if len(mb.dmap) == 0 {
+		mb.dmap = nil
+	}
+	if fseq > mb.last.seq {
+		mb.first.seq, mb.first.ts, mb.cbytes = fseq, 0, 0
+		return msgs, bytes, charge, nil
+	}
+	sm, err := mb.cacheLookupLocked(fseq)
+	if err != nil {
+		return msgs, bytes, 0, err
+	}
+	mb.first.seq, mb.first.ts = fseq, sm.ts
+
+	// The records are in sequence order, so we keep everything from our new first.
+	raw := append([]byte(nil), mb.cache.buf[sm.off:]...)
+	buf := raw
+	if mb.cmp != NoCompression {
+		if buf, err = mb.compressBlock(raw, mb.cmp); err != nil {
+			return msgs, bytes, 0, err
+		}
+		mb.rawsz = uint64(len(raw))
+		mb.setCompressedCharge(uint64(len(buf)))
+	} else if mb.bek != nil {
+		if buf, err = mb.sealFrame(raw, 0); err != nil {
+			return msgs, bytes, 0, err
+		}
+	}
+	if err := mb.replaceBlockFile(buf); err != nil {
+		return msgs, bytes, 0, err
+	}
+	// Offsets have changed, so drop our cache and reopen the file if we are appending to it.
+	mb.cache, mb.woff = nil, 0
+	atomic.AddUint64(&mb.cgenid, 1)
+	if mb.mfd != nil {
+		mb.mfd.Close()
+		if mb.mfd, err = os.OpenFile(mb.mfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			return msgs, bytes, 0, err
+		}
+	}
+	return msgs, bytes, charge - mb.chargedBytes(), nil
+}
+
+// Will load the messages for the block into our cache if needed.
+// Lock should be held.
+func (mb *msgBlock) loadCacheLocked() error {
+	if mb.cache != nil {
+		return nil
+	}
+	buf, err := mb.loadBlock()
+	if err == nil {
+		err = mb.indexCacheBuf(buf)
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) > 0 {
+		mb.cloads++
+		mb.startCacheExpireTimer()
+	}
+	return nil
+}
+
+// Will remove all messages, with the new first sequence being fseq if larger
+// than our next sequence.
+func (fs *fileStore) purge(fseq uint64) uint64 {
 	fs.mu.Lock()
 	if fs.closed {
 		fs.mu.Unlock()
@@ -1910,8 +3231,11 @@ func (fs *fileStore) Purge() uint64 {
 	}
 
 	purged := fs.state.Msgs
-	rbytes := int64(fs.state.Bytes)
+	rbytes := int64(fs.chargedBytes())
 
+	if fseq > fs.state.LastSeq+1 {
+		fs.state.LastSeq = fseq - 1
+	}
 	fs.state.FirstSeq = fs.state.LastSeq + 1
 	fs.state.FirstTime = time.Time{}
 
@@ -1925,6 +3249,11 @@ func (fs *fileStore) Purge() uint64 {
 	fs.blks = nil
 	fs.wmb = &bytes.Buffer{}
 	fs.lmb = nil
+	if fs.fss != nil {
+		fs.fss = make(subjectIndex)
+	}
+	fs.ttls, fs.sched = ttlIndex{}, schedIndex{}
+	fs.resetTTLChk()
 
 	// Move the msgs directory out of the way, will delete out of band.
 	// FIXME(dlc) - These can error and we need to change api above to propagate?
@@ -1976,12 +3305,14 @@ func (mb *msgBlock) removeIndex() {
 // Removes the msgBlock
 // Both locks should be held.
 func (fs *fileStore) removeMsgBlock(mb *msgBlock) {
+	mb.gone = true
 	mb.removeIndex()
 	if mb.mfd != nil {
 		mb.mfd.Close()
 		mb.mfd = nil
 	}
 	os.Remove(mb.mfn)
+	os.Remove(mb.kfn)
 
 	for i, omb := range fs.blks {
 		if mb == omb {
@@ -2007,6 +3338,7 @@ func (mb *msgBlock) dirtyClose() {
 		return
 	}
 	mb.mu.Lock()
+	mb.gone = true
 	// Close cache
 	mb.cache = nil
 	// Quit our loops.
@@ -2092,6 +3424,10 @@ func (fs *fileStore) Stop() error {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
 	}
+	if fs.ttlChk != nil {
+		fs.ttlChk.Stop()
+		fs.ttlChk = nil
+	}
 
 	var _cfs [256]*consumerFileStore
 	cfs := append(_cfs[:0], fs.cfs...)
@@ -2193,7 +3529,11 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, blks []*msgBlock, includeC
 			fs.flushPendingWritesUnlocked()
 		}
 		mb.mu.Lock()
+		// Snapshots are always written in plaintext.
 		buf, err := ioutil.ReadFile(mb.ifn)
+		if err == nil && mb.aek != nil {
+			buf, err = openWithNonce(mb.aek, buf)
+		}
 		if err != nil {
 			mb.mu.Unlock()
 			writeErr(fmt.Sprintf("Could not read message block [%d] meta file: %v", mb.index, err))
@@ -2206,7 +3546,7 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, blks []*msgBlock, includeC
 		// We could stream but don't want to hold the lock and prevent changes, so just read in and
 		// release the lock for now.
 		// TODO(dlc) - Maybe reuse buffer?
-		buf, err = ioutil.ReadFile(mb.mfn)
+		buf, err = mb.loadBlock()
 		if err != nil {
 			mb.mu.Unlock()
 			writeErr(fmt.Sprintf("Could not read message block [%d]: %v", mb.index, err))
@@ -2245,6 +3585,9 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, blks []*msgBlock, includeC
 			return
 		}
 		state, err := ioutil.ReadFile(path.Join(o.odir, consumerState))
+		if err == nil && o.aek != nil && len(state) > 0 {
+			state, err = openWithNonce(o.aek, state)
+		}
 		if err != nil {
 			o.mu.Unlock()
 			writeErr(fmt.Sprintf("Could not read consumer state for %q: %v", o.name, err))
@@ -2315,6 +3658,7 @@ type consumerFileStore struct {
 	ifd    *os.File
 	lwsz   int64
 	hh     hash.Hash64
+	aek    cipher.AEAD
 	fch    chan struct{}
 	qch    chan struct{}
 	closed bool
@@ -2351,6 +3695,11 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	}
 	o.hh = hh
 
+	// Setup encryption for our state if needed.
+	if err := o.setupEncryption(); err != nil {
+		return nil, err
+	}
+
 	// Write our meta data iff does not exist.
 	meta := path.Join(odir, JetStreamMetaFile)
 	if _, err := os.Stat(meta); err != nil && os.IsNotExist(err) {
@@ -2367,25 +3716,74 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	return o, nil
 }
 
+// Setup the AEAD for our state file if we have or need a key file.
+// Plaintext state, e.g. from a restored snapshot, will be converted if we are encrypting.
+func (o *consumerFileStore) setupEncryption() error {
+	fs, kfn := o.fs, path.Join(o.odir, consumerKey)
+	context := fs.cfg.Name + "/" + o.name
+
+	var sc StoreCipher
+	var seed []byte
+	var plain []byte
+
+	if _, err := os.Stat(kfn); err == nil {
+		if sc, seed, err = fs.loadEncryptionSeed(kfn, context); err != nil {
+			return err
+		}
+	} else if fs.isEncrypted() {
+		buf, err := ioutil.ReadFile(o.ifn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		plain = buf
+		if sc, seed, err = fs.genEncryptionSeed(kfn, context); err != nil {
+			return err
+		}
+	} else {
+		return nil
+	}
+
+	aek, err := genAEAD(sc, deriveKey(seed, aekContext))
+	if err != nil {
+		return err
+	}
+	o.aek = aek
+
+	if len(plain) > 0 {
+		buf, err := sealWithNonce(o.aek, plain)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(o.ifn, buf, 0644)
+	}
+	return nil
+}
+
 const seqsHdrSize = 6*binary.MaxVarintLen64 + hdrLen
 
-func (o *consumerFileStore) Update(state *ConsumerState) error {
+// Flags for the consumer state.
+const (
+	consumerPausedFlag = 1 << iota
+)
+
+// Will encode the consumer state in the format used for our state file.
+func encodeConsumerState(state *ConsumerState) ([]byte, error) {
 	// Sanity checks.
 	if state.Delivered.ConsumerSeq < 1 || state.Delivered.StreamSeq < 1 {
-		return fmt.Errorf("bad delivered sequences")
+		return nil, fmt.Errorf("bad delivered sequences")
 	}
 	if state.AckFloor.ConsumerSeq > state.Delivered.ConsumerSeq {
-		return fmt.Errorf("bad ack floor for consumer")
+		return nil, fmt.Errorf("bad ack floor for consumer")
 	}
 	if state.AckFloor.StreamSeq > state.Delivered.StreamSeq {
-		return fmt.Errorf("bad ack floor for stream")
+		return nil, fmt.Errorf("bad ack floor for stream")
 	}
 
 	var hdr [seqsHdrSize]byte
 
 	// Write header
 	hdr[0] = magic
-	hdr[1] = version
+	hdr[1] = consumerStateVersion
 
 	n := hdrLen
 	n += binary.PutUvarint(hdr[n:], state.AckFloor.ConsumerSeq)
@@ -2410,7 +3808,7 @@ func (o *consumerFileStore) Update(state *ConsumerState) error {
 				mints = v
 			}
 			if k <= aflr || k > maxd {
-				return fmt.Errorf("bad pending entry, sequence [%d] out of range", k)
+				return nil, fmt.Errorf("bad pending entry, sequence [%d] out of range", k)
 			}
 		}
 
@@ -2446,24 +3844,50 @@ func (o *consumerFileStore) Update(state *ConsumerState) error {
 		buf = append(buf, mbuf[:n]...)
 	}
 
+	var flags uint64
+	if state.Paused {
+		flags |= consumerPausedFlag
+	}
+	n = binary.PutUvarint(lenbuf[0:], flags)
+	buf = append(buf, lenbuf[:n]...)
+
+	return buf, nil
+}
+
+func (o *consumerFileStore) Update(state *ConsumerState) error {
+	buf, err := encodeConsumerState(state)
+	if err != nil {
+		return err
+	}
+	if o.aek != nil {
+		if buf, err = sealWithNonce(o.aek, buf); err != nil {
+			return err
+		}
+	}
+
 	// Check if we have the index file open.
 	o.mu.Lock()
 
-	err := o.ensureStateFileOpen()
+	err = o.ensureStateFileOpen()
 	if err == nil {
+		var n int
 		n, err = o.ifd.WriteAt(buf, 0)
 		o.lwsz = int64(n)
+		// Sealed contents can not have any trailing data.
+		if err == nil && o.aek != nil {
+			err = o.ifd.Truncate(o.lwsz)
+		}
 	}
 	o.mu.Unlock()
 
 	return err
 }
 
-// Will upodate the config. Only used when recovering ephemerals.
+// Will update the config. Used when recovering ephemerals and for config updates.
 func (o *consumerFileStore) updateConfig(cfg ConsumerConfig) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	o.cfg = &FileConsumerInfo{ConsumerConfig: cfg}
+	o.cfg = &FileConsumerInfo{Created: o.cfg.Created, ConsumerConfig: cfg}
 	return o.writeConsumerMeta()
 }
 
@@ -2471,9 +3895,6 @@ func (o *consumerFileStore) updateConfig(cfg ConsumerConfig) error {
 // Lock should be held.
 func (cfs *consumerFileStore) writeConsumerMeta() error {
 	meta := path.Join(cfs.odir, JetStreamMetaFile)
-	if _, err := os.Stat(meta); (err != nil && !os.IsNotExist(err)) || err == nil {
-		return err
-	}
 	b, err := json.MarshalIndent(cfs.cfg, _EMPTY_, "  ")
 	if err != nil {
 		return err
@@ -2537,8 +3958,19 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 		return state, nil
 	}
 
-	if err := checkHeader(buf); err != nil {
-		return nil, err
+	if o.aek != nil {
+		if buf, err = openWithNonce(o.aek, buf); err != nil {
+			return nil, fmt.Errorf("corrupt state file")
+		}
+	}
+
+	return decodeConsumerState(buf)
+}
+
+// Will decode the consumer state from the format used for our state file.
+func decodeConsumerState(buf []byte) (*ConsumerState, error) {
+	if len(buf) < hdrLen || buf[0] != magic || (buf[1] != version && buf[1] != consumerStateVersion) {
+		return nil, fmt.Errorf("corrupt state file")
 	}
 
 	bi := hdrLen
@@ -2572,7 +4004,7 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 	readLen := readSeq
 	readCount := readSeq
 
-	state = &ConsumerState{}
+	state := &ConsumerState{}
 	state.AckFloor.ConsumerSeq = readSeq()
 	state.AckFloor.StreamSeq = readSeq()
 	state.Delivered.ConsumerSeq = readSeq()
@@ -2620,6 +4052,15 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 			state.Redelivered[seq] = n
 		}
 	}
+
+	// Flags were added with the consumer state version.
+	if buf[1] == consumerStateVersion {
+		flags := readSeq()
+		if bi == -1 {
+			return nil, fmt.Errorf("corrupt state file")
+		}
+		state.Paused = flags&consumerPausedFlag != 0
+	}
 	return state, nil
 }
 
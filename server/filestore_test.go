@@ -28,6 +28,8 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -279,6 +281,22 @@ func TestFileStoreSkipMsg(t *testing.T) {
 	if state.FirstSeq != uint64(numSkips+1) || state.LastSeq != uint64(numSkips+4) {
 		t.Fatalf("Expected first to be %d and last to be %d. got first %d and last %d", numSkips+1, numSkips+4, state.FirstSeq, state.LastSeq)
 	}
+
+	// Skip a larger gap at once.
+	fs.SkipMsgs(100)
+	seq, _, err := fs.StoreMsg("zzz", nil, []byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if seq != uint64(numSkips+105) {
+		t.Fatalf("Expected seq of %d, got %d", numSkips+105, seq)
+	}
+	if _, _, _, _, err := fs.LoadMsg(seq); err != nil {
+		t.Fatalf("Unexpected error looking up msg: %v", err)
+	}
+	if state = fs.State(); state.Msgs != 3 || state.LastSeq != seq {
+		t.Fatalf("Expected 3 msgs with last of %d, got %+v", seq, state)
+	}
 }
 
 func TestFileStoreMsgLimit(t *testing.T) {
@@ -976,7 +994,7 @@ func TestFileStoreMeta(t *testing.T) {
 	if err := json.Unmarshal(buf, &oconfig2); err != nil {
 		t.Fatalf("Error unmarshalling: %v", err)
 	}
-	if oconfig2 != oconfig {
+	if !reflect.DeepEqual(oconfig2, oconfig) {
 		t.Fatalf("Consumer configs not equal, got %+v vs %+v", oconfig2, oconfig)
 	}
 	checksum, err = ioutil.ReadFile(ometasum)
@@ -1477,6 +1495,688 @@ func TestFileStoreConsumer(t *testing.T) {
 	updateAndCheck()
 }
 
+func TestFileStoreEncrypted(t *testing.T) {
+	for _, cipher := range []StoreCipher{ChaCha, AES} {
+		t.Run(cipher.String(), func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			os.MkdirAll(storeDir, 0755)
+			defer os.RemoveAll(storeDir)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024, Cipher: cipher, Key: []byte("s3cr3t")}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+			fs, err := newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			subj, msg := "foo", []byte("Hello Secret World!")
+			toStore := 100
+			for i := 0; i < toStore; i++ {
+				if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			// Make sure we have rolled some blocks.
+			if fs.numMsgBlocks() < 2 {
+				t.Fatalf("Expected multiple message blocks, got %d", fs.numMsgBlocks())
+			}
+			fs.EraseMsg(50)
+
+			o, err := fs.ConsumerStore("o22", &ConsumerConfig{})
+			if err != nil {
+				t.Fatalf("Unexepected error: %v", err)
+			}
+			state := &ConsumerState{}
+			state.Delivered.ConsumerSeq = 22
+			state.Delivered.StreamSeq = 22
+			state.AckFloor.ConsumerSeq = 11
+			state.AckFloor.StreamSeq = 11
+			state.Pending = map[uint64]int64{12: time.Now().Unix() * int64(time.Second)}
+			if err := o.Update(state); err != nil {
+				t.Fatalf("Unexepected error updating state: %v", err)
+			}
+			if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+				t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+			}
+			o.Stop()
+			fs.Stop()
+
+			// Nothing we stored should be found on disk in plaintext.
+			filepath.Walk(storeDir, func(fpath string, fi os.FileInfo, err error) error {
+				if err != nil || fi.IsDir() || fi.Name() == JetStreamMetaFile {
+					return nil
+				}
+				buf, _ := ioutil.ReadFile(fpath)
+				if fi.Name() == consumerState || filepath.Ext(fpath) == ".idx" {
+					if checkHeader(buf) == nil {
+						t.Fatalf("Expected %q to be encrypted", fpath)
+					}
+				}
+				return nil
+			})
+			// Our blocks can only be read with their own key.
+			mb := &msgBlock{index: 1, mfn: path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1))}
+			if err := mb.setupEncryption(cipher, []byte("not the seed")); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := mb.loadBlock(); err != errBadCipherText {
+				t.Fatalf("Expected %v with the wrong key, got %v", errBadCipherText, err)
+			}
+			if buf, err := fs.readMsgBlock(1); err != nil || !bytes.Contains(buf, msg) {
+				t.Fatalf("Expected to read the block with its key, got %v", err)
+			}
+
+			// Recover with the same key.
+			fs, err = newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			if state := fs.State(); state.Msgs != uint64(toStore-1) {
+				t.Fatalf("Expected %d msgs, got %d", toStore-1, state.Msgs)
+			}
+			for _, seq := range []uint64{1, 49, 51, uint64(toStore)} {
+				nsubj, _, nmsg, _, err := fs.LoadMsg(seq)
+				if err != nil {
+					t.Fatalf("Unexpected error looking up msg %d: %v", seq, err)
+				}
+				if nsubj != subj || !bytes.Equal(nmsg, msg) {
+					t.Fatalf("Msgs don't match for %d, %q %q", seq, nsubj, nmsg)
+				}
+			}
+			if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+				t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+			}
+			// Make sure we can keep writing to the recovered last block.
+			if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, _, _, _, err := fs.LoadMsg(uint64(toStore + 1)); err != nil {
+				t.Fatalf("Unexpected error looking up msg: %v", err)
+			}
+			o, err = fs.ConsumerStore("o22", &ConsumerConfig{})
+			if err != nil {
+				t.Fatalf("Unexepected error: %v", err)
+			}
+			if rstate, err := o.State(); err != nil || !reflect.DeepEqual(state, rstate) {
+				t.Fatalf("Consumer state does not match: %+v vs %+v (%v)", rstate, state, err)
+			}
+			o.Stop()
+			fs.Stop()
+
+			// Tampering with a block should be detected.
+			mfn := path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1))
+			buf, err := ioutil.ReadFile(mfn)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			buf[len(buf)/2] ^= 0xff
+			if err := ioutil.WriteFile(mfn, buf, 0644); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := newFileStore(fcfg, cfg); err == nil {
+				t.Fatalf("Expected an error with a tampered block")
+			}
+
+			// A different key or no key should fail.
+			if _, err := newFileStore(FileStoreConfig{StoreDir: storeDir, Key: []byte("bad")}, cfg); err == nil {
+				t.Fatalf("Expected an error with the wrong key")
+			}
+			if _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg); err != errNoEncryptionKey {
+				t.Fatalf("Expected %v, got %v", errNoEncryptionKey, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreEncryptedSnapshotRestore(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	key := []byte("s3cr3t")
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 4096, Key: key}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello Snappy!")
+	toSend := 500
+	for i := 0; i < toSend; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	o, err := fs.ConsumerStore("o22", &ConsumerConfig{})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	state := &ConsumerState{}
+	state.Delivered.ConsumerSeq = 100
+	state.Delivered.StreamSeq = 100
+	state.AckFloor.ConsumerSeq = 22
+	state.AckFloor.StreamSeq = 22
+	if err := o.Update(state); err != nil {
+		t.Fatalf("Unexepected error updating state: %v", err)
+	}
+
+	r, err := fs.Snapshot(5*time.Second, true, true)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	snap, err := ioutil.ReadAll(r.Reader)
+	if err != nil {
+		t.Fatalf("Error reading snapshot: %v", err)
+	}
+
+	// Snapshots are in plaintext, restore into a store with a different key.
+	gzr, err := gzip.NewReader(bytes.NewReader(snap))
+	if err != nil {
+		t.Fatalf("Error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	rstoreDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(rstoreDir)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error getting next entry from snapshot: %v", err)
+		}
+		if strings.HasSuffix(hdr.Name, ".key") {
+			t.Fatalf("Did not expect key files in snapshot, got %q", hdr.Name)
+		}
+		fpath := path.Join(rstoreDir, filepath.Clean(hdr.Name))
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		buf, _ := ioutil.ReadAll(tr)
+		ioutil.WriteFile(fpath, buf, 0644)
+	}
+
+	fsr, err := newFileStore(FileStoreConfig{StoreDir: rstoreDir, Cipher: AES, Key: []byte("other")}, cfg)
+	if err != nil {
+		t.Fatalf("Error restoring from snapshot: %v", err)
+	}
+	defer fsr.Stop()
+
+	if rstate, state := fsr.State(), fs.State(); rstate.Msgs != state.Msgs || rstate.LastSeq != state.LastSeq {
+		t.Fatalf("Restored state does not match, %+v vs %+v", rstate, state)
+	}
+	if badSeqs := len(fsr.checkMsgs()); badSeqs > 0 {
+		t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+	}
+	if _, _, nmsg, _, err := fsr.LoadMsg(22); err != nil || !bytes.Equal(nmsg, msg) {
+		t.Fatalf("Unexpected msg or error: %q %v", nmsg, err)
+	}
+	ro, err := fsr.ConsumerStore("o22", &ConsumerConfig{})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	defer ro.Stop()
+	if rstate, err := ro.State(); err != nil || !reflect.DeepEqual(state, rstate) {
+		t.Fatalf("Consumer state does not match: %+v vs %+v (%v)", rstate, state, err)
+	}
+
+	// The restored blocks and consumer state should have been encrypted.
+	blks, _ := filepath.Glob(path.Join(rstoreDir, msgDir, "*.blk"))
+	keys, _ := filepath.Glob(path.Join(rstoreDir, msgDir, "*.key"))
+	if len(blks) == 0 || len(blks) != len(keys) {
+		t.Fatalf("Expected a key file for each block, got %d vs %d", len(keys), len(blks))
+	}
+	for _, fn := range blks {
+		if buf, _ := ioutil.ReadFile(fn); bytes.Contains(buf, msg) {
+			t.Fatalf("Found plaintext in %q", fn)
+		}
+	}
+	if _, err := os.Stat(path.Join(rstoreDir, consumerDir, "o22", consumerKey)); err != nil {
+		t.Fatalf("Expected a consumer key file: %v", err)
+	}
+}
+
+func TestFileStoreEncryptedTornFrame(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, Key: []byte("s3cr3t")}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello Secret World!")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	fs.Stop()
+
+	// Simulate a crash in the middle of writing a frame.
+	mfn := path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1))
+	fi, err := os.Stat(mfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f, err := os.OpenFile(mfn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8})
+	f.Close()
+
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	// The partial frame should be gone so new frames line up.
+	if nfi, err := os.Stat(mfn); err != nil || nfi.Size() != fi.Size() {
+		t.Fatalf("Expected the block to be truncated to %d, got %v", fi.Size(), err)
+	}
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	fs.Stop()
+
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if state := fs.State(); state.Msgs != 20 {
+		t.Fatalf("Expected 20 msgs, got %d", state.Msgs)
+	}
+	if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+		t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+	}
+}
+
+func TestFileStoreEncryptedConvertInterrupted(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello Secret World!")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	fs.Stop()
+
+	mfn := path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1))
+	plain, err := ioutil.ReadFile(mfn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Convert to encrypted, then put things back as if we crashed after writing the key file.
+	fcfg := FileStoreConfig{StoreDir: storeDir, Key: []byte("s3cr3t")}
+	if fs, err = newFileStore(fcfg, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.Stop()
+
+	mb := &msgBlock{index: 1, mfn: mfn}
+	if err := os.Rename(mfn, mb.encryptedBlockFile()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(mfn, plain, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if state := fs.State(); state.Msgs != 10 {
+		t.Fatalf("Expected 10 msgs, got %d", state.Msgs)
+	}
+	if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+		t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+	}
+	if buf, _ := ioutil.ReadFile(mfn); bytes.Contains(buf, msg) {
+		t.Fatalf("Found plaintext in %q", mfn)
+	}
+	if _, err := os.Stat(mb.encryptedBlockFile()); err == nil {
+		t.Fatalf("Expected the encrypted block to be moved in place")
+	}
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("s3cr3t")} {
+		name := "Plain"
+		if key != nil {
+			name = "Encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			os.MkdirAll(storeDir, 0755)
+			defer os.RemoveAll(storeDir)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4096, Key: key}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: GzipCompression}
+
+			fs, err := newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			var charged int64
+			fs.StorageBytesUpdate(func(delta int64) { atomic.AddInt64(&charged, delta) })
+
+			numCompressed := func(fs *fileStore) int {
+				fs.mu.RLock()
+				defer fs.mu.RUnlock()
+				var n int
+				for _, mb := range fs.blks {
+					mb.mu.RLock()
+					if mb.cmp != NoCompression {
+						n++
+					}
+					mb.mu.RUnlock()
+				}
+				return n
+			}
+
+			subj, msg := "foo", []byte(`{"id":"ORDER","status":"pending","items":["a","b","c"]}`)
+			toStore := 500
+			for i := 0; i < toStore; i++ {
+				if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			numBlks := fs.numMsgBlocks()
+			if numBlks < 4 {
+				t.Fatalf("Expected multiple message blocks, got %d", numBlks)
+			}
+			// All but the last block should be compressed.
+			checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+				if n := numCompressed(fs); n != numBlks-1 {
+					return fmt.Errorf("Expected %d compressed blocks, got %d", numBlks-1, n)
+				}
+				return nil
+			})
+			state := fs.State()
+			if c := atomic.LoadInt64(&charged); c <= 0 || uint64(c) >= state.Bytes/2 {
+				t.Fatalf("Expected compressed usage to be charged, got %d for %d bytes", c, state.Bytes)
+			}
+
+			// Remove and erase from compressed blocks.
+			if removed, err := fs.RemoveMsg(10); err != nil || !removed {
+				t.Fatalf("Unexpected remove result: %v %v", removed, err)
+			}
+			if erased, err := fs.EraseMsg(20); err != nil || !erased {
+				t.Fatalf("Unexpected erase result: %v %v", erased, err)
+			}
+			for _, seq := range []uint64{1, 19, 21, uint64(toStore)} {
+				nsubj, _, nmsg, _, err := fs.LoadMsg(seq)
+				if err != nil {
+					t.Fatalf("Unexpected error looking up msg %d: %v", seq, err)
+				}
+				if nsubj != subj || !bytes.Equal(nmsg, msg) {
+					t.Fatalf("Msgs don't match for %d, %q %q", seq, nsubj, nmsg)
+				}
+			}
+			if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+				t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+			}
+			fs.Stop()
+
+			// Compressed blocks should not contain our payload as is.
+			blks, _ := filepath.Glob(path.Join(storeDir, msgDir, "*.blk"))
+			var found int
+			for _, fn := range blks {
+				if buf, _ := ioutil.ReadFile(fn); bytes.Contains(buf, msg) {
+					found++
+				}
+			}
+			if found > 1 {
+				t.Fatalf("Expected only the last block to be uncompressed, found %d", found)
+			}
+
+			// Recover.
+			fs, err = newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			if state := fs.State(); state.Msgs != uint64(toStore-2) {
+				t.Fatalf("Expected %d msgs, got %d", toStore-2, state.Msgs)
+			}
+			if n := numCompressed(fs); n != numBlks-1 {
+				t.Fatalf("Expected %d compressed blocks, got %d", numBlks-1, n)
+			}
+			if _, _, _, _, err := fs.LoadMsg(10); err == nil {
+				t.Fatalf("Expected an error looking up removed msg")
+			}
+			if _, _, nmsg, _, err := fs.LoadMsg(11); err != nil || !bytes.Equal(nmsg, msg) {
+				t.Fatalf("Unexpected msg or error: %q %v", nmsg, err)
+			}
+			if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+				t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+			}
+
+			// Purging should release everything we charged.
+			charged = 0
+			fs.StorageBytesUpdate(func(delta int64) { atomic.AddInt64(&charged, delta) })
+			fs.Purge()
+			if c := atomic.LoadInt64(&charged); c != 0 {
+				t.Fatalf("Expected no usage after purge, got %d", c)
+			}
+			if _, _, err := fs.StoreMsg(subj, nil, msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreLoadLastMsg(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	toStore := 100
+	for i := 0; i < toStore; i++ {
+		subj := fmt.Sprintf("kv.%d", i%5)
+		if _, _, err := fs.StoreMsg(subj, nil, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if numBlks := fs.numMsgBlocks(); numBlks < 2 {
+		t.Fatalf("Expected multiple message blocks, got %d", numBlks)
+	}
+	checkLast := func(fs *fileStore, subj string, eseq uint64) {
+		t.Helper()
+		seq, _, msg, _, err := fs.LoadLastMsg(subj)
+		if eseq == 0 {
+			if err != ErrStoreMsgNotFound {
+				t.Fatalf("Expected not found error for %q, got %v", subj, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if seq != eseq || string(msg) != fmt.Sprintf("%d", eseq-1) {
+			t.Fatalf("Expected seq %d for %q, got %d %q", eseq, subj, seq, msg)
+		}
+	}
+	checkLast(fs, "kv.0", 96)
+	checkLast(fs, "kv.4", 100)
+	checkLast(fs, "kv.5", 0)
+	fs.Stop()
+
+	// Recover and make sure we rebuild properly.
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	checkLast(fs, "kv.0", 96)
+	checkLast(fs, "kv.3", 99)
+
+	// Index should be kept up to date once built.
+	if _, _, err := fs.StoreMsg("kv.0", nil, []byte("100")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLast(fs, "kv.0", 101)
+	fs.RemoveMsg(101)
+	fs.RemoveMsg(96)
+	checkLast(fs, "kv.0", 91)
+	fs.RemoveMsg(99)
+	checkLast(fs, "kv.3", 94)
+
+	fs.Purge()
+	checkLast(fs, "kv.3", 0)
+	if _, _, err := fs.StoreMsg("kv.3", nil, []byte("101")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLast(fs, "kv.3", 102)
+}
+
+func TestFileStoreSubjectsState(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.StoreMsg(fmt.Sprintf("kv.%d", i%5), nil, []byte("ok")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	fs.RemoveMsg(1)
+	fs.RemoveMsg(100)
+
+	fss := fs.SubjectsState("kv.>")
+	if len(fss) != 5 {
+		t.Fatalf("Expected 5 subjects, got %d", len(fss))
+	}
+	if ss := fss["kv.0"]; ss != (SubjectState{Msgs: 19, First: 6, Last: 96}) {
+		t.Fatalf("Unexpected state for kv.0: %+v", ss)
+	}
+	if ss := fss["kv.4"]; ss != (SubjectState{Msgs: 19, First: 5, Last: 95}) {
+		t.Fatalf("Unexpected state for kv.4: %+v", ss)
+	}
+	fss = fs.SubjectsState("kv.2")
+	if ss := fss["kv.2"]; len(fss) != 1 || ss != (SubjectState{Msgs: 20, First: 3, Last: 98}) {
+		t.Fatalf("Unexpected state for kv.2: %+v", fss)
+	}
+	if fss = fs.SubjectsState("kv.5"); len(fss) != 0 {
+		t.Fatalf("Expected no subjects, got %+v", fss)
+	}
+}
+
+func TestFileStoreMsgsPerSubjectLimit(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	toStore := 100
+	for i := 0; i < toStore; i++ {
+		if _, _, err := fs.StoreMsg(fmt.Sprintf("kv.%d", i%5), nil, []byte("ok")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	fs.Stop()
+
+	// Recover with a per subject limit, which should be enforced on startup.
+	cfg.MaxMsgsPer = 3
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if state := fs.State(); state.Msgs != 15 || state.FirstSeq != 86 {
+		t.Fatalf("Expected 15 msgs starting at 86, got %d at %d", state.Msgs, state.FirstSeq)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := fs.StoreMsg("kv.0", nil, []byte("ok")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if state := fs.State(); state.Msgs != 15 || state.FirstSeq != 87 {
+		t.Fatalf("Expected 15 msgs starting at 87, got %d at %d", state.Msgs, state.FirstSeq)
+	}
+	for _, seq := range []uint64{86, 91, 96, 101, 102} {
+		if _, _, _, _, err := fs.LoadMsg(seq); err == nil {
+			t.Fatalf("Expected msg %d to be removed", seq)
+		}
+	}
+
+	// Lowering the limit should enforce it for all subjects.
+	cfg.MaxMsgsPer = 1
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := fs.State(); state.Msgs != 5 || state.FirstSeq != 97 {
+		t.Fatalf("Expected 5 msgs starting at 97, got %d at %d", state.Msgs, state.FirstSeq)
+	}
+
+	// Now check discard new.
+	cfg.Discard = DiscardNew
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := fs.StoreMsg("kv.1", nil, []byte("ok")); err != ErrMaxMsgsPerSubject {
+		t.Fatalf("Expected a per subject limit error, got %v", err)
+	}
+	if _, _, err := fs.StoreMsg("kv.5", nil, []byte("ok")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
 func TestFileStorePerf(t *testing.T) {
 	// Comment out to run, holding place for now.
 	t.SkipNow()
@@ -1735,3 +2435,427 @@ func TestFileStoreConsumerPerf(t *testing.T) {
 	fmt.Printf("time is %v\n", tt)
 	fmt.Printf("%.0f updates/sec\n", float64(toStore)/tt.Seconds())
 }
+
+func TestFileStoreMsgTTL(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	short := []byte("NATS/1.0\r\nNats-TTL: 50ms\r\n\r\n")
+	long := []byte("NATS/1.0\r\nNats-TTL: 250ms\r\n\r\n")
+	msg := []byte("Hello World")
+
+	fs.StoreMsg("foo", nil, msg)
+	fs.StoreMsg("foo", short, msg)
+	fs.StoreMsg("foo", long, msg)
+	fs.StoreMsg("foo", nil, msg)
+
+	checkState := func(msgs, first uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != msgs || state.FirstSeq != first {
+				return fmt.Errorf("Expected %d msgs starting at %d, got %+v", msgs, first, state)
+			}
+			return nil
+		})
+	}
+	checkState(3, 1)
+	if _, _, _, _, err := fs.LoadMsg(2); err == nil {
+		t.Fatalf("Expected msg 2 to be expired")
+	}
+	if state := fs.State(); state.Expired != 1 {
+		t.Fatalf("Expected 1 expired msg, got %d", state.Expired)
+	}
+
+	// Make sure we track the remaining TTL after a restart.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	checkState(2, 1)
+	if _, _, _, _, err := fs.LoadMsg(3); err == nil {
+		t.Fatalf("Expected msg 3 to be expired")
+	}
+	if state := fs.State(); state.Expired != 1 {
+		t.Fatalf("Expected 1 expired msg since the restart, got %d", state.Expired)
+	}
+}
+
+func TestFileStoreMsgTTLRecoverOnlyMarkedBlocks(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 20; i++ {
+		fs.StoreMsg("foo", nil, msg)
+	}
+	fs.StoreMsg("foo", []byte("NATS/1.0\r\nNats-TTL: 1h\r\n\r\n"), msg)
+
+	checkMarked := func() {
+		t.Helper()
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		if len(fs.blks) < 2 {
+			t.Fatalf("Expected multiple message blocks, got %d", len(fs.blks))
+		}
+		for _, mb := range fs.blks {
+			mb.mu.RLock()
+			hdrIdx, last := mb.hdrIdx, mb.last.seq
+			mb.mu.RUnlock()
+			if expected := last == 21; hdrIdx != expected {
+				t.Fatalf("Expected block with last seq %d to be marked %v", last, expected)
+			}
+		}
+		if fs.ttls.Len() != 1 || fs.ttls.ttls[0].seq != 21 {
+			t.Fatalf("Expected to track msg 21, got %+v", fs.ttls)
+		}
+	}
+	checkMarked()
+
+	// The marks should be persisted with the index info.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkMarked()
+}
+
+func TestFileStoreMsgTTLRemovedMsgs(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	hdr := []byte("NATS/1.0\r\nNats-TTL: 1h\r\n\r\n")
+	msg := []byte("Hello World")
+	for i := 0; i < 20; i++ {
+		fs.StoreMsg(fmt.Sprintf("foo.%d", i%2), hdr, msg)
+	}
+	checkTracked := func(expected int) {
+		t.Helper()
+		fs.mu.RLock()
+		tracked := append([]msgTTL(nil), fs.ttls.ttls...)
+		fs.mu.RUnlock()
+		if len(tracked) != expected {
+			t.Fatalf("Expected to track %d msgs, got %d", expected, len(tracked))
+		}
+		for _, mt := range tracked {
+			if _, _, _, _, err := fs.LoadMsg(mt.seq); err != nil {
+				t.Fatalf("Expected to only track msgs we have, got %d: %v", mt.seq, err)
+			}
+		}
+	}
+	checkTracked(20)
+
+	// Removed messages should no longer be tracked.
+	fs.RemoveMsg(10)
+	fs.EraseMsg(11)
+	checkTracked(18)
+	if purged, err := fs.PurgeEx("foo.0", 0, 0); err != nil || purged != 9 {
+		t.Fatalf("Expected 9 purged, got %d and %v", purged, err)
+	}
+	checkTracked(9)
+	if purged, err := fs.Compact(16); err != nil || purged != 6 {
+		t.Fatalf("Expected 6 purged, got %d and %v", purged, err)
+	}
+	checkTracked(3)
+	fs.Purge()
+	checkTracked(0)
+}
+
+func TestFileStorePurgeExAndCompact(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 256}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(fmt.Sprintf("foo.%d", i%2), nil, msg)
+	}
+
+	if _, err := fs.PurgeEx("foo.0", 2, 2); err != ErrPurgeArgMismatch {
+		t.Fatalf("Expected %v, got %v", ErrPurgeArgMismatch, err)
+	}
+	// Keep the last 2 of foo.0, which are 7 and 9.
+	if purged, err := fs.PurgeEx("foo.0", 0, 2); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d and %v", purged, err)
+	}
+	// Purge foo.1 below 6, which are 2 and 4.
+	if purged, err := fs.PurgeEx("foo.*", 6, 0); err != nil || purged != 2 {
+		t.Fatalf("Expected 2 purged, got %d and %v", purged, err)
+	}
+	if state := fs.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if purged, err := fs.Compact(9); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d and %v", purged, err)
+	}
+	if state := fs.State(); state.Msgs != 2 || state.FirstSeq != 9 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	// Make sure this all survives a restart.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if state := fs.State(); state.Msgs != 2 || state.FirstSeq != 9 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state after restart: %+v", state)
+	}
+	// Compact past the end will move our sequences forward.
+	if purged, err := fs.Compact(100); err != nil || purged != 2 {
+		t.Fatalf("Expected 2 purged, got %d and %v", purged, err)
+	}
+	if state := fs.State(); state.Msgs != 0 || state.FirstSeq != 100 || state.LastSeq != 99 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seq, _, _ := fs.StoreMsg("foo.0", nil, msg); seq != 100 {
+		t.Fatalf("Expected seq of 100, got %d", seq)
+	}
+}
+
+func TestFileStoreCompactBlocks(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		key  []byte
+		cmp  StoreCompression
+	}{
+		{"Plain", nil, NoCompression},
+		{"Encrypted", []byte("s3cr3t"), NoCompression},
+		{"Compressed", nil, GzipCompression},
+		{"EncryptedCompressed", []byte("s3cr3t"), GzipCompression},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			os.MkdirAll(storeDir, 0755)
+			defer os.RemoveAll(storeDir)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024, Key: test.key}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: test.cmp}
+			fs, err := newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			msg := []byte(`{"id":"ORDER","status":"pending","items":["a","b","c"]}`)
+			toStore := 200
+			for i := 0; i < toStore; i++ {
+				if _, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%3), nil, msg); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			numBlks := fs.numMsgBlocks()
+			if numBlks < 10 {
+				t.Fatalf("Expected multiple message blocks, got %d", numBlks)
+			}
+			if test.cmp != NoCompression {
+				checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+					fs.mu.RLock()
+					defer fs.mu.RUnlock()
+					for _, mb := range fs.blks[:len(fs.blks)-1] {
+						mb.mu.RLock()
+						cmp := mb.cmp
+						mb.mu.RUnlock()
+						if cmp == NoCompression {
+							return fmt.Errorf("Expected block %d to be compressed", mb.index)
+						}
+					}
+					return nil
+				})
+			}
+			var charged int64
+			fs.StorageBytesUpdate(func(delta int64) { atomic.AddInt64(&charged, delta) })
+
+			checkCharged := func(fs *fileStore) {
+				t.Helper()
+				fs.mu.RLock()
+				expected := int64(fs.chargedBytes())
+				fs.mu.RUnlock()
+				if c := atomic.LoadInt64(&charged); c != expected {
+					t.Fatalf("Expected %d bytes charged, got %d", expected, c)
+				}
+			}
+			checkMsgs := func(fs *fileStore, first uint64, msgs int) {
+				t.Helper()
+				if state := fs.State(); state.Msgs != uint64(msgs) || state.FirstSeq != first {
+					t.Fatalf("Unexpected state: %+v", state)
+				}
+				if _, _, _, _, err := fs.LoadMsg(first - 1); err == nil {
+					t.Fatalf("Expected an error looking up compacted msg %d", first-1)
+				}
+				if _, _, nmsg, _, err := fs.LoadMsg(first); err != nil || !bytes.Equal(nmsg, msg) {
+					t.Fatalf("Unexpected msg or error for %d: %q %v", first, nmsg, err)
+				}
+				if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+					t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+				}
+				var total uint64
+				for subj, ss := range fs.SubjectsState("foo.*") {
+					if ss.First < first {
+						t.Fatalf("Expected first for %q to be at least %d, got %d", subj, first, ss.First)
+					}
+					total += ss.Msgs
+				}
+				if total != uint64(msgs) {
+					t.Fatalf("Expected %d msgs across subjects, got %d", msgs, total)
+				}
+			}
+
+			// Remove the messages right at our new first, which should be skipped over.
+			for _, seq := range []uint64{105, 106} {
+				if removed, err := fs.RemoveMsg(seq); err != nil || !removed {
+					t.Fatalf("Unexpected remove result: %v %v", removed, err)
+				}
+			}
+			if purged, err := fs.Compact(105); err != nil || purged != 104 {
+				t.Fatalf("Expected 104 purged, got %d and %v", purged, err)
+			}
+			checkMsgs(fs, 107, toStore-106)
+			checkCharged(fs)
+			if n := fs.numMsgBlocks(); n >= numBlks-5 {
+				t.Fatalf("Expected whole blocks to be removed, had %d and now %d", numBlks, n)
+			}
+			// The block holding our new first should have been rewritten.
+			fs.mu.RLock()
+			mb := fs.blks[0]
+			fs.mu.RUnlock()
+			if fi, err := os.Stat(mb.mfn); err != nil || fi.Size() >= int64(fcfg.BlockSize) {
+				t.Fatalf("Expected the first block to be rewritten, got %v", err)
+			}
+
+			// Compact into the block we are writing to and keep writing.
+			if purged, err := fs.Compact(195); err != nil || purged != 88 {
+				t.Fatalf("Expected 88 purged, got %d and %v", purged, err)
+			}
+			checkMsgs(fs, 195, toStore-194)
+			checkCharged(fs)
+			if seq, _, err := fs.StoreMsg("foo.0", nil, msg); err != nil || seq != uint64(toStore+1) {
+				t.Fatalf("Expected seq of %d, got %d and %v", toStore+1, seq, err)
+			}
+			checkMsgs(fs, 195, toStore-193)
+
+			// Make sure this all survives a restart.
+			fs.Stop()
+			fs, err = newFileStore(fcfg, cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			checkMsgs(fs, 195, toStore-193)
+			if _, _, nmsg, _, err := fs.LoadMsg(uint64(toStore + 1)); err != nil || !bytes.Equal(nmsg, msg) {
+				t.Fatalf("Unexpected msg or error: %q %v", nmsg, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreMsgSchedules(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgSchedules: true}
+	fs, err := newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	at := time.Now().Add(time.Hour).UTC()
+	msg := []byte("Hello World")
+	fs.StoreMsg("foo", nil, msg)
+	fs.StoreMsg("foo", []byte("NATS/1.0\r\nNats-Delay: 1m\r\n\r\n"), msg)
+	fs.StoreMsg("foo", []byte(fmt.Sprintf("NATS/1.0\r\nNats-Schedule-At: %s\r\n\r\n", at.Format(time.RFC3339Nano))), msg)
+	fs.StoreMsg("foo", []byte("NATS/1.0\r\nNats-Delay: 2m\r\n\r\n"), msg)
+
+	// Removing a held message should no longer track it.
+	fs.RemoveMsg(4)
+
+	checkScheduled := func(pending uint64) int64 {
+		t.Helper()
+		n, next := fs.ScheduledState()
+		if n != pending {
+			t.Fatalf("Expected %d held msgs, got %d", pending, n)
+		}
+		return next
+	}
+	next := checkScheduled(2)
+	if _, _, _, ts, _ := fs.LoadMsg(2); next != ts+int64(time.Minute) {
+		t.Fatalf("Expected msg 2 to be due next, got %v", time.Unix(0, next))
+	}
+
+	// Make sure we recover our held messages.
+	fs.Stop()
+	fs, err = newFileStore(fcfg, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	checkScheduled(2)
+	if seqs := fs.DueMsgs(time.Now().UnixNano()); len(seqs) != 0 {
+		t.Fatalf("Expected no due msgs, got %v", seqs)
+	}
+	seqs := fs.DueMsgs(at.UnixNano())
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Fatalf("Expected msgs 2 and 3 to be due, got %v", seqs)
+	}
+	// These are still held until removed but only returned once.
+	checkScheduled(2)
+	if seqs := fs.DueMsgs(at.Add(time.Hour).UnixNano()); len(seqs) != 0 {
+		t.Fatalf("Expected no due msgs, got %v", seqs)
+	}
+	// Unless we reset them, e.g. after a leader change.
+	fs.RemoveMsg(3)
+	fs.ResetDueMsgs()
+	if seqs := fs.DueMsgs(at.UnixNano()); len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("Expected msg 2 to be due again, got %v", seqs)
+	}
+	fs.RemoveMsg(2)
+	if next := checkScheduled(0); next != 0 {
+		t.Fatalf("Expected nothing to be due, got %v", time.Unix(0, next))
+	}
+}
@@ -33,18 +33,22 @@ import (
 
 // JetStreamConfig determines this server's configuration.
 // MaxMemory and MaxStore are in bytes.
+// If Key is set, file storage will be encrypted at rest using Cipher.
 type JetStreamConfig struct {
 	MaxMemory int64
 	MaxStore  int64
 	StoreDir  string
+	Key       string
+	Cipher    StoreCipher
 }
 
 // TODO(dlc) - need to track and rollup against server limits, etc.
 type JetStreamAccountLimits struct {
-	MaxMemory    int64 `json:"max_memory"`
-	MaxStore     int64 `json:"max_storage"`
-	MaxStreams   int   `json:"max_streams"`
-	MaxConsumers int   `json:"max_consumers"`
+	MaxMemory     int64 `json:"max_memory"`
+	MaxStore      int64 `json:"max_storage"`
+	MaxStreams    int   `json:"max_streams"`
+	MaxConsumers  int   `json:"max_consumers"`
+	MaxAckPending int   `json:"max_ack_pending"`
 }
 
 // JetStreamAccountStats returns current statistics about the account's JetStream usage.
@@ -63,6 +67,7 @@ type jetStream struct {
 	accounts      map[*Account]*jsAccount
 	memReserved   int64
 	storeReserved int64
+	cluster       *jetStreamCluster
 }
 
 // This represents a jetstream enabled account.
@@ -90,10 +95,6 @@ type jsAccount struct {
 // If this server is part of a cluster, a system account will need to be defined.
 func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	s.mu.Lock()
-	if !s.standAloneMode() {
-		s.mu.Unlock()
-		return fmt.Errorf("jetstream restricted to single server mode for now")
-	}
 	if s.js != nil {
 		s.mu.Unlock()
 		return fmt.Errorf("jetstream already enabled")
@@ -102,18 +103,29 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	if config == nil || config.MaxMemory <= 0 || config.MaxStore <= 0 {
 		var storeDir string
 		s.Debugf("JetStream creating dynamic configuration - 75%% of system memory, %s disk", FriendlyBytes(JetStreamMaxStoreDefault))
+		var key string
+		var cipher StoreCipher
 		if config != nil {
-			storeDir = config.StoreDir
+			storeDir, key, cipher = config.StoreDir, config.Key, config.Cipher
 		}
 		config = s.dynJetStreamConfig(storeDir)
+		config.Key, config.Cipher = key, cipher
 	}
 	// Copy, don't change callers.
 	cfg := *config
 	if cfg.StoreDir == "" {
 		cfg.StoreDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
 	}
+	// The encryption key can also be supplied through the environment.
+	if cfg.Key == _EMPTY_ {
+		cfg.Key = os.Getenv(JetStreamKeyEnv)
+	}
 
 	s.js = &jetStream{srv: s, config: cfg, accounts: make(map[*Account]*jsAccount)}
+	// If we are part of a cluster our assets will be placed by the meta group.
+	if s.jetStreamClusterConfigured() {
+		s.js.cluster = &jetStreamCluster{streams: make(map[string]map[string]*streamAssignment)}
+	}
 	s.mu.Unlock()
 
 	// FIXME(dlc) - Allow memory only operation?
@@ -161,6 +173,9 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	s.Noticef("  Max Memory:      %s", FriendlyBytes(cfg.MaxMemory))
 	s.Noticef("  Max Storage:     %s", FriendlyBytes(cfg.MaxStore))
 	s.Noticef("  Store Directory: %q", cfg.StoreDir)
+	if cfg.Key != _EMPTY_ {
+		s.Noticef("  Encryption:      %s", cfg.Cipher)
+	}
 
 	// Setup our internal system exports.
 	sacc := s.SystemAccount()
@@ -183,6 +198,13 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 		return fmt.Errorf("Error enabling jetstream on configured accounts: %v", err)
 	}
 
+	// If we are clustered start the meta group.
+	if s.JetStreamIsClustered() {
+		if err := s.startJetStreamCluster(); err != nil {
+			return fmt.Errorf("Error starting jetstream cluster: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -301,10 +323,14 @@ func (s *Server) shutdownJetStream() {
 	for _, jsa := range s.js.accounts {
 		jsas = append(jsas, jsa)
 	}
+	js := s.js
 	s.mu.Unlock()
 
+	// Stop our groups first.
+	js.shutdownCluster()
+
 	for _, jsa := range jsas {
-		s.js.disableJetStream(jsa)
+		js.disableJetStream(jsa)
 	}
 
 	s.mu.Lock()
@@ -364,7 +390,6 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 	if s == nil {
 		return fmt.Errorf("jetstream account not registered")
 	}
-	// FIXME(dlc) - cluster mode
 	js := s.getJetStream()
 	if js == nil {
 		return fmt.Errorf("jetstream not enabled")
@@ -423,6 +448,11 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 		}
 	}
 
+	// When clustered our streams and consumers are restored by the meta group.
+	if js.isClustered() {
+		return nil
+	}
+
 	// Restore any state here.
 	s.Noticef("  Recovering JetStream state for account %q", a.Name)
 
@@ -788,14 +818,22 @@ func (jsa *jsAccount) limitsExceeded(storeType StorageType) bool {
 	return exceeded
 }
 
+// Returns the account limit for max ack pending of consumers, if any.
+func (jsa *jsAccount) maxAckPending() int {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.limits.MaxAckPending
+}
+
 // Check if a new proposed msg set while exceed our account limits.
 // Lock should be held.
 func (jsa *jsAccount) checkLimits(config *StreamConfig) error {
 	if jsa.limits.MaxStreams > 0 && len(jsa.streams) >= jsa.limits.MaxStreams {
 		return fmt.Errorf("maximum number of streams reached")
 	}
-	// FIXME(dlc) - Add check here for replicas based on clustering.
-	if config.Replicas != 1 {
+	// Replicas are only allowed when clustered. The cluster is set before
+	// any accounts are enabled and never changes so no need to lock here.
+	if config.Replicas != 1 && jsa.js.cluster == nil {
 		return fmt.Errorf("replicas setting of %d not allowed", config.Replicas)
 	}
 	// Check MaxConsumers
@@ -864,7 +902,7 @@ func (js *jetStream) lookupAccount(a *Account) *jsAccount {
 func (js *jetStream) dynamicAccountLimits() *JetStreamAccountLimits {
 	js.mu.RLock()
 	// For now used all resources. Mostly meant for $G in non-account mode.
-	limits := &JetStreamAccountLimits{js.config.MaxMemory, js.config.MaxStore, -1, -1}
+	limits := &JetStreamAccountLimits{js.config.MaxMemory, js.config.MaxStore, -1, -1, -1}
 	js.mu.RUnlock()
 	return limits
 }
@@ -919,6 +957,9 @@ const (
 	JetStreamMaxStoreDefault = 1024 * 1024 * 1024 * 1024
 	// JetStreamMaxMemDefault is only used when we can't determine system memory. 256MB
 	JetStreamMaxMemDefault = 1024 * 1024 * 256
+	// JetStreamKeyEnv is the environment variable checked for an encryption key
+	// when one is not configured.
+	JetStreamKeyEnv = "NATS_JETSTREAM_KEY"
 )
 
 // Dynamically create a config with a tmp based directory (repeatable) and 75% of system memory.
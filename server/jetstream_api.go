@@ -117,6 +117,11 @@ const (
 	JSApiDurableCreate  = "$JS.API.CONSUMER.DURABLE.CREATE.*.*"
 	JSApiDurableCreateT = "$JS.API.CONSUMER.DURABLE.CREATE.%s.%s"
 
+	// JSApiConsumerUpdate is the endpoint to update the config of an existing durable consumer.
+	// You need to include the stream and consumer name in the subject.
+	JSApiConsumerUpdate  = "$JS.API.CONSUMER.UPDATE.*.*"
+	JSApiConsumerUpdateT = "$JS.API.CONSUMER.UPDATE.%s.%s"
+
 	// JSApiConsumers is the endpoint to list all consumer names for the stream.
 	// Will return JSON response.
 	JSApiConsumers  = "$JS.API.CONSUMER.NAMES.*"
@@ -136,9 +141,89 @@ const (
 	JSApiConsumerDelete  = "$JS.API.CONSUMER.DELETE.*.*"
 	JSApiConsumerDeleteT = "$JS.API.CONSUMER.DELETE.%s.%s"
 
+	// JSApiConsumerPause is the endpoint to stop a consumer from delivering messages.
+	// Will return JSON response.
+	JSApiConsumerPause  = "$JS.API.CONSUMER.PAUSE.*.*"
+	JSApiConsumerPauseT = "$JS.API.CONSUMER.PAUSE.%s.%s"
+
+	// JSApiConsumerResume is the endpoint to resume delivery for a paused consumer.
+	// Will return JSON response.
+	JSApiConsumerResume  = "$JS.API.CONSUMER.RESUME.*.*"
+	JSApiConsumerResumeT = "$JS.API.CONSUMER.RESUME.%s.%s"
+
+	// JSApiConsumerSeek is the endpoint to move a consumer to a stream sequence or time.
+	// Will return JSON response.
+	JSApiConsumerSeek  = "$JS.API.CONSUMER.SEEK.*.*"
+	JSApiConsumerSeekT = "$JS.API.CONSUMER.SEEK.%s.%s"
+
 	// JSApiRequestNextT is the prefix for the request next message(s) for a consumer in worker/pull mode.
 	JSApiRequestNextT = "$JS.API.CONSUMER.MSG.NEXT.%s.%s"
 
+	// JSApiKVCreate is the endpoint to create key/value buckets.
+	// Will return JSON response.
+	JSApiKVCreate  = "$JS.API.KV.CREATE.*"
+	JSApiKVCreateT = "$JS.API.KV.CREATE.%s"
+
+	// JSApiKVInfo is for obtaining general information about a key/value bucket.
+	// Will return JSON response.
+	JSApiKVInfo  = "$JS.API.KV.INFO.*"
+	JSApiKVInfoT = "$JS.API.KV.INFO.%s"
+
+	// JSApiKVDelete is the endpoint to delete key/value buckets.
+	// Will return JSON response.
+	JSApiKVDelete  = "$JS.API.KV.DELETE.*"
+	JSApiKVDeleteT = "$JS.API.KV.DELETE.%s"
+
+	// JSApiKVGet is the endpoint to get the value for a key, optionally at a given revision.
+	// Will return JSON response.
+	JSApiKVGet  = "$JS.API.KV.GET.*"
+	JSApiKVGetT = "$JS.API.KV.GET.%s"
+
+	// JSApiKVWatch is the endpoint to watch a bucket for updates to keys.
+	// Will return JSON response.
+	JSApiKVWatch  = "$JS.API.KV.WATCH.*"
+	JSApiKVWatchT = "$JS.API.KV.WATCH.%s"
+
+	// JSApiObjectStoreCreate is the endpoint to create object store buckets.
+	// Will return JSON response.
+	JSApiObjectStoreCreate  = "$JS.API.OBJ.CREATE.*"
+	JSApiObjectStoreCreateT = "$JS.API.OBJ.CREATE.%s"
+
+	// JSApiObjectStoreInfo is for obtaining general information about an object store bucket.
+	// Will return JSON response.
+	JSApiObjectStoreInfo  = "$JS.API.OBJ.INFO.*"
+	JSApiObjectStoreInfoT = "$JS.API.OBJ.INFO.%s"
+
+	// JSApiObjectStoreDelete is the endpoint to delete object store buckets.
+	// Will return JSON response.
+	JSApiObjectStoreDelete  = "$JS.API.OBJ.DELETE.*"
+	JSApiObjectStoreDeleteT = "$JS.API.OBJ.DELETE.%s"
+
+	// JSApiObjectPut is the endpoint to store an object once its chunks have been published.
+	// Will return JSON response.
+	JSApiObjectPut  = "$JS.API.OBJ.PUT.*"
+	JSApiObjectPutT = "$JS.API.OBJ.PUT.%s"
+
+	// JSApiObjectGet is the endpoint to get an object. The chunks are delivered to the deliver subject.
+	// Will return JSON response.
+	JSApiObjectGet  = "$JS.API.OBJ.GET.*"
+	JSApiObjectGetT = "$JS.API.OBJ.GET.%s"
+
+	// JSApiObjectList is the endpoint to list the objects in a bucket.
+	// Will return JSON response.
+	JSApiObjectList  = "$JS.API.OBJ.LIST.*"
+	JSApiObjectListT = "$JS.API.OBJ.LIST.%s"
+
+	// JSApiObjectRemove is the endpoint to delete an object.
+	// Will return JSON response.
+	JSApiObjectRemove  = "$JS.API.OBJ.REMOVE.*"
+	JSApiObjectRemoveT = "$JS.API.OBJ.REMOVE.%s"
+
+	// JSApiObjectLink is the endpoint to link to another object.
+	// Will return JSON response.
+	JSApiObjectLink  = "$JS.API.OBJ.LINK.*"
+	JSApiObjectLinkT = "$JS.API.OBJ.LINK.%s"
+
 	// For snapshots and restores. The ack will have additional tokens.
 	jsSnapshotAckT    = "$JS.SNAPSHOT.ACK.%s.%s"
 	jsRestoreDeliverT = "$JS.SNAPSHOT.RESTORE.%s.%s"
@@ -153,6 +238,9 @@ const (
 	jsAckT   = "$JS.ACK.%s.%s"
 	jsAckPre = "$JS.ACK."
 
+	// jsFlowControlT is the template for the replies to flow control requests sent to push consumers.
+	jsFlowControlT = "$JS.FC.%s.%s"
+
 	// JSAdvisoryPrefix is a prefix for all JetStream advisories.
 	JSAdvisoryPrefix = "$JS.EVENT.ADVISORY"
 
@@ -165,6 +253,12 @@ const (
 	// JSAdvisoryConsumerMaxDeliveryExceedPre is a notification published when a message exceeds its delivery threshold.
 	JSAdvisoryConsumerMaxDeliveryExceedPre = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES"
 
+	// JSAdvisoryConsumerMaxAckPendingPre is a notification published when a consumer stalls on its max ack pending.
+	JSAdvisoryConsumerMaxAckPendingPre = "$JS.EVENT.ADVISORY.CONSUMER.MAX_ACK_PENDING"
+
+	// JSAdvisoryConsumerInactivePre is a notification published when a consumer is deleted for being inactive.
+	JSAdvisoryConsumerInactivePre = "$JS.EVENT.ADVISORY.CONSUMER.INACTIVE"
+
 	// JSAdvisoryConsumerMsgTerminatedPre is a notification published when a message has been terminated.
 	JSAdvisoryConsumerMsgTerminatedPre = "$JS.EVENT.ADVISORY.CONSUMER.MSG_TERMINATED"
 
@@ -183,6 +277,9 @@ const (
 	// JSAdvisoryConsumerDeletedPre notification that a template deleted
 	JSAdvisoryConsumerDeletedPre = "$JS.EVENT.ADVISORY.CONSUMER.DELETED"
 
+	// JSAdvisoryConsumerUpdatedPre notification that a consumer was updated
+	JSAdvisoryConsumerUpdatedPre = "$JS.EVENT.ADVISORY.CONSUMER.UPDATED"
+
 	// JSAdvisoryStreamSnapshotCreatePre notification that a snapshot was created
 	JSAdvisoryStreamSnapshotCreatePre = "$JS.EVENT.ADVISORY.STREAM.SNAPSHOT_CREATE"
 
@@ -291,6 +388,22 @@ type JSApiStreamListResponse struct {
 
 const JSApiStreamListResponseType = "io.nats.jetstream.api.v1.stream_list_response"
 
+// JSApiStreamPurgeRequest is optional request information to the purge API.
+// Without it all messages are purged.
+type JSApiStreamPurgeRequest struct {
+	// Only purge messages matching the subject, which can contain wildcards.
+	Subject string `json:"filter,omitempty"`
+	// Purge up to but not including this sequence.
+	Sequence uint64 `json:"seq,omitempty"`
+	// Number of matching messages to keep.
+	Keep uint64 `json:"keep,omitempty"`
+}
+
+// Returns true if the request will purge all messages.
+func (preq *JSApiStreamPurgeRequest) isPurgeAll() bool {
+	return isPurgeAll(preq.Subject) && preq.Sequence == 0 && preq.Keep == 0
+}
+
 // JSApiStreamPurgeResponse.
 type JSApiStreamPurgeResponse struct {
 	ApiResponse
@@ -344,6 +457,12 @@ type JSApiStreamSnapshotResponse struct {
 
 const JSApiStreamSnapshotResponseType = "io.nats.jetstream.api.v1.stream_snapshot_response"
 
+// JSApiStreamRestoreRequest is the optional request to restore a stream.
+type JSApiStreamRestoreRequest struct {
+	// Storage type to restore into. Defaults to the storage type of the snapshot.
+	Storage *StorageType `json:"storage,omitempty"`
+}
+
 // JSApiStreamRestoreResponse is the direct response to the restore request.
 type JSApiStreamRestoreResponse struct {
 	ApiResponse
@@ -354,8 +473,10 @@ type JSApiStreamRestoreResponse struct {
 const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_response"
 
 // JSApiMsgGetRequest get a message request.
+// Either Seq or LastFor should be set, not both.
 type JSApiMsgGetRequest struct {
-	Seq uint64 `json:"seq"`
+	Seq     uint64 `json:"seq"`
+	LastFor string `json:"last_by_subj,omitempty"`
 }
 
 // JSApiMsgGetResponse.
@@ -366,6 +487,147 @@ type JSApiMsgGetResponse struct {
 
 const JSApiMsgGetResponseType = "io.nats.jetstream.api.v1.stream_msg_get_response"
 
+// JSApiKVCreateResponse.
+type JSApiKVCreateResponse struct {
+	ApiResponse
+	*KVBucketInfo
+}
+
+const JSApiKVCreateResponseType = "io.nats.jetstream.api.v1.kv_create_response"
+
+// JSApiKVInfoResponse.
+type JSApiKVInfoResponse struct {
+	ApiResponse
+	*KVBucketInfo
+}
+
+const JSApiKVInfoResponseType = "io.nats.jetstream.api.v1.kv_info_response"
+
+// JSApiKVDeleteResponse.
+type JSApiKVDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiKVDeleteResponseType = "io.nats.jetstream.api.v1.kv_delete_response"
+
+// JSApiKVGetRequest get a key request.
+type JSApiKVGetRequest struct {
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// JSApiKVGetResponse.
+type JSApiKVGetResponse struct {
+	ApiResponse
+	Entry *KVEntry `json:"entry,omitempty"`
+}
+
+const JSApiKVGetResponseType = "io.nats.jetstream.api.v1.kv_get_response"
+
+// JSApiKVWatchRequest watch a bucket request. Key can contain wildcards.
+// By default all revisions are delivered, followed by any updates.
+type JSApiKVWatchRequest struct {
+	Key            string `json:"key,omitempty"`
+	DeliverSubject string `json:"deliver_subject"`
+	UpdatesOnly    bool   `json:"updates_only,omitempty"`
+}
+
+// JSApiKVWatchResponse.
+type JSApiKVWatchResponse struct {
+	ApiResponse
+	Consumer string `json:"consumer,omitempty"`
+}
+
+const JSApiKVWatchResponseType = "io.nats.jetstream.api.v1.kv_watch_response"
+
+// JSApiObjectStoreCreateResponse.
+type JSApiObjectStoreCreateResponse struct {
+	ApiResponse
+	*ObjectStoreInfo
+}
+
+const JSApiObjectStoreCreateResponseType = "io.nats.jetstream.api.v1.obj_create_response"
+
+// JSApiObjectStoreInfoResponse.
+type JSApiObjectStoreInfoResponse struct {
+	ApiResponse
+	*ObjectStoreInfo
+}
+
+const JSApiObjectStoreInfoResponseType = "io.nats.jetstream.api.v1.obj_info_response"
+
+// JSApiObjectStoreDeleteResponse.
+type JSApiObjectStoreDeleteResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiObjectStoreDeleteResponseType = "io.nats.jetstream.api.v1.obj_delete_response"
+
+// JSApiObjectPutRequest is the info for an object whose chunks have been published.
+// If the digest is empty it will be calculated from the chunks.
+type JSApiObjectPutRequest struct {
+	ObjectInfo
+}
+
+// JSApiObjectPutResponse.
+type JSApiObjectPutResponse struct {
+	ApiResponse
+	Info *ObjectInfo `json:"info,omitempty"`
+}
+
+const JSApiObjectPutResponseType = "io.nats.jetstream.api.v1.obj_put_response"
+
+// JSApiObjectGetRequest get an object request.
+type JSApiObjectGetRequest struct {
+	Name           string `json:"name"`
+	DeliverSubject string `json:"deliver_subject"`
+}
+
+// JSApiObjectGetResponse. The chunks of the object will follow on the deliver subject.
+type JSApiObjectGetResponse struct {
+	ApiResponse
+	Info *ObjectInfo `json:"info,omitempty"`
+}
+
+const JSApiObjectGetResponseType = "io.nats.jetstream.api.v1.obj_get_response"
+
+// JSApiObjectListResponse.
+type JSApiObjectListResponse struct {
+	ApiResponse
+	Objects []*ObjectInfo `json:"objects"`
+}
+
+const JSApiObjectListResponseType = "io.nats.jetstream.api.v1.obj_list_response"
+
+// JSApiObjectRemoveRequest delete an object request.
+type JSApiObjectRemoveRequest struct {
+	Name string `json:"name"`
+}
+
+// JSApiObjectRemoveResponse.
+type JSApiObjectRemoveResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+}
+
+const JSApiObjectRemoveResponseType = "io.nats.jetstream.api.v1.obj_remove_response"
+
+// JSApiObjectLinkRequest link to another object request.
+type JSApiObjectLinkRequest struct {
+	Name string      `json:"name"`
+	Link *ObjectLink `json:"link"`
+}
+
+// JSApiObjectLinkResponse.
+type JSApiObjectLinkResponse struct {
+	ApiResponse
+	Info *ObjectInfo `json:"info,omitempty"`
+}
+
+const JSApiObjectLinkResponseType = "io.nats.jetstream.api.v1.obj_link_response"
+
 // JSWaitQueueDefaultMax is the default max number of outstanding requests for pull consumers.
 const JSWaitQueueDefaultMax = 512
 
@@ -377,6 +639,14 @@ type JSApiConsumerCreateResponse struct {
 
 const JSApiConsumerCreateResponseType = "io.nats.jetstream.api.v1.consumer_create_response"
 
+// JSApiConsumerUpdateResponse.
+type JSApiConsumerUpdateResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerUpdateResponseType = "io.nats.jetstream.api.v1.consumer_update_response"
+
 // JSApiConsumerDeleteResponse.
 type JSApiConsumerDeleteResponse struct {
 	ApiResponse
@@ -393,6 +663,36 @@ type JSApiConsumerInfoResponse struct {
 
 const JSApiConsumerInfoResponseType = "io.nats.jetstream.api.v1.consumer_info_response"
 
+// JSApiConsumerPauseResponse.
+type JSApiConsumerPauseResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerPauseResponseType = "io.nats.jetstream.api.v1.consumer_pause_response"
+
+// JSApiConsumerResumeResponse.
+type JSApiConsumerResumeResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerResumeResponseType = "io.nats.jetstream.api.v1.consumer_resume_response"
+
+// JSApiConsumerSeekRequest moves a consumer to a stream sequence or to the first message at or after a time.
+type JSApiConsumerSeekRequest struct {
+	Seq  uint64     `json:"seq,omitempty"`
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// JSApiConsumerSeekResponse.
+type JSApiConsumerSeekResponse struct {
+	ApiResponse
+	*ConsumerInfo
+}
+
+const JSApiConsumerSeekResponseType = "io.nats.jetstream.api.v1.consumer_seek_response"
+
 // JSApiConsumersRequest
 type JSApiConsumersRequest struct {
 	ApiPagedRequest
@@ -488,17 +788,38 @@ var allJsExports = []string{
 	JSApiMsgGet,
 	JSApiConsumerCreate,
 	JSApiDurableCreate,
+	JSApiConsumerUpdate,
 	JSApiConsumers,
 	JSApiConsumerList,
 	JSApiConsumerInfo,
 	JSApiConsumerDelete,
-}
-
-func (s *Server) setJetStreamExportSubs() error {
-	pairs := []struct {
-		subject string
-		handler msgHandler
-	}{
+	JSApiConsumerPause,
+	JSApiConsumerResume,
+	JSApiConsumerSeek,
+	JSApiKVCreate,
+	JSApiKVInfo,
+	JSApiKVDelete,
+	JSApiKVGet,
+	JSApiKVWatch,
+	JSApiObjectStoreCreate,
+	JSApiObjectStoreInfo,
+	JSApiObjectStoreDelete,
+	JSApiObjectPut,
+	JSApiObjectGet,
+	JSApiObjectList,
+	JSApiObjectRemove,
+	JSApiObjectLink,
+}
+
+// jsApiHandler pairs an API subject with its handler.
+type jsApiHandler struct {
+	subject string
+	handler msgHandler
+}
+
+// jsAPIHandlers returns all of the JetStream API handlers.
+func (s *Server) jsAPIHandlers() []jsApiHandler {
+	return []jsApiHandler{
 		{JSApiAccountInfo, s.jsAccountInfoRequest},
 		{JSApiTemplateCreate, s.jsTemplateCreateRequest},
 		{JSApiTemplates, s.jsTemplateNamesRequest},
@@ -517,14 +838,55 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiMsgGet, s.jsMsgGetRequest},
 		{JSApiConsumerCreate, s.jsConsumerCreateRequest},
 		{JSApiDurableCreate, s.jsDurableCreateRequest},
+		{JSApiConsumerUpdate, s.jsConsumerUpdateRequest},
 		{JSApiConsumers, s.jsConsumerNamesRequest},
 		{JSApiConsumerList, s.jsConsumerListRequest},
 		{JSApiConsumerInfo, s.jsConsumerInfoRequest},
 		{JSApiConsumerDelete, s.jsConsumerDeleteRequest},
+		{JSApiConsumerPause, s.jsConsumerPauseRequest},
+		{JSApiConsumerResume, s.jsConsumerResumeRequest},
+		{JSApiConsumerSeek, s.jsConsumerSeekRequest},
+		{JSApiKVCreate, s.jsKVCreateRequest},
+		{JSApiKVInfo, s.jsKVInfoRequest},
+		{JSApiKVDelete, s.jsKVDeleteRequest},
+		{JSApiKVGet, s.jsKVGetRequest},
+		{JSApiKVWatch, s.jsKVWatchRequest},
+		{JSApiObjectStoreCreate, s.jsObjectStoreCreateRequest},
+		{JSApiObjectStoreInfo, s.jsObjectStoreInfoRequest},
+		{JSApiObjectStoreDelete, s.jsObjectStoreDeleteRequest},
+		{JSApiObjectPut, s.jsObjectPutRequest},
+		{JSApiObjectGet, s.jsObjectGetRequest},
+		{JSApiObjectList, s.jsObjectListRequest},
+		{JSApiObjectRemove, s.jsObjectRemoveRequest},
+		{JSApiObjectLink, s.jsObjectLinkRequest},
+	}
+}
+
+// jsAPIHandler returns the handler for the given API subject.
+func (s *Server) jsAPIHandler(subject string) msgHandler {
+	for _, p := range s.jsAPIHandlers() {
+		if matchLiteral(subject, p.subject) {
+			return p.handler
+		}
+	}
+	return nil
+}
+
+// jsLocalRequest will only pass along requests that originated on this server.
+// When clustered, requests are also routed to the other servers, but only the
+// server the requestor is connected to should process them.
+func jsLocalRequest(h msgHandler) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		if c != nil && c.kind == ROUTER {
+			return
+		}
+		h(sub, c, subject, reply, msg)
 	}
+}
 
-	for _, p := range pairs {
-		if _, err := s.sysSubscribe(p.subject, p.handler); err != nil {
+func (s *Server) setJetStreamExportSubs() error {
+	for _, p := range s.jsAPIHandlers() {
+		if _, err := s.sysSubscribe(p.subject, jsLocalRequest(p.handler)); err != nil {
 			return err
 		}
 	}
@@ -532,7 +894,10 @@ func (s *Server) setJetStreamExportSubs() error {
 }
 
 func (s *Server) sendAPIResponse(c *client, subject, reply, request, response string) {
-	s.sendInternalAccountMsg(c.acc, reply, response)
+	// Requests forwarded from other servers may not want a response.
+	if reply != _EMPTY_ {
+		s.sendInternalAccountMsg(c.acc, reply, response)
+	}
 	s.sendJetStreamAPIAuditAdvisory(c, subject, request, response)
 }
 
@@ -569,6 +934,10 @@ func consumerNameFromSubject(subject string) string {
 	return tokenAt(subject, 6)
 }
 
+func bucketNameFromSubject(subject string) string {
+	return tokenAt(subject, 5)
+}
+
 // Request to create a new template.
 func (s *Server) jsTemplateCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
 	if c == nil || c.acc == nil {
@@ -581,6 +950,11 @@ func (s *Server) jsTemplateCreateRequest(sub *subscription, c *client, subject,
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if s.JetStreamIsClustered() {
+		resp.Error = &ApiError{Code: 400, Description: "stream templates not supported in clustered mode"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 	var cfg StreamTemplateConfig
 	if err := json.Unmarshal(msg, &cfg); err != nil {
 		resp.Error = jsInvalidJSONErr
@@ -774,13 +1148,19 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, subject, re
 		return
 	}
 
+	// When clustered the meta leader will assign the stream to a group.
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamRequest(c, subject, reply, msg, &cfg, _EMPTY_)
+		return
+	}
+
 	mset, err := c.acc.AddStream(&cfg)
 	if err != nil {
 		resp.Error = jsError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	resp.StreamInfo = mset.Info()
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -808,6 +1188,10 @@ func (s *Server) jsStreamUpdateRequest(sub *subscription, c *client, subject, re
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamUpdateRequest(c, subject, reply, msg, &cfg)
+		return
+	}
 	mset, err := c.acc.LookupStream(streamName)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -820,7 +1204,7 @@ func (s *Server) jsStreamUpdateRequest(sub *subscription, c *client, subject, re
 		return
 	}
 
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	resp.StreamInfo = mset.Info()
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -850,18 +1234,23 @@ func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, subject, rep
 
 	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
 	// TODO(dlc) - If this list is long maybe do this in a Go routine?
-	msets := c.acc.Streams()
-	sort.Slice(msets, func(i, j int) bool {
-		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-	})
+	var names []string
+	if s.JetStreamIsClustered() {
+		names = s.jsClusteredStreamNames(c.acc)
+	} else {
+		for _, mset := range c.acc.Streams() {
+			names = append(names, mset.Name())
+		}
+		sort.Strings(names)
+	}
 
-	scnt := len(msets)
+	scnt := len(names)
 	if offset > scnt {
 		offset = scnt
 	}
 
-	for _, mset := range msets[offset:] {
-		resp.Streams = append(resp.Streams, mset.config.Name)
+	for _, name := range names[offset:] {
+		resp.Streams = append(resp.Streams, name)
 		if len(resp.Streams) >= JSApiNamesLimit {
 			break
 		}
@@ -903,18 +1292,26 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, subject, repl
 
 	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
 	// TODO(dlc) - If this list is long maybe do this in a Go routine?
-	msets := c.acc.Streams()
-	sort.Slice(msets, func(i, j int) bool {
-		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-	})
+	var infos []*StreamInfo
+	if s.JetStreamIsClustered() {
+		infos = s.jsClusteredStreamList(c.acc)
+	} else {
+		msets := c.acc.Streams()
+		sort.Slice(msets, func(i, j int) bool {
+			return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
+		})
+		for _, mset := range msets {
+			infos = append(infos, mset.Info())
+		}
+	}
 
-	scnt := len(msets)
+	scnt := len(infos)
 	if offset > scnt {
 		offset = scnt
 	}
 
-	for _, mset := range msets[offset:] {
-		resp.Streams = append(resp.Streams, &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()})
+	for _, info := range infos[offset:] {
+		resp.Streams = append(resp.Streams, info)
 		if len(resp.Streams) >= JSApiListLimit {
 			break
 		}
@@ -943,13 +1340,16 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, subject, repl
 		return
 	}
 	name := streamNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, name, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(name)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	resp.StreamInfo = mset.Info()
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -990,6 +1390,10 @@ func (s *Server) jsStreamDeleteRequest(sub *subscription, c *client, subject, re
 		return
 	}
 	stream := streamNameFromSubject(subject)
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamDeleteRequest(c, stream, subject, reply, msg, _EMPTY_)
+		return
+	}
 	mset, err := c.acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -1031,12 +1435,29 @@ func (s *Server) jsMsgDeleteRequest(sub *subscription, c *client, subject, reply
 	}
 
 	stream := tokenAt(subject, 6)
+	if s.jsForwardToStreamLeader(c, stream, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if cfg := mset.Config(); cfg.Sealed || cfg.DenyDelete {
+		resp.Error = &ApiError{Code: 400, Description: "message delete not permitted"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// When clustered the leader will respond once the delete is applied.
+	if mset.isClustered() {
+		if err := mset.propose(deleteMsgOp, &streamMsgDeleteOp{Seq: req.Seq, Reply: reply}); err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
 
 	removed, err := mset.EraseMsg(req.Seq)
 	if err != nil {
@@ -1075,8 +1496,21 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if req.Seq > 0 && req.LastFor != _EMPTY_ {
+		resp.Error = &ApiError{Code: 400, Description: "only one of sequence or last by subject allowed"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.LastFor != _EMPTY_ && (!IsValidSubject(req.LastFor) || subjectHasWildcard(req.LastFor)) {
+		resp.Error = &ApiError{Code: 400, Description: "last by subject must be a valid literal subject"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 
 	stream := tokenAt(subject, 6)
+	if s.jsForwardToStreamLeader(c, stream, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -1084,7 +1518,19 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 		return
 	}
 
-	subj, hdr, msg, ts, err := mset.store.LoadMsg(req.Seq)
+	var (
+		seq  = req.Seq
+		subj string
+		hdr  []byte
+		data []byte
+		ts   int64
+	)
+	if req.LastFor != _EMPTY_ {
+		subj = req.LastFor
+		seq, hdr, data, ts, err = mset.store.LoadLastMsg(req.LastFor)
+	} else {
+		subj, hdr, data, ts, err = mset.store.LoadMsg(req.Seq)
+	}
 	if err != nil {
 		resp.Error = jsError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
@@ -1092,21 +1538,64 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, subject, reply st
 	}
 	resp.Message = &StoredMsg{
 		Subject:  subj,
-		Sequence: req.Seq,
+		Sequence: seq,
 		Header:   hdr,
-		Data:     msg,
+		Data:     data,
 		Time:     time.Unix(0, ts),
 	}
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
-// Request to purge a stream.
-func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+// Request to create a key/value bucket.
+func (s *Server) jsKVCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
 	if c == nil || c.acc == nil {
 		return
 	}
 
-	var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+	var resp = JSApiKVCreateResponse{ApiResponse: ApiResponse{Type: JSApiKVCreateResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var cfg KVConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if bucketNameFromSubject(subject) != cfg.Bucket {
+		resp.Error = &ApiError{Code: 400, Description: "bucket name in subject does not match request"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if s.JetStreamIsClustered() {
+		scfg, err := cfg.streamConfig()
+		if err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.jsClusteredStreamRequest(c, subject, reply, msg, scfg, kvStreamKind)
+		return
+	}
+	mset, err := c.acc.AddKeyValue(&cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.KVBucketInfo = mset.KeyValueInfo()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for information about a key/value bucket.
+func (s *Server) jsKVInfoRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiKVInfoResponse{ApiResponse: ApiResponse{Type: JSApiKVInfoResponseType}}
 	if !c.acc.JetStreamEnabled() {
 		resp.Error = jsNotEnabledErr
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
@@ -1117,27 +1606,28 @@ func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, rep
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	stream := streamNameFromSubject(subject)
-	mset, err := c.acc.LookupStream(stream)
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, kvStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupKeyValue(bucket)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	resp.Purged = mset.Purge()
-	resp.Success = true
+	resp.KVBucketInfo = mset.KeyValueInfo()
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
-// Request to restore a stream.
-func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
-	if c.acc == nil {
+// Request to delete a key/value bucket.
+func (s *Server) jsKVDeleteRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
 		return
 	}
-	acc := c.acc
 
-	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
-	if !acc.JetStreamEnabled() {
+	var resp = JSApiKVDeleteResponse{ApiResponse: ApiResponse{Type: JSApiKVDeleteResponseType}}
+	if !c.acc.JetStreamEnabled() {
 		resp.Error = jsNotEnabledErr
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
@@ -1147,25 +1637,665 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, r
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	stream := streamNameFromSubject(subject)
-	if _, err := acc.LookupStream(stream); err == nil {
-		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("stream [%q] already exists", stream)}
-		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+	bucket := bucketNameFromSubject(subject)
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamDeleteRequest(c, kvStreamPrefix+bucket, subject, reply, msg, kvStreamKind)
 		return
 	}
-
-	// FIXME(dlc) - Need to close these up if we fail for some reason.
-	// TODO(dlc) - Might need to make configurable or stream direct to storage dir.
-	tfile, err := ioutil.TempFile("", "jetstream-restore-")
+	mset, err := c.acc.LookupKeyValue(bucket)
 	if err != nil {
-		resp.Error = &ApiError{Code: 500, Description: "jetstream unable to open temp storage for restore"}
+		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-
-	s.Noticef("Starting restore for stream %q in account %q", stream, c.acc.Name)
-	start := time.Now()
-	received := 0
+	if err := mset.Delete(); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to get the value for a key.
+func (s *Server) jsKVGetRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiKVGetResponse{ApiResponse: ApiResponse{Type: JSApiKVGetResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiKVGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !IsValidSubject(req.Key) || subjectHasWildcard(req.Key) {
+		resp.Error = &ApiError{Code: 400, Description: "key must be a valid literal subject"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, kvStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupKeyValue(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	entry, err := mset.KeyValueGet(req.Key, req.Revision)
+	if err == ErrKVKeyNotFound {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Entry = entry
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to watch a key/value bucket. This will create an ephemeral consumer
+// that delivers the matching keys to the deliver subject.
+func (s *Server) jsKVWatchRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiKVWatchResponse{ApiResponse: ApiResponse{Type: JSApiKVWatchResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiKVWatchRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Key == _EMPTY_ {
+		req.Key = ">"
+	}
+	if !IsValidSubject(req.Key) {
+		resp.Error = &ApiError{Code: 400, Description: "key must be a valid subject"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	cfg := &ConsumerConfig{
+		DeliverSubject: req.DeliverSubject,
+		DeliverPolicy:  DeliverAll,
+		AckPolicy:      AckNone,
+		FilterSubject:  fmt.Sprintf(KVSubjectT, bucket, req.Key),
+	}
+	if req.UpdatesOnly {
+		cfg.DeliverPolicy = DeliverNew
+	}
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerRequest(c, subject, reply, msg, kvStreamPrefix+bucket, cfg, kvStreamKind)
+		return
+	}
+	mset, err := c.acc.LookupKeyValue(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	o, err := mset.AddConsumer(cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Consumer = o.Name()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to create an object store bucket.
+func (s *Server) jsObjectStoreCreateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectStoreCreateResponse{ApiResponse: ApiResponse{Type: JSApiObjectStoreCreateResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var cfg ObjectStoreConfig
+	if err := json.Unmarshal(msg, &cfg); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if bucketNameFromSubject(subject) != cfg.Bucket {
+		resp.Error = &ApiError{Code: 400, Description: "bucket name in subject does not match request"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if s.JetStreamIsClustered() {
+		scfg, err := cfg.streamConfig()
+		if err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.jsClusteredStreamRequest(c, subject, reply, msg, scfg, objStreamKind)
+		return
+	}
+	mset, err := c.acc.AddObjectStore(&cfg)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ObjectStoreInfo = mset.ObjectStoreInfo()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request for information about an object store bucket.
+func (s *Server) jsObjectStoreInfoRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectStoreInfoResponse{ApiResponse: ApiResponse{Type: JSApiObjectStoreInfoResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ObjectStoreInfo = mset.ObjectStoreInfo()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to delete an object store bucket.
+func (s *Server) jsObjectStoreDeleteRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectStoreDeleteResponse{ApiResponse: ApiResponse{Type: JSApiObjectStoreDeleteResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamDeleteRequest(c, objStreamPrefix+bucket, subject, reply, msg, objStreamKind)
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := mset.Delete(); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to store an object. The chunks should already have been published
+// to the chunk subject for the object's nuid.
+func (s *Server) jsObjectPutRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectPutResponse{ApiResponse: ApiResponse{Type: JSApiObjectPutResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiObjectPutRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// When clustered the leader will respond once the metadata is stored.
+	if mset.isClustered() {
+		err := mset.checkPutObject(&req.ObjectInfo)
+		if err == nil {
+			err = mset.proposeObjectInfo(&req.ObjectInfo, JSApiObjectPutResponseType, reply)
+		}
+		if err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	info, err := mset.PutObject(&req.ObjectInfo)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Info = info
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to get an object. The chunks are then delivered in order to the
+// deliver subject, and the digest is verified as they are delivered.
+func (s *Server) jsObjectGetRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectGetResponse{ApiResponse: ApiResponse{Type: JSApiObjectGetResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiObjectGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !IsValidSubject(req.DeliverSubject) || subjectHasWildcard(req.DeliverSubject) {
+		resp.Error = &ApiError{Code: 400, Description: "deliver subject must be a valid literal subject"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	info, err := mset.ObjectInfo(req.Name)
+	// Links are only followed once.
+	if err == nil && info.Link != nil {
+		if mset, err = c.acc.LookupObjectStore(info.Link.Bucket); err == nil {
+			info, err = mset.ObjectInfo(info.Link.Name)
+		}
+		if err == nil && info.Link != nil {
+			err = ErrObjectNotFound
+		}
+	}
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := mset.checkObjectChunks(info); err == ErrObjectDigestMismatch {
+		resp.Error = &ApiError{Code: 500, Description: err.Error()}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := mset.deliverObject(info, req.DeliverSubject); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Info = info
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to list the objects in a bucket.
+func (s *Server) jsObjectListRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectListResponse{
+		ApiResponse: ApiResponse{Type: JSApiObjectListResponseType},
+		Objects:     []*ObjectInfo{},
+	}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = jsNotEmptyRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	infos, err := mset.ListObjects()
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Objects = append(resp.Objects, infos...)
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to delete an object from a bucket.
+func (s *Server) jsObjectRemoveRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectRemoveResponse{ApiResponse: ApiResponse{Type: JSApiObjectRemoveResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiObjectRemoveRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// When clustered the leader will respond once the object is marked as deleted.
+	if mset.isClustered() {
+		_, err := mset.ObjectInfo(req.Name)
+		if err == nil {
+			err = mset.proposeObjectInfo(&ObjectInfo{Name: req.Name, Deleted: true}, JSApiObjectRemoveResponseType, reply)
+		}
+		if err == ErrObjectNotFound {
+			resp.Error = jsNotFoundError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		} else if err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if _, err := mset.DeleteObject(req.Name); err == ErrObjectNotFound {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Success = true
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to link an object to another object, possibly in another bucket.
+func (s *Server) jsObjectLinkRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiObjectLinkResponse{ApiResponse: ApiResponse{Type: JSApiObjectLinkResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if isEmptyRequest(msg) {
+		resp.Error = jsBadRequestErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiObjectLinkRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Link == nil {
+		resp.Error = &ApiError{Code: 400, Description: "object link requires a bucket and name"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	bucket := bucketNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, objStreamPrefix+bucket, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupObjectStore(bucket)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// The target has to exist and can not itself be a link.
+	target, err := c.acc.LookupObjectStore(req.Link.Bucket)
+	if err == nil {
+		var tinfo *ObjectInfo
+		if tinfo, err = target.ObjectInfo(req.Link.Name); err == nil && tinfo.Link != nil {
+			resp.Error = &ApiError{Code: 400, Description: "object link can not point to another link"}
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// When clustered the leader will respond once the link is stored.
+	if mset.isClustered() {
+		err := checkObjectLink(req.Name, req.Link)
+		if err == nil {
+			err = mset.proposeObjectInfo(&ObjectInfo{Name: req.Name, Link: req.Link}, JSApiObjectLinkResponseType, reply)
+		}
+		if err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	info, err := mset.LinkObject(req.Name, req.Link)
+	if err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.Info = info
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to purge a stream.
+func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var preq *JSApiStreamPurgeRequest
+	if !isEmptyRequest(msg) {
+		var req JSApiStreamPurgeRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if req.Sequence > 0 && req.Keep > 0 {
+			resp.Error = &ApiError{Code: 400, Description: "sequence and keep can not both be set"}
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		if req.Subject != _EMPTY_ && !IsValidSubject(req.Subject) {
+			resp.Error = &ApiError{Code: 400, Description: "purge filter subject is not valid"}
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		preq = &req
+	}
+	stream := streamNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, stream, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if cfg := mset.Config(); cfg.Sealed || cfg.DenyPurge {
+		resp.Error = &ApiError{Code: 400, Description: "stream purge not permitted"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// When clustered the leader will respond once the purge is applied.
+	if mset.isClustered() {
+		if err := mset.propose(purgeStreamOp, &streamPurgeOp{Request: preq, Reply: reply}); err != nil {
+			resp.Error = jsError(err)
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	purged, err := mset.purge(preq)
+	if err != nil {
+		resp.Error = jsError(err)
+	} else {
+		resp.Purged = purged
+		resp.Success = true
+	}
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to restore a stream.
+func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c.acc == nil {
+		return
+	}
+	acc := c.acc
+
+	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
+	if !acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if s.JetStreamIsClustered() {
+		resp.Error = &ApiError{Code: 400, Description: "stream restore not supported in clustered mode"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req JSApiStreamRestoreRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = jsInvalidJSONErr
+			s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+	stream := streamNameFromSubject(subject)
+	if _, err := acc.LookupStream(stream); err == nil {
+		resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("stream [%q] already exists", stream)}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// FIXME(dlc) - Need to close these up if we fail for some reason.
+	// TODO(dlc) - Might need to make configurable or stream direct to storage dir.
+	tfile, err := ioutil.TempFile("", "jetstream-restore-")
+	if err != nil {
+		resp.Error = &ApiError{Code: 500, Description: "jetstream unable to open temp storage for restore"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	s.Noticef("Starting restore for stream %q in account %q", stream, c.acc.Name)
+	start := time.Now()
+	received := 0
 
 	caudit := c.apiAuditClient()
 	s.publishAdvisory(c.acc, JSAdvisoryStreamRestoreCreatePre+"."+stream, &JSRestoreCreateAdvisory{
@@ -1201,7 +2331,7 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, r
 
 		if len(msg) == 0 {
 			tfile.Seek(0, 0)
-			mset, err := acc.RestoreStream(stream, tfile)
+			mset, err := acc.restoreStream(stream, tfile, req.Storage)
 			tfile.Close()
 			os.Remove(tfile.Name())
 			sub.client.processUnsub(sub.sid)
@@ -1230,7 +2360,7 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, r
 			if err != nil {
 				resp.Error = jsError(err)
 			} else {
-				resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+				resp.StreamInfo = mset.Info()
 			}
 			s.sendInternalAccountMsg(acc, reply, s.jsonResponse(&resp))
 
@@ -1276,6 +2406,9 @@ func (s *Server) jsStreamSnapshotRequest(sub *subscription, c *client, subject,
 		return
 	}
 	stream := streamNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, stream, subject, reply, msg) {
+		return
+	}
 	mset, err := acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -1479,12 +2612,6 @@ func (s *Server) jsConsumerCreate(sub *subscription, c *client, subject, reply s
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	stream, err := c.acc.LookupStream(req.Stream)
-	if err != nil {
-		resp.Error = jsNotFoundError(err)
-		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
-	}
 
 	if expectDurable {
 		if numTokens(subject) != 7 {
@@ -1517,6 +2644,19 @@ func (s *Server) jsConsumerCreate(sub *subscription, c *client, subject, reply s
 		}
 	}
 
+	// When clustered the meta leader will assign the consumer to the stream's peers.
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerRequest(c, subject, reply, msg, req.Stream, &req.Config, _EMPTY_)
+		return
+	}
+
+	stream, err := c.acc.LookupStream(req.Stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
 	o, err := stream.AddConsumer(&req.Config)
 	if err != nil {
 		resp.Error = jsError(err)
@@ -1527,6 +2667,61 @@ func (s *Server) jsConsumerCreate(sub *subscription, c *client, subject, reply s
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
+// Request to update the config of a durable consumer.
+func (s *Server) jsConsumerUpdateRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	var resp = JSApiConsumerUpdateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerUpdateResponseType}}
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	var req CreateConsumerRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = jsInvalidJSONErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if tokenAt(subject, 5) != req.Stream {
+		resp.Error = &ApiError{Code: 400, Description: "stream name in subject does not match request"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Config.Durable == _EMPTY_ || tokenAt(subject, 6) != req.Config.Durable {
+		resp.Error = &ApiError{Code: 400, Description: "consumer name in subject does not match durable name in request"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerUpdateRequest(c, subject, reply, msg, req.Stream, &req.Config)
+		return
+	}
+
+	mset, err := c.acc.LookupStream(req.Stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	o := mset.LookupConsumer(req.Config.Durable)
+	if o == nil {
+		resp.Error = jsNotFoundError(fmt.Errorf("consumer not found"))
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := o.Update(&req.Config); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ConsumerInfo = o.Info()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
 // Request for the list of all consumer names.
 func (s *Server) jsConsumerNamesRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
 	if c == nil || c.acc == nil {
@@ -1556,6 +2751,9 @@ func (s *Server) jsConsumerNamesRequest(sub *subscription, c *client, subject, r
 	}
 
 	streamName := streamNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, streamName, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(streamName)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -1614,6 +2812,9 @@ func (s *Server) jsConsumerListRequest(sub *subscription, c *client, subject, re
 	}
 
 	streamName := streamNameFromSubject(subject)
+	if s.jsForwardToStreamLeader(c, streamName, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(streamName)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
@@ -1662,19 +2863,113 @@ func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, subject, re
 	}
 
 	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+	if s.jsForwardToConsumerLeader(c, stream, consumer, subject, reply, msg) {
+		return
+	}
 	mset, err := c.acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	obs := mset.LookupConsumer(consumer)
+	if obs == nil {
+		resp.Error = &ApiError{Code: 404, Description: "consumer not found"}
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	resp.ConsumerInfo = obs.Info()
+	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to pause a consumer.
+func (s *Server) jsConsumerPauseRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	s.jsConsumerOpRequest(c, subject, reply, msg, JSApiConsumerPauseResponseType, checkEmptyRequest, (*Consumer).Pause)
+}
+
+// Request to resume a paused consumer.
+func (s *Server) jsConsumerResumeRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	s.jsConsumerOpRequest(c, subject, reply, msg, JSApiConsumerResumeResponseType, checkEmptyRequest, (*Consumer).Resume)
+}
+
+// Request to move a consumer to a stream sequence or time.
+func (s *Server) jsConsumerSeekRequest(sub *subscription, c *client, subject, reply string, msg []byte) {
+	var req JSApiConsumerSeekRequest
+	check := func(msg []byte) *ApiError {
+		if isEmptyRequest(msg) {
+			return jsBadRequestErr
+		}
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return jsInvalidJSONErr
+		}
+		if (req.Seq > 0) == (req.Time != nil) {
+			return &ApiError{Code: 400, Description: "exactly one of sequence or time required"}
+		}
+		return nil
+	}
+	s.jsConsumerOpRequest(c, subject, reply, msg, JSApiConsumerSeekResponseType, check, func(o *Consumer) error {
+		if req.Time != nil {
+			return o.SeekTime(*req.Time)
+		}
+		return o.Seek(req.Seq)
+	})
+}
+
+// Returns an error if the request is not empty.
+func checkEmptyRequest(msg []byte) *ApiError {
+	if !isEmptyRequest(msg) {
+		return jsNotEmptyRequestErr
+	}
+	return nil
+}
+
+// Will process a request that operates on a consumer and responds with its info,
+// such as pause, resume and seek. The request is checked before it is forwarded to
+// the consumer leader when clustered, and op is called on the consumer by its leader.
+func (s *Server) jsConsumerOpRequest(c *client, subject, reply string, msg []byte, respType string, check func(msg []byte) *ApiError, op func(o *Consumer) error) {
+	if c == nil || c.acc == nil {
+		return
+	}
+
+	// This has the same form as the typed responses for these requests.
+	var resp = struct {
+		ApiResponse
+		*ConsumerInfo
+	}{ApiResponse: ApiResponse{Type: respType}}
+
+	if !c.acc.JetStreamEnabled() {
+		resp.Error = jsNotEnabledErr
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if resp.Error = check(msg); resp.Error != nil {
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	stream := streamNameFromSubject(subject)
 	consumer := consumerNameFromSubject(subject)
+	if s.jsForwardToConsumerLeader(c, stream, consumer, subject, reply, msg) {
+		return
+	}
+	mset, err := c.acc.LookupStream(stream)
+	if err != nil {
+		resp.Error = jsNotFoundError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 	obs := mset.LookupConsumer(consumer)
 	if obs == nil {
 		resp.Error = &ApiError{Code: 404, Description: "consumer not found"}
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if err := op(obs); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 	resp.ConsumerInfo = obs.Info()
 	s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(resp))
 }
@@ -1697,13 +2992,17 @@ func (s *Server) jsConsumerDeleteRequest(sub *subscription, c *client, subject,
 		return
 	}
 	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+	if s.JetStreamIsClustered() {
+		s.jsClusteredConsumerDeleteRequest(c, stream, consumer, subject, reply, msg)
+		return
+	}
 	mset, err := c.acc.LookupStream(stream)
 	if err != nil {
 		resp.Error = jsNotFoundError(err)
 		s.sendAPIResponse(c, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	consumer := consumerNameFromSubject(subject)
 	obs := mset.LookupConsumer(consumer)
 	if obs == nil {
 		resp.Error = &ApiError{Code: 404, Description: "consumer not found"}
@@ -0,0 +1,2038 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// jetStreamCluster holds the meta layer when running JetStream in clustered mode.
+type jetStreamCluster struct {
+	// The meta group, all JetStream enabled servers in the cluster are members.
+	meta RaftNode
+	// For stream and consumer assignments. All servers will have this be the same.
+	// ACCOUNT -> STREAM -> streamAssignment
+	streams map[string]map[string]*streamAssignment
+	// Peers we learned about before the meta group was started.
+	peers []string
+	// Subscription for forwarded meta requests.
+	fsub *subscription
+	// Set while we replay our meta log on startup.
+	recovering bool
+}
+
+// Define types of the entries we place into our groups.
+type entryOp uint8
+
+const (
+	// Meta ops.
+	assignStreamOp entryOp = iota
+	removeStreamOp
+	updateStreamOp
+	assignConsumerOp
+	removeConsumerOp
+	// Stream ops.
+	streamMsgOp
+	purgeStreamOp
+	deleteMsgOp
+	// Consumer ops.
+	updateConsumerStateOp
+	// Mirror ops, these keep the sequence from the origin stream.
+	mirrorMsgOp
+	// Schedule ops, these make a held message visible once due.
+	scheduleMsgOp
+	// Object store ops, these store the metadata for an object.
+	objectInfoOp
+)
+
+// raftGroup is the set of peers that replicate a stream or consumer.
+type raftGroup struct {
+	Name    string      `json:"name"`
+	Peers   []string    `json:"peers"`
+	Storage StorageType `json:"store"`
+	node    RaftNode
+}
+
+// streamAssignment is what the meta leader uses to assign streams to peers.
+type streamAssignment struct {
+	Account string        `json:"account"`
+	Created time.Time     `json:"created"`
+	Config  *StreamConfig `json:"stream"`
+	Group   *raftGroup    `json:"group"`
+	Reply   string        `json:"reply,omitempty"`
+	Kind    string        `json:"kind,omitempty"`
+	// Internal
+	consumers map[string]*consumerAssignment
+	csub      *subscription
+	fsub      *subscription
+	responded bool
+}
+
+// consumerAssignment is what the meta leader uses to assign consumers to streams.
+type consumerAssignment struct {
+	Account string          `json:"account"`
+	Stream  string          `json:"stream"`
+	Name    string          `json:"name"`
+	Created time.Time       `json:"created"`
+	Config  *ConsumerConfig `json:"consumer"`
+	Group   *raftGroup      `json:"group"`
+	Reply   string          `json:"reply,omitempty"`
+	Update  bool            `json:"update,omitempty"`
+	Kind    string          `json:"kind,omitempty"`
+	// Internal
+	fsub      *subscription
+	responded bool
+}
+
+// Kinds of streams that are created through their own API, e.g. key/value buckets.
+// Requests for these are answered with the responses for that API.
+const (
+	kvStreamKind  = "kv"
+	objStreamKind = "obj"
+)
+
+// Returns true if the stream config is for the kind of stream.
+func isStreamKind(kind string, cfg *StreamConfig) bool {
+	switch kind {
+	case kvStreamKind:
+		return kvBucket(cfg) != _EMPTY_
+	case objStreamKind:
+		return objBucket(cfg) != _EMPTY_
+	}
+	return true
+}
+
+// Response to a create request for the kind of stream, with either the new stream or the error.
+func streamCreateResponse(kind string, mset *Stream, err *ApiError) interface{} {
+	switch kind {
+	case kvStreamKind:
+		resp := &JSApiKVCreateResponse{ApiResponse: ApiResponse{Type: JSApiKVCreateResponseType, Error: err}}
+		if mset != nil {
+			resp.KVBucketInfo = mset.KeyValueInfo()
+		}
+		return resp
+	case objStreamKind:
+		resp := &JSApiObjectStoreCreateResponse{ApiResponse: ApiResponse{Type: JSApiObjectStoreCreateResponseType, Error: err}}
+		if mset != nil {
+			resp.ObjectStoreInfo = mset.ObjectStoreInfo()
+		}
+		return resp
+	}
+	resp := &JSApiStreamCreateResponse{ApiResponse: ApiResponse{Type: JSApiStreamCreateResponseType, Error: err}}
+	if mset != nil {
+		resp.StreamInfo = mset.Info()
+	}
+	return resp
+}
+
+// Subject to request the info for an existing stream of the kind, which answers a repeated create request.
+func streamInfoSubject(kind, stream string) string {
+	switch kind {
+	case kvStreamKind:
+		return fmt.Sprintf(JSApiKVInfoT, stream[len(kvStreamPrefix):])
+	case objStreamKind:
+		return fmt.Sprintf(JSApiObjectStoreInfoT, stream[len(objStreamPrefix):])
+	}
+	return fmt.Sprintf(JSApiStreamInfoT, stream)
+}
+
+// Response to a delete request for the kind of stream.
+func streamDeleteResponse(kind string, err *ApiError) interface{} {
+	switch kind {
+	case kvStreamKind:
+		return &JSApiKVDeleteResponse{ApiResponse: ApiResponse{Type: JSApiKVDeleteResponseType, Error: err}, Success: err == nil}
+	case objStreamKind:
+		return &JSApiObjectStoreDeleteResponse{ApiResponse: ApiResponse{Type: JSApiObjectStoreDeleteResponseType, Error: err}, Success: err == nil}
+	}
+	return &JSApiStreamDeleteResponse{ApiResponse: ApiResponse{Type: JSApiStreamDeleteResponseType, Error: err}, Success: err == nil}
+}
+
+// Response to a create request for a consumer on the kind of stream, with either the new consumer or the error.
+func consumerCreateResponse(kind string, o *Consumer, err *ApiError) interface{} {
+	switch kind {
+	case kvStreamKind:
+		resp := &JSApiKVWatchResponse{ApiResponse: ApiResponse{Type: JSApiKVWatchResponseType, Error: err}}
+		if o != nil {
+			resp.Consumer = o.Name()
+		}
+		return resp
+	}
+	resp := &JSApiConsumerCreateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerCreateResponseType, Error: err}}
+	if o != nil {
+		resp.ConsumerInfo = o.Info()
+	}
+	return resp
+}
+
+// Response to an object put, link or remove request once the metadata for the object is stored.
+func objectInfoResponse(rtype string, info *ObjectInfo, err *ApiError) interface{} {
+	switch rtype {
+	case JSApiObjectLinkResponseType:
+		resp := &JSApiObjectLinkResponse{ApiResponse: ApiResponse{Type: rtype, Error: err}}
+		if err == nil {
+			resp.Info = info
+		}
+		return resp
+	case JSApiObjectRemoveResponseType:
+		return &JSApiObjectRemoveResponse{ApiResponse: ApiResponse{Type: rtype, Error: err}, Success: err == nil}
+	}
+	resp := &JSApiObjectPutResponse{ApiResponse: ApiResponse{Type: JSApiObjectPutResponseType, Error: err}}
+	if err == nil {
+		resp.Info = info
+	}
+	return resp
+}
+
+// Request forwarded to the leader of a group.
+type jsForwardedRequest struct {
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	Reply   string `json:"reply,omitempty"`
+	Msg     []byte `json:"msg,omitempty"`
+}
+
+// Stream ops that need to respond once applied.
+type streamObjectInfoOp struct {
+	Info  *ObjectInfo `json:"info"`
+	Type  string      `json:"type"`
+	Reply string      `json:"reply,omitempty"`
+}
+
+type streamPurgeOp struct {
+	Request *JSApiStreamPurgeRequest `json:"request,omitempty"`
+	Reply   string                   `json:"reply,omitempty"`
+}
+
+type streamMsgDeleteOp struct {
+	Seq   uint64 `json:"seq"`
+	Reply string `json:"reply,omitempty"`
+}
+
+type streamMsgScheduleOp struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Replicated consumer state.
+type consumerStateOp struct {
+	Leader string         `json:"leader"`
+	State  *ConsumerState `json:"state"`
+	Reset  bool           `json:"reset,omitempty"`
+}
+
+// Leaders send this to followers that need messages the log no longer holds.
+type streamSyncState struct {
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+// Followers request ranges of messages with this.
+type streamCatchupRequest struct {
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+const (
+	defaultMetaGroupName = "_meta_"
+	// Directory for our groups under the system account.
+	jsClusterDir = "_js_"
+	// Forwarded API requests, only the group leader will process these.
+	jscForwardT = "$JSC.FWD.%s"
+	// Stream followers will send requests for missing messages here.
+	jscCatchupT = "$JSC.CATCHUP.%s"
+	// Inbox for catchup messages.
+	jscCatchupReplyT = "$JSC.CR.%s.%s"
+	// Maximum number of messages we will ask for in one catchup request.
+	jscCatchupBatch = 1024
+	// How long we will wait for each catchup batch.
+	jscCatchupWait = 2 * time.Second
+)
+
+// Markers for catchup messages.
+const (
+	catchupMsg byte = iota
+	catchupSkip
+	catchupEOB
+)
+
+// Returns true if we have been configured to be part of a cluster.
+// Lock should be held.
+func (s *Server) jetStreamClusterConfigured() bool {
+	return s.getOpts().Cluster.Port != 0
+}
+
+// JetStreamIsClustered will report if we are running JetStream in clustered mode.
+func (s *Server) JetStreamIsClustered() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	return js.isClustered()
+}
+
+// JetStreamIsLeader will report if we are the leader of the meta group.
+func (s *Server) JetStreamIsLeader() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	n := js.getMetaGroup()
+	return n != nil && n.Leader()
+}
+
+// JetStreamIsStreamLeader will report if we are the leader for the given stream.
+func (s *Server) JetStreamIsStreamLeader(account, stream string) bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	sa := js.cluster.streamAssignment(account, stream)
+	return sa != nil && sa.Group.node != nil && sa.Group.node.Leader()
+}
+
+// JetStreamIsConsumerLeader will report if we are the leader for the given consumer.
+func (s *Server) JetStreamIsConsumerLeader(account, stream, consumer string) bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	ca := js.cluster.consumerAssignment(account, stream, consumer)
+	return ca != nil && ca.Group.node != nil && ca.Group.node.Leader()
+}
+
+func (js *jetStream) isClustered() bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.cluster != nil
+}
+
+func (js *jetStream) getMetaGroup() RaftNode {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if js.cluster == nil {
+		return nil
+	}
+	return js.cluster.meta
+}
+
+// Return the directory used for the group's state.
+func (js *jetStream) groupStoreDir(group string) string {
+	s := js.srv
+	sacc := s.SystemAccount()
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return path.Join(js.config.StoreDir, sacc.Name, jsClusterDir, group)
+}
+
+// startJetStreamCluster will start the meta group and begin processing the catalog.
+func (s *Server) startJetStreamCluster() error {
+	js := s.getJetStream()
+	if js == nil {
+		return fmt.Errorf("jetstream not enabled")
+	}
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil || cc.meta != nil {
+		js.mu.Unlock()
+		return nil
+	}
+	peers := cc.peers
+	cc.peers = nil
+	js.mu.Unlock()
+
+	s.Noticef("Starting JetStream cluster")
+
+	cfg := &raftConfig{
+		Name:    defaultMetaGroupName,
+		Store:   js.groupStoreDir(defaultMetaGroupName),
+		Peers:   peers,
+		WAL:     true,
+		Dynamic: true,
+	}
+	n, err := s.startRaftNode(cfg)
+	if err != nil {
+		return fmt.Errorf("could not start the metadata group: %v", err)
+	}
+	fsub, err := s.sysSubscribe(fmt.Sprintf(jscForwardT, defaultMetaGroupName), s.jsForwardedRequest(n))
+	if err != nil {
+		n.Stop()
+		return err
+	}
+
+	js.mu.Lock()
+	cc.meta = n
+	cc.fsub = fsub
+	cc.recovering = true
+	js.mu.Unlock()
+
+	go js.monitorCluster()
+
+	return nil
+}
+
+// jsClusterAddPeer is called when we see a new JetStream enabled server.
+func (s *Server) jsClusterAddPeer(peer string) {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil {
+		js.mu.Unlock()
+		return
+	}
+	if cc.meta == nil {
+		cc.peers = append(cc.peers, peer)
+		js.mu.Unlock()
+		return
+	}
+	meta := cc.meta
+	js.mu.Unlock()
+	meta.AddPeer(peer)
+}
+
+// Shutdown the cluster and all of our groups.
+func (js *jetStream) shutdownCluster() {
+	s := js.srv
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil || cc.meta == nil {
+		js.mu.Unlock()
+		return
+	}
+	var nodes []RaftNode
+	var subs []*subscription
+	if cc.meta != nil {
+		nodes = append(nodes, cc.meta)
+	}
+	if cc.fsub != nil {
+		subs = append(subs, cc.fsub)
+	}
+	for _, asa := range cc.streams {
+		for _, sa := range asa {
+			if sa.Group.node != nil {
+				nodes = append(nodes, sa.Group.node)
+			}
+			subs = append(subs, sa.fsub, sa.csub)
+			for _, ca := range sa.consumers {
+				if ca.Group.node != nil {
+					nodes = append(nodes, ca.Group.node)
+				}
+				subs = append(subs, ca.fsub)
+			}
+		}
+	}
+	cc.meta, cc.fsub = nil, nil
+	cc.streams = make(map[string]map[string]*streamAssignment)
+	js.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub != nil {
+			s.sysUnsubscribe(sub)
+		}
+	}
+	for _, n := range nodes {
+		n.Stop()
+	}
+}
+
+// Check if we are a member of the group.
+func (rg *raftGroup) isMember(id string) bool {
+	if rg == nil {
+		return false
+	}
+	for _, peer := range rg.Peers {
+		if peer == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup a stream assignment.
+// Lock should be held.
+func (cc *jetStreamCluster) streamAssignment(account, stream string) *streamAssignment {
+	if cc == nil {
+		return nil
+	}
+	if asa := cc.streams[account]; asa != nil {
+		return asa[stream]
+	}
+	return nil
+}
+
+// Lookup a consumer assignment.
+// Lock should be held.
+func (cc *jetStreamCluster) consumerAssignment(account, stream, consumer string) *consumerAssignment {
+	if sa := cc.streamAssignment(account, stream); sa != nil {
+		return sa.consumers[consumer]
+	}
+	return nil
+}
+
+// Returns the stream assignments for an account sorted by name.
+func (js *jetStream) streamAssignments(account string) []*streamAssignment {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if js.cluster == nil {
+		return nil
+	}
+	var sas []*streamAssignment
+	for _, sa := range js.cluster.streams[account] {
+		sas = append(sas, sa)
+	}
+	sort.Slice(sas, func(i, j int) bool { return sas[i].Config.Name < sas[j].Config.Name })
+	return sas
+}
+
+// Process entries for the meta group.
+func (js *jetStream) monitorCluster() {
+	s, n := js.srv, js.getMetaGroup()
+	if n == nil {
+		return
+	}
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			if ce == nil {
+				js.processMetaRecovered()
+				continue
+			}
+			if err := js.applyMetaEntry(ce.Data); err != nil {
+				s.Warnf("JetStream cluster error applying metadata entry: %v", err)
+			}
+		case isLeader := <-lch:
+			if isLeader {
+				s.Noticef("JetStream cluster new metadata leader")
+			}
+		}
+	}
+}
+
+// Called once we have replayed our meta log on startup. We will create
+// all of the assets that were assigned to us.
+func (js *jetStream) processMetaRecovered() {
+	s := js.srv
+	ourID := s.ID()
+
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil || !cc.recovering {
+		js.mu.Unlock()
+		return
+	}
+	cc.recovering = false
+	var sas []*streamAssignment
+	for _, asa := range cc.streams {
+		for _, sa := range asa {
+			sa.responded = true
+			for _, ca := range sa.consumers {
+				ca.responded = true
+			}
+			if sa.Group.isMember(ourID) {
+				sas = append(sas, sa)
+			}
+		}
+	}
+	js.mu.Unlock()
+
+	for _, sa := range sas {
+		js.processClusterCreateStream(sa)
+		js.mu.RLock()
+		var cas []*consumerAssignment
+		for _, ca := range sa.consumers {
+			cas = append(cas, ca)
+		}
+		js.mu.RUnlock()
+		for _, ca := range cas {
+			js.processClusterCreateConsumer(ca)
+		}
+	}
+}
+
+func (js *jetStream) applyMetaEntry(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	switch entryOp(buf[0]) {
+	case assignStreamOp, updateStreamOp, removeStreamOp:
+		var sa streamAssignment
+		if err := json.Unmarshal(buf[1:], &sa); err != nil {
+			return err
+		}
+		if sa.Config == nil || sa.Group == nil {
+			return errBadRaftMsg
+		}
+		switch entryOp(buf[0]) {
+		case assignStreamOp:
+			js.processStreamAssignment(&sa)
+		case updateStreamOp:
+			js.processUpdateStreamAssignment(&sa)
+		case removeStreamOp:
+			js.processStreamRemoval(&sa)
+		}
+	case assignConsumerOp, removeConsumerOp:
+		var ca consumerAssignment
+		if err := json.Unmarshal(buf[1:], &ca); err != nil {
+			return err
+		}
+		if ca.Config == nil || ca.Group == nil {
+			return errBadRaftMsg
+		}
+		if entryOp(buf[0]) == assignConsumerOp {
+			js.processConsumerAssignment(&ca)
+		} else {
+			js.processConsumerRemoval(&ca)
+		}
+	default:
+		return fmt.Errorf("unknown metadata entry type %d", buf[0])
+	}
+	return nil
+}
+
+// Returns true if we are the meta leader and not recovering.
+// Lock should be held.
+func (cc *jetStreamCluster) isLeader() bool {
+	return cc != nil && !cc.recovering && cc.meta != nil && cc.meta.Leader()
+}
+
+func (js *jetStream) processStreamAssignment(sa *streamAssignment) {
+	s := js.srv
+
+	js.mu.Lock()
+	cc := js.cluster
+	if cc == nil {
+		js.mu.Unlock()
+		return
+	}
+	asa := cc.streams[sa.Account]
+	if asa == nil {
+		asa = make(map[string]*streamAssignment)
+		cc.streams[sa.Account] = asa
+	}
+	if osa := asa[sa.Config.Name]; osa != nil {
+		js.mu.Unlock()
+		return
+	}
+	sa.consumers = make(map[string]*consumerAssignment)
+	asa[sa.Config.Name] = sa
+	recovering, isLeader := cc.recovering, cc.isLeader()
+	js.mu.Unlock()
+
+	if recovering {
+		return
+	}
+	if isLeader {
+		if acc, err := s.LookupAccount(sa.Account); err == nil {
+			s.sendStreamActionAdvisory(acc, sa.Config, CreateEvent)
+		}
+	}
+	if sa.Group.isMember(s.ID()) {
+		js.processClusterCreateStream(sa)
+	}
+}
+
+func (js *jetStream) processUpdateStreamAssignment(sa *streamAssignment) {
+	s := js.srv
+
+	js.mu.Lock()
+	cc := js.cluster
+	osa := cc.streamAssignment(sa.Account, sa.Config.Name)
+	if osa == nil {
+		js.mu.Unlock()
+		return
+	}
+	osa.Config = sa.Config
+	recovering, isLeader := cc.recovering, cc.isLeader()
+	js.mu.Unlock()
+
+	if recovering {
+		return
+	}
+	acc, err := s.LookupAccount(sa.Account)
+	if err != nil {
+		return
+	}
+	if isLeader {
+		s.sendStreamActionAdvisory(acc, sa.Config, ModifyEvent)
+	}
+	mset, err := acc.LookupStream(sa.Config.Name)
+	if err != nil {
+		return
+	}
+	err = mset.Update(sa.Config)
+	if sa.Reply == _EMPTY_ || !mset.isLeader() {
+		return
+	}
+	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	if err != nil {
+		resp.Error = jsError(err)
+	} else {
+		resp.StreamInfo = mset.Info()
+	}
+	s.sendInternalAccountMsg(acc, sa.Reply, s.jsonResponse(&resp))
+}
+
+func (js *jetStream) processStreamRemoval(sa *streamAssignment) {
+	s := js.srv
+
+	js.mu.Lock()
+	cc := js.cluster
+	osa := cc.streamAssignment(sa.Account, sa.Config.Name)
+	if osa == nil {
+		js.mu.Unlock()
+		return
+	}
+	delete(cc.streams[sa.Account], sa.Config.Name)
+	recovering, isLeader := cc.recovering, cc.isLeader()
+	var nodes []RaftNode
+	var subs []*subscription
+	if osa.Group.node != nil {
+		nodes = append(nodes, osa.Group.node)
+	}
+	subs = append(subs, osa.fsub, osa.csub)
+	for _, ca := range osa.consumers {
+		if ca.Group.node != nil {
+			nodes = append(nodes, ca.Group.node)
+		}
+		subs = append(subs, ca.fsub)
+	}
+	js.mu.Unlock()
+
+	if recovering {
+		return
+	}
+	for _, sub := range subs {
+		if sub != nil {
+			s.sysUnsubscribe(sub)
+		}
+	}
+	acc, err := s.LookupAccount(sa.Account)
+	if err == nil {
+		if mset, err := acc.LookupStream(sa.Config.Name); err == nil {
+			mset.Delete()
+		}
+	}
+	for _, n := range nodes {
+		n.Delete()
+	}
+	if !isLeader || acc == nil {
+		return
+	}
+	s.sendStreamActionAdvisory(acc, osa.Config, DeleteEvent)
+	if sa.Reply != _EMPTY_ {
+		s.sendInternalAccountMsg(acc, sa.Reply, s.jsonResponse(streamDeleteResponse(sa.Kind, nil)))
+	}
+}
+
+func (js *jetStream) processConsumerAssignment(ca *consumerAssignment) {
+	s := js.srv
+
+	js.mu.Lock()
+	cc := js.cluster
+	sa := cc.streamAssignment(ca.Account, ca.Stream)
+	if sa == nil {
+		js.mu.Unlock()
+		return
+	}
+	if oca := sa.consumers[ca.Name]; oca != nil {
+		// This is an update for an existing consumer, either a new delivery
+		// subject for a durable or a config update.
+		updated := !configsEqualSansDelivery(*oca.Config, *ca.Config)
+		oca.Config, oca.Reply, oca.Update = ca.Config, ca.Reply, ca.Update
+		recovering, isLeader := cc.recovering, cc.isLeader()
+		js.mu.Unlock()
+		if recovering {
+			return
+		}
+		if updated && isLeader {
+			if acc, err := s.LookupAccount(ca.Account); err == nil {
+				s.sendConsumerActionAdvisory(acc, ca.Stream, ca.Name, ModifyEvent)
+			}
+		}
+		js.processClusterUpdateConsumer(oca, updated)
+		return
+	}
+	sa.consumers[ca.Name] = ca
+	recovering, isLeader := cc.recovering, cc.isLeader()
+	js.mu.Unlock()
+
+	if recovering {
+		return
+	}
+	if isLeader {
+		if acc, err := s.LookupAccount(ca.Account); err == nil {
+			s.sendConsumerActionAdvisory(acc, ca.Stream, ca.Name, CreateEvent)
+		}
+	}
+	if ca.Group.isMember(s.ID()) {
+		js.processClusterCreateConsumer(ca)
+	}
+}
+
+func (js *jetStream) processConsumerRemoval(ca *consumerAssignment) {
+	s := js.srv
+
+	js.mu.Lock()
+	cc := js.cluster
+	sa := cc.streamAssignment(ca.Account, ca.Stream)
+	if sa == nil || sa.consumers[ca.Name] == nil {
+		js.mu.Unlock()
+		return
+	}
+	oca := sa.consumers[ca.Name]
+	delete(sa.consumers, ca.Name)
+	recovering, isLeader := cc.recovering, cc.isLeader()
+	node, fsub := oca.Group.node, oca.fsub
+	js.mu.Unlock()
+
+	if recovering {
+		return
+	}
+	if fsub != nil {
+		s.sysUnsubscribe(fsub)
+	}
+	acc, err := s.LookupAccount(ca.Account)
+	if err == nil {
+		if mset, err := acc.LookupStream(ca.Stream); err == nil {
+			if o := mset.LookupConsumer(ca.Name); o != nil {
+				o.Delete()
+			}
+		}
+	}
+	if node != nil {
+		node.Delete()
+	}
+	if !isLeader || acc == nil {
+		return
+	}
+	s.sendConsumerActionAdvisory(acc, ca.Stream, ca.Name, DeleteEvent)
+	if ca.Reply != _EMPTY_ {
+		var resp = JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}, Success: true}
+		s.sendInternalAccountMsg(acc, ca.Reply, s.jsonResponse(&resp))
+	}
+}
+
+// Create the local stream for an assignment that includes us.
+func (js *jetStream) processClusterCreateStream(sa *streamAssignment) {
+	s := js.srv
+
+	acc, err := s.LookupAccount(sa.Account)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to lookup account %q: %v", sa.Account, err)
+		return
+	}
+	rg := sa.Group
+	stream := sa.Config.Name
+	n, err := s.startRaftNode(&raftConfig{
+		Name:  rg.Name,
+		Store: js.groupStoreDir(rg.Name),
+		Peers: rg.Peers,
+		Snapshot: func() []byte {
+			mset, err := acc.LookupStream(stream)
+			if err != nil {
+				return nil
+			}
+			state := mset.store.State()
+			b, _ := json.Marshal(&streamSyncState{FirstSeq: state.FirstSeq, LastSeq: state.LastSeq})
+			return b
+		},
+	})
+	if err != nil {
+		s.Warnf("JetStream cluster failed to start group for stream %q: %v", stream, err)
+		return
+	}
+	js.mu.Lock()
+	rg.node = n
+	js.mu.Unlock()
+
+	mset, err := acc.addStream(sa.Config, nil, sa)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to create stream %q: %v", stream, err)
+		n.Delete()
+		js.mu.Lock()
+		rg.node = nil
+		responded := sa.responded
+		sa.responded = true
+		js.mu.Unlock()
+		if sa.Reply != _EMPTY_ && !responded {
+			s.sendInternalAccountMsg(acc, sa.Reply, s.jsonResponse(streamCreateResponse(sa.Kind, nil, jsError(err))))
+		}
+		// Have the meta leader remove the assignment.
+		s.jsForwardRequest(acc, defaultMetaGroupName, fmt.Sprintf(JSApiStreamDeleteT, stream), _EMPTY_, nil)
+		return
+	}
+	if !sa.Created.IsZero() {
+		mset.setCreated(sa.Created)
+	}
+
+	// Setup our subscriptions for forwarded requests and catchup requests.
+	fsub, _ := s.sysSubscribe(fmt.Sprintf(jscForwardT, rg.Name), s.jsForwardedRequest(n))
+	csub, _ := s.sysSubscribe(fmt.Sprintf(jscCatchupT, rg.Name), func(_ *subscription, _ *client, _, reply string, msg []byte) {
+		if n.Leader() && reply != _EMPTY_ {
+			var req streamCatchupRequest
+			if err := json.Unmarshal(msg, &req); err == nil {
+				go mset.sendCatchupMsgs(&req, reply)
+			}
+		}
+	})
+	js.mu.Lock()
+	sa.fsub, sa.csub = fsub, csub
+	js.mu.Unlock()
+
+	go js.monitorStream(mset, sa)
+}
+
+// Process entries for a stream group.
+func (js *jetStream) monitorStream(mset *Stream, sa *streamAssignment) {
+	s, n := js.srv, sa.Group.node
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			if ce == nil {
+				continue
+			}
+			if ce.Snapshot {
+				mset.processSyncState(ce.Data)
+				continue
+			}
+			if err := mset.applyEntry(ce.Data); err != nil {
+				s.Warnf("JetStream cluster error applying entry for stream %q: %v", mset.Name(), err)
+			}
+		case isLeader := <-lch:
+			js.processStreamLeaderChange(mset, sa, isLeader)
+		}
+	}
+}
+
+func (js *jetStream) processStreamLeaderChange(mset *Stream, sa *streamAssignment, isLeader bool) {
+	s := js.srv
+	// Only the leader runs the consumers for a mirror or sources.
+	mset.checkSources()
+	if !isLeader {
+		return
+	}
+	// Make sure held messages that are due are not left behind by the old leader.
+	mset.resetSchedules()
+	js.mu.Lock()
+	shouldRespond := sa.Reply != _EMPTY_ && !sa.responded
+	sa.responded = true
+	js.mu.Unlock()
+
+	if !shouldRespond {
+		return
+	}
+	acc, err := s.LookupAccount(sa.Account)
+	if err != nil {
+		return
+	}
+	s.sendInternalAccountMsg(acc, sa.Reply, s.jsonResponse(streamCreateResponse(sa.Kind, mset, nil)))
+}
+
+// Create the local consumer for an assignment that includes us.
+func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment) {
+	s := js.srv
+
+	acc, err := s.LookupAccount(ca.Account)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to lookup account %q: %v", ca.Account, err)
+		return
+	}
+	mset, err := acc.LookupStream(ca.Stream)
+	if err != nil {
+		s.Warnf("JetStream cluster failed to lookup stream %q for consumer %q", ca.Stream, ca.Name)
+		return
+	}
+	rg := ca.Group
+	stream, consumer := ca.Stream, ca.Name
+	n, err := s.startRaftNode(&raftConfig{
+		Name:  rg.Name,
+		Store: js.groupStoreDir(rg.Name),
+		Peers: rg.Peers,
+		Snapshot: func() []byte {
+			if o := mset.LookupConsumer(consumer); o != nil {
+				return o.encodeState()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		s.Warnf("JetStream cluster failed to start group for consumer %q on stream %q: %v", consumer, stream, err)
+		return
+	}
+	js.mu.Lock()
+	rg.node = n
+	js.mu.Unlock()
+
+	cfg := *ca.Config
+	o, err := mset.addConsumer(&cfg, consumer, n)
+	if err == nil {
+		err = o.readStoredState()
+	}
+	if err != nil {
+		s.Warnf("JetStream cluster failed to create consumer %q on stream %q: %v", consumer, stream, err)
+		if o != nil {
+			o.deleteWithoutAdvisory()
+		}
+		n.Delete()
+		js.mu.Lock()
+		rg.node = nil
+		responded := ca.responded
+		ca.responded = true
+		js.mu.Unlock()
+		if ca.Reply != _EMPTY_ && !responded {
+			s.sendInternalAccountMsg(acc, ca.Reply, s.jsonResponse(consumerCreateResponse(ca.Kind, nil, jsError(err))))
+		}
+		// Have the meta leader remove the assignment.
+		s.jsForwardRequest(acc, defaultMetaGroupName, fmt.Sprintf(JSApiConsumerDeleteT, stream, consumer), _EMPTY_, nil)
+		return
+	}
+	if !ca.Created.IsZero() {
+		o.setCreated(ca.Created)
+	}
+
+	fsub, _ := s.sysSubscribe(fmt.Sprintf(jscForwardT, rg.Name), s.jsForwardedRequest(n))
+	js.mu.Lock()
+	ca.fsub = fsub
+	js.mu.Unlock()
+
+	go js.monitorConsumer(o, ca)
+}
+
+// An existing consumer had its assignment updated, e.g. a new deliver subject or a config update.
+func (js *jetStream) processClusterUpdateConsumer(ca *consumerAssignment, updated bool) {
+	s := js.srv
+
+	acc, err := s.LookupAccount(ca.Account)
+	if err != nil {
+		return
+	}
+	mset, err := acc.LookupStream(ca.Stream)
+	if err != nil {
+		return
+	}
+	o := mset.LookupConsumer(ca.Name)
+	if o == nil {
+		return
+	}
+	if ca.Config.DeliverSubject != o.Config().DeliverSubject {
+		o.updateDeliverSubject(ca.Config.DeliverSubject)
+	}
+	if updated {
+		cfg := *ca.Config
+		if err = o.Update(&cfg); err != nil {
+			s.Warnf("JetStream cluster failed to update consumer %q on stream %q: %v", ca.Name, ca.Stream, err)
+		}
+	}
+	if ca.Reply == _EMPTY_ || !o.isLeader() {
+		return
+	}
+	js.mu.Lock()
+	ca.responded = true
+	js.mu.Unlock()
+	if ca.Update {
+		var resp = JSApiConsumerUpdateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerUpdateResponseType}}
+		if err != nil {
+			resp.Error = jsError(err)
+		} else {
+			resp.ConsumerInfo = o.Info()
+		}
+		s.sendInternalAccountMsg(acc, ca.Reply, s.jsonResponse(&resp))
+		return
+	}
+	s.sendInternalAccountMsg(acc, ca.Reply, s.jsonResponse(consumerCreateResponse(ca.Kind, o, nil)))
+}
+
+// Process entries for a consumer group.
+func (js *jetStream) monitorConsumer(o *Consumer, ca *consumerAssignment) {
+	s, n := js.srv, ca.Group.node
+	qch, lch, ach := n.QuitC(), n.LeadChangeC(), n.ApplyC()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case ce := <-ach:
+			if ce == nil || len(ce.Data) == 0 {
+				continue
+			}
+			if err := o.applyEntry(ce.Data); err != nil {
+				s.Warnf("JetStream cluster error applying entry for consumer %q: %v", o.Name(), err)
+			}
+		case isLeader := <-lch:
+			js.processConsumerLeaderChange(o, ca, isLeader)
+		}
+	}
+}
+
+func (js *jetStream) processConsumerLeaderChange(o *Consumer, ca *consumerAssignment, isLeader bool) {
+	s := js.srv
+
+	o.setLeader(isLeader)
+	if !isLeader {
+		return
+	}
+	js.mu.Lock()
+	shouldRespond := ca.Reply != _EMPTY_ && !ca.responded
+	ca.responded = true
+	js.mu.Unlock()
+
+	if !shouldRespond {
+		return
+	}
+	acc, err := s.LookupAccount(ca.Account)
+	if err != nil {
+		return
+	}
+	s.sendInternalAccountMsg(acc, ca.Reply, s.jsonResponse(consumerCreateResponse(ca.Kind, o, nil)))
+}
+
+// Advisories for the catalog are sent by the meta leader.
+func (s *Server) sendStreamActionAdvisory(acc *Account, cfg *StreamConfig, action ActionAdvisoryType) {
+	var subj string
+	switch action {
+	case CreateEvent:
+		subj = JSAdvisoryStreamCreatedPre
+	case DeleteEvent:
+		subj = JSAdvisoryStreamDeletedPre
+	case ModifyEvent:
+		subj = JSAdvisoryStreamUpdatedPre
+	}
+	s.publishAdvisory(acc, subj+"."+cfg.Name, &JSStreamActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSStreamActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   cfg.Name,
+		Action:   action,
+		Template: cfg.Template,
+	})
+}
+
+func (s *Server) sendConsumerActionAdvisory(acc *Account, stream, consumer string, action ActionAdvisoryType) {
+	var subj string
+	switch action {
+	case CreateEvent:
+		subj = JSAdvisoryConsumerCreatedPre
+	case DeleteEvent:
+		subj = JSAdvisoryConsumerDeletedPre
+	case ModifyEvent:
+		subj = JSAdvisoryConsumerUpdatedPre
+	}
+	s.publishAdvisory(acc, subj+"."+stream+"."+consumer, &JSConsumerActionAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerActionAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   stream,
+		Consumer: consumer,
+		Action:   action,
+	})
+}
+
+// Forwarding of API requests.
+
+// Returns a handler for requests forwarded to the leader of the group.
+func (s *Server) jsForwardedRequest(n RaftNode) msgHandler {
+	return func(_ *subscription, _ *client, _, _ string, msg []byte) {
+		if !n.Leader() {
+			return
+		}
+		var fr jsForwardedRequest
+		if err := json.Unmarshal(msg, &fr); err != nil {
+			return
+		}
+		acc, err := s.LookupAccount(fr.Account)
+		if err != nil {
+			return
+		}
+		h := s.jsAPIHandler(fr.Subject)
+		if h == nil {
+			return
+		}
+		// Process as an internal client bound to the requestor's account.
+		c := s.createInternalJetStreamClient()
+		c.acc = acc
+		h(nil, c, fr.Subject, fr.Reply, fr.Msg)
+	}
+}
+
+// Send the request to the leader of the given group.
+func (s *Server) jsForwardRequest(acc *Account, group, subject, reply string, msg []byte) {
+	fr := &jsForwardedRequest{Account: acc.Name, Subject: subject, Reply: reply}
+	if len(msg) > 0 {
+		fr.Msg = append(msg[:0:0], msg...)
+	}
+	s.sendInternalMsgLocked(fmt.Sprintf(jscForwardT, group), _EMPTY_, nil, fr)
+}
+
+// If we are clustered and not the meta leader this will forward the request.
+// Returns true if the request was forwarded.
+func (s *Server) jsForwardToMetaLeader(c *client, subject, reply string, msg []byte) bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	n := js.getMetaGroup()
+	if n == nil || n.Leader() {
+		return false
+	}
+	s.jsForwardRequest(c.acc, defaultMetaGroupName, subject, reply, msg)
+	return true
+}
+
+// If we are clustered and this stream is handled by another server, forward the request
+// to the stream leader. Returns true if the request was forwarded.
+func (s *Server) jsForwardToStreamLeader(c *client, stream, subject, reply string, msg []byte) bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	sa := js.cluster.streamAssignment(c.acc.Name, stream)
+	if sa == nil {
+		js.mu.RUnlock()
+		return false
+	}
+	group, n := sa.Group.Name, sa.Group.node
+	js.mu.RUnlock()
+
+	if n != nil && n.Leader() {
+		return false
+	}
+	s.jsForwardRequest(c.acc, group, subject, reply, msg)
+	return true
+}
+
+// Same as above but for the consumer leader.
+func (s *Server) jsForwardToConsumerLeader(c *client, stream, consumer, subject, reply string, msg []byte) bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	js.mu.RLock()
+	ca := js.cluster.consumerAssignment(c.acc.Name, stream, consumer)
+	if ca == nil {
+		js.mu.RUnlock()
+		return false
+	}
+	group, n := ca.Group.Name, ca.Group.node
+	js.mu.RUnlock()
+
+	if n != nil && n.Leader() {
+		return false
+	}
+	s.jsForwardRequest(c.acc, group, subject, reply, msg)
+	return true
+}
+
+// Proposals to the meta group.
+
+func encodeMetaEntry(op entryOp, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(op)}, b...), nil
+}
+
+func (js *jetStream) proposeMetaEntry(op entryOp, v interface{}) error {
+	n := js.getMetaGroup()
+	if n == nil {
+		return fmt.Errorf("jetstream cluster not available")
+	}
+	b, err := encodeMetaEntry(op, v)
+	if err != nil {
+		return err
+	}
+	return n.Propose(b)
+}
+
+// Select peers for a new group. We prefer servers we are currently connected to.
+func (s *Server) selectPeerGroup(r int) []string {
+	js := s.getJetStream()
+	n := js.getMetaGroup()
+	if n == nil {
+		return nil
+	}
+	ourID := s.ID()
+	var candidates []string
+	s.mu.Lock()
+	for _, peer := range n.Peers() {
+		if _, ok := s.remotes[peer]; ok || peer == ourID {
+			candidates = append(candidates, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(candidates) < r {
+		return nil
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:r]
+}
+
+// Create a unique name for a group.
+func groupName(prefix string, r int, storage StorageType) string {
+	var s string
+	if storage == MemoryStorage {
+		s = "M"
+	} else {
+		s = "F"
+	}
+	return fmt.Sprintf("%s-R%d%s-%s", prefix, r, s, createConsumerName())
+}
+
+// Meta leader processing of a stream create request.
+// The kind is set for streams created through their own API, e.g. key/value buckets.
+func (s *Server) jsClusteredStreamRequest(c *client, subject, reply string, rmsg []byte, config *StreamConfig, kind string) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	sendErr := func(err *ApiError) {
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(streamCreateResponse(kind, nil, err)))
+	}
+
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	if cfg.Template != _EMPTY_ {
+		sendErr(&ApiError{Code: 400, Description: "stream templates not supported in clustered mode"})
+		return
+	}
+	_, jsa, err := c.acc.checkForJetStream()
+	if err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	js := s.getJetStream()
+
+	js.mu.RLock()
+	asa := js.cluster.streams[c.acc.Name]
+	if osa := asa[cfg.Name]; osa != nil {
+		js.mu.RUnlock()
+		if !reflect.DeepEqual(*osa.Config, cfg) {
+			sendErr(jsError(fmt.Errorf("stream name already in use")))
+			return
+		}
+		// Same config, let the stream leader respond.
+		s.jsForwardToStreamLeader(c, cfg.Name, streamInfoSubject(kind, cfg.Name), reply, nil)
+		return
+	}
+	numStreams := len(asa)
+	var overlap bool
+	for _, osa := range asa {
+		for _, subj := range osa.Config.Subjects {
+			for _, tsubj := range cfg.Subjects {
+				if SubjectsCollide(tsubj, subj) {
+					overlap = true
+				}
+			}
+		}
+	}
+	js.mu.RUnlock()
+
+	if overlap {
+		sendErr(jsError(fmt.Errorf("subjects overlap with an existing stream")))
+		return
+	}
+	jsa.mu.RLock()
+	maxStreams, maxConsumers := jsa.limits.MaxStreams, jsa.limits.MaxConsumers
+	jsa.mu.RUnlock()
+	if maxStreams > 0 && numStreams >= maxStreams {
+		sendErr(jsError(fmt.Errorf("maximum number of streams reached")))
+		return
+	}
+	if cfg.MaxConsumers > 0 && maxConsumers > 0 && cfg.MaxConsumers > maxConsumers {
+		sendErr(jsError(fmt.Errorf("maximum consumers exceeds account limit")))
+		return
+	}
+
+	peers := s.selectPeerGroup(cfg.Replicas)
+	if peers == nil {
+		sendErr(&ApiError{Code: 500, Description: "insufficient resources"})
+		return
+	}
+	rg := &raftGroup{Name: groupName("S", cfg.Replicas, cfg.Storage), Peers: peers, Storage: cfg.Storage}
+	sa := &streamAssignment{Account: c.acc.Name, Created: time.Now().UTC(), Config: &cfg, Group: rg, Reply: reply, Kind: kind}
+	if err := js.proposeMetaEntry(assignStreamOp, sa); err != nil {
+		sendErr(jsError(err))
+	}
+}
+
+// Meta leader processing of a stream update request.
+func (s *Server) jsClusteredStreamUpdateRequest(c *client, subject, reply string, rmsg []byte, config *StreamConfig) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	sendErr := func(err *ApiError) {
+		resp.Error = err
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(&resp))
+	}
+
+	_, jsa, err := c.acc.checkForJetStream()
+	if err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	js := s.getJetStream()
+	js.mu.RLock()
+	osa := js.cluster.streamAssignment(c.acc.Name, config.Name)
+	if osa == nil {
+		js.mu.RUnlock()
+		sendErr(jsNotFoundError(fmt.Errorf("stream not found")))
+		return
+	}
+	ocfg, rg := *osa.Config, *osa.Group
+	js.mu.RUnlock()
+
+	cfg, err := jsa.configUpdateCheck(&ocfg, config)
+	if err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	if cfg.Replicas != ocfg.Replicas {
+		sendErr(jsError(fmt.Errorf("stream configuration update can not change replicas")))
+		return
+	}
+	sa := &streamAssignment{Account: c.acc.Name, Config: cfg, Group: &rg, Reply: reply}
+	if err := js.proposeMetaEntry(updateStreamOp, sa); err != nil {
+		sendErr(jsError(err))
+	}
+}
+
+// Meta leader processing of a stream delete request.
+func (s *Server) jsClusteredStreamDeleteRequest(c *client, stream, subject, reply string, rmsg []byte, kind string) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	sendErr := func(err *ApiError) {
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(streamDeleteResponse(kind, err)))
+	}
+
+	js := s.getJetStream()
+	js.mu.RLock()
+	osa := js.cluster.streamAssignment(c.acc.Name, stream)
+	var sa *streamAssignment
+	if osa != nil && isStreamKind(kind, osa.Config) {
+		sa = &streamAssignment{Account: osa.Account, Config: osa.Config, Group: osa.Group, Reply: reply, Kind: kind}
+	}
+	js.mu.RUnlock()
+
+	if sa == nil {
+		sendErr(jsNotFoundError(fmt.Errorf("stream not found")))
+		return
+	}
+	if err := js.proposeMetaEntry(removeStreamOp, sa); err != nil {
+		sendErr(jsError(err))
+	}
+}
+
+// Meta leader processing of a consumer create request.
+// The kind is set for consumers created through the API of their stream, e.g. key/value watchers.
+func (s *Server) jsClusteredConsumerRequest(c *client, subject, reply string, rmsg []byte, stream string, config *ConsumerConfig, kind string) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	sendErr := func(err *ApiError) {
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(consumerCreateResponse(kind, nil, err)))
+	}
+
+	js := s.getJetStream()
+	js.mu.RLock()
+	sa := js.cluster.streamAssignment(c.acc.Name, stream)
+	if sa == nil || !isStreamKind(kind, sa.Config) {
+		js.mu.RUnlock()
+		sendErr(jsNotFoundError(fmt.Errorf("stream not found")))
+		return
+	}
+	scfg, srg := *sa.Config, sa.Group
+	var ca *consumerAssignment
+	if isDurableConsumer(config) {
+		if oca := sa.consumers[config.Durable]; oca != nil {
+			ocfg := *oca.Config
+			if !reflect.DeepEqual(&ocfg, config) && !configsEqualSansDelivery(ocfg, *config) {
+				js.mu.RUnlock()
+				sendErr(jsError(fmt.Errorf("consumer already exists")))
+				return
+			}
+			ca = &consumerAssignment{Account: oca.Account, Stream: stream, Name: oca.Name, Created: oca.Created, Config: config, Group: oca.Group, Reply: reply, Kind: kind}
+		}
+	}
+	numConsumers := len(sa.consumers)
+	js.mu.RUnlock()
+
+	// Update to an existing durable.
+	if ca != nil {
+		if err := js.proposeMetaEntry(assignConsumerOp, ca); err != nil {
+			sendErr(jsError(err))
+		}
+		return
+	}
+
+	if scfg.MaxConsumers > 0 && numConsumers >= scfg.MaxConsumers {
+		sendErr(jsError(fmt.Errorf("maximum consumers limit reached")))
+		return
+	}
+	if config.DeliverSubject == _EMPTY_ && config.Durable == _EMPTY_ {
+		sendErr(jsError(fmt.Errorf("consumer in pull mode requires a durable name")))
+		return
+	}
+	if scfg.Retention == WorkQueuePolicy && config.AckPolicy != AckExplicit {
+		sendErr(jsError(fmt.Errorf("workqueue stream requires explicit ack")))
+		return
+	}
+
+	name := config.Durable
+	if name == _EMPTY_ {
+		js.mu.RLock()
+		for {
+			name = createConsumerName()
+			if _, ok := sa.consumers[name]; !ok {
+				break
+			}
+		}
+		js.mu.RUnlock()
+	} else if !isValidName(name) {
+		sendErr(jsError(fmt.Errorf("durable name can not contain '.', '*', '>'")))
+		return
+	}
+
+	// Consumers are placed on the same peers as their stream.
+	rg := &raftGroup{Name: groupName("C", len(srg.Peers), scfg.Storage), Peers: srg.Peers, Storage: scfg.Storage}
+	ca = &consumerAssignment{Account: c.acc.Name, Stream: stream, Name: name, Created: time.Now().UTC(), Config: config, Group: rg, Reply: reply, Kind: kind}
+	if err := js.proposeMetaEntry(assignConsumerOp, ca); err != nil {
+		sendErr(jsError(err))
+	}
+}
+
+// Meta leader processing of a consumer config update request.
+func (s *Server) jsClusteredConsumerUpdateRequest(c *client, subject, reply string, rmsg []byte, stream string, config *ConsumerConfig) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	var resp = JSApiConsumerUpdateResponse{ApiResponse: ApiResponse{Type: JSApiConsumerUpdateResponseType}}
+	sendErr := func(err *ApiError) {
+		resp.Error = err
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(&resp))
+	}
+
+	js := s.getJetStream()
+	js.mu.RLock()
+	sa := js.cluster.streamAssignment(c.acc.Name, stream)
+	if sa == nil {
+		js.mu.RUnlock()
+		sendErr(jsNotFoundError(fmt.Errorf("stream not found")))
+		return
+	}
+	oca := sa.consumers[config.Durable]
+	if oca == nil {
+		js.mu.RUnlock()
+		sendErr(jsNotFoundError(fmt.Errorf("consumer not found")))
+		return
+	}
+	ocfg := *oca.Config
+	ca := &consumerAssignment{Account: oca.Account, Stream: stream, Name: oca.Name, Created: oca.Created, Config: config, Group: oca.Group, Reply: reply, Update: true}
+	js.mu.RUnlock()
+
+	_, jsa, err := c.acc.checkForJetStream()
+	if err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	if err := checkConsumerCfgUpdate(&ocfg, config, jsa.maxAckPending()); err != nil {
+		sendErr(jsError(err))
+		return
+	}
+	if err := js.proposeMetaEntry(assignConsumerOp, ca); err != nil {
+		sendErr(jsError(err))
+	}
+}
+
+// Meta leader processing of a consumer delete request.
+func (s *Server) jsClusteredConsumerDeleteRequest(c *client, stream, consumer, subject, reply string, rmsg []byte) {
+	if s.jsForwardToMetaLeader(c, subject, reply, rmsg) {
+		return
+	}
+	var resp = JSApiConsumerDeleteResponse{ApiResponse: ApiResponse{Type: JSApiConsumerDeleteResponseType}}
+
+	js := s.getJetStream()
+	js.mu.RLock()
+	if js.cluster.streamAssignment(c.acc.Name, stream) == nil {
+		js.mu.RUnlock()
+		resp.Error = jsNotFoundError(fmt.Errorf("stream not found"))
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	oca := js.cluster.consumerAssignment(c.acc.Name, stream, consumer)
+	var ca *consumerAssignment
+	if oca != nil {
+		ca = &consumerAssignment{Account: oca.Account, Stream: stream, Name: consumer, Config: oca.Config, Group: oca.Group, Reply: reply}
+	}
+	js.mu.RUnlock()
+
+	if ca == nil {
+		resp.Error = &ApiError{Code: 404, Description: "consumer not found"}
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	if err := js.proposeMetaEntry(removeConsumerOp, ca); err != nil {
+		resp.Error = jsError(err)
+		s.sendAPIResponse(c, subject, reply, string(rmsg), s.jsonResponse(&resp))
+	}
+}
+
+// Requests for the list of streams are answered from the catalog.
+func (s *Server) jsClusteredStreamNames(acc *Account) []string {
+	var names []string
+	for _, sa := range s.getJetStream().streamAssignments(acc.Name) {
+		names = append(names, sa.Config.Name)
+	}
+	return names
+}
+
+func (s *Server) jsClusteredStreamList(acc *Account) []*StreamInfo {
+	var infos []*StreamInfo
+	for _, sa := range s.getJetStream().streamAssignments(acc.Name) {
+		if mset, err := acc.LookupStream(sa.Config.Name); err == nil {
+			infos = append(infos, mset.Info())
+		} else {
+			infos = append(infos, &StreamInfo{Created: sa.Created, Config: *sa.Config})
+		}
+	}
+	return infos
+}
+
+// Encoding for the replicated stream ops.
+
+func encodeStreamMsg(subject, reply string, hdr, msg []byte) []byte {
+	buf := make([]byte, 0, 1+4+len(subject)+len(reply)+8+len(hdr)+len(msg))
+	buf = append(buf, byte(streamMsgOp))
+	buf = appendString(buf, subject)
+	buf = appendString(buf, reply)
+	buf = appendUint32(buf, uint32(len(hdr)))
+	buf = append(buf, hdr...)
+	buf = appendUint32(buf, uint32(len(msg)))
+	return append(buf, msg...)
+}
+
+func decodeStreamMsg(buf []byte) (subject, reply string, hdr, msg []byte, err error) {
+	d := &raftDecoder{buf: buf}
+	subject, reply = d.string(), d.string()
+	hdr = d.bytes(int(d.uint32()))
+	msg = d.bytes(int(d.uint32()))
+	if len(hdr) == 0 {
+		hdr = nil
+	}
+	return subject, reply, hdr, msg, d.err
+}
+
+func encodeMirrorMsg(sseq uint64, subject string, hdr, msg []byte) []byte {
+	buf := make([]byte, 0, 1+8+2+len(subject)+8+len(hdr)+len(msg))
+	buf = append(buf, byte(mirrorMsgOp))
+	buf = appendUint64(buf, sseq)
+	buf = appendString(buf, subject)
+	buf = appendUint32(buf, uint32(len(hdr)))
+	buf = append(buf, hdr...)
+	buf = appendUint32(buf, uint32(len(msg)))
+	return append(buf, msg...)
+}
+
+func decodeMirrorMsg(buf []byte) (sseq uint64, subject string, hdr, msg []byte, err error) {
+	d := &raftDecoder{buf: buf}
+	sseq, subject = d.uint64(), d.string()
+	hdr = d.bytes(int(d.uint32()))
+	msg = d.bytes(int(d.uint32()))
+	if len(hdr) == 0 {
+		hdr = nil
+	}
+	return sseq, subject, hdr, msg, d.err
+}
+
+// isLeader will return if we are the leader for this stream.
+// Streams that are not clustered are always the leader.
+func (mset *Stream) isLeader() bool {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+	return node == nil || node.Leader()
+}
+
+// isClustered returns if this stream is replicated.
+func (mset *Stream) isClustered() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.node != nil
+}
+
+// Apply a committed entry for this stream.
+func (mset *Stream) applyEntry(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	s := mset.jsa.js.srv
+	switch entryOp(buf[0]) {
+	case streamMsgOp:
+		subject, reply, hdr, msg, err := decodeStreamMsg(buf[1:])
+		if err != nil {
+			return err
+		}
+		if err := mset.processJetStreamMsg(subject, reply, hdr, msg); err != nil && len(hdr) > 0 {
+			// Pick up again from the last message we stored from the source.
+			mset.retrySource(hdr)
+		}
+	case mirrorMsgOp:
+		sseq, subject, hdr, msg, err := decodeMirrorMsg(buf[1:])
+		if err != nil {
+			return err
+		}
+		if err := mset.processMirrorStore(sseq, subject, hdr, msg); err != nil {
+			// Pick up again from the last message we stored from the origin.
+			mset.retryMirror()
+		}
+	case purgeStreamOp:
+		var op streamPurgeOp
+		if err := json.Unmarshal(buf[1:], &op); err != nil {
+			return err
+		}
+		purged, err := mset.purge(op.Request)
+		if op.Reply != _EMPTY_ && mset.isLeader() {
+			var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
+			if err != nil {
+				resp.Error = jsError(err)
+			} else {
+				resp.Purged, resp.Success = purged, true
+			}
+			s.sendInternalAccountMsg(mset.jsa.account, op.Reply, s.jsonResponse(&resp))
+		}
+	case deleteMsgOp:
+		var op streamMsgDeleteOp
+		if err := json.Unmarshal(buf[1:], &op); err != nil {
+			return err
+		}
+		removed, err := mset.EraseMsg(op.Seq)
+		if op.Reply != _EMPTY_ && mset.isLeader() {
+			var resp = JSApiMsgDeleteResponse{ApiResponse: ApiResponse{Type: JSApiMsgDeleteResponseType}}
+			if err != nil {
+				resp.Error = jsError(err)
+			} else if !removed {
+				resp.Error = &ApiError{Code: 400, Description: fmt.Sprintf("sequence [%d] not found", op.Seq)}
+			} else {
+				resp.Success = true
+			}
+			s.sendInternalAccountMsg(mset.jsa.account, op.Reply, s.jsonResponse(&resp))
+		}
+	case scheduleMsgOp:
+		var op streamMsgScheduleOp
+		if err := json.Unmarshal(buf[1:], &op); err != nil {
+			return err
+		}
+		// Errors are the same on all replicas, so the message just stays held.
+		mset.processScheduledMsg(op.Seq)
+	case objectInfoOp:
+		var op streamObjectInfoOp
+		if err := json.Unmarshal(buf[1:], &op); err != nil {
+			return err
+		}
+		err := mset.storeObjectInfo(op.Info)
+		if op.Reply != _EMPTY_ && mset.isLeader() {
+			var apiErr *ApiError
+			if err != nil {
+				apiErr = jsError(err)
+			}
+			s.sendInternalAccountMsg(mset.jsa.account, op.Reply, s.jsonResponse(objectInfoResponse(op.Type, op.Info, apiErr)))
+		}
+	default:
+		return fmt.Errorf("unknown stream entry type %d", buf[0])
+	}
+	return nil
+}
+
+// Propose a stream op through our group.
+func (mset *Stream) propose(op entryOp, v interface{}) error {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+	if node == nil {
+		return fmt.Errorf("stream not clustered")
+	}
+	b, err := encodeMetaEntry(op, v)
+	if err != nil {
+		return err
+	}
+	return node.Propose(b)
+}
+
+// The leader has sent us its state since we need messages it no longer has in its log.
+func (mset *Stream) processSyncState(buf []byte) {
+	var snap streamSyncState
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		return
+	}
+	state := mset.store.State()
+	if state.LastSeq >= snap.LastSeq {
+		return
+	}
+	if err := mset.catchup(state.LastSeq+1, snap.LastSeq); err != nil {
+		mset.jsa.js.srv.Warnf("JetStream cluster catchup for stream %q failed: %v", mset.Name(), err)
+	}
+}
+
+// Catchup will request the missing messages from the leader.
+// This is called from our monitor loop so entries will not be applied while we catch up.
+func (mset *Stream) catchup(first, last uint64) error {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+	if node == nil {
+		return nil
+	}
+	s := mset.jsa.js.srv
+
+	msgs := make(chan []byte, jscCatchupBatch+1)
+	inbox := fmt.Sprintf(jscCatchupReplyT, node.Group(), nuid.Next())
+	sub, err := s.sysSubscribe(inbox, func(_ *subscription, _ *client, _, _ string, msg []byte) {
+		select {
+		case msgs <- append(msg[:0:0], msg...):
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer s.sysUnsubscribe(sub)
+
+	store := mset.store
+	for first <= last {
+		req := &streamCatchupRequest{FirstSeq: first, LastSeq: last}
+		if last-first >= jscCatchupBatch {
+			req.LastSeq = first + jscCatchupBatch - 1
+		}
+		s.sendInternalMsgLocked(fmt.Sprintf(jscCatchupT, node.Group()), inbox, nil, req)
+
+	batch:
+		for {
+			select {
+			case buf := <-msgs:
+				if len(buf) == 0 || buf[0] == catchupEOB {
+					break batch
+				}
+				d := &raftDecoder{buf: buf[1:]}
+				seq := d.uint64()
+				if d.err != nil {
+					continue
+				}
+				lseq := store.State().LastSeq
+				if seq <= lseq {
+					continue
+				}
+				for ; lseq+1 < seq; lseq++ {
+					store.SkipMsg()
+				}
+				if buf[0] == catchupSkip {
+					store.SkipMsg()
+				} else {
+					subject, _, hdr, msg, err := decodeStreamMsg(d.buf)
+					if err != nil {
+						return err
+					}
+					if _, _, err := store.StoreMsg(subject, hdr, msg); err != nil {
+						return err
+					}
+				}
+			case <-time.After(jscCatchupWait):
+				return fmt.Errorf("timeout waiting for catchup messages")
+			case <-node.QuitC():
+				return nil
+			}
+		}
+		next := store.State().LastSeq + 1
+		if next <= first {
+			return fmt.Errorf("no progress during catchup")
+		}
+		first = next
+	}
+	return nil
+}
+
+// Leader side of catchup, send the requested messages.
+func (mset *Stream) sendCatchupMsgs(req *streamCatchupRequest, reply string) {
+	s := mset.jsa.js.srv
+	if req.LastSeq < req.FirstSeq || req.LastSeq-req.FirstSeq >= jscCatchupBatch {
+		return
+	}
+	for seq := req.FirstSeq; seq <= req.LastSeq; seq++ {
+		subj, hdr, msg, _, err := mset.store.LoadMsg(seq)
+		var buf []byte
+		if err == ErrStoreEOF {
+			break
+		} else if err != nil {
+			buf = appendUint64([]byte{catchupSkip}, seq)
+		} else {
+			buf = appendUint64([]byte{catchupMsg}, seq)
+			buf = append(buf, encodeStreamMsg(subj, _EMPTY_, hdr, msg)[1:]...)
+		}
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, buf)
+	}
+	s.sendInternalMsgLocked(reply, _EMPTY_, nil, []byte{catchupEOB})
+}
+
+// Consumer helpers.
+
+// isLeader will return if we are the leader for this consumer.
+// Consumers that are not clustered are always the leader.
+// Lock should be held.
+func (o *Consumer) isLeader() bool {
+	return o.node == nil || o.node.Leader()
+}
+
+// Called when our leadership changes.
+func (o *Consumer) setLeader(isLeader bool) {
+	o.mu.Lock()
+	mset := o.mset
+	if mset == nil {
+		o.mu.Unlock()
+		return
+	}
+	if isLeader {
+		// Make sure we track any pending acks we inherited.
+		if len(o.pending) > 0 && o.ptmr == nil {
+			o.trackAllPending()
+		}
+		if o.isPushMode() && !o.isDurable() && !o.active && o.dtmr == nil {
+			o.dtmr = time.AfterFunc(o.dthresh, o.deleteNotActive)
+		}
+		// We do not know about activity seen by the old leader, so start over.
+		o.resetInactiveTimer()
+	} else {
+		stopAndClearTimer(&o.ptmr)
+		stopAndClearTimer(&o.dtmr)
+		stopAndClearTimer(&o.itmr)
+		stopAndClearTimer(&o.dltmr)
+		o.rdq, o.rdh, o.dlp = nil, ttlIndex{}, nil
+		if o.waiting != nil {
+			o.waiting = newWaitQueue(o.config.MaxWaiting)
+		}
+	}
+	o.mu.Unlock()
+
+	// Kick the delivery loop.
+	mset.signalConsumers()
+}
+
+// Encode our current state for replication.
+func (o *Consumer) encodeState() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.encodeStateLocked(false)
+}
+
+// Lock should be held.
+func (o *Consumer) encodeStateLocked(reset bool) []byte {
+	op := &consumerStateOp{State: o.stateLocked(), Reset: reset}
+	if o.node != nil {
+		op.Leader = o.node.ID()
+	}
+	b, _ := encodeMetaEntry(updateConsumerStateOp, op)
+	return b
+}
+
+// Apply a committed entry for this consumer.
+func (o *Consumer) applyEntry(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if entryOp(buf[0]) != updateConsumerStateOp {
+		return fmt.Errorf("unknown consumer entry type %d", buf[0])
+	}
+	var op consumerStateOp
+	if err := json.Unmarshal(buf[1:], &op); err != nil {
+		return err
+	}
+	if op.State == nil {
+		return nil
+	}
+
+	o.mu.Lock()
+	// The leader's state is always more current than what it proposed.
+	if o.mset == nil || (o.isLeader() && op.Leader == o.node.ID()) {
+		o.mu.Unlock()
+		return nil
+	}
+	state := op.State
+	// Never go backwards, unless the leader moved our sequences back.
+	if !op.Reset && state.Delivered.ConsumerSeq < o.dseq {
+		o.mu.Unlock()
+		return nil
+	}
+	mset := o.mset
+	// Figure out what has been acked so the stream can remove messages if needed.
+	var acked []uint64
+	if mset.config.Retention != LimitsPolicy {
+		for seq := o.asflr + 1; seq <= state.AckFloor.StreamSeq; seq++ {
+			if _, ok := state.Pending[seq]; !ok {
+				acked = append(acked, seq)
+			}
+		}
+		for seq := range o.pending {
+			if _, ok := state.Pending[seq]; !ok && seq > state.AckFloor.StreamSeq {
+				acked = append(acked, seq)
+			}
+		}
+	}
+	o.dseq, o.sseq = state.Delivered.ConsumerSeq, state.Delivered.StreamSeq
+	o.adflr, o.asflr = state.AckFloor.ConsumerSeq, state.AckFloor.StreamSeq
+	o.pending, o.rdc = state.Pending, state.Redelivered
+	o.paused = state.Paused
+	if o.store != nil {
+		o.store.Update(state)
+	}
+	o.mu.Unlock()
+
+	for _, seq := range acked {
+		mset.ackMsg(o, seq)
+	}
+	return nil
+}
@@ -98,6 +98,32 @@ type JSConsumerDeliveryExceededAdvisory struct {
 // JSConsumerDeliveryExceededAdvisoryType is the schema type for JSConsumerDeliveryExceededAdvisory
 const JSConsumerDeliveryExceededAdvisoryType = "io.nats.jetstream.advisory.v1.max_deliver"
 
+// JSConsumerMaxAckPendingAdvisory is an advisory informing that a consumer stopped
+// delivering new messages since it has reached its MaxAckPending threshold
+type JSConsumerMaxAckPendingAdvisory struct {
+	TypedEvent
+	Stream        string `json:"stream"`
+	Consumer      string `json:"consumer"`
+	MaxAckPending int    `json:"max_ack_pending"`
+	NumPending    int    `json:"num_pending"`
+}
+
+// JSConsumerMaxAckPendingAdvisoryType is the schema type for JSConsumerMaxAckPendingAdvisory
+const JSConsumerMaxAckPendingAdvisoryType = "io.nats.jetstream.advisory.v1.max_ack_pending"
+
+// JSConsumerInactiveAdvisory is an advisory informing that a consumer is being deleted
+// since it has been inactive for longer than its InactiveThreshold
+type JSConsumerInactiveAdvisory struct {
+	TypedEvent
+	Stream            string        `json:"stream"`
+	Consumer          string        `json:"consumer"`
+	InactiveThreshold time.Duration `json:"inactive_threshold"`
+	LastActive        time.Time     `json:"last_active"`
+}
+
+// JSConsumerInactiveAdvisoryType is the schema type for JSConsumerInactiveAdvisory
+const JSConsumerInactiveAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_inactive"
+
 // JSConsumerDeliveryTerminatedAdvisory is an advisory informing that a message was
 // terminated by the consumer, so might be a candidate for DLQ handling
 type JSConsumerDeliveryTerminatedAdvisory struct {
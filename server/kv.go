@@ -0,0 +1,250 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Key/Value buckets are streams named KV_<bucket> that capture all subjects
+// under $KV.<bucket>.>, one subject per key. The revision of a key is the
+// stream sequence of the message holding its value, and the history per key
+// is kept with the max messages per subject limit.
+//
+// Values are written by publishing to $KV.<bucket>.<key>, which returns a normal
+// PubAck. Deletes and purges are markers published with the KV-Operation header,
+// a purge will also remove all prior revisions for the key. Creates and updates
+// use the Nats-Expected-Last-Subject-Sequence header, with 0 meaning the key
+// must not exist or must have been deleted.
+
+const (
+	// KVOperation is the header used to mark delete and purge operations.
+	KVOperation = "KV-Operation"
+	// KVOperationDel marks a key as deleted, keeping its history.
+	KVOperationDel = "DEL"
+	// KVOperationPurge marks a key as deleted and removes its history.
+	KVOperationPurge = "PURGE"
+
+	// KVMaxHistory is the maximum history per key we allow for a bucket.
+	KVMaxHistory = 64
+
+	// KVSubjectT is the template for the subject of a key in a bucket.
+	KVSubjectT = "$KV.%s.%s"
+
+	kvStreamPrefix  = "KV_"
+	kvSubjectPrefix = "$KV."
+)
+
+var (
+	// ErrKVKeyNotFound is returned when a key does not exist or was deleted.
+	ErrKVKeyNotFound = errors.New("key not found")
+)
+
+// KVConfig is the configuration for a key/value bucket.
+type KVConfig struct {
+	Bucket       string        `json:"bucket"`
+	History      int64         `json:"history,omitempty"`
+	TTL          time.Duration `json:"ttl,omitempty"`
+	MaxValueSize int32         `json:"max_value_size,omitempty"`
+	MaxBytes     int64         `json:"max_bytes,omitempty"`
+	Storage      StorageType   `json:"storage"`
+	Replicas     int           `json:"num_replicas"`
+}
+
+// KVBucketInfo shows config and current state for a key/value bucket.
+type KVBucketInfo struct {
+	Config  KVConfig  `json:"config"`
+	Created time.Time `json:"created"`
+	Values  uint64    `json:"values"`
+	Bytes   uint64    `json:"bytes"`
+}
+
+// KVEntry is a single revision of a key in a bucket.
+type KVEntry struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Value     []byte    `json:"value,omitempty"`
+	Revision  uint64    `json:"revision"`
+	Created   time.Time `json:"created"`
+	Operation string    `json:"operation,omitempty"`
+}
+
+// Will check the bucket config and return the stream config for it.
+func (cfg *KVConfig) streamConfig() (*StreamConfig, error) {
+	if !isValidName(cfg.Bucket) {
+		return nil, fmt.Errorf("bucket name is required and can not contain '.', '*', '>'")
+	}
+	history := cfg.History
+	if history == 0 {
+		history = 1
+	}
+	if history < 0 || history > KVMaxHistory {
+		return nil, fmt.Errorf("bucket history must be between 1 and %d", KVMaxHistory)
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("bucket ttl can not be negative")
+	}
+	return &StreamConfig{
+		Name:       kvStreamPrefix + cfg.Bucket,
+		Subjects:   []string{kvSubjectPrefix + cfg.Bucket + ".>"},
+		MaxMsgsPer: history,
+		MaxAge:     cfg.TTL,
+		MaxBytes:   cfg.MaxBytes,
+		MaxMsgSize: cfg.MaxValueSize,
+		Storage:    cfg.Storage,
+		Replicas:   cfg.Replicas,
+		Discard:    DiscardOld,
+	}, nil
+}
+
+// kvBucket returns the bucket name if the stream config is for a key/value bucket.
+func kvBucket(cfg *StreamConfig) string {
+	if !strings.HasPrefix(cfg.Name, kvStreamPrefix) || len(cfg.Subjects) != 1 {
+		return _EMPTY_
+	}
+	bucket := cfg.Name[len(kvStreamPrefix):]
+	if cfg.Subjects[0] != kvSubjectPrefix+bucket+".>" {
+		return _EMPTY_
+	}
+	return bucket
+}
+
+// Fast lookup of the KV operation.
+func getKVOperation(hdr []byte) string {
+	return string(getHdrVal(KVOperation, hdr))
+}
+
+// AddKeyValue will create a key/value bucket for the account.
+func (a *Account) AddKeyValue(cfg *KVConfig) (*Stream, error) {
+	scfg, err := cfg.streamConfig()
+	if err != nil {
+		return nil, err
+	}
+	return a.AddStream(scfg)
+}
+
+// LookupKeyValue will return the stream for the key/value bucket.
+func (a *Account) LookupKeyValue(bucket string) (*Stream, error) {
+	mset, err := a.LookupStream(kvStreamPrefix + bucket)
+	if err != nil {
+		return nil, err
+	}
+	if kvBucket(&mset.config) != bucket {
+		return nil, fmt.Errorf("stream is not a key/value bucket")
+	}
+	return mset, nil
+}
+
+// KeyValueInfo returns the config and state for a key/value bucket.
+func (mset *Stream) KeyValueInfo() *KVBucketInfo {
+	cfg := mset.Config()
+	state := mset.State()
+	return &KVBucketInfo{
+		Config: KVConfig{
+			Bucket:       kvBucket(&cfg),
+			History:      cfg.MaxMsgsPer,
+			TTL:          cfg.MaxAge,
+			MaxValueSize: cfg.MaxMsgSize,
+			MaxBytes:     cfg.MaxBytes,
+			Storage:      cfg.Storage,
+			Replicas:     cfg.Replicas,
+		},
+		Created: mset.Created(),
+		Values:  state.Msgs,
+		Bytes:   state.Bytes,
+	}
+}
+
+// KeyValueGet will return the entry for the key. If revision is 0 the latest
+// revision is returned, and an error if the key was deleted.
+func (mset *Stream) KeyValueGet(key string, revision uint64) (*KVEntry, error) {
+	mset.mu.RLock()
+	bucket, store := kvBucket(&mset.config), mset.store
+	mset.mu.RUnlock()
+
+	if bucket == _EMPTY_ {
+		return nil, fmt.Errorf("stream is not a key/value bucket")
+	}
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+	subj := fmt.Sprintf(KVSubjectT, bucket, key)
+
+	var (
+		hdr, msg []byte
+		ts       int64
+		err      error
+	)
+	if revision == 0 {
+		revision, hdr, msg, ts, err = store.LoadLastMsg(subj)
+		if err == nil && kvIsDeleted(hdr) {
+			err = ErrKVKeyNotFound
+		}
+	} else {
+		var ssubj string
+		ssubj, hdr, msg, ts, err = store.LoadMsg(revision)
+		if err == nil && ssubj != subj {
+			err = ErrKVKeyNotFound
+		}
+	}
+	if err == ErrStoreMsgNotFound || err == ErrStoreEOF || err == errDeletedMsg {
+		err = ErrKVKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &KVEntry{
+		Bucket:   bucket,
+		Key:      key,
+		Value:    msg,
+		Revision: revision,
+		Created:  time.Unix(0, ts).UTC(),
+	}
+	if len(hdr) > 0 {
+		entry.Operation = getKVOperation(hdr)
+	}
+	return entry, nil
+}
+
+// Will check if the last message for a key is a delete or purge marker.
+// Used to allow creates for deleted keys.
+func kvIsDeleted(hdr []byte) bool {
+	if len(hdr) == 0 {
+		return false
+	}
+	op := getKVOperation(hdr)
+	return op == KVOperationDel || op == KVOperationPurge
+}
+
+// Will remove all revisions of the key prior to the given sequence.
+// This is called after a purge marker has been stored. When clustered
+// the leader proposes the purge so all replicas apply it in order.
+func (mset *Stream) purgeKVKey(subject string, seq uint64) {
+	mset.mu.RLock()
+	store, node := mset.store, mset.node
+	mset.mu.RUnlock()
+
+	if node != nil {
+		if node.Leader() {
+			mset.propose(purgeStreamOp, &streamPurgeOp{Request: &JSApiStreamPurgeRequest{Subject: subject, Sequence: seq}})
+		}
+		return
+	}
+	if store != nil {
+		store.PurgeEx(subject, seq, 0)
+	}
+}
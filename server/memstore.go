@@ -14,22 +14,37 @@
 package server
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/minio/highwayhash"
 )
 
 // TODO(dlc) - This is a fairly simplistic approach but should do for now.
 type memStore struct {
-	mu        sync.RWMutex
-	cfg       StreamConfig
-	state     StreamState
-	msgs      map[uint64]*storedMsg
-	scb       func(int64)
-	ageChk    *time.Timer
-	consumers int
+	mu      sync.RWMutex
+	cfg     StreamConfig
+	created time.Time
+	state   StreamState
+	msgs    map[uint64]*storedMsg
+	fss     subjectIndex
+	scb     func(int64)
+	ageChk  *time.Timer
+	ttls    ttlIndex
+	ttlChk  *time.Timer
+	sched   schedIndex
+	cfs     []*consumerMemStore
 }
 
 type storedMsg struct {
@@ -47,7 +62,13 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 	if cfg.Storage != MemoryStorage {
 		return nil, fmt.Errorf("memStore requires memory storage type in config")
 	}
-	return &memStore{msgs: make(map[uint64]*storedMsg), cfg: *cfg}, nil
+	ms := &memStore{
+		msgs:    make(map[uint64]*storedMsg),
+		fss:     make(subjectIndex),
+		cfg:     *cfg,
+		created: time.Now().UTC(),
+	}
+	return ms, nil
 }
 
 func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
@@ -63,6 +84,7 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
+	ms.enforcePerSubjectLimits()
 	// Do age timers.
 	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
 		ms.startAgeChk()
@@ -93,6 +115,10 @@ func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error
 			ms.mu.Unlock()
 			return 0, 0, ErrMaxBytes
 		}
+		if ms.cfg.MaxMsgsPer > 0 && ms.fss.numMsgs(subj) >= uint64(ms.cfg.MaxMsgsPer) {
+			ms.mu.Unlock()
+			return 0, 0, ErrMaxMsgsPerSubject
+		}
 	}
 
 	// Grab time.
@@ -116,12 +142,19 @@ func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error
 
 	startBytes := int64(ms.state.Bytes)
 	ms.msgs[seq] = &storedMsg{subj, hdr, msg, seq, ts}
+	ms.fss.add(subj, seq)
 	ms.state.Msgs++
 	ms.state.Bytes += memStoreMsgSize(subj, hdr, msg)
 	ms.state.LastSeq = seq
 	ms.state.LastTime = now.UTC()
 
+	// Track the message if it is held until due or has its own TTL.
+	if !ms.trackMsgSchedule(seq, ts, hdr) {
+		ms.trackMsgTTL(seq, ts, hdr)
+	}
+
 	// Limits checks and enforcement.
+	ms.enforcePerSubjectLimit(subj)
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
 
@@ -158,6 +191,24 @@ func (ms *memStore) SkipMsg() uint64 {
 	return seq
 }
 
+// SkipMsgs will use the next num sequence numbers but not store anything.
+func (ms *memStore) SkipMsgs(num uint64) {
+	if num == 0 {
+		return
+	}
+	// Grab time.
+	now := time.Now().UTC()
+
+	ms.mu.Lock()
+	ms.state.LastSeq += num
+	ms.state.LastTime = now
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq = ms.state.LastSeq + 1
+		ms.state.FirstTime = now
+	}
+	ms.mu.Unlock()
+}
+
 // StorageBytesUpdate registers an async callback for updates to storage changes.
 func (ms *memStore) StorageBytesUpdate(cb func(int64)) {
 	ms.mu.Lock()
@@ -213,6 +264,32 @@ func (ms *memStore) enforceBytesLimit() {
 	}
 }
 
+// Will check the per subject msg limit and drop the oldest msgs for the subject if needed.
+// Lock should be held.
+func (ms *memStore) enforcePerSubjectLimit(subj string) {
+	if ms.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	for nmsgs := ms.fss.numMsgs(subj); nmsgs > uint64(ms.cfg.MaxMsgsPer); nmsgs = ms.fss.numMsgs(subj) {
+		if !ms.removeMsg(ms.fss.firstSeq(subj), false) {
+			panic("jetstream memstore has inconsistent state, can't find first seq msg for subject")
+		}
+	}
+}
+
+// Will check the per subject msg limit for all subjects.
+// Lock should be held.
+func (ms *memStore) enforcePerSubjectLimits() {
+	if ms.cfg.MaxMsgsPer <= 0 {
+		return
+	}
+	for subj, ss := range ms.fss {
+		if uint64(len(ss.seqs)) > uint64(ms.cfg.MaxMsgsPer) {
+			ms.enforcePerSubjectLimit(subj)
+		}
+	}
+}
+
 // Will start the age check timer.
 // Lock should be held.
 func (ms *memStore) startAgeChk() {
@@ -250,18 +327,183 @@ func (ms *memStore) expireMsgs() {
 	}
 }
 
+// Will track the message if it is held until due, returning true if so.
+// Lock should be held.
+func (ms *memStore) trackMsgSchedule(seq uint64, ts int64, hdr []byte) bool {
+	if !ms.cfg.AllowMsgSchedules || len(hdr) == 0 {
+		return false
+	}
+	due, err := getMessageSchedule(hdr, ts)
+	if err != nil || due == 0 {
+		return false
+	}
+	ms.sched.add(seq, due)
+	return true
+}
+
+// DueMsgs returns the sequences of held messages that are due by now.
+// These are only returned once, see ResetDueMsgs.
+func (ms *memStore) DueMsgs(now int64) []uint64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.sched.expired(now)
+}
+
+// ResetDueMsgs will have DueMsgs return the held messages that are due again.
+func (ms *memStore) ResetDueMsgs() {
+	ms.mu.Lock()
+	ms.sched.reset()
+	ms.mu.Unlock()
+}
+
+// ScheduledState returns the number of held messages and when the next one is due.
+func (ms *memStore) ScheduledState() (uint64, int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.sched.state()
+}
+
+// Will track the message for expiration if it has its own TTL.
+// Lock should be held.
+func (ms *memStore) trackMsgTTL(seq uint64, ts int64, hdr []byte) {
+	if !ms.cfg.AllowMsgTTL || len(hdr) == 0 {
+		return
+	}
+	ttl, err := getMessageTTL(hdr)
+	if err != nil || ttl <= 0 {
+		return
+	}
+	expires := ts + int64(ttl)
+	ms.ttls.add(seq, expires)
+	// Only need to adjust the timer if we are now the next to expire.
+	if ms.ttls.next() == expires {
+		ms.resetTTLChk()
+	}
+}
+
+// Will reset the timer for messages with their own TTL.
+// Lock should be held.
+func (ms *memStore) resetTTLChk() {
+	next := ms.ttls.next()
+	if next == 0 {
+		if ms.ttlChk != nil {
+			ms.ttlChk.Stop()
+			ms.ttlChk = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - time.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if ms.ttlChk != nil {
+		ms.ttlChk.Reset(fireIn)
+	} else {
+		ms.ttlChk = time.AfterFunc(fireIn, ms.expireTTLMsgs)
+	}
+}
+
+// Will expire msgs whose own TTL has passed.
+func (ms *memStore) expireTTLMsgs() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.msgs == nil {
+		return
+	}
+	for _, seq := range ms.ttls.expired(time.Now().UnixNano()) {
+		if ms.removeMsg(seq, false) {
+			ms.state.Expired++
+		}
+	}
+	ms.resetTTLChk()
+}
+
 // Purge will remove all messages from this store.
 // Will return the number of purged messages.
 func (ms *memStore) Purge() uint64 {
+	return ms.purge(0)
+}
+
+// PurgeEx will remove the messages matching the subject filter, below seq if set,
+// keeping the last keep matching messages if set.
+// Will return the number of purged messages.
+func (ms *memStore) PurgeEx(subject string, seq, keep uint64) (uint64, error) {
+	if seq > 0 && keep > 0 {
+		return 0, ErrPurgeArgMismatch
+	}
+	if isPurgeAll(subject) && keep == 0 {
+		if seq == 0 {
+			return ms.Purge(), nil
+		}
+		return ms.Compact(seq)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	first, last := ms.state.FirstSeq, ms.state.LastSeq
+	// For a literal subject we can bound our scan with the per-subject index.
+	if subjectIsLiteral(subject) {
+		ss := ms.fss.filtered(subject)[subject]
+		first, last = ss.First, ss.Last
+	}
+	seqs := purgeExSeqs(subject, seq, keep, first, last, func(seq uint64) (string, bool) {
+		if sm := ms.msgs[seq]; sm != nil {
+			return sm.subj, true
+		}
+		return _EMPTY_, false
+	})
+	var purged uint64
+	for _, seq := range seqs {
+		if ms.removeMsg(seq, false) {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Compact will remove all messages up to but not including seq.
+// If seq is past our last sequence we will be empty and start at seq.
+// Will return the number of purged messages.
+func (ms *memStore) Compact(seq uint64) (uint64, error) {
+	if seq == 0 {
+		return ms.Purge(), nil
+	}
+
+	ms.mu.Lock()
+	if seq > ms.state.LastSeq {
+		ms.mu.Unlock()
+		return ms.purge(seq), nil
+	}
+	var purged uint64
+	for cseq := ms.state.FirstSeq; cseq < seq; cseq++ {
+		if ms.removeMsg(cseq, false) {
+			purged++
+		}
+	}
+	ms.mu.Unlock()
+	return purged, nil
+}
+
+// Will remove all messages, with the new first sequence being fseq if larger
+// than our next sequence.
+func (ms *memStore) purge(fseq uint64) uint64 {
 	ms.mu.Lock()
 	purged := uint64(len(ms.msgs))
 	cb := ms.scb
 	bytes := int64(ms.state.Bytes)
+	if fseq > ms.state.LastSeq+1 {
+		ms.state.LastSeq = fseq - 1
+	}
 	ms.state.FirstSeq = ms.state.LastSeq + 1
 	ms.state.FirstTime = time.Time{}
 	ms.state.Bytes = 0
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*storedMsg)
+	ms.fss = make(subjectIndex)
+	ms.ttls, ms.sched = ttlIndex{}, schedIndex{}
+	ms.resetTTLChk()
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -298,6 +540,26 @@ func (ms *memStore) LoadMsg(seq uint64) (string, []byte, []byte, int64, error) {
 	return sm.subj, sm.hdr, sm.msg, sm.ts, nil
 }
 
+// LoadLastMsg will lookup the last message we have for the subject and return it if found.
+func (ms *memStore) LoadLastMsg(subj string) (uint64, []byte, []byte, int64, error) {
+	ms.mu.Lock()
+	seq := ms.fss.lastSeq(subj)
+	sm := ms.msgs[seq]
+	ms.mu.Unlock()
+
+	if sm == nil {
+		return 0, nil, nil, 0, ErrStoreMsgNotFound
+	}
+	return seq, sm.hdr, sm.msg, sm.ts, nil
+}
+
+// SubjectsState returns the state for each subject that matches the filter.
+func (ms *memStore) SubjectsState(filter string) map[string]SubjectState {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.fss.filtered(filter)
+}
+
 // RemoveMsg will remove the message from this store.
 // Will return the number of bytes removed.
 func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
@@ -347,6 +609,9 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 	}
 
 	delete(ms.msgs, seq)
+	ms.fss.remove(sm.subj, seq)
+	ms.ttls.remove(seq)
+	ms.sched.remove(seq)
 	ms.state.Msgs--
 	ss = memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
 	ms.state.Bytes -= ss
@@ -375,7 +640,7 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 func (ms *memStore) State() StreamState {
 	ms.mu.RLock()
 	state := ms.state
-	state.Consumers = ms.consumers
+	state.Consumers = len(ms.cfs)
 	ms.mu.RUnlock()
 	return state
 }
@@ -396,52 +661,336 @@ func (ms *memStore) Stop() error {
 		ms.ageChk.Stop()
 		ms.ageChk = nil
 	}
+	if ms.ttlChk != nil {
+		ms.ttlChk.Stop()
+		ms.ttlChk = nil
+	}
 	ms.msgs = nil
 	ms.mu.Unlock()
 	return nil
 }
 
-func (ms *memStore) incConsumers() {
+// Will load all messages from another store, preserving sequences and timestamps.
+// This is used when a snapshot is restored into a memory based stream.
+func (ms *memStore) loadMsgs(src StreamStore) error {
+	state := src.State()
+
+	ms.mu.Lock()
+	if ms.state.Msgs > 0 || ms.state.LastSeq > 0 {
+		ms.mu.Unlock()
+		return fmt.Errorf("memory store not empty")
+	}
+	for seq := state.FirstSeq; state.Msgs > 0 && seq <= state.LastSeq; seq++ {
+		subj, hdr, msg, ts, err := src.LoadMsg(seq)
+		if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+			continue
+		}
+		if err != nil {
+			ms.mu.Unlock()
+			return err
+		}
+		if len(msg) > 0 {
+			msg = append(msg[:0:0], msg...)
+		}
+		if len(hdr) > 0 {
+			hdr = append(hdr[:0:0], hdr...)
+		}
+		ms.msgs[seq] = &storedMsg{subj, hdr, msg, seq, ts}
+		ms.fss.add(subj, seq)
+		ms.state.Msgs++
+		ms.state.Bytes += memStoreMsgSize(subj, hdr, msg)
+		ms.trackMsgTTL(seq, ts, hdr)
+	}
+	ms.state.FirstSeq, ms.state.FirstTime = state.FirstSeq, state.FirstTime
+	ms.state.LastSeq, ms.state.LastTime = state.LastSeq, state.LastTime
+
+	// Limits checks and enforcement.
+	ms.enforcePerSubjectLimits()
+	ms.enforceMsgLimit()
+	ms.enforceBytesLimit()
+
+	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
+		ms.startAgeChk()
+	}
+	cb, bsz := ms.scb, ms.state.Bytes
+	ms.mu.Unlock()
+
+	if cb != nil && bsz > 0 {
+		cb(int64(bsz))
+	}
+	return nil
+}
+
+func (ms *memStore) addConsumer(o *consumerMemStore) {
 	ms.mu.Lock()
-	ms.consumers++
+	ms.cfs = append(ms.cfs, o)
 	ms.mu.Unlock()
 }
 
-func (ms *memStore) decConsumers() {
+func (ms *memStore) removeConsumer(cms *consumerMemStore) {
 	ms.mu.Lock()
-	if ms.consumers > 0 {
-		ms.consumers--
+	for i, o := range ms.cfs {
+		if o == cms {
+			ms.cfs = append(ms.cfs[:i], ms.cfs[i+1:]...)
+			break
+		}
 	}
 	ms.mu.Unlock()
 }
 
-type consumerMemStore struct {
-	ms *memStore
+// Stream our snapshot through gzip and tar.
+// The layout is the same as the fileStore so it can be restored into either storage type.
+func (ms *memStore) streamSnapshot(w io.WriteCloser, fsi *FileStreamInfo, state StreamState, blks [][]storedMsg, cfs []*consumerMemStore) {
+	defer w.Close()
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	gzw, _ := gzip.NewWriterLevel(bw, gzip.BestSpeed)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	modTime := time.Now().UTC()
+
+	writeFile := func(name string, buf []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			ModTime: modTime,
+			Uname:   "nats",
+			Gname:   "nats",
+			Size:    int64(len(buf)),
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	writeErr := func(err string) {
+		writeFile(errFile, []byte(err))
+	}
+
+	// Meta first.
+	meta, err := json.MarshalIndent(fsi, _EMPTY_, "  ")
+	if err != nil {
+		writeErr(fmt.Sprintf("Could not write stream meta file: %v", err))
+		return
+	}
+	if writeFile(JetStreamMetaFile, meta) != nil {
+		return
+	}
+	if writeFile(JetStreamMetaFileSum, []byte(metaChecksum(fsi.Name, meta))) != nil {
+		return
+	}
+
+	// Now do messages themselves, as message blocks.
+	msgPre := msgDir + "/"
+
+	writeBlock := func(mb *msgBlock, buf []byte) error {
+		if err := writeFile(msgPre+fmt.Sprintf(indexScan, mb.index), mb.indexInfo()); err != nil {
+			return err
+		}
+		return writeFile(msgPre+fmt.Sprintf(blkScan, mb.index), buf)
+	}
+
+	var buf bytes.Buffer
+	var index, lseq uint64
+
+	for _, blk := range blks {
+		index++
+		key := sha256.Sum256(blockHashKey(fsi.Name, index))
+		hh, _ := highwayhash.New64(key[:])
+		mb := &msgBlock{index: index}
+		buf.Reset()
+
+		for _, sm := range blk {
+			if mb.first.seq == 0 {
+				mb.first.seq, mb.first.ts = sm.seq, sm.ts
+			}
+			// Records need to be contiguous within a block, so fill any gaps
+			// with empty records that are marked as deleted.
+			for seq := mb.last.seq + 1; mb.last.seq > 0 && seq < sm.seq; seq++ {
+				encodeMsgRecord(&buf, hh, seq, mb.last.ts, _EMPTY_, nil, nil)
+				if mb.dmap == nil {
+					mb.dmap = make(map[uint64]struct{})
+				}
+				mb.dmap[seq] = struct{}{}
+			}
+			checksum := encodeMsgRecord(&buf, hh, sm.seq, sm.ts, sm.subj, sm.hdr, sm.msg)
+			copy(mb.lchk[0:], checksum)
+			mb.last.seq, mb.last.ts = sm.seq, sm.ts
+			mb.msgs++
+			mb.bytes += fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+		}
+		if writeBlock(mb, buf.Bytes()) != nil {
+			return
+		}
+		lseq = mb.last.seq
+	}
+
+	// If we have no messages at the end, write an empty block to preserve our
+	// last sequence like a purge would.
+	if state.LastSeq > lseq {
+		mb := &msgBlock{index: index + 1}
+		mb.first.seq = state.LastSeq + 1
+		mb.last.seq, mb.last.ts = state.LastSeq, state.LastTime.UnixNano()
+		if writeBlock(mb, nil) != nil {
+			return
+		}
+	}
+
+	// Do consumers' state last.
+	for _, o := range cfs {
+		o.mu.Lock()
+		meta, err := json.MarshalIndent(&o.cfg, _EMPTY_, "  ")
+		state := o.buf
+		odirPre := consumerDir + "/" + o.name
+		o.mu.Unlock()
+
+		if err != nil {
+			writeErr(fmt.Sprintf("Could not write consumer meta file for %q: %v", o.name, err))
+			return
+		}
+		// Write all the consumer files.
+		if writeFile(odirPre+"/"+JetStreamMetaFile, meta) != nil {
+			return
+		}
+		if writeFile(odirPre+"/"+JetStreamMetaFileSum, []byte(metaChecksum(fsi.Name+"/"+o.name, meta))) != nil {
+			return
+		}
+		writeFile(odirPre+"/"+consumerState, state)
+	}
 }
 
-func (ms *memStore) ConsumerStore(_ string, _ *ConsumerConfig) (ConsumerStore, error) {
-	ms.incConsumers()
-	return &consumerMemStore{ms}, nil
+// Snapshot creates a snapshot of this stream and its consumer's state along with messages.
+// This uses the same format as the fileStore.
+func (ms *memStore) Snapshot(deadline time.Duration, _, includeConsumers bool) (*SnapshotResult, error) {
+	ms.mu.RLock()
+	if ms.msgs == nil {
+		ms.mu.RUnlock()
+		return nil, ErrStoreClosed
+	}
+	fsi := &FileStreamInfo{Created: ms.created, StreamConfig: ms.cfg}
+	state := ms.state
+	msgs := make([]storedMsg, 0, len(ms.msgs))
+	for _, sm := range ms.msgs {
+		msgs = append(msgs, *sm)
+	}
+	var cfs []*consumerMemStore
+	if includeConsumers {
+		cfs = append(cfs, ms.cfs...)
+	}
+	ms.mu.RUnlock()
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+
+	// Split into blocks like the fileStore would.
+	blkSize := dynBlkSize(fsi.Retention, fsi.MaxBytes)
+	var blks [][]storedMsg
+	var start int
+	var sz, lseq uint64
+	for i, sm := range msgs {
+		rl := fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+		// Account for any empty records used to fill gaps.
+		if lseq > 0 && sm.seq > lseq+1 {
+			rl += (sm.seq - lseq - 1) * fileStoreMsgSize(_EMPTY_, nil, nil)
+		}
+		if i > start && sz+rl > blkSize {
+			blks = append(blks, msgs[start:i])
+			start, sz = i, fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+		} else {
+			sz += rl
+		}
+		lseq = sm.seq
+	}
+	if len(msgs) > start {
+		blks = append(blks, msgs[start:])
+	}
+	numBlks := len(blks)
+	if state.LastSeq > lseq {
+		numBlks++
+	}
+
+	pr, pw := net.Pipe()
+
+	// Set a write deadline here to protect ourselves.
+	if deadline > 0 {
+		pw.SetWriteDeadline(time.Now().Add(deadline))
+	}
+	// Stream in separate Go routine.
+	go ms.streamSnapshot(pw, fsi, state, blks, cfs)
+
+	return &SnapshotResult{pr, int(blkSize), numBlks}, nil
 }
 
-func (ms *memStore) Snapshot(_ time.Duration, _, _ bool) (*SnapshotResult, error) {
-	return nil, fmt.Errorf("no impl")
+type consumerMemStore struct {
+	mu     sync.Mutex
+	ms     *memStore
+	cfg    FileConsumerInfo
+	name   string
+	buf    []byte
+	closed bool
+}
+
+func (ms *memStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerStore, error) {
+	if cfg == nil || name == _EMPTY_ {
+		return nil, fmt.Errorf("bad consumer config")
+	}
+	o := &consumerMemStore{
+		ms:   ms,
+		cfg:  FileConsumerInfo{Created: time.Now().UTC(), ConsumerConfig: *cfg},
+		name: name,
+	}
+	ms.addConsumer(o)
+	return o, nil
 }
 
-// No-ops.
-func (os *consumerMemStore) Update(_ *ConsumerState) error {
+// Update will keep the state in the same format as the fileStore for snapshots.
+func (o *consumerMemStore) Update(state *ConsumerState) error {
+	buf, err := encodeConsumerState(state)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.buf = buf
+	o.mu.Unlock()
 	return nil
 }
-func (os *consumerMemStore) Stop() error {
-	os.ms.decConsumers()
+
+func (o *consumerMemStore) Stop() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	ms := o.ms
+	o.mu.Unlock()
+	ms.removeConsumer(o)
 	return nil
 }
 
-func (os *consumerMemStore) Delete() error {
-	return os.Stop()
+func (o *consumerMemStore) Delete() error {
+	return o.Stop()
 }
 
-func (os *consumerMemStore) State() (*ConsumerState, error) { return nil, nil }
+func (o *consumerMemStore) State() (*ConsumerState, error) {
+	o.mu.Lock()
+	buf := o.buf
+	o.mu.Unlock()
+
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return decodeConsumerState(buf)
+}
 
 // Templates
 type templateMemStore struct{}
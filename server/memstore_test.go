@@ -14,8 +14,16 @@
 package server
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -174,6 +182,50 @@ func TestMemStoreAgeLimit(t *testing.T) {
 	checkExpired(t)
 }
 
+func TestMemStoreMsgsPerSubjectLimit(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(fmt.Sprintf("kv.%d", i%3), nil, []byte("ok"))
+	}
+	// kv.0 -> 7,10  kv.1 -> 5,8  kv.2 -> 6,9
+	if state := ms.State(); state.Msgs != 6 || state.FirstSeq != 5 {
+		t.Fatalf("Expected 6 msgs starting at 5, got %d at %d", state.Msgs, state.FirstSeq)
+	}
+	for _, seq := range []uint64{5, 6, 7, 8, 9, 10} {
+		if _, _, _, _, err := ms.LoadMsg(seq); err != nil {
+			t.Fatalf("Unexpected error looking up msg %d: %v", seq, err)
+		}
+	}
+	// Removing the older one should allow us to keep one more.
+	ms.RemoveMsg(8)
+	ms.StoreMsg("kv.1", nil, []byte("ok"))
+	ms.StoreMsg("kv.1", nil, []byte("ok"))
+	if _, _, _, _, err := ms.LoadMsg(5); err == nil {
+		t.Fatalf("Expected msg 5 to be removed")
+	}
+	if state := ms.State(); state.Msgs != 6 {
+		t.Fatalf("Expected 6 msgs, got %d", state.Msgs)
+	}
+
+	// Lowering the limit should enforce it for all subjects.
+	ms.UpdateConfig(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 1})
+	if state := ms.State(); state.Msgs != 3 || state.FirstSeq != 9 {
+		t.Fatalf("Expected 3 msgs starting at 9, got %d at %d", state.Msgs, state.FirstSeq)
+	}
+
+	// Now check discard new.
+	ms.UpdateConfig(&StreamConfig{Storage: MemoryStorage, MaxMsgsPer: 1, Discard: DiscardNew})
+	if _, _, err := ms.StoreMsg("kv.1", nil, []byte("ok")); err != ErrMaxMsgsPerSubject {
+		t.Fatalf("Expected a per subject limit error, got %v", err)
+	}
+	if _, _, err := ms.StoreMsg("kv.3", nil, []byte("ok")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
 func TestMemStoreTimeStamps(t *testing.T) {
 	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
 	if err != nil {
@@ -241,3 +293,375 @@ func TestMemStoreMsgHeaders(t *testing.T) {
 		t.Fatalf("Expected erase msg to return success")
 	}
 }
+
+func TestMemStoreLoadLastMsg(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		subj := fmt.Sprintf("kv.%d", i%3)
+		if _, _, err := ms.StoreMsg(subj, nil, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkLast := func(subj string, eseq uint64) {
+		t.Helper()
+		seq, _, msg, _, err := ms.LoadLastMsg(subj)
+		if eseq == 0 {
+			if err != ErrStoreMsgNotFound {
+				t.Fatalf("Expected not found error for %q, got %v", subj, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if seq != eseq || string(msg) != fmt.Sprintf("%d", eseq-1) {
+			t.Fatalf("Expected seq %d for %q, got %d %q", eseq, subj, seq, msg)
+		}
+	}
+	// kv.0 -> 1,4,7,10  kv.1 -> 2,5,8  kv.2 -> 3,6,9
+	checkLast("kv.0", 10)
+	checkLast("kv.1", 8)
+	checkLast("kv.2", 9)
+	checkLast("kv.3", 0)
+
+	ms.RemoveMsg(10)
+	checkLast("kv.0", 7)
+	ms.RemoveMsg(8)
+	ms.RemoveMsg(5)
+	checkLast("kv.1", 2)
+	ms.RemoveMsg(2)
+	checkLast("kv.1", 0)
+
+	ms.Purge()
+	checkLast("kv.0", 0)
+	if _, _, err := ms.StoreMsg("kv.0", nil, []byte("10")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkLast("kv.0", 11)
+}
+
+func TestMemStoreSubjectsState(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := ms.StoreMsg(fmt.Sprintf("kv.%d", i%3), nil, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, _, err := ms.StoreMsg("foo", nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// kv.0 -> 1,4,7,10  kv.1 -> 2,5,8  kv.2 -> 3,6,9
+	ms.RemoveMsg(1)
+	ms.RemoveMsg(8)
+
+	fss := ms.SubjectsState("kv.*")
+	if len(fss) != 3 {
+		t.Fatalf("Expected 3 subjects, got %d", len(fss))
+	}
+	if ss := fss["kv.0"]; ss != (SubjectState{Msgs: 3, First: 4, Last: 10}) {
+		t.Fatalf("Unexpected state for kv.0: %+v", ss)
+	}
+	if ss := fss["kv.1"]; ss != (SubjectState{Msgs: 2, First: 2, Last: 5}) {
+		t.Fatalf("Unexpected state for kv.1: %+v", ss)
+	}
+	fss = ms.SubjectsState("foo")
+	if ss := fss["foo"]; len(fss) != 1 || ss != (SubjectState{Msgs: 1, First: 11, Last: 11}) {
+		t.Fatalf("Unexpected state for foo: %+v", fss)
+	}
+	if fss = ms.SubjectsState("bar"); len(fss) != 0 {
+		t.Fatalf("Expected no subjects, got %+v", fss)
+	}
+
+	// Bounds should move past any interior messages that were already removed.
+	ms.RemoveMsg(7)
+	ms.RemoveMsg(4)
+	if ss := ms.SubjectsState("kv.0")["kv.0"]; ss != (SubjectState{Msgs: 1, First: 10, Last: 10}) {
+		t.Fatalf("Unexpected state for kv.0: %+v", ss)
+	}
+	ms.RemoveMsg(5)
+	if ss := ms.SubjectsState("kv.1")["kv.1"]; ss != (SubjectState{Msgs: 1, First: 2, Last: 2}) {
+		t.Fatalf("Unexpected state for kv.1: %+v", ss)
+	}
+	ms.RemoveMsg(10)
+	if fss = ms.SubjectsState("kv.0"); len(fss) != 0 {
+		t.Fatalf("Expected no subjects, got %+v", fss)
+	}
+}
+
+func TestMemStoreConsumerState(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	o, err := ms.ConsumerStore("o22", &ConsumerConfig{})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	if state, err := o.State(); err != nil || state != nil {
+		t.Fatalf("Expected no state, got %+v %v", state, err)
+	}
+	state := &ConsumerState{}
+	state.Delivered.ConsumerSeq = 22
+	state.Delivered.StreamSeq = 22
+	state.AckFloor.ConsumerSeq = 11
+	state.AckFloor.StreamSeq = 11
+	state.Pending = map[uint64]int64{12: time.Now().Unix() * int64(time.Second)}
+	state.Redelivered = map[uint64]uint64{12: 2}
+	state.Paused = true
+	if err := o.Update(state); err != nil {
+		t.Fatalf("Unexepected error updating state: %v", err)
+	}
+	if rstate, err := o.State(); err != nil || !reflect.DeepEqual(state, rstate) {
+		t.Fatalf("Consumer state does not match: %+v vs %+v (%v)", rstate, state, err)
+	}
+	// State from before flags were added should still decode.
+	buf, _ := encodeConsumerState(state)
+	buf[1] = version
+	if rstate, err := decodeConsumerState(buf[:len(buf)-1]); err != nil || rstate.Paused || rstate.Delivered != state.Delivered {
+		t.Fatalf("Unexpected state: %+v (%v)", rstate, err)
+	}
+	// Bad states should be rejected.
+	state.AckFloor.StreamSeq = 33
+	if err := o.Update(state); err == nil {
+		t.Fatalf("Expected an error for a bad ack floor")
+	}
+	if n := ms.State().Consumers; n != 1 {
+		t.Fatalf("Expected 1 consumer, got %d", n)
+	}
+	o.Stop()
+	if n := ms.State().Consumers; n != 0 {
+		t.Fatalf("Expected no consumers, got %d", n)
+	}
+}
+
+func TestMemStoreSnapshotRestoreToFileStore(t *testing.T) {
+	cfg := StreamConfig{Name: "zzz", Storage: MemoryStorage}
+	ms, err := newMemStore(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	subj, hdr, msg := "foo", []byte("name:derek"), []byte("Hello Snappy!")
+	toStore := 100
+	for i := 0; i < toStore; i++ {
+		ms.StoreMsg(subj, hdr, msg)
+	}
+	// Create some gaps, at the front, in the middle and at the end.
+	for _, seq := range []uint64{1, 2, 33, 34, 35, 50, 99, 100} {
+		ms.RemoveMsg(seq)
+	}
+	o, err := ms.ConsumerStore("o22", &ConsumerConfig{Durable: "o22"})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	state := &ConsumerState{}
+	state.Delivered.ConsumerSeq = 40
+	state.Delivered.StreamSeq = 40
+	state.AckFloor.ConsumerSeq = 22
+	state.AckFloor.StreamSeq = 22
+	if err := o.Update(state); err != nil {
+		t.Fatalf("Unexepected error updating state: %v", err)
+	}
+
+	r, err := ms.Snapshot(5*time.Second, false, true)
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+	snap, err := ioutil.ReadAll(r.Reader)
+	if err != nil {
+		t.Fatalf("Error reading snapshot: %v", err)
+	}
+	if r.NumBlks != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", r.NumBlks)
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(snap))
+	if err != nil {
+		t.Fatalf("Error creating gzip reader: %v", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error getting next entry from snapshot: %v", err)
+		}
+		fpath := path.Join(storeDir, filepath.Clean(hdr.Name))
+		os.MkdirAll(filepath.Dir(fpath), 0755)
+		buf, _ := ioutil.ReadAll(tr)
+		ioutil.WriteFile(fpath, buf, 0644)
+	}
+
+	fcfg := cfg
+	fcfg.Storage = FileStorage
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, fcfg)
+	if err != nil {
+		t.Fatalf("Error restoring from snapshot: %v", err)
+	}
+	defer fs.Stop()
+
+	if rstate, state := fs.State(), ms.State(); rstate.Msgs != state.Msgs || rstate.Bytes == 0 ||
+		rstate.FirstSeq != state.FirstSeq || rstate.LastSeq != state.LastSeq {
+		t.Fatalf("Restored state does not match, %+v vs %+v", rstate, state)
+	}
+	if badSeqs := len(fs.checkMsgs()); badSeqs > 0 {
+		t.Fatalf("Expected to have no corrupt msgs, got %d", badSeqs)
+	}
+	for seq := uint64(1); seq <= uint64(toStore); seq++ {
+		_, _, _, _, merr := ms.LoadMsg(seq)
+		nsubj, nhdr, nmsg, _, err := fs.LoadMsg(seq)
+		if (merr == nil) != (err == nil) {
+			t.Fatalf("Expected the same result for msg %d, got %v vs %v", seq, err, merr)
+		}
+		if err == nil && (nsubj != subj || !bytes.Equal(nhdr, hdr) || !bytes.Equal(nmsg, msg)) {
+			t.Fatalf("Msgs don't match for %d, %q %q %q", seq, nsubj, nhdr, nmsg)
+		}
+	}
+	// New messages should continue from our last sequence.
+	if seq, _, err := fs.StoreMsg(subj, nil, msg); err != nil || seq != uint64(toStore+1) {
+		t.Fatalf("Unexpected sequence or error: %d %v", seq, err)
+	}
+	ro, err := fs.ConsumerStore("o22", &ConsumerConfig{Durable: "o22"})
+	if err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	if rstate, err := ro.State(); err != nil || !reflect.DeepEqual(state, rstate) {
+		t.Fatalf("Consumer state does not match: %+v vs %+v (%v)", rstate, state, err)
+	}
+
+	// Now load back into a memory store.
+	nms, err := newMemStore(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	if err := nms.loadMsgs(fs); err != nil {
+		t.Fatalf("Unexpected error loading msgs: %v", err)
+	}
+	if nstate, state := nms.State(), fs.State(); nstate.Msgs != state.Msgs ||
+		nstate.FirstSeq != state.FirstSeq || nstate.LastSeq != state.LastSeq {
+		t.Fatalf("Loaded state does not match, %+v vs %+v", nstate, state)
+	}
+	if _, _, nmsg, _, err := nms.LoadMsg(36); err != nil || !bytes.Equal(nmsg, msg) {
+		t.Fatalf("Unexpected msg or error: %q %v", nmsg, err)
+	}
+}
+
+func TestMemStoreMsgTTL(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, AllowMsgTTL: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	short := []byte("NATS/1.0\r\nNats-TTL: 50ms\r\n\r\n")
+	long := []byte("NATS/1.0\r\nNats-TTL: 1\r\n\r\n")
+	msg := []byte("Hello World")
+
+	ms.StoreMsg("foo", nil, msg)
+	ms.StoreMsg("foo", long, msg)
+	ms.StoreMsg("foo", short, msg)
+	ms.StoreMsg("foo", nil, msg)
+
+	checkState := func(msgs, first uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+			if state := ms.State(); state.Msgs != msgs || state.FirstSeq != first {
+				return fmt.Errorf("Expected %d msgs starting at %d, got %+v", msgs, first, state)
+			}
+			return nil
+		})
+	}
+	// The short one should expire first from the middle.
+	checkState(3, 1)
+	if _, _, _, _, err := ms.LoadMsg(3); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected msg 3 to be expired, got %v", err)
+	}
+	checkState(2, 1)
+	if _, _, _, _, err := ms.LoadMsg(2); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected msg 2 to be expired, got %v", err)
+	}
+	if state := ms.State(); state.Expired != 2 {
+		t.Fatalf("Expected 2 expired msgs, got %d", state.Expired)
+	}
+
+	// Removed messages should no longer be tracked.
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg("bar", long, msg)
+	}
+	ms.RemoveMsg(5)
+	ms.PurgeEx("bar", 10, 0)
+	ms.mu.RLock()
+	tracked := ms.ttls.Len()
+	ms.mu.RUnlock()
+	if tracked != 5 {
+		t.Fatalf("Expected to track 5 msgs, got %d", tracked)
+	}
+	for seq := uint64(10); seq < 15; seq++ {
+		ms.RemoveMsg(seq)
+	}
+
+	// TTLs are ignored if not allowed.
+	ms.UpdateConfig(&StreamConfig{Storage: MemoryStorage})
+	ms.StoreMsg("foo", short, msg)
+	time.Sleep(100 * time.Millisecond)
+	if state := ms.State(); state.Msgs != 3 {
+		t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+	}
+}
+
+func TestMemStorePurgeExAndCompact(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(fmt.Sprintf("foo.%d", i%2), nil, msg)
+	}
+
+	if _, err := ms.PurgeEx("foo.0", 2, 2); err != ErrPurgeArgMismatch {
+		t.Fatalf("Expected %v, got %v", ErrPurgeArgMismatch, err)
+	}
+	// Keep the last 2 of foo.0, which are 7 and 9.
+	if purged, err := ms.PurgeEx("foo.0", 0, 2); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d and %v", purged, err)
+	}
+	// Purge foo.1 below 6, which are 2 and 4.
+	if purged, err := ms.PurgeEx("foo.*", 6, 0); err != nil || purged != 2 {
+		t.Fatalf("Expected 2 purged, got %d and %v", purged, err)
+	}
+	if state := ms.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if purged, err := ms.Compact(9); err != nil || purged != 3 {
+		t.Fatalf("Expected 3 purged, got %d and %v", purged, err)
+	}
+	if state := ms.State(); state.Msgs != 2 || state.FirstSeq != 9 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	// Compact past the end will move our sequences forward.
+	if purged, err := ms.Compact(100); err != nil || purged != 2 {
+		t.Fatalf("Expected 2 purged, got %d and %v", purged, err)
+	}
+	if state := ms.State(); state.Msgs != 0 || state.FirstSeq != 100 || state.LastSeq != 99 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	if seq, _, _ := ms.StoreMsg("foo.0", nil, msg); seq != 100 {
+		t.Fatalf("Expected seq of 100, got %d", seq)
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object store buckets are streams named OBJ_<bucket> that capture all subjects
+// under $O.<bucket>.>. An object is stored as a series of chunk messages on
+// $O.<bucket>.C.<nuid>, and a metadata message on $O.<bucket>.M.<name> that
+// holds the object info. Names are base64 encoded to form a single token.
+//
+// Clients publish the chunks directly, so each chunk is bound by the max payload,
+// and then request the put. The put verifies the chunks against the size, chunk
+// count and digest before storing the metadata, and removes any prior version.
+//
+// A get delivers the chunks in order to the deliver subject, verifying the digest
+// as they are sent. The last chunk is only sent once the digest matches, otherwise
+// a digest mismatch status is sent in its place. Delivery is paced with the same
+// flow control requests we send to push consumers, which the client must respond to.
+
+const (
+	// ObjChunkSubjectT is the template for the subject of the chunks for an object.
+	ObjChunkSubjectT = "$O.%s.C.%s"
+
+	objMetaSubjectT  = "$O.%s.M.%s"
+	objStreamPrefix  = "OBJ_"
+	objSubjectPrefix = "$O."
+	objDigestPrefix  = "SHA-256="
+
+	objDigestMismatchHdr = "NATS/1.0 500 Object Digest Mismatch\r\n\r\n"
+
+	// How long we wait for the client to respond to a flow control request before we stop delivery.
+	objFlowControlWait = 5 * time.Second
+)
+
+var (
+	// ErrObjectNotFound is returned when an object does not exist or was deleted.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrObjectDigestMismatch is returned when the chunks of an object do not match its digest.
+	ErrObjectDigestMismatch = errors.New("object digest mismatch")
+
+	errObjectDeliveryStopped = errors.New("object delivery stopped")
+)
+
+// ObjectStoreConfig is the configuration for an object store bucket.
+type ObjectStoreConfig struct {
+	Bucket       string        `json:"bucket"`
+	TTL          time.Duration `json:"ttl,omitempty"`
+	MaxChunkSize int32         `json:"max_chunk_size,omitempty"`
+	MaxBytes     int64         `json:"max_bytes,omitempty"`
+	Storage      StorageType   `json:"storage"`
+	Replicas     int           `json:"num_replicas"`
+}
+
+// ObjectStoreInfo shows config and current state for an object store bucket.
+type ObjectStoreInfo struct {
+	Config  ObjectStoreConfig `json:"config"`
+	Created time.Time         `json:"created"`
+	Bytes   uint64            `json:"bytes"`
+}
+
+// ObjectLink points to an object in the same or another bucket.
+type ObjectLink struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+// ObjectInfo is the metadata for an object.
+type ObjectInfo struct {
+	Name    string      `json:"name"`
+	Bucket  string      `json:"bucket,omitempty"`
+	NUID    string      `json:"nuid,omitempty"`
+	Size    uint64      `json:"size"`
+	Chunks  uint32      `json:"chunks"`
+	Digest  string      `json:"digest,omitempty"`
+	ModTime time.Time   `json:"mtime"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Link    *ObjectLink `json:"link,omitempty"`
+}
+
+// Will check the bucket config and return the stream config for it.
+func (cfg *ObjectStoreConfig) streamConfig() (*StreamConfig, error) {
+	if !isValidName(cfg.Bucket) {
+		return nil, fmt.Errorf("bucket name is required and can not contain '.', '*', '>'")
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("bucket ttl can not be negative")
+	}
+	return &StreamConfig{
+		Name:       objStreamPrefix + cfg.Bucket,
+		Subjects:   []string{objSubjectPrefix + cfg.Bucket + ".>"},
+		MaxAge:     cfg.TTL,
+		MaxBytes:   cfg.MaxBytes,
+		MaxMsgSize: cfg.MaxChunkSize,
+		Storage:    cfg.Storage,
+		Replicas:   cfg.Replicas,
+		Discard:    DiscardNew,
+	}, nil
+}
+
+// objBucket returns the bucket name if the stream config is for an object store.
+func objBucket(cfg *StreamConfig) string {
+	if !strings.HasPrefix(cfg.Name, objStreamPrefix) || len(cfg.Subjects) != 1 {
+		return _EMPTY_
+	}
+	bucket := cfg.Name[len(objStreamPrefix):]
+	if cfg.Subjects[0] != objSubjectPrefix+bucket+".>" {
+		return _EMPTY_
+	}
+	return bucket
+}
+
+// Returns the subject for the metadata of the named object.
+func objMetaSubject(bucket, name string) string {
+	return fmt.Sprintf(objMetaSubjectT, bucket, base64.URLEncoding.EncodeToString([]byte(name)))
+}
+
+// Returns the digest for the given hash in the form we store.
+func objDigest(sum []byte) string {
+	return objDigestPrefix + base64.URLEncoding.EncodeToString(sum)
+}
+
+// AddObjectStore will create an object store bucket for the account.
+func (a *Account) AddObjectStore(cfg *ObjectStoreConfig) (*Stream, error) {
+	scfg, err := cfg.streamConfig()
+	if err != nil {
+		return nil, err
+	}
+	return a.AddStream(scfg)
+}
+
+// LookupObjectStore will return the stream for the object store bucket.
+func (a *Account) LookupObjectStore(bucket string) (*Stream, error) {
+	mset, err := a.LookupStream(objStreamPrefix + bucket)
+	if err != nil {
+		return nil, err
+	}
+	if objBucket(&mset.config) != bucket {
+		return nil, fmt.Errorf("stream is not an object store bucket")
+	}
+	return mset, nil
+}
+
+// ObjectStoreInfo returns the config and state for an object store bucket.
+func (mset *Stream) ObjectStoreInfo() *ObjectStoreInfo {
+	cfg := mset.Config()
+	return &ObjectStoreInfo{
+		Config: ObjectStoreConfig{
+			Bucket:       objBucket(&cfg),
+			TTL:          cfg.MaxAge,
+			MaxChunkSize: cfg.MaxMsgSize,
+			MaxBytes:     cfg.MaxBytes,
+			Storage:      cfg.Storage,
+			Replicas:     cfg.Replicas,
+		},
+		Created: mset.Created(),
+		Bytes:   mset.State().Bytes,
+	}
+}
+
+// Will call fn for each message on the subject, in order. We use the per-subject
+// index of the store to only walk the sequences between the subject's first and last.
+func (mset *Stream) subjectMsgs(subject string, fn func(seq uint64, msg []byte) error) error {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+
+	if store == nil {
+		return ErrStoreClosed
+	}
+	ss, ok := store.SubjectsState(subject)[subject]
+	if !ok {
+		return nil
+	}
+	for seq, n := ss.First, uint64(0); seq > 0 && seq <= ss.Last && n < ss.Msgs; seq++ {
+		subj, _, msg, _, err := store.LoadMsg(seq)
+		if err != nil || subj != subject {
+			continue
+		}
+		n++
+		if err := fn(seq, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Will remove all messages for the subject.
+func (mset *Stream) removeSubjectMsgs(subject string) {
+	var seqs []uint64
+	mset.subjectMsgs(subject, func(seq uint64, _ []byte) error {
+		seqs = append(seqs, seq)
+		return nil
+	})
+	mset.removeMsgs(seqs...)
+}
+
+// Will remove the messages from the store.
+func (mset *Stream) removeMsgs(seqs ...uint64) {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+
+	if store == nil {
+		return
+	}
+	for _, seq := range seqs {
+		store.RemoveMsg(seq)
+	}
+}
+
+// Will lookup the metadata for the named object. This will also
+// return the sequence of the metadata message.
+func (mset *Stream) objectInfo(name string) (*ObjectInfo, uint64, error) {
+	mset.mu.RLock()
+	bucket, store := objBucket(&mset.config), mset.store
+	mset.mu.RUnlock()
+
+	if store == nil {
+		return nil, 0, ErrStoreClosed
+	}
+	seq, _, msg, _, err := store.LoadLastMsg(objMetaSubject(bucket, name))
+	if err == ErrStoreMsgNotFound {
+		return nil, 0, ErrObjectNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(msg, &info); err != nil {
+		return nil, 0, err
+	}
+	return &info, seq, nil
+}
+
+// ObjectInfo returns the metadata for the named object.
+func (mset *Stream) ObjectInfo(name string) (*ObjectInfo, error) {
+	info, _, err := mset.objectInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Deleted {
+		return nil, ErrObjectNotFound
+	}
+	return info, nil
+}
+
+// ObjectChunks will call fn with each chunk of the object in order.
+func (mset *Stream) ObjectChunks(info *ObjectInfo, fn func(chunk []byte) error) error {
+	if info.NUID == _EMPTY_ {
+		return nil
+	}
+	csubj := fmt.Sprintf(ObjChunkSubjectT, info.Bucket, info.NUID)
+	return mset.subjectMsgs(csubj, func(_ uint64, chunk []byte) error {
+		return fn(chunk)
+	})
+}
+
+// Will check that the chunks match the size, count and digest of the object.
+// If the object info has no digest we will fill it in.
+func (mset *Stream) verifyObject(info *ObjectInfo) error {
+	var (
+		size   uint64
+		chunks uint32
+	)
+	h := sha256.New()
+	err := mset.ObjectChunks(info, func(chunk []byte) error {
+		size += uint64(len(chunk))
+		chunks++
+		h.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if size != info.Size || chunks != info.Chunks {
+		return fmt.Errorf("object size or chunks do not match, got %d bytes in %d chunks", size, chunks)
+	}
+	if digest := objDigest(h.Sum(nil)); info.Digest == _EMPTY_ {
+		info.Digest = digest
+	} else if info.Digest != digest {
+		return ErrObjectDigestMismatch
+	}
+	return nil
+}
+
+// Will check the object can be delivered. This only counts the chunks with the
+// per-subject index, the digest is verified as the chunks are delivered.
+func (mset *Stream) checkObjectChunks(info *ObjectInfo) error {
+	if info.Link != nil {
+		return nil
+	}
+	if info.Digest == _EMPTY_ {
+		return ErrObjectDigestMismatch
+	}
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+
+	if store == nil {
+		return ErrStoreClosed
+	}
+	var chunks uint64
+	if info.NUID != _EMPTY_ {
+		csubj := fmt.Sprintf(ObjChunkSubjectT, info.Bucket, info.NUID)
+		chunks = store.SubjectsState(csubj)[csubj].Msgs
+	}
+	// Any missing chunk is reported as a mismatch.
+	if chunks != uint64(info.Chunks) {
+		return ErrObjectDigestMismatch
+	}
+	return nil
+}
+
+// Will send the chunks of the object in order to the deliver subject.
+// The chunks are read once and sent from their own go routine, see sendObjectChunks.
+func (mset *Stream) deliverObject(info *ObjectInfo, dsubj string) error {
+	fch := make(chan struct{}, 1)
+	mset.mu.Lock()
+	sendq := mset.sendq
+	if sendq == nil {
+		mset.mu.Unlock()
+		return ErrStoreClosed
+	}
+	fcReply := fmt.Sprintf(jsFlowControlT, mset.config.Name, createConsumerName())
+	sub, err := mset.subscribeInternal(fcReply, func(_ *subscription, _ *client, _, _ string, _ []byte) {
+		select {
+		case fch <- struct{}{}:
+		default:
+		}
+	})
+	mset.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go mset.sendObjectChunks(info, dsubj, fcReply, fch, sub, sendq)
+	return nil
+}
+
+// Will send the chunks of the object and verify its size, chunk count and digest as we go.
+// The last chunk is held back until the object is verified, and a digest mismatch status
+// is sent in its place if it does not match. Every JsFlowControlWindow bytes we send a flow
+// control request and wait for the client to respond before sending more.
+func (mset *Stream) sendObjectChunks(info *ObjectInfo, dsubj, fcReply string, fch chan struct{}, sub *subscription, sendq chan *jsPubMsg) {
+	defer mset.unsubscribeUnlocked(sub)
+
+	s := mset.jsa.js.srv
+	send := func(reply string, hdr, msg []byte) bool {
+		select {
+		case sendq <- &jsPubMsg{dsubj, dsubj, reply, hdr, msg, nil, 0}:
+			return true
+		case <-s.quitCh:
+			return false
+		}
+	}
+	waitForFlowControl := func() bool {
+		// Drop any late response to a prior request.
+		select {
+		case <-fch:
+		default:
+		}
+		if !send(fcReply, []byte(jsFlowControlHdr), nil) {
+			return false
+		}
+		select {
+		case <-fch:
+			return true
+		case <-time.After(objFlowControlWait):
+			return false
+		case <-s.quitCh:
+			return false
+		}
+	}
+
+	var (
+		size, pending uint64
+		chunks        uint32
+		last          []byte
+	)
+	h := sha256.New()
+	err := mset.ObjectChunks(info, func(chunk []byte) error {
+		size += uint64(len(chunk))
+		chunks++
+		h.Write(chunk)
+		if last != nil {
+			if !send(_EMPTY_, nil, last) {
+				return errObjectDeliveryStopped
+			}
+			if pending += uint64(len(last)); pending >= JsFlowControlWindow {
+				if !waitForFlowControl() {
+					return errObjectDeliveryStopped
+				}
+				pending = 0
+			}
+		}
+		// The chunk may be backed by the store's cache, so we keep our own copy.
+		last = append([]byte(nil), chunk...)
+		return nil
+	})
+	if err == errObjectDeliveryStopped {
+		return
+	}
+	if err != nil || size != info.Size || chunks != info.Chunks || objDigest(h.Sum(nil)) != info.Digest {
+		s.Warnf("JetStream object %q in bucket %q does not match its digest", info.Name, info.Bucket)
+		send(_EMPTY_, []byte(objDigestMismatchHdr), nil)
+		return
+	}
+	if last != nil {
+		send(_EMPTY_, nil, last)
+	}
+}
+
+// Will store the metadata for an object and remove any prior version.
+// When clustered this is called by all replicas as the proposal is applied.
+func (mset *Stream) storeObjectInfo(info *ObjectInfo) error {
+	mset.mu.RLock()
+	bucket := objBucket(&mset.config)
+	mset.mu.RUnlock()
+
+	// Make sure we see the prior version stored by any concurrent update.
+	mset.omu.Lock()
+	defer mset.omu.Unlock()
+
+	oinfo, oseq, err := mset.objectInfo(info.Name)
+	if err != nil && err != ErrObjectNotFound {
+		return err
+	}
+	info.Bucket = bucket
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := mset.processJetStreamMsg(objMetaSubject(bucket, info.Name), _EMPTY_, nil, meta); err != nil {
+		return err
+	}
+	// Now remove the prior version.
+	if oinfo != nil {
+		mset.removeMsgs(oseq)
+		if oinfo.NUID != _EMPTY_ && oinfo.NUID != info.NUID {
+			mset.removeSubjectMsgs(fmt.Sprintf(ObjChunkSubjectT, bucket, oinfo.NUID))
+		}
+	}
+	return nil
+}
+
+// Will propose the metadata for an object to our group. The leader
+// will respond to the reply once the metadata has been stored.
+func (mset *Stream) proposeObjectInfo(info *ObjectInfo, rtype, reply string) error {
+	info.ModTime = time.Now().UTC()
+	return mset.propose(objectInfoOp, &streamObjectInfoOp{Info: info, Type: rtype, Reply: reply})
+}
+
+// Will check the object and verify the chunks already stored for it.
+func (mset *Stream) checkPutObject(info *ObjectInfo) error {
+	if info.Name == _EMPTY_ {
+		return fmt.Errorf("object name is required")
+	}
+	if info.NUID == _EMPTY_ || !isValidName(info.NUID) {
+		return fmt.Errorf("object nuid is required and can not contain '.', '*', '>'")
+	}
+	mset.mu.RLock()
+	info.Bucket = objBucket(&mset.config)
+	mset.mu.RUnlock()
+
+	info.Deleted, info.Link = false, nil
+	return mset.verifyObject(info)
+}
+
+// PutObject will verify the chunks already stored for the object and
+// then store its metadata, replacing any prior version.
+func (mset *Stream) PutObject(info *ObjectInfo) (*ObjectInfo, error) {
+	if err := mset.checkPutObject(info); err != nil {
+		return nil, err
+	}
+	info.ModTime = time.Now().UTC()
+	if err := mset.storeObjectInfo(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Will check the name and target of an object link.
+func checkObjectLink(name string, link *ObjectLink) error {
+	if name == _EMPTY_ {
+		return fmt.Errorf("object name is required")
+	}
+	if link == nil || link.Bucket == _EMPTY_ || link.Name == _EMPTY_ {
+		return fmt.Errorf("object link requires a bucket and name")
+	}
+	return nil
+}
+
+// LinkObject will store an object that points to another object.
+func (mset *Stream) LinkObject(name string, link *ObjectLink) (*ObjectInfo, error) {
+	if err := checkObjectLink(name, link); err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{Name: name, Link: link, ModTime: time.Now().UTC()}
+	if err := mset.storeObjectInfo(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DeleteObject will mark the object as deleted and remove its chunks.
+func (mset *Stream) DeleteObject(name string) (*ObjectInfo, error) {
+	if _, err := mset.ObjectInfo(name); err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{Name: name, Deleted: true, ModTime: time.Now().UTC()}
+	if err := mset.storeObjectInfo(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ListObjects returns the metadata for all objects in the bucket, sorted by name.
+func (mset *Stream) ListObjects() ([]*ObjectInfo, error) {
+	mset.mu.RLock()
+	filter, store := fmt.Sprintf(objMetaSubjectT, objBucket(&mset.config), "*"), mset.store
+	mset.mu.RUnlock()
+
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+	var infos []*ObjectInfo
+	// Only the last metadata message for each name is current.
+	for _, ss := range store.SubjectsState(filter) {
+		_, _, meta, _, err := store.LoadMsg(ss.Last)
+		if err != nil {
+			continue
+		}
+		var info ObjectInfo
+		if err := json.Unmarshal(meta, &info); err != nil {
+			return nil, err
+		}
+		if !info.Deleted {
+			infos = append(infos, &info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
@@ -0,0 +1,1373 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RaftNode is a member of a consensus group. JetStream uses these groups to
+// replicate the meta layer as well as each clustered stream and consumer.
+type RaftNode interface {
+	Propose(entry []byte) error
+	ForwardProposal(entry []byte) error
+	SendSnapshot(snap []byte) error
+	State() RaftState
+	Leader() bool
+	GroupLeader() string
+	Term() uint64
+	ID() string
+	Group() string
+	Peers() []string
+	AddPeer(peer string)
+	ApplyC() <-chan *CommittedEntry
+	LeadChangeC() <-chan bool
+	QuitC() <-chan struct{}
+	Stop()
+	Delete()
+}
+
+// RaftState is the current role of a node within its group.
+type RaftState uint8
+
+const (
+	Follower RaftState = iota
+	Leader
+	Candidate
+	Closed
+)
+
+func (state RaftState) String() string {
+	switch state {
+	case Follower:
+		return "FOLLOWER"
+	case Candidate:
+		return "CANDIDATE"
+	case Leader:
+		return "LEADER"
+	case Closed:
+		return "CLOSED"
+	}
+	return "UNKNOWN"
+}
+
+// CommittedEntry is handed to the upper layer once an entry has been
+// stored by a quorum of the group. Snapshot will be set if the entry
+// represents application state sent by the leader to catch us up.
+// Groups that persist their log will send a nil entry once everything
+// that was committed before a restart has been replayed.
+type CommittedEntry struct {
+	Index    uint64
+	Data     []byte
+	Snapshot bool
+}
+
+var (
+	errNotLeader      = errors.New("raft: not leader")
+	errRaftClosed     = errors.New("raft: node is closed")
+	errBadRaftMsg     = errors.New("raft: malformed message")
+	errBadRaftConfig  = errors.New("raft: config invalid")
+	errRaftNoSnapshot = errors.New("raft: no snapshot available")
+)
+
+// These are vars so tests can tune them.
+var (
+	minElectionTimeout = 300 * time.Millisecond
+	maxElectionTimeout = 600 * time.Millisecond
+	hbInterval         = 100 * time.Millisecond
+	// Groups that learn their peers dynamically, like the meta group, will hold off
+	// their first election to allow routes to form.
+	dynamicStartupDelay = 2 * time.Second
+	// If the leader has not heard from a quorum in this amount of time it will step down.
+	lostQuorumInterval = 4 * maxElectionTimeout
+)
+
+const (
+	raftStateFile    = "state.json"
+	raftWALFile      = "wal.dat"
+	raftMsgsQLen     = 8192
+	raftProposeQLen  = 8192
+	raftApplyQLen    = 8192
+	maxAppendEntries = 1024
+	// Once this many entries are held that every peer already has we will compact.
+	raftCompactThreshold = 8192
+	// Hard limit on entries held for peers that are not responding.
+	raftMaxLogEntries = 256 * 1024
+)
+
+// Subjects used by the groups. These are all in the system account.
+const (
+	raftVoteSubj     = "$NRG.V.%s"
+	raftAppendSubj   = "$NRG.AE.%s.%s"
+	raftProposeSubj  = "$NRG.P.%s"
+	raftReplySubj    = "$NRG.R.%s.%s"
+	raftSnapshotSubj = "$NRG.S.%s.%s"
+)
+
+// Message types on the wire.
+const (
+	raftVoteRequest = iota + 1
+	raftVoteResponse
+	raftAppendEntry
+	raftAppendEntryResponse
+	raftProposal
+	raftSnapshot
+)
+
+type raftConfig struct {
+	// Name of the group.
+	Name string
+	// Directory used to persist our state.
+	Store string
+	// Initial set of peers, we will always be added.
+	Peers []string
+	// If set we will persist the log itself. Groups whose upper layer
+	// already persists the state, e.g. streams, do not need this.
+	WAL bool
+	// Dynamic groups learn new peers as they show up.
+	Dynamic bool
+	// Snapshot is used by the leader to catch up followers that need
+	// entries that we have already compacted.
+	Snapshot func() []byte
+}
+
+type raftEntry struct {
+	term uint64
+	data []byte
+}
+
+type raft struct {
+	sync.RWMutex
+	s       *Server
+	group   string
+	id      string
+	sd      string
+	wal     *os.File
+	dynamic bool
+	snap    func() []byte
+
+	state  RaftState
+	term   uint64
+	vote   string
+	leader string
+	peers  map[string]struct{}
+
+	log    []*raftEntry
+	pindex uint64
+	pterm  uint64
+	commit uint64
+	dindex uint64
+	dirty  bool
+
+	// Replay tracking for groups with a persisted log.
+	rcommit  uint64
+	replayed bool
+
+	// Leader state.
+	next  map[string]uint64
+	match map[string]uint64
+	sent  map[string]uint64
+	seen  map[string]time.Time
+	stuck map[string]bool
+	votes map[string]struct{}
+
+	etimer *time.Timer
+
+	vsubj string
+	psubj string
+	rsubj string
+	ssubj string
+	subs  []*subscription
+
+	msgs   chan []byte
+	propc  chan []byte
+	applyc chan *CommittedEntry
+	leadc  chan bool
+	quit   chan struct{}
+}
+
+// This is what we persist for state.
+type raftPersistedState struct {
+	Term   uint64   `json:"term"`
+	Vote   string   `json:"vote,omitempty"`
+	Peers  []string `json:"peers"`
+	PIndex uint64   `json:"pindex"`
+	PTerm  uint64   `json:"pterm"`
+	Commit uint64   `json:"commit"`
+}
+
+// startRaftNode will create and start a new consensus group member.
+func (s *Server) startRaftNode(cfg *raftConfig) (RaftNode, error) {
+	if cfg == nil || !isValidName(cfg.Name) || cfg.Store == _EMPTY_ {
+		return nil, errBadRaftConfig
+	}
+	if !s.EventsEnabled() {
+		return nil, ErrNoSysAccount
+	}
+	if err := os.MkdirAll(cfg.Store, 0755); err != nil {
+		return nil, fmt.Errorf("could not create raft storage directory - %v", err)
+	}
+
+	id := s.ID()
+	n := &raft{
+		s:       s,
+		group:   cfg.Name,
+		id:      id,
+		sd:      cfg.Store,
+		dynamic: cfg.Dynamic,
+		snap:    cfg.Snapshot,
+		peers:   make(map[string]struct{}),
+		vsubj:   fmt.Sprintf(raftVoteSubj, cfg.Name),
+		psubj:   fmt.Sprintf(raftProposeSubj, cfg.Name),
+		rsubj:   fmt.Sprintf(raftReplySubj, cfg.Name, id),
+		ssubj:   fmt.Sprintf(raftSnapshotSubj, cfg.Name, id),
+		msgs:    make(chan []byte, raftMsgsQLen),
+		propc:   make(chan []byte, raftProposeQLen),
+		applyc:  make(chan *CommittedEntry, raftApplyQLen),
+		leadc:   make(chan bool, 1),
+		quit:    make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		n.peers[p] = struct{}{}
+	}
+	n.peers[id] = struct{}{}
+
+	if err := n.readState(); err != nil {
+		return nil, err
+	}
+	if cfg.WAL {
+		if err := n.openWAL(); err != nil {
+			return nil, err
+		}
+		n.rcommit = n.commit
+	} else {
+		n.replayed = true
+	}
+
+	// Subscribe to our inbound subjects.
+	for _, subj := range []string{
+		n.vsubj,
+		n.psubj,
+		n.rsubj,
+		n.ssubj,
+		fmt.Sprintf(raftAppendSubj, cfg.Name, id),
+	} {
+		sub, err := s.sysSubscribe(subj, n.handleMsg)
+		if err != nil {
+			n.unsubscribe()
+			return nil, err
+		}
+		n.subs = append(n.subs, sub)
+	}
+
+	et := randElectionTimeout()
+	if n.dynamic && n.term == 0 {
+		et += dynamicStartupDelay
+	}
+	n.etimer = time.NewTimer(et)
+
+	go n.run()
+
+	return n, nil
+}
+
+func randElectionTimeout() time.Duration {
+	delta := rand.Int63n(int64(maxElectionTimeout - minElectionTimeout))
+	return minElectionTimeout + time.Duration(delta)
+}
+
+func (n *raft) unsubscribe() {
+	for _, sub := range n.subs {
+		n.s.sysUnsubscribe(sub)
+	}
+	n.subs = nil
+}
+
+// Propose will propose a new entry to the group. Only valid on the leader.
+func (n *raft) Propose(entry []byte) error {
+	n.RLock()
+	if n.state != Leader {
+		n.RUnlock()
+		return errNotLeader
+	}
+	propc, quit := n.propc, n.quit
+	n.RUnlock()
+
+	select {
+	case propc <- entry:
+	case <-quit:
+		return errRaftClosed
+	}
+	return nil
+}
+
+// ForwardProposal will forward the entry to the leader if we are not the leader.
+func (n *raft) ForwardProposal(entry []byte) error {
+	if n.Leader() {
+		return n.Propose(entry)
+	}
+	n.RLock()
+	closed := n.state == Closed
+	n.RUnlock()
+	if closed {
+		return errRaftClosed
+	}
+	buf := make([]byte, 0, len(entry)+1)
+	buf = append(buf, raftProposal)
+	buf = append(buf, entry...)
+	n.s.sendInternalMsgLocked(n.psubj, _EMPTY_, nil, buf)
+	return nil
+}
+
+// SendSnapshot allows the upper layer to push its state to all followers.
+// This is mostly used when a follower is asking for entries we no longer hold.
+func (n *raft) SendSnapshot(snap []byte) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.state != Leader {
+		return errNotLeader
+	}
+	for peer := range n.peers {
+		if peer != n.id {
+			n.sendSnapshotLocked(peer, snap)
+		}
+	}
+	return nil
+}
+
+// State returns our current role.
+func (n *raft) State() RaftState {
+	n.RLock()
+	defer n.RUnlock()
+	return n.state
+}
+
+// Leader returns if we are the leader of our group.
+func (n *raft) Leader() bool {
+	if n == nil {
+		return false
+	}
+	n.RLock()
+	defer n.RUnlock()
+	return n.state == Leader
+}
+
+// GroupLeader returns the id of the current leader if known.
+func (n *raft) GroupLeader() string {
+	n.RLock()
+	defer n.RUnlock()
+	return n.leader
+}
+
+// Term returns our current term.
+func (n *raft) Term() uint64 {
+	n.RLock()
+	defer n.RUnlock()
+	return n.term
+}
+
+// ID returns our id, which is our server's id.
+func (n *raft) ID() string {
+	return n.id
+}
+
+// Group returns the name of our group.
+func (n *raft) Group() string {
+	return n.group
+}
+
+// Peers returns the ids of all known peers, including ourselves.
+func (n *raft) Peers() []string {
+	n.RLock()
+	defer n.RUnlock()
+	peers := make([]string, 0, len(n.peers))
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// AddPeer will add a new peer to our group.
+func (n *raft) AddPeer(peer string) {
+	n.Lock()
+	n.addPeerLocked(peer)
+	n.Unlock()
+}
+
+// Lock should be held.
+func (n *raft) addPeerLocked(peer string) {
+	if peer == _EMPTY_ || n.state == Closed {
+		return
+	}
+	if _, ok := n.peers[peer]; ok {
+		return
+	}
+	n.peers[peer] = struct{}{}
+	if n.state == Leader {
+		n.next[peer] = n.lastIndex() + 1
+		n.seen[peer] = time.Now()
+	}
+	n.writeState()
+}
+
+// ApplyC returns the channel for committed entries.
+func (n *raft) ApplyC() <-chan *CommittedEntry {
+	return n.applyc
+}
+
+// LeadChangeC will signal when we become or stop being the leader.
+func (n *raft) LeadChangeC() <-chan bool {
+	return n.leadc
+}
+
+// QuitC will be closed when we are stopped.
+func (n *raft) QuitC() <-chan struct{} {
+	return n.quit
+}
+
+// Stop will stop this node.
+func (n *raft) Stop() {
+	n.Lock()
+	if n.state == Closed {
+		n.Unlock()
+		return
+	}
+	wasLeader := n.state == Leader
+	n.state = Closed
+	close(n.quit)
+	n.etimer.Stop()
+	n.writeState()
+	if n.wal != nil {
+		n.wal.Close()
+		n.wal = nil
+	}
+	n.Unlock()
+
+	n.unsubscribe()
+
+	if wasLeader {
+		n.notifyLeaderChange(false)
+	}
+}
+
+// Delete will stop this node and remove all persisted state.
+func (n *raft) Delete() {
+	n.Stop()
+	os.RemoveAll(n.sd)
+}
+
+// Callback for all of our subscriptions. We do not process the messages
+// here but hand them to our run loop. The buffer needs to be copied.
+func (n *raft) handleMsg(_ *subscription, _ *client, _, reply string, msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	// We place the reply subject in front if present.
+	buf := make([]byte, 0, len(msg)+len(reply)+2)
+	buf = append(buf, byte(len(reply)>>8), byte(len(reply)))
+	buf = append(buf, reply...)
+	buf = append(buf, msg...)
+
+	select {
+	case n.msgs <- buf:
+	default:
+		// The protocol will recover from dropped messages.
+		n.s.Debugf("Raft group %q inbound queue full, dropping message", n.group)
+	}
+}
+
+func (n *raft) run() {
+	hb := time.NewTicker(hbInterval)
+	defer hb.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.etimer.C:
+			n.campaign()
+		case <-hb.C:
+			n.heartbeat()
+		case msg := <-n.msgs:
+			n.processMsg(msg)
+		case entry := <-n.propc:
+			n.processProposals(entry)
+		}
+	}
+}
+
+// Will reset our election timer.
+// Should only be called from our run loop.
+func (n *raft) resetElectionTimeout() {
+	if !n.etimer.Stop() {
+		select {
+		case <-n.etimer.C:
+		default:
+		}
+	}
+	n.etimer.Reset(randElectionTimeout())
+}
+
+func (n *raft) notifyLeaderChange(isLeader bool) {
+	// Drain any stale notification first.
+	select {
+	case <-n.leadc:
+	default:
+	}
+	select {
+	case n.leadc <- isLeader:
+	default:
+	}
+}
+
+// Lock should be held.
+func (n *raft) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+// Lock should be held.
+func (n *raft) lastIndex() uint64 {
+	return n.pindex + uint64(len(n.log))
+}
+
+// Lock should be held.
+func (n *raft) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// Returns the term for the given index if we know it.
+// Lock should be held.
+func (n *raft) termAt(index uint64) uint64 {
+	if index == n.pindex {
+		return n.pterm
+	}
+	if index < n.pindex || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.pindex-1].term
+}
+
+// Lock should be held.
+func (n *raft) entryAt(index uint64) *raftEntry {
+	if index <= n.pindex || index > n.lastIndex() {
+		return nil
+	}
+	return n.log[index-n.pindex-1]
+}
+
+// Lock should be held.
+func (n *raft) switchToFollower(term uint64, leader string) {
+	wasLeader := n.state == Leader
+	if term > n.term {
+		n.term = term
+		n.vote = _EMPTY_
+		n.writeState()
+	}
+	n.state = Follower
+	n.leader = leader
+	n.votes = nil
+	n.resetElectionTimeout()
+	if wasLeader {
+		n.s.Debugf("Raft group %q stepping down as leader", n.group)
+		n.notifyLeaderChange(false)
+	}
+}
+
+// Lock should be held.
+func (n *raft) switchToLeader() {
+	n.s.Debugf("Raft group %q elected leader for term %d", n.group, n.term)
+	n.state = Leader
+	n.leader = n.id
+	n.votes = nil
+	n.next = make(map[string]uint64, len(n.peers))
+	n.match = make(map[string]uint64, len(n.peers))
+	n.sent = make(map[string]uint64, len(n.peers))
+	n.seen = make(map[string]time.Time, len(n.peers))
+	n.stuck = make(map[string]bool)
+	li, now := n.lastIndex(), time.Now()
+	for peer := range n.peers {
+		n.next[peer] = li + 1
+		n.sent[peer] = li
+		n.seen[peer] = now
+	}
+	// Commit an empty entry for our term. This will also commit
+	// anything outstanding from previous terms.
+	n.appendEntry(n.term, nil)
+	n.sendAppendEntries(false)
+	n.checkCommit()
+	n.notifyLeaderChange(true)
+}
+
+// Election timer fired.
+func (n *raft) campaign() {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.state == Closed {
+		return
+	}
+	n.resetElectionTimeout()
+	if n.state == Leader {
+		return
+	}
+
+	n.state = Candidate
+	n.term++
+	n.vote = n.id
+	n.leader = _EMPTY_
+	n.votes = map[string]struct{}{n.id: {}}
+	n.writeState()
+
+	if len(n.votes) >= n.quorum() {
+		n.switchToLeader()
+		return
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, raftVoteRequest)
+	buf = appendUint64(buf, n.term)
+	buf = appendUint64(buf, n.lastTerm())
+	buf = appendUint64(buf, n.lastIndex())
+	buf = appendString(buf, n.id)
+	n.s.sendInternalMsgLocked(n.vsubj, n.rsubj, nil, buf)
+}
+
+func (n *raft) heartbeat() {
+	n.Lock()
+	defer n.Unlock()
+
+	switch n.state {
+	case Closed:
+		return
+	case Leader:
+		// Check that we can still hear from a quorum.
+		now, active := time.Now(), 1
+		for peer, last := range n.seen {
+			if peer != n.id && now.Sub(last) < lostQuorumInterval {
+				active++
+			}
+		}
+		if active < n.quorum() {
+			n.s.Debugf("Raft group %q lost quorum", n.group)
+			n.switchToFollower(n.term, _EMPTY_)
+			return
+		}
+		n.sendAppendEntries(true)
+		n.compact()
+	}
+	if n.dirty {
+		n.writeState()
+	}
+	n.deliverCommitted()
+}
+
+func (n *raft) processProposals(entry []byte) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.state != Leader {
+		return
+	}
+	n.appendEntry(n.term, entry)
+	// Grab any others that are waiting.
+	for i := 1; i < maxAppendEntries; i++ {
+		select {
+		case entry := <-n.propc:
+			n.appendEntry(n.term, entry)
+			continue
+		default:
+		}
+		break
+	}
+	n.sendAppendEntries(false)
+	n.checkCommit()
+	n.deliverCommitted()
+}
+
+// Lock should be held.
+func (n *raft) appendEntry(term uint64, data []byte) {
+	n.log = append(n.log, &raftEntry{term, data})
+	if n.wal != nil {
+		if _, err := n.wal.Write(encodeWALEntry(nil, term, data)); err != nil {
+			n.s.Warnf("Raft group %q error writing log: %v", n.group, err)
+		}
+	}
+}
+
+// Send entries to our followers. If resend is true we will send starting at the
+// next index we need acknowledged, otherwise we will only send new entries.
+// Lock should be held.
+func (n *raft) sendAppendEntries(resend bool) {
+	li := n.lastIndex()
+	for peer := range n.peers {
+		if peer == n.id {
+			continue
+		}
+		start := n.sent[peer] + 1
+		if resend || start <= n.pindex {
+			start = n.next[peer]
+		}
+		if start <= n.pindex {
+			// We no longer have what this peer needs.
+			n.sendSnapshot(peer)
+			continue
+		}
+		// Nothing new to send and not a heartbeat.
+		if start > li && !resend {
+			continue
+		}
+		end := li
+		if end >= start && end-start >= maxAppendEntries {
+			end = start + maxAppendEntries - 1
+		}
+		var entries []*raftEntry
+		if end >= start {
+			entries = n.log[start-n.pindex-1 : end-n.pindex]
+		}
+		n.sendAppendEntry(peer, start-1, entries)
+		if end > n.sent[peer] {
+			n.sent[peer] = end
+		}
+	}
+}
+
+// Lock should be held.
+func (n *raft) sendAppendEntry(peer string, pindex uint64, entries []*raftEntry) {
+	sz := 64 + len(n.id)
+	for _, e := range entries {
+		sz += 12 + len(e.data)
+	}
+	buf := make([]byte, 0, sz)
+	buf = append(buf, raftAppendEntry)
+	buf = appendUint64(buf, n.term)
+	buf = appendUint64(buf, n.commit)
+	buf = appendUint64(buf, n.termAt(pindex))
+	buf = appendUint64(buf, pindex)
+	buf = appendString(buf, n.id)
+	buf = appendUint32(buf, uint32(len(entries)))
+	for _, e := range entries {
+		buf = appendUint64(buf, e.term)
+		buf = appendUint32(buf, uint32(len(e.data)))
+		buf = append(buf, e.data...)
+	}
+	n.s.sendInternalMsgLocked(fmt.Sprintf(raftAppendSubj, n.group, peer), n.rsubj, nil, buf)
+}
+
+// Will ask the upper layer for a snapshot to send to a peer that
+// needs entries we no longer have.
+// Lock should be held.
+func (n *raft) sendSnapshot(peer string) {
+	if n.snap == nil {
+		if !n.stuck[peer] {
+			n.stuck[peer] = true
+			n.s.Warnf("Raft group %q can not catch up peer %q, no snapshot available", n.group, peer)
+		}
+		return
+	}
+	n.sendSnapshotLocked(peer, n.snap())
+}
+
+// Lock should be held.
+func (n *raft) sendSnapshotLocked(peer string, snap []byte) {
+	buf := make([]byte, 0, 64+len(n.id)+len(snap))
+	buf = append(buf, raftSnapshot)
+	buf = appendUint64(buf, n.term)
+	buf = appendUint64(buf, n.pindex)
+	buf = appendUint64(buf, n.pterm)
+	buf = appendString(buf, n.id)
+	buf = append(buf, snap...)
+	n.s.sendInternalMsgLocked(fmt.Sprintf(raftSnapshotSubj, n.group, peer), n.rsubj, nil, buf)
+	// Assume the peer will be at our compacted index.
+	n.next[peer] = n.pindex + 1
+	n.sent[peer] = n.pindex
+}
+
+// Check to see if we can move our commit index forward.
+// Lock should be held.
+func (n *raft) checkCommit() {
+	if n.state != Leader {
+		return
+	}
+	matched := make([]uint64, 0, len(n.peers))
+	for peer := range n.peers {
+		if peer == n.id {
+			matched = append(matched, n.lastIndex())
+		} else {
+			matched = append(matched, n.match[peer])
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i] > matched[j] })
+	ci := matched[n.quorum()-1]
+	// We can only commit entries from our own term.
+	if ci > n.commit && n.termAt(ci) == n.term {
+		n.commit = ci
+		n.dirty = true
+	}
+}
+
+// Hand any committed entries to the upper layer.
+// Lock should be held.
+func (n *raft) deliverCommitted() {
+	for n.dindex < n.commit {
+		if !n.checkReplayed() {
+			return
+		}
+		index := n.dindex + 1
+		e := n.entryAt(index)
+		if e == nil {
+			// Compacted or restored past this point.
+			n.dindex = index
+			continue
+		}
+		// We do not deliver empty entries.
+		if len(e.data) > 0 {
+			select {
+			case n.applyc <- &CommittedEntry{Index: index, Data: e.data}:
+			default:
+				// Will try again later.
+				return
+			}
+		}
+		n.dindex = index
+		n.dirty = true
+	}
+	n.checkReplayed()
+}
+
+// Will signal the upper layer once we have delivered everything from
+// our log that was committed on startup. Returns false if we could not.
+// Lock should be held.
+func (n *raft) checkReplayed() bool {
+	if n.replayed || n.dindex < n.rcommit {
+		return true
+	}
+	select {
+	case n.applyc <- nil:
+		n.replayed = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Drop entries that we have delivered and that all of our peers have.
+// If some peers are not responding we will hold on to a bounded amount.
+// Lock should be held.
+func (n *raft) compact() {
+	// We do not compact groups that persist their log.
+	if n.wal != nil || len(n.log) < raftCompactThreshold {
+		return
+	}
+	upto := n.dindex
+	for peer := range n.peers {
+		if peer != n.id && n.match[peer] < upto {
+			upto = n.match[peer]
+		}
+	}
+	if len(n.log) > raftMaxLogEntries && n.snap != nil {
+		upto = n.dindex
+	}
+	if upto <= n.pindex {
+		return
+	}
+	n.pterm = n.termAt(upto)
+	n.log = append(n.log[:0:0], n.log[upto-n.pindex:]...)
+	n.pindex = upto
+}
+
+func (n *raft) processMsg(msg []byte) {
+	if len(msg) < 3 {
+		return
+	}
+	rl := int(msg[0])<<8 | int(msg[1])
+	if len(msg) < 2+rl+1 {
+		return
+	}
+	reply, msg := string(msg[2:2+rl]), msg[2+rl:]
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.state == Closed {
+		return
+	}
+
+	var err error
+	switch msg[0] {
+	case raftVoteRequest:
+		err = n.processVoteRequest(reply, msg[1:])
+	case raftVoteResponse:
+		err = n.processVoteResponse(msg[1:])
+	case raftAppendEntry:
+		err = n.processAppendEntry(reply, msg[1:])
+	case raftAppendEntryResponse:
+		err = n.processAppendEntryResponse(msg[1:])
+	case raftProposal:
+		if n.state == Leader {
+			// Copied already, so can just use the slice.
+			n.appendEntry(n.term, msg[1:])
+			n.sendAppendEntries(false)
+			n.checkCommit()
+		}
+	case raftSnapshot:
+		err = n.processSnapshot(msg[1:])
+	default:
+		err = errBadRaftMsg
+	}
+	if err != nil {
+		n.s.Debugf("Raft group %q error processing message: %v", n.group, err)
+	}
+	n.deliverCommitted()
+}
+
+// Lock should be held.
+func (n *raft) processVoteRequest(reply string, buf []byte) error {
+	d := &raftDecoder{buf: buf}
+	term, lterm, lindex, candidate := d.uint64(), d.uint64(), d.uint64(), d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if candidate == n.id {
+		return nil
+	}
+	if n.dynamic {
+		n.addPeerLocked(candidate)
+	} else if _, ok := n.peers[candidate]; !ok {
+		return nil
+	}
+	if term > n.term {
+		n.switchToFollower(term, _EMPTY_)
+	}
+	var granted bool
+	if term == n.term && (n.vote == _EMPTY_ || n.vote == candidate) {
+		// Make sure the candidate's log is at least as up to date as ours.
+		mlt, mli := n.lastTerm(), n.lastIndex()
+		if lterm > mlt || (lterm == mlt && lindex >= mli) {
+			granted = true
+			n.vote = candidate
+			n.writeState()
+			n.resetElectionTimeout()
+		}
+	}
+	if reply == _EMPTY_ {
+		return nil
+	}
+	rbuf := make([]byte, 0, 16+len(n.id))
+	rbuf = append(rbuf, raftVoteResponse)
+	rbuf = appendUint64(rbuf, n.term)
+	if granted {
+		rbuf = append(rbuf, 1)
+	} else {
+		rbuf = append(rbuf, 0)
+	}
+	rbuf = appendString(rbuf, n.id)
+	n.s.sendInternalMsgLocked(reply, _EMPTY_, nil, rbuf)
+	return nil
+}
+
+// Lock should be held.
+func (n *raft) processVoteResponse(buf []byte) error {
+	d := &raftDecoder{buf: buf}
+	term, granted, peer := d.uint64(), d.byte() == 1, d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if term > n.term {
+		n.switchToFollower(term, _EMPTY_)
+		return nil
+	}
+	if n.state != Candidate || term != n.term || !granted {
+		return nil
+	}
+	if _, ok := n.peers[peer]; !ok {
+		return nil
+	}
+	n.votes[peer] = struct{}{}
+	if len(n.votes) >= n.quorum() {
+		n.switchToLeader()
+	}
+	return nil
+}
+
+// Lock should be held.
+func (n *raft) processAppendEntry(reply string, buf []byte) error {
+	d := &raftDecoder{buf: buf}
+	term, commit, pterm, pindex, leader := d.uint64(), d.uint64(), d.uint64(), d.uint64(), d.string()
+	ne := int(d.uint32())
+	if d.err != nil {
+		return d.err
+	}
+	if leader == n.id {
+		return nil
+	}
+	if n.dynamic {
+		n.addPeerLocked(leader)
+	}
+
+	respond := func(index uint64, success bool) {
+		if reply == _EMPTY_ {
+			return
+		}
+		rbuf := make([]byte, 0, 24+len(n.id))
+		rbuf = append(rbuf, raftAppendEntryResponse)
+		rbuf = appendUint64(rbuf, n.term)
+		rbuf = appendUint64(rbuf, index)
+		if success {
+			rbuf = append(rbuf, 1)
+		} else {
+			rbuf = append(rbuf, 0)
+		}
+		rbuf = appendString(rbuf, n.id)
+		n.s.sendInternalMsgLocked(reply, _EMPTY_, nil, rbuf)
+	}
+
+	if term < n.term {
+		respond(n.lastIndex(), false)
+		return nil
+	}
+	// We have a valid leader. If we thought we were leader for this term as well
+	// this will have us step down, and the election timer will sort things out.
+	n.switchToFollower(term, leader)
+
+	// Check that we agree on the previous entry.
+	if pindex > n.lastIndex() {
+		respond(n.lastIndex(), false)
+		return nil
+	}
+	if pindex >= n.pindex && n.termAt(pindex) != pterm {
+		// Conflict, drop everything from this point.
+		n.truncate(pindex - 1)
+		respond(n.lastIndex(), false)
+		return nil
+	}
+
+	var truncated bool
+	index := pindex
+	for i := 0; i < ne; i++ {
+		eterm := d.uint64()
+		data := d.bytes(int(d.uint32()))
+		if d.err != nil {
+			return d.err
+		}
+		index++
+		if index <= n.pindex {
+			continue
+		}
+		if index <= n.lastIndex() {
+			if n.termAt(index) == eterm {
+				continue
+			}
+			n.truncate(index - 1)
+			truncated = true
+		}
+		n.appendEntry(eterm, data)
+	}
+	if truncated && n.wal != nil {
+		n.rewriteWAL()
+	}
+
+	if commit > n.commit {
+		if commit > index {
+			commit = index
+		}
+		if commit > n.commit {
+			n.commit = commit
+			n.dirty = true
+		}
+	}
+	if index < n.pindex {
+		index = n.pindex
+	}
+	respond(index, true)
+	return nil
+}
+
+// Drop all entries after index.
+// Lock should be held.
+func (n *raft) truncate(index uint64) {
+	if index < n.pindex {
+		index = n.pindex
+	}
+	if index >= n.lastIndex() {
+		return
+	}
+	n.log = n.log[:index-n.pindex]
+	if n.commit > index {
+		n.commit = index
+	}
+	if n.wal != nil {
+		n.rewriteWAL()
+	}
+}
+
+// Lock should be held.
+func (n *raft) processAppendEntryResponse(buf []byte) error {
+	d := &raftDecoder{buf: buf}
+	term, index, success, peer := d.uint64(), d.uint64(), d.byte() == 1, d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if term > n.term {
+		n.switchToFollower(term, _EMPTY_)
+		return nil
+	}
+	if n.state != Leader {
+		return nil
+	}
+	if _, ok := n.peers[peer]; !ok {
+		return nil
+	}
+	n.seen[peer] = time.Now()
+	if success {
+		if index > n.match[peer] {
+			n.match[peer] = index
+		}
+		if n.match[peer]+1 > n.next[peer] {
+			n.next[peer] = n.match[peer] + 1
+		}
+		delete(n.stuck, peer)
+		n.checkCommit()
+	} else {
+		// We will resend from here on the next heartbeat.
+		n.next[peer] = index + 1
+		n.sent[peer] = index
+		if n.match[peer] > index {
+			n.match[peer] = index
+		}
+	}
+	return nil
+}
+
+// Lock should be held.
+func (n *raft) processSnapshot(buf []byte) error {
+	d := &raftDecoder{buf: buf}
+	term, pindex, pterm, leader := d.uint64(), d.uint64(), d.uint64(), d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if term < n.term || leader == n.id {
+		return nil
+	}
+	n.switchToFollower(term, leader)
+
+	snap := d.bytes(len(d.buf))
+	// Reset our log if we are behind the snapshot.
+	if pindex > n.lastIndex() || n.termAt(pindex) != pterm {
+		n.log = nil
+		n.pindex, n.pterm = pindex, pterm
+		if n.commit < pindex {
+			n.commit = pindex
+		}
+		n.dindex = pindex
+		n.dirty = true
+		if n.wal != nil {
+			n.rewriteWAL()
+		}
+	}
+	// Always hand the snapshot to the upper layer to check.
+	select {
+	case n.applyc <- &CommittedEntry{Index: pindex, Data: snap, Snapshot: true}:
+	default:
+	}
+	return nil
+}
+
+// Read our persisted state.
+func (n *raft) readState() error {
+	buf, err := ioutil.ReadFile(path.Join(n.sd, raftStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var ps raftPersistedState
+	if err := json.Unmarshal(buf, &ps); err != nil {
+		return fmt.Errorf("raft state corrupt - %v", err)
+	}
+	n.term, n.vote = ps.Term, ps.Vote
+	n.pindex, n.pterm = ps.PIndex, ps.PTerm
+	n.commit, n.dindex = ps.PIndex, ps.PIndex
+	if ps.Commit > n.commit {
+		n.commit = ps.Commit
+	}
+	for _, p := range ps.Peers {
+		n.peers[p] = struct{}{}
+	}
+	return nil
+}
+
+// Write out our state.
+// Lock should be held.
+func (n *raft) writeState() {
+	ps := raftPersistedState{Term: n.term, Vote: n.vote, Commit: n.commit}
+	for p := range n.peers {
+		ps.Peers = append(ps.Peers, p)
+	}
+	sort.Strings(ps.Peers)
+	// If we have our log persisted we can recover everything from it, otherwise
+	// we mark what we have handed to the upper layer and restart from there.
+	if n.wal == nil {
+		ps.PIndex, ps.PTerm = n.dindex, n.termAt(n.dindex)
+		if ps.PTerm == 0 && ps.PIndex > 0 {
+			ps.PIndex, ps.PTerm = n.pindex, n.pterm
+		}
+	}
+	buf, err := json.Marshal(&ps)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(n.sd, raftStateFile), buf, 0644); err != nil {
+		n.s.Warnf("Raft group %q error writing state: %v", n.group, err)
+		return
+	}
+	n.dirty = false
+}
+
+// Open our log and recover any entries.
+func (n *raft) openWAL() error {
+	fn := path.Join(n.sd, raftWALFile)
+	if f, err := os.Open(fn); err == nil {
+		r := bufio.NewReader(f)
+		var hdr [12]byte
+		for {
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				break
+			}
+			term := binary.LittleEndian.Uint64(hdr[0:])
+			data := make([]byte, binary.LittleEndian.Uint32(hdr[8:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+			n.log = append(n.log, &raftEntry{term, data})
+		}
+		f.Close()
+	}
+	// Log always starts at the beginning for us.
+	n.pindex, n.pterm = 0, 0
+	n.dindex = 0
+	if n.commit > n.lastIndex() {
+		n.commit = n.lastIndex()
+	}
+	wal, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	n.wal = wal
+	return nil
+}
+
+// Rewrite our log after a truncation.
+// Lock should be held.
+func (n *raft) rewriteWAL() {
+	var buf []byte
+	for _, e := range n.log {
+		buf = encodeWALEntry(buf, e.term, e.data)
+	}
+	fn := path.Join(n.sd, raftWALFile)
+	n.wal.Close()
+	if err := ioutil.WriteFile(fn, buf, 0644); err != nil {
+		n.s.Warnf("Raft group %q error rewriting log: %v", n.group, err)
+	}
+	wal, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		n.s.Warnf("Raft group %q error opening log: %v", n.group, err)
+	}
+	n.wal = wal
+}
+
+func encodeWALEntry(buf []byte, term uint64, data []byte) []byte {
+	buf = appendUint64(buf, term)
+	buf = appendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// Helpers for our wire encoding.
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+type raftDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *raftDecoder) bytes(l int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if l < 0 || len(d.buf) < l {
+		d.err = errBadRaftMsg
+		return nil
+	}
+	b := d.buf[:l]
+	d.buf = d.buf[l:]
+	return b
+}
+
+func (d *raftDecoder) byte() byte {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *raftDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *raftDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *raftDecoder) string() string {
+	b := d.bytes(2)
+	if b == nil {
+		return _EMPTY_
+	}
+	return string(d.bytes(int(b[0])<<8 | int(b[1])))
+}
@@ -766,7 +766,7 @@ func imposeOrder(value interface{}) error {
 	case WebsocketOpts:
 		sort.Strings(value.AllowedOrigins)
 	case string, bool, int, int32, int64, time.Duration, float64, nil,
-		LeafNodeOpts, ClusterOpts, *tls.Config, *URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication:
+		LeafNodeOpts, ClusterOpts, *tls.Config, *URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, StoreCipher:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -961,6 +961,8 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			return nil, fmt.Errorf("config reload not supported for jetstream max memory")
 		case "jetstreammaxstore":
 			return nil, fmt.Errorf("config reload not supported for jetstream max storage")
+		case "jetstreamkey", "jetstreamcipher":
+			return nil, fmt.Errorf("config reload not supported for jetstream encryption")
 		case "websocket":
 			// Similar to gateways
 			tmpOld := oldValue.(WebsocketOpts)
@@ -1478,6 +1478,11 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 	}
 	s.mu.Unlock()
 
+	// If the remote has JetStream enabled add it to our meta group.
+	if !exists && info.JetStream {
+		s.jsClusterAddPeer(id)
+	}
+
 	if exists {
 		var r *route
 
@@ -1720,6 +1725,7 @@ func (s *Server) startRouteAcceptLoop() {
 		Cluster:      s.info.Cluster,
 		Dynamic:      s.isClusterNameDynamic(),
 		LNOC:         true,
+		JetStream:    s.info.JetStream,
 	}
 	// Set this if only if advertise is not disabled
 	if !opts.Cluster.NoAdvertise {
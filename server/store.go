@@ -14,10 +14,12 @@
 package server
 
 import (
+	"container/heap"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 )
@@ -32,6 +34,16 @@ const (
 	FileStorage
 )
 
+// StoreCompression determines how sealed message blocks are compressed on disk.
+type StoreCompression int
+
+const (
+	// NoCompression stores message blocks as is.
+	NoCompression StoreCompression = iota
+	// GzipCompression compresses sealed message blocks with gzip.
+	GzipCompression
+)
+
 var (
 	// ErrStoreClosed is returned when the store has been closed
 	ErrStoreClosed = errors.New("store is closed")
@@ -45,22 +57,35 @@ var (
 	// ErrMaxBytes is returned when we have discard new as a policy and we reached
 	// the bytes limit.
 	ErrMaxBytes = errors.New("maximum bytes exceeded")
+	// ErrMaxMsgsPerSubject is returned when we have discard new as a policy and we reached
+	// the message limit for a subject.
+	ErrMaxMsgsPerSubject = errors.New("maximum messages per subject exceeded")
 	// ErrStoreSnapshotInProgress is returned when RemoveMsg or EraseMsg is called
 	// while a snapshot is in progress.
 	ErrStoreSnapshotInProgress = errors.New("snapshot in progress")
 	// ErrMsgTooBig is returned when a message is considered too large.
 	ErrMsgTooLarge = errors.New("message to large")
+	// ErrPurgeArgMismatch is returned when PurgeEx is called with both a sequence and keep.
+	ErrPurgeArgMismatch = errors.New("sequence and keep can not both be set")
 )
 
 type StreamStore interface {
 	StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error)
 	SkipMsg() uint64
+	SkipMsgs(num uint64)
 	LoadMsg(seq uint64) (subj string, hdr, msg []byte, ts int64, err error)
+	LoadLastMsg(subj string) (seq uint64, hdr, msg []byte, ts int64, err error)
 	RemoveMsg(seq uint64) (bool, error)
 	EraseMsg(seq uint64) (bool, error)
 	Purge() uint64
+	PurgeEx(subject string, seq, keep uint64) (uint64, error)
+	Compact(seq uint64) (uint64, error)
+	DueMsgs(now int64) []uint64
+	ResetDueMsgs()
+	ScheduledState() (pending uint64, next int64)
 	GetSeqFromTime(t time.Time) uint64
 	State() StreamState
+	SubjectsState(filter string) map[string]SubjectState
 	StorageBytesUpdate(func(int64))
 	UpdateConfig(cfg *StreamConfig) error
 	Delete() error
@@ -69,12 +94,269 @@ type StreamStore interface {
 	Snapshot(deadline time.Duration, includeConsumers, checkMsgs bool) (*SnapshotResult, error)
 }
 
+// subjectState tracks the messages for a single subject in a subjectIndex.
+// Sequences are kept in order, so the first and last are always known.
+type subjectState struct {
+	seqs []uint64
+}
+
+// subjectIndex is a per-subject index of the messages held in a store.
+type subjectIndex map[string]*subjectState
+
+// Track a new message for the subject.
+// Sequences are always increasing, so this is an append.
+func (si subjectIndex) add(subj string, seq uint64) {
+	if ss := si[subj]; ss != nil {
+		ss.seqs = append(ss.seqs, seq)
+	} else {
+		si[subj] = &subjectState{seqs: []uint64{seq}}
+	}
+}
+
+// Remove a message for the subject.
+func (si subjectIndex) remove(subj string, seq uint64) {
+	ss := si[subj]
+	if ss == nil {
+		return
+	}
+	n := len(ss.seqs)
+	// Optimize for removing from either end.
+	switch {
+	case ss.seqs[0] == seq:
+		ss.seqs = ss.seqs[1:]
+	case ss.seqs[n-1] == seq:
+		ss.seqs = ss.seqs[:n-1]
+	default:
+		i := sort.Search(n, func(i int) bool { return ss.seqs[i] >= seq })
+		if i == n || ss.seqs[i] != seq {
+			return
+		}
+		ss.seqs = append(ss.seqs[:i], ss.seqs[i+1:]...)
+	}
+	if len(ss.seqs) == 0 {
+		delete(si, subj)
+	}
+}
+
+// Returns the number of messages we have for the subject.
+func (si subjectIndex) numMsgs(subj string) uint64 {
+	if ss := si[subj]; ss != nil {
+		return uint64(len(ss.seqs))
+	}
+	return 0
+}
+
+// Returns the first sequence for the subject or 0 if we have none.
+func (si subjectIndex) firstSeq(subj string) uint64 {
+	if ss := si[subj]; ss != nil {
+		return ss.seqs[0]
+	}
+	return 0
+}
+
+// Returns the last sequence for the subject or 0 if we have none.
+func (si subjectIndex) lastSeq(subj string) uint64 {
+	if ss := si[subj]; ss != nil {
+		return ss.seqs[len(ss.seqs)-1]
+	}
+	return 0
+}
+
+// Returns the state for each subject that matches the filter.
+func (si subjectIndex) filtered(filter string) map[string]SubjectState {
+	fss := make(map[string]SubjectState)
+	add := func(subj string) {
+		fss[subj] = SubjectState{Msgs: si.numMsgs(subj), First: si.firstSeq(subj), Last: si.lastSeq(subj)}
+	}
+	if subjectIsLiteral(filter) {
+		if si[filter] != nil {
+			add(filter)
+		}
+		return fss
+	}
+	for subj := range si {
+		if subjectIsSubsetMatch(subj, filter) {
+			add(subj)
+		}
+	}
+	return fss
+}
+
+// Returns true if the subject filter for PurgeEx selects all messages.
+func isPurgeAll(subject string) bool {
+	return subject == _EMPTY_ || subject == ">"
+}
+
+// Will determine the sequences to remove for PurgeEx from the messages between first
+// and last that match the subject filter, below seq if set and keeping the last keep
+// matching messages if set. Load returns the subject for a sequence or false if we
+// do not have the message.
+func purgeExSeqs(subject string, seq, keep, first, last uint64, load func(seq uint64) (string, bool)) []uint64 {
+	if seq > 0 && seq <= last {
+		last = seq - 1
+	}
+	all := isPurgeAll(subject)
+	var seqs []uint64
+	for i := first; i > 0 && i <= last; i++ {
+		if subj, ok := load(i); ok && (all || subjectIsSubsetMatch(subj, subject)) {
+			seqs = append(seqs, i)
+		}
+	}
+	if keep > 0 {
+		if keep >= uint64(len(seqs)) {
+			return nil
+		}
+		seqs = seqs[:uint64(len(seqs))-keep]
+	}
+	return seqs
+}
+
+// msgTTL is the expiration of a single message in a ttlIndex.
+type msgTTL struct {
+	seq     uint64
+	expires int64 // nanoseconds
+}
+
+// ttlIndex tracks messages that have their own TTL as a min heap on expiration,
+// so that stores do not need to scan from the first sequence to find them.
+// We also keep the position of each message in the heap so they can be removed.
+// The zero value is ready to use.
+type ttlIndex struct {
+	ttls []msgTTL
+	pos  map[uint64]int
+}
+
+func (ti *ttlIndex) Len() int           { return len(ti.ttls) }
+func (ti *ttlIndex) Less(i, j int) bool { return ti.ttls[i].expires < ti.ttls[j].expires }
+func (ti *ttlIndex) Swap(i, j int) {
+	ti.ttls[i], ti.ttls[j] = ti.ttls[j], ti.ttls[i]
+	ti.pos[ti.ttls[i].seq], ti.pos[ti.ttls[j].seq] = i, j
+}
+func (ti *ttlIndex) Push(x interface{}) {
+	mt := x.(msgTTL)
+	if ti.pos == nil {
+		ti.pos = make(map[uint64]int)
+	}
+	ti.pos[mt.seq] = len(ti.ttls)
+	ti.ttls = append(ti.ttls, mt)
+}
+func (ti *ttlIndex) Pop() interface{} {
+	n := len(ti.ttls)
+	mt := ti.ttls[n-1]
+	ti.ttls = ti.ttls[:n-1]
+	delete(ti.pos, mt.seq)
+	return mt
+}
+
+// Track a message that expires at the given time.
+// If we are already tracking the message its expiration is updated.
+func (ti *ttlIndex) add(seq uint64, expires int64) {
+	if i, ok := ti.pos[seq]; ok {
+		ti.ttls[i].expires = expires
+		heap.Fix(ti, i)
+		return
+	}
+	heap.Push(ti, msgTTL{seq, expires})
+}
+
+// Remove a message if we are tracking it.
+func (ti *ttlIndex) remove(seq uint64) {
+	if i, ok := ti.pos[seq]; ok {
+		heap.Remove(ti, i)
+	}
+}
+
+// Remove all messages below seq.
+func (ti *ttlIndex) compact(seq uint64) {
+	ttls := ti.ttls[:0]
+	for _, mt := range ti.ttls {
+		if mt.seq >= seq {
+			ttls = append(ttls, mt)
+		} else {
+			delete(ti.pos, mt.seq)
+		}
+	}
+	ti.ttls = ttls
+	for i, mt := range ti.ttls {
+		ti.pos[mt.seq] = i
+	}
+	heap.Init(ti)
+}
+
+// Returns the next expiration or 0 if we are not tracking any messages.
+func (ti *ttlIndex) next() int64 {
+	if len(ti.ttls) == 0 {
+		return 0
+	}
+	return ti.ttls[0].expires
+}
+
+// Removes and returns the sequences for all messages that have expired by now.
+func (ti *ttlIndex) expired(now int64) []uint64 {
+	var seqs []uint64
+	for len(ti.ttls) > 0 && ti.ttls[0].expires <= now {
+		seqs = append(seqs, heap.Pop(ti).(msgTTL).seq)
+	}
+	return seqs
+}
+
+// schedIndex tracks messages that are held until they are due. The order of the
+// ones that have not been returned as due yet is kept with a ttlIndex.
+type schedIndex struct {
+	due   map[uint64]int64
+	order ttlIndex
+}
+
+// Track a message that is held until due.
+func (si *schedIndex) add(seq uint64, due int64) {
+	if si.due == nil {
+		si.due = make(map[uint64]int64)
+	}
+	si.due[seq] = due
+	si.order.add(seq, due)
+}
+
+// Remove a message if we are tracking it.
+func (si *schedIndex) remove(seq uint64) {
+	delete(si.due, seq)
+	si.order.remove(seq)
+}
+
+// Remove all messages below seq.
+func (si *schedIndex) compact(seq uint64) {
+	for dseq := range si.due {
+		if dseq < seq {
+			delete(si.due, dseq)
+		}
+	}
+	si.order.compact(seq)
+}
+
+// Returns the number of held messages and the next time one is due, or 0 if none.
+func (si *schedIndex) state() (uint64, int64) {
+	return uint64(len(si.due)), si.order.next()
+}
+
+// Returns the sequences for held messages that are due by now. These are
+// only returned once, but are still held until removed.
+func (si *schedIndex) expired(now int64) []uint64 {
+	return si.order.expired(now)
+}
+
+// Queues all held messages again, so the ones that are due will be returned again.
+func (si *schedIndex) reset() {
+	si.order = ttlIndex{}
+	for seq, due := range si.due {
+		si.order.add(seq, due)
+	}
+}
+
 // RetentionPolicy determines how messages in a set are retained.
 type RetentionPolicy int
 
 const (
 	// LimitsPolicy (default) means that messages are retained until any given limit is reached.
-	// This could be one of MaxMsgs, MaxBytes, or MaxAge.
+	// This could be one of MaxMsgs, MaxBytes, MaxAge or MaxMsgsPer.
 	LimitsPolicy RetentionPolicy = iota
 	// InterestPolicy specifies that when all known observables have acknowledged a message it can be removed.
 	InterestPolicy
@@ -102,6 +384,16 @@ type StreamState struct {
 	LastSeq   uint64    `json:"last_seq"`
 	LastTime  time.Time `json:"last_ts"`
 	Consumers int       `json:"consumer_count"`
+	// Expired is the number of messages removed since the store was loaded
+	// because their own TTL passed.
+	Expired uint64 `json:"expired,omitempty"`
+}
+
+// SubjectState is the state of the messages for a single subject.
+type SubjectState struct {
+	Msgs  uint64 `json:"messages"`
+	First uint64 `json:"first_seq"`
+	Last  uint64 `json:"last_seq"`
 }
 
 // SnapshotResult contains information about the snapshot.
@@ -137,6 +429,8 @@ type ConsumerState struct {
 	Pending map[uint64]int64 `json:"pending"`
 	// This is for messages that have been redelivered, so count > 1.
 	Redelivered map[uint64]uint64 `json:"redelivered"`
+	// Paused is set when the consumer has been paused.
+	Paused bool `json:"paused,omitempty"`
 }
 
 // TemplateStore stores templates.
@@ -268,6 +562,45 @@ func (st *StorageType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	noCompressionString   = "none"
+	gzipCompressionString = "gzip"
+)
+
+func (sc StoreCompression) String() string {
+	switch sc {
+	case NoCompression:
+		return "None"
+	case GzipCompression:
+		return "Gzip"
+	default:
+		return "Unknown Compression"
+	}
+}
+
+func (sc StoreCompression) MarshalJSON() ([]byte, error) {
+	switch sc {
+	case NoCompression:
+		return json.Marshal(noCompressionString)
+	case GzipCompression:
+		return json.Marshal(gzipCompressionString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", sc)
+	}
+}
+
+func (sc *StoreCompression) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(string(data)) {
+	case jsonString(noCompressionString):
+		*sc = NoCompression
+	case jsonString(gzipCompressionString):
+		*sc = GzipCompression
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	ackNonePolicyString     = "none"
 	ackAllPolicyString      = "all"
@@ -26,7 +26,9 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,20 +38,58 @@ import (
 // StreamConfig will determine the name, subjects and retention policy
 // for a given stream. If subjects is empty the name will be used.
 type StreamConfig struct {
-	Name         string          `json:"name"`
-	Subjects     []string        `json:"subjects,omitempty"`
-	Retention    RetentionPolicy `json:"retention"`
-	MaxConsumers int             `json:"max_consumers"`
-	MaxMsgs      int64           `json:"max_msgs"`
-	MaxBytes     int64           `json:"max_bytes"`
-	Discard      DiscardPolicy   `json:"discard"`
-	MaxAge       time.Duration   `json:"max_age"`
-	MaxMsgSize   int32           `json:"max_msg_size,omitempty"`
-	Storage      StorageType     `json:"storage"`
-	Replicas     int             `json:"num_replicas"`
-	NoAck        bool            `json:"no_ack,omitempty"`
-	Template     string          `json:"template_owner,omitempty"`
-	Duplicates   time.Duration   `json:"duplicate_window,omitempty"`
+	Name              string           `json:"name"`
+	Subjects          []string         `json:"subjects,omitempty"`
+	Retention         RetentionPolicy  `json:"retention"`
+	MaxConsumers      int              `json:"max_consumers"`
+	MaxMsgs           int64            `json:"max_msgs"`
+	MaxMsgsPer        int64            `json:"max_msgs_per_subject"`
+	MaxBytes          int64            `json:"max_bytes"`
+	Discard           DiscardPolicy    `json:"discard"`
+	MaxAge            time.Duration    `json:"max_age"`
+	MaxMsgSize        int32            `json:"max_msg_size,omitempty"`
+	Storage           StorageType      `json:"storage"`
+	Replicas          int              `json:"num_replicas"`
+	NoAck             bool             `json:"no_ack,omitempty"`
+	Template          string           `json:"template_owner,omitempty"`
+	Duplicates        time.Duration    `json:"duplicate_window,omitempty"`
+	Compression       StoreCompression `json:"compression,omitempty"`
+	Mirror            *StreamSource    `json:"mirror,omitempty"`
+	Sources           []*StreamSource  `json:"sources,omitempty"`
+	RePublish         *RePublish       `json:"republish,omitempty"`
+	AllowMsgTTL       bool             `json:"allow_msg_ttl,omitempty"`
+	Sealed            bool             `json:"sealed,omitempty"`
+	DenyDelete        bool             `json:"deny_delete,omitempty"`
+	DenyPurge         bool             `json:"deny_purge,omitempty"`
+	AllowRollup       bool             `json:"allow_rollup,omitempty"`
+	AllowMsgSchedules bool             `json:"allow_msg_schedules,omitempty"`
+}
+
+// RePublish is for republishing messages once committed to a stream. The source
+// filter defaults to all subjects and the destination is a subject transform of it.
+// HeadersOnly will send the headers and the message size but not the payload.
+type RePublish struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
+}
+
+// StreamSource dictates how to create a stream that mirrors another stream,
+// or that sources messages from other streams.
+type StreamSource struct {
+	Name          string          `json:"name"`
+	OptStartSeq   uint64          `json:"opt_start_seq,omitempty"`
+	OptStartTime  *time.Time      `json:"opt_start_time,omitempty"`
+	FilterSubject string          `json:"filter_subject,omitempty"`
+	External      *ExternalStream `json:"external,omitempty"`
+}
+
+// ExternalStream allows you to qualify access to a stream source in another account.
+// The API prefix is where we send our requests and the deliver prefix where the messages
+// are delivered, both need to be imported from the other account.
+type ExternalStream struct {
+	ApiPrefix     string `json:"api"`
+	DeliverPrefix string `json:"deliver"`
 }
 
 // PubAck is the detail you get back from a publish to a stream that was successful.
@@ -62,9 +102,20 @@ type PubAck struct {
 
 // StreamInfo shows config and current state for this stream.
 type StreamInfo struct {
-	Config  StreamConfig `json:"config"`
-	Created time.Time    `json:"created"`
-	State   StreamState  `json:"state"`
+	Config    StreamConfig        `json:"config"`
+	Created   time.Time           `json:"created"`
+	State     StreamState         `json:"state"`
+	Mirror    *StreamSourceInfo   `json:"mirror,omitempty"`
+	Sources   []*StreamSourceInfo `json:"sources,omitempty"`
+	Scheduled uint64              `json:"scheduled_msgs,omitempty"`
+}
+
+// StreamSourceInfo shows information about an upstream stream source.
+// Active is the time since we last heard from the source, or -1 if never.
+type StreamSourceInfo struct {
+	Name   string        `json:"name"`
+	Lag    uint64        `json:"lag"`
+	Active time.Duration `json:"active"`
 }
 
 // Stream is a jetstream stream of messages. When we receive a message internally destined
@@ -86,10 +137,57 @@ type Stream struct {
 	ddarr     []*ddentry
 	ddindex   int
 	ddtmr     *time.Timer
+	node      RaftNode
+	mirror    *sourceInfo
+	sources   map[string]*sourceInfo
+	tr        *transform
+	schedTmr  *time.Timer
+
+	// pmu serializes message processing so that expected header
+	// checks and the store happen atomically. Also guards lmsgId.
+	pmu    sync.Mutex
+	lmsgId string
+
+	// omu serializes updates to object store metadata so that replacing
+	// a prior version of an object is atomic.
+	omu sync.Mutex
 }
 
-// JSPubId is used for identifying published messages and performing de-duplication.
-const JSPubId = "Msg-Id"
+const (
+	// JSPubId is used for identifying published messages and performing de-duplication.
+	JSPubId = "Msg-Id"
+	// JSExpectedStream only stores the message if the stream name matches.
+	JSExpectedStream = "Nats-Expected-Stream"
+	// JSExpectedLastSeq only stores the message if the last sequence of the stream matches.
+	JSExpectedLastSeq = "Nats-Expected-Last-Sequence"
+	// JSExpectedLastSubjSeq only stores the message if the last sequence for the subject matches.
+	JSExpectedLastSubjSeq = "Nats-Expected-Last-Subject-Sequence"
+	// JSExpectedLastMsgId only stores the message if the last message id of the stream matches.
+	JSExpectedLastMsgId = "Nats-Expected-Last-Msg-Id"
+	// JSStreamSource is set on messages from a source with the source and its sequence.
+	JSStreamSource = "Nats-Stream-Source"
+	// JSStream is set on republished messages with the name of the stream.
+	JSStream = "Nats-Stream"
+	// JSSequence is set on republished messages with the stream sequence.
+	JSSequence = "Nats-Sequence"
+	// JSMsgSize is set on headers only republished messages with the size of the payload.
+	JSMsgSize = "Nats-Msg-Size"
+	// JSMessageTTL sets a TTL for a single message, either as a duration or in seconds.
+	JSMessageTTL = "Nats-TTL"
+	// JSMsgRollup will purge all prior messages for the subject or the stream once the message is stored.
+	JSMsgRollup = "Nats-Rollup"
+	// JSScheduleAt holds the message until the given time, in RFC 3339 format.
+	JSScheduleAt = "Nats-Schedule-At"
+	// JSDelay holds the message for the given delay, either as a duration or in seconds.
+	JSDelay = "Nats-Delay"
+)
+
+// Rollup values for the JSMsgRollup header.
+const (
+	JSMsgRollupSubject = "sub"
+	JSMsgRollupAll     = "all"
+)
+
 const StreamDefaultDuplicatesWindow = 2 * time.Minute
 
 // Dedupe entry
@@ -112,6 +210,12 @@ func (a *Account) AddStream(config *StreamConfig) (*Stream, error) {
 
 // AddStreamWithStore adds a stream for the given account with custome store config options.
 func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreConfig) (*Stream, error) {
+	return a.addStream(config, fsConfig, nil)
+}
+
+// addStream will add the stream. If sa is not nil the stream is part of a
+// clustered group and will replicate through the group's node.
+func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment) (*Stream, error) {
 	s, jsa, err := a.checkForJetStream()
 	if err != nil {
 		return nil, err
@@ -155,8 +259,11 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 
 	// Setup the internal client.
 	c := s.createInternalJetStreamClient()
-	mset := &Stream{jsa: jsa, config: cfg, client: c, consumers: make(map[string]*Consumer)}
+	mset := &Stream{jsa: jsa, config: cfg, client: c, consumers: make(map[string]*Consumer), tr: cfg.rePublishTransform()}
 	mset.sg = sync.NewCond(&mset.mu)
+	if sa != nil {
+		mset.node = sa.Group.node
+	}
 
 	jsa.streams[cfg.Name] = mset
 	storeDir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
@@ -171,6 +278,9 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 		fsCfg = &FileStoreConfig{}
 	}
 	fsCfg.StoreDir = storeDir
+	if key := jsa.js.config.Key; key != _EMPTY_ {
+		fsCfg.Key, fsCfg.Cipher = []byte(key), jsa.js.config.Cipher
+	}
 	if err := mset.setupStore(fsCfg); err != nil {
 		mset.Delete()
 		return nil, err
@@ -194,9 +304,20 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 		mset.Delete()
 		return nil, err
 	}
+	// Setup our mirror or sources if we have them, and check for any held messages.
+	mset.mu.Lock()
+	err = mset.setupSources()
+	mset.resetScheduleTimer()
+	mset.mu.Unlock()
+	if err != nil {
+		mset.Delete()
+		return nil, err
+	}
 
-	// Send advisory.
-	mset.sendCreateAdvisory()
+	// Send advisory. When clustered the meta leader will send this.
+	if mset.node == nil {
+		mset.sendCreateAdvisory()
+	}
 
 	return mset, nil
 }
@@ -210,6 +331,10 @@ func (mset *Stream) rebuildDedupe() {
 	if state.Msgs == 0 {
 		return
 	}
+	// Restore the last msgId for any expected last msgId checks.
+	if _, hdr, _, _, err := mset.store.LoadMsg(state.LastSeq); err == nil && len(hdr) > 0 {
+		mset.lmsgId = getMsgId(hdr)
+	}
 	// We have some messages. Lookup starting sequence by duplicate time window.
 	sseq := mset.store.GetSeqFromTime(time.Now().Add(-mset.config.Duplicates))
 	if sseq == 0 {
@@ -343,20 +468,21 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	}
 	cfg := *config
 
-	// TODO(dlc) - check config for conflicts, e.g replicas > 1 in single server mode.
+	if cfg.Compression != NoCompression && cfg.Storage != FileStorage {
+		return StreamConfig{}, fmt.Errorf("compression is only supported for file storage")
+	}
 	if cfg.Replicas == 0 {
 		cfg.Replicas = 1
 	}
-	// TODO(dlc) - Remove when clustering happens.
-	if cfg.Replicas > 1 {
-		return StreamConfig{}, fmt.Errorf("maximum replicas is 1")
-	}
 	if cfg.Replicas > StreamMaxReplicas {
 		return cfg, fmt.Errorf("maximum replicas is %d", StreamMaxReplicas)
 	}
 	if cfg.MaxMsgs == 0 {
 		cfg.MaxMsgs = -1
 	}
+	if cfg.MaxMsgsPer == 0 {
+		cfg.MaxMsgsPer = -1
+	}
 	if cfg.MaxBytes == 0 {
 		cfg.MaxBytes = -1
 	}
@@ -380,8 +506,21 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 		return StreamConfig{}, fmt.Errorf("duplicates window can not be larger then max age")
 	}
 
+	if cfg.Mirror != nil {
+		if err := checkStreamMirrorCfg(&cfg); err != nil {
+			return StreamConfig{}, err
+		}
+	} else if len(cfg.Sources) > 0 {
+		if err := checkStreamSourcesCfg(&cfg); err != nil {
+			return StreamConfig{}, err
+		}
+	}
+
 	if len(cfg.Subjects) == 0 {
-		cfg.Subjects = append(cfg.Subjects, cfg.Name)
+		// Streams with a mirror or sources do not need subjects of their own.
+		if cfg.Mirror == nil && len(cfg.Sources) == 0 {
+			cfg.Subjects = append(cfg.Subjects, cfg.Name)
+		}
 	} else {
 		// We can allow overlaps, but don't allow direct duplicates.
 		dset := make(map[string]struct{}, len(cfg.Subjects))
@@ -397,9 +536,108 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 			dset[subj] = struct{}{}
 		}
 	}
+	if cfg.AllowRollup && cfg.DenyPurge {
+		return StreamConfig{}, fmt.Errorf("stream can not allow rollups and also deny purge")
+	}
+	if cfg.RePublish != nil {
+		if err := checkStreamRePublishCfg(&cfg); err != nil {
+			return StreamConfig{}, err
+		}
+	}
 	return cfg, nil
 }
 
+// Will check the republish source and destination, we need to make sure
+// that the destination will not be captured by the stream itself.
+func checkStreamRePublishCfg(cfg *StreamConfig) error {
+	rp := cfg.RePublish
+	if _, err := newTransform(rp.source(), rp.Destination); err != nil {
+		return fmt.Errorf("stream republish transform from %q to %q is not valid", rp.source(), rp.Destination)
+	}
+	overlap := len(cfg.Subjects) == 0
+	for _, subj := range cfg.Subjects {
+		if SubjectsCollide(rp.Destination, subj) {
+			return fmt.Errorf("stream republish destination can not overlap the stream subjects")
+		}
+		if SubjectsCollide(rp.source(), subj) {
+			overlap = true
+		}
+	}
+	if !overlap {
+		return fmt.Errorf("stream republish source must overlap the stream subjects")
+	}
+	return nil
+}
+
+// Returns the source filter for republish, which defaults to all subjects.
+func (rp *RePublish) source() string {
+	if rp.Source == _EMPTY_ {
+		return ">"
+	}
+	return rp.Source
+}
+
+// Returns the transform used to republish messages, or nil if not configured.
+func (cfg *StreamConfig) rePublishTransform() *transform {
+	if cfg.RePublish == nil {
+		return nil
+	}
+	// This has been checked already with the config.
+	tr, _ := newTransform(cfg.RePublish.source(), cfg.RePublish.Destination)
+	return tr
+}
+
+// Mirrors only receive messages from their origin, so can not have subjects or other sources.
+func checkStreamMirrorCfg(cfg *StreamConfig) error {
+	if len(cfg.Subjects) > 0 {
+		return fmt.Errorf("stream mirrors can not contain subjects")
+	}
+	if len(cfg.Sources) > 0 {
+		return fmt.Errorf("stream mirrors can not also contain other sources")
+	}
+	return checkStreamSource(cfg.Name, "mirror", cfg.Mirror)
+}
+
+// Will check each source and make sure they are unique.
+func checkStreamSourcesCfg(cfg *StreamConfig) error {
+	inames := make(map[string]struct{}, len(cfg.Sources))
+	for _, ss := range cfg.Sources {
+		if ss == nil {
+			return fmt.Errorf("stream source configuration invalid")
+		}
+		if err := checkStreamSource(cfg.Name, "source", ss); err != nil {
+			return err
+		}
+		iname := ss.indexName()
+		if _, ok := inames[iname]; ok {
+			return fmt.Errorf("duplicate stream sources detected")
+		}
+		inames[iname] = struct{}{}
+	}
+	return nil
+}
+
+func checkStreamSource(stream, kind string, ss *StreamSource) error {
+	if !isValidName(ss.Name) {
+		return fmt.Errorf("stream %s name is required and can not contain '.', '*', '>'", kind)
+	}
+	if ss.Name == stream && ss.External == nil {
+		return fmt.Errorf("stream %s can not be the stream itself", kind)
+	}
+	if ss.OptStartSeq > 0 && ss.OptStartTime != nil {
+		return fmt.Errorf("stream %s can not have both a start sequence and a start time", kind)
+	}
+	if ss.FilterSubject != _EMPTY_ && !IsValidSubject(ss.FilterSubject) {
+		return fmt.Errorf("stream %s filter subject is not valid", kind)
+	}
+	if ext := ss.External; ext != nil {
+		if !IsValidLiteralSubject(ext.ApiPrefix) || !IsValidLiteralSubject(ext.DeliverPrefix) {
+			return fmt.Errorf("stream %s external prefixes must be valid literal subjects", kind)
+		}
+	}
+	return nil
+}
+
 // Config returns the stream's configuration.
 func (mset *Stream) Config() StreamConfig {
 	mset.mu.Lock()
@@ -424,53 +662,16 @@ func (mset *Stream) Delete() error {
 
 // Update will allow certain configuration properties of an existing stream to be updated.
 func (mset *Stream) Update(config *StreamConfig) error {
-	cfg, err := checkStreamCfg(config)
-	if err != nil {
-		return err
-	}
 	o_cfg := mset.Config()
 
-	// Name must match.
-	if cfg.Name != o_cfg.Name {
-		return fmt.Errorf("stream configuration name must match original")
-	}
-	// Can't change MaxConsumers for now.
-	if cfg.MaxConsumers != o_cfg.MaxConsumers {
-		return fmt.Errorf("stream configuration update can not change MaxConsumers")
-	}
-	// Can't change storage types.
-	if cfg.Storage != o_cfg.Storage {
-		return fmt.Errorf("stream configuration update can not change storage type")
-	}
-	// Can't change retention.
-	if cfg.Retention != o_cfg.Retention {
-		return fmt.Errorf("stream configuration update can not change retention policy")
-	}
-	// Can not have a template owner for now.
-	if o_cfg.Template != "" {
-		return fmt.Errorf("stream configuration update not allowed on template owned stream")
-	}
-	if cfg.Template != "" {
-		return fmt.Errorf("stream configuration update can not be owned by a template")
-	}
-
-	// Check limits.
 	mset.mu.Lock()
 	jsa := mset.jsa
 	mset.mu.Unlock()
 
-	jsa.mu.Lock()
-	if cfg.MaxConsumers > 0 && cfg.MaxConsumers > jsa.limits.MaxConsumers {
-		jsa.mu.Unlock()
-		return fmt.Errorf("stream configuration maximum consumers exceeds account limit")
-	}
-	if cfg.MaxBytes > 0 && cfg.MaxBytes > o_cfg.MaxBytes {
-		if err := jsa.checkBytesLimits(cfg.MaxBytes*int64(cfg.Replicas), cfg.Storage); err != nil {
-			jsa.mu.Unlock()
-			return err
-		}
+	cfg, err := jsa.configUpdateCheck(&o_cfg, config)
+	if err != nil {
+		return err
 	}
-	jsa.mu.Unlock()
 
 	// Now check for subject interest differences.
 	current := make(map[string]struct{}, len(o_cfg.Subjects))
@@ -504,24 +705,121 @@ func (mset *Stream) Update(config *StreamConfig) error {
 		mset.ddtmr.Reset(time.Microsecond)
 	}
 	// Now update config and store's version of our config.
-	mset.config = cfg
-	mset.store.UpdateConfig(&cfg)
+	mset.config = *cfg
+	mset.tr = cfg.rePublishTransform()
+	mset.store.UpdateConfig(cfg)
+
+	// Let our consumers know if they need to skip held messages.
+	if cfg.AllowMsgSchedules != o_cfg.AllowMsgSchedules {
+		for _, o := range mset.consumers {
+			o.setAllowMsgSchedules(cfg.AllowMsgSchedules)
+		}
+	}
 
-	mset.sendUpdateAdvisoryLocked()
+	// When clustered the meta leader will send this.
+	if mset.node == nil {
+		mset.sendUpdateAdvisoryLocked()
+	}
 
 	return nil
 }
 
+// configUpdateCheck will check the new config against the original and the account limits.
+// Returns the new config with defaults applied.
+func (jsa *jsAccount) configUpdateCheck(o_cfg, config *StreamConfig) (*StreamConfig, error) {
+	cfg, err := checkStreamCfg(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Name must match.
+	if cfg.Name != o_cfg.Name {
+		return nil, fmt.Errorf("stream configuration name must match original")
+	}
+	// Can't change MaxConsumers for now.
+	if cfg.MaxConsumers != o_cfg.MaxConsumers {
+		return nil, fmt.Errorf("stream configuration update can not change MaxConsumers")
+	}
+	// Can't change storage types.
+	if cfg.Storage != o_cfg.Storage {
+		return nil, fmt.Errorf("stream configuration update can not change storage type")
+	}
+	// Can't change retention.
+	if cfg.Retention != o_cfg.Retention {
+		return nil, fmt.Errorf("stream configuration update can not change retention policy")
+	}
+	// Can't change the mirror or sources.
+	if !reflect.DeepEqual(cfg.Mirror, o_cfg.Mirror) {
+		return nil, fmt.Errorf("stream configuration update can not change mirror")
+	}
+	if !reflect.DeepEqual(cfg.Sources, o_cfg.Sources) {
+		return nil, fmt.Errorf("stream configuration update can not change sources")
+	}
+	// A sealed stream can not be changed at all.
+	if o_cfg.Sealed {
+		return nil, fmt.Errorf("stream configuration update not allowed on sealed stream")
+	}
+	// Protections can not be removed once set.
+	if o_cfg.DenyDelete && !cfg.DenyDelete {
+		return nil, fmt.Errorf("stream configuration update can not cancel deny message deletes")
+	}
+	if o_cfg.DenyPurge && !cfg.DenyPurge {
+		return nil, fmt.Errorf("stream configuration update can not cancel deny purge")
+	}
+	// Can not have a template owner for now.
+	if o_cfg.Template != "" {
+		return nil, fmt.Errorf("stream configuration update not allowed on template owned stream")
+	}
+	if cfg.Template != "" {
+		return nil, fmt.Errorf("stream configuration update can not be owned by a template")
+	}
+
+	// Check limits.
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	if cfg.MaxConsumers > 0 && cfg.MaxConsumers > jsa.limits.MaxConsumers {
+		return nil, fmt.Errorf("stream configuration maximum consumers exceeds account limit")
+	}
+	if cfg.MaxBytes > 0 && cfg.MaxBytes > o_cfg.MaxBytes {
+		if err := jsa.checkBytesLimits(cfg.MaxBytes*int64(cfg.Replicas), cfg.Storage); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
 // Purge will remove all messages from the stream and underlying store.
 func (mset *Stream) Purge() uint64 {
+	purged, _ := mset.purge(nil)
+	return purged
+}
+
+// PurgeEx will remove the messages matching the subject filter, below seq if set,
+// keeping the last keep matching messages if set.
+func (mset *Stream) PurgeEx(subject string, seq, keep uint64) (uint64, error) {
+	return mset.purge(&JSApiStreamPurgeRequest{Subject: subject, Sequence: seq, Keep: keep})
+}
+
+// Will purge based on the request, a nil request purges all messages.
+// Our consumers will be moved past any messages below the new first sequence.
+func (mset *Stream) purge(preq *JSApiStreamPurgeRequest) (uint64, error) {
 	mset.mu.Lock()
 	if mset.client == nil {
 		mset.mu.Unlock()
-		return 0
+		return 0, nil
+	}
+	var (
+		purged uint64
+		err    error
+	)
+	if preq == nil || preq.isPurgeAll() {
+		purged = mset.store.Purge()
+		// Purge dedupe.
+		mset.ddmap = nil
+	} else if purged, err = mset.store.PurgeEx(preq.Subject, preq.Sequence, preq.Keep); err != nil {
+		mset.mu.Unlock()
+		return 0, err
 	}
-	purged := mset.store.Purge()
-	// Purge dedupe.
-	mset.ddmap = nil
 	stats := mset.store.State()
 	var obs []*Consumer
 	for _, o := range mset.consumers {
@@ -531,7 +829,7 @@ func (mset *Stream) Purge() uint64 {
 	for _, o := range obs {
 		o.purge(stats.FirstSeq)
 	}
-	return purged
+	return purged, nil
 }
 
 // RemoveMsg will remove a message from a stream.
@@ -727,9 +1025,19 @@ func (mset *Stream) storeMsgId(dde *ddentry) {
 // Will return the value for the header denoted by key or nil if it does not exists.
 // This function ignores errors and tries to achieve speed and no additional allocations.
 func getHdrVal(key string, hdr []byte) []byte {
-	index := bytes.Index(hdr, []byte(key))
-	if index < 0 {
-		return nil
+	var index int
+	for start := 0; ; start = index + len(key) {
+		i := bytes.Index(hdr[start:], []byte(key))
+		if i < 0 {
+			return nil
+		}
+		index = start + i
+		// Make sure we matched a whole key and not the tail of a longer one, e.g. Msg-Id
+		// inside of Nats-Expected-Last-Msg-Id.
+		end := index + len(key)
+		if (index == 0 || hdr[index-1] == '\n') && end < len(hdr) && hdr[end] == ':' {
+			break
+		}
 	}
 	var value []byte
 	for i := index + len(key) + 2; i > 0 && i < len(hdr); i++ {
@@ -746,135 +1054,1101 @@ func getMsgId(hdr []byte) string {
 	return string(getHdrVal(JSPubId, hdr))
 }
 
-// processInboundJetStreamMsg handles processing messages bound for a stream.
-func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subject, reply string, msg []byte) {
-	mset.mu.Lock()
-	store := mset.store
-	c := mset.client
-	var accName string
-	if c != nil && c.acc != nil {
-		accName = c.acc.Name
-	}
-	doAck := !mset.config.NoAck
-	pubAck := mset.pubAck
-	jsa := mset.jsa
-	stype := mset.config.Storage
-	name := mset.config.Name
-	maxMsgSize := int(mset.config.MaxMsgSize)
-	numConsumers := len(mset.consumers)
-	interestRetention := mset.config.Retention == InterestPolicy
-
-	// Process msgId if we have headers.
-	var msgId string
-	if pc != nil && pc.pa.hdr > 0 {
-		msgId = getMsgId(msg[:pc.pa.hdr])
-		if dde := mset.checkMsgId(msgId); dde != nil {
-			if doAck && len(reply) > 0 {
-				response := append(pubAck, strconv.FormatUint(dde.seq, 10)...)
-				response = append(response, ", \"duplicate\": true}"...)
-				mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
-			}
-			mset.mu.Unlock()
-			return
-		}
+// Lookup of the stream source header, returns the source and its sequence.
+func getStreamSource(hdr []byte) (string, uint64) {
+	val := getHdrVal(JSStreamSource, hdr)
+	i := bytes.LastIndexByte(val, ' ')
+	if i <= 0 {
+		return _EMPTY_, 0
 	}
-	mset.mu.Unlock()
-
-	if c == nil {
-		return
+	seq := parseInt64(val[i+1:])
+	if seq <= 0 {
+		return _EMPTY_, 0
 	}
+	return string(val[:i]), uint64(seq)
+}
 
-	// Response Ack.
-	var (
-		response []byte
-		seq      uint64
-		err      error
-		ts       int64
-	)
-
-	// Header support.
-	var hdr []byte
+const hdrLine = "NATS/1.0\r\n"
 
-	// Check to see if we are over the max msg size.
-	if maxMsgSize >= 0 && len(msg) > maxMsgSize {
-		response = []byte("-ERR 'message size exceeds maximum allowed'")
-		if doAck && len(reply) > 0 {
-			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
-		}
-		return
+// Will set the header key to value, replacing any existing value
+// and creating the header if needed.
+func setHeader(key, value string, hdr []byte) []byte {
+	if len(hdr) == 0 {
+		return []byte(fmt.Sprintf("%s%s: %s\r\n\r\n", hdrLine, key, value))
 	}
+	hdr = removeHeader(key, hdr)
+	// Add before the trailing CRLF, always on a copy.
+	nhdr := make([]byte, 0, len(hdr)+len(key)+len(value)+4)
+	nhdr = append(nhdr, hdr[:len(hdr)-2]...)
+	return append(nhdr, fmt.Sprintf("%s: %s\r\n\r\n", key, value)...)
+}
 
-	// If we are interest based retention and have no consumers then skip.
-	if interestRetention && numConsumers == 0 {
-		seq = store.SkipMsg()
-		if doAck && len(reply) > 0 {
-			response = append(pubAck, strconv.FormatUint(seq, 10)...)
-			response = append(response, '}')
-			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
-		}
-		// If we have a msgId make sure to save.
-		if msgId != "" {
-			mset.storeMsgId(&ddentry{msgId, seq, time.Now().UnixNano()})
-		}
-		return
+// Will remove the header line for key if present, returning a copy if so.
+func removeHeader(key string, hdr []byte) []byte {
+	start := bytes.Index(hdr, []byte("\r\n"+key+":"))
+	if start < 0 {
+		return hdr
+	}
+	start += 2
+	end := bytes.Index(hdr[start:], []byte("\r\n"))
+	if end < 0 {
+		return hdr
 	}
+	return append(hdr[:start:start], hdr[start+end+2:]...)
+}
 
-	// If here we will attempt to store the message.
-	// Headers.
-	if pc != nil && pc.pa.hdr > 0 {
-		hdr = msg[:pc.pa.hdr]
-		msg = msg[pc.pa.hdr:]
+// Lookup of the per message TTL. Returns 0 if not present.
+// The TTL can be a duration, e.g. 1m30s, or a number of seconds.
+func getMessageTTL(hdr []byte) (time.Duration, error) {
+	val := getHdrVal(JSMessageTTL, hdr)
+	if len(val) == 0 {
+		return 0, nil
 	}
-	seq, ts, err = store.StoreMsg(subject, hdr, msg)
+	ttl, err := time.ParseDuration(string(val))
 	if err != nil {
-		if err != ErrStoreClosed {
-			c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
-		}
-		response = []byte(fmt.Sprintf("-ERR '%v'", err))
-	} else if jsa.limitsExceeded(stype) {
-		c.Warnf("JetStream resource limits exceeded for account: %q", accName)
-		response = []byte("-ERR 'resource limits exceeded for account'")
-		store.RemoveMsg(seq)
-		seq = 0
-	} else {
-		if doAck && len(reply) > 0 {
-			response = append(pubAck, strconv.FormatUint(seq, 10)...)
-			response = append(response, '}')
-		}
-		// If we have a msgId make sure to save.
-		if msgId != "" {
-			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		secs := parseInt64(val)
+		if secs <= 0 {
+			return 0, fmt.Errorf("invalid per message TTL")
 		}
+		ttl = time.Duration(secs) * time.Second
 	}
-
-	// Send response here.
-	if doAck && len(reply) > 0 {
-		mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid per message TTL")
 	}
+	return ttl, nil
+}
 
-	if err == nil && seq > 0 && numConsumers > 0 {
-		var needSignal bool
-		mset.mu.Lock()
-		for _, o := range mset.consumers {
-			if !o.deliverCurrentMsg(subject, hdr, msg, seq, ts) {
-				needSignal = true
+// Returns true if the message has a schedule and would be held until due.
+func isScheduledMsg(hdr []byte) bool {
+	return len(hdr) > 0 && (len(getHdrVal(JSScheduleAt, hdr)) > 0 || len(getHdrVal(JSDelay, hdr)) > 0)
+}
+
+// Lookup of the schedule for a message stored at ts. Returns when the message
+// is due in nanoseconds, or 0 if the message does not have a schedule.
+func getMessageSchedule(hdr []byte, ts int64) (int64, error) {
+	at, delay := getHdrVal(JSScheduleAt, hdr), getHdrVal(JSDelay, hdr)
+	switch {
+	case len(at) > 0 && len(delay) > 0:
+		return 0, fmt.Errorf("message schedule can not have both a time and a delay")
+	case len(at) > 0:
+		t, err := time.Parse(time.RFC3339Nano, string(at))
+		if err != nil {
+			return 0, fmt.Errorf("invalid message schedule time")
+		}
+		return t.UnixNano(), nil
+	case len(delay) > 0:
+		d, err := time.ParseDuration(string(delay))
+		if err != nil {
+			secs := parseInt64(delay)
+			if secs < 0 {
+				return 0, fmt.Errorf("invalid message schedule delay")
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("invalid message schedule delay")
+		}
+		return ts + int64(d), nil
+	}
+	return 0, nil
+}
+
+// Will remove the schedule from a message that is due, along with any headers
+// that were already processed when the message was held.
+func removeScheduleHeaders(hdr []byte) []byte {
+	for _, key := range []string{JSScheduleAt, JSDelay, JSPubId, JSExpectedStream, JSExpectedLastSeq, JSExpectedLastSubjSeq, JSExpectedLastMsgId} {
+		hdr = removeHeader(key, hdr)
+	}
+	if len(hdr) <= len(hdrLine)+2 {
+		return nil
+	}
+	return hdr
+}
+
+// Fast lookup of the rollup header.
+func getRollup(hdr []byte) string {
+	return string(getHdrVal(JSMsgRollup, hdr))
+}
+
+// Fast lookup of expected stream.
+func getExpectedStream(hdr []byte) string {
+	return string(getHdrVal(JSExpectedStream, hdr))
+}
+
+// Fast lookup of expected last msgId.
+func getExpectedLastMsgId(hdr []byte) string {
+	return string(getHdrVal(JSExpectedLastMsgId, hdr))
+}
+
+// Lookup of an expected sequence header. Will return -1 if not present
+// and an error if present but not a valid sequence.
+func getExpectedSeq(key string, hdr []byte) (int64, error) {
+	val := getHdrVal(key, hdr)
+	if val == nil {
+		return -1, nil
+	}
+	seq := parseInt64(val)
+	if seq < 0 {
+		return -1, fmt.Errorf("invalid %s header", key)
+	}
+	return seq, nil
+}
+
+// Will check the message schedule if present, which needs to be allowed by the stream.
+// Lock should be held.
+func (mset *Stream) checkMsgSchedule(hdr []byte) error {
+	if !isScheduledMsg(hdr) {
+		return nil
+	}
+	if !mset.config.AllowMsgSchedules {
+		return fmt.Errorf("message schedules not permitted for stream")
+	}
+	_, err := getMessageSchedule(hdr, time.Now().UnixNano())
+	return err
+}
+
+// Will check the rollup header if present, which needs to be allowed by the stream.
+// Lock should be held.
+func (mset *Stream) checkRollup(hdr []byte) error {
+	switch rollup := getRollup(hdr); rollup {
+	case _EMPTY_:
+		return nil
+	case JSMsgRollupSubject, JSMsgRollupAll:
+		if !mset.config.AllowRollup {
+			return fmt.Errorf("rollup not permitted for stream")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid rollup value %q", rollup)
+	}
+}
+
+// Will check the per message TTL if present, which needs to be allowed by the stream.
+// Lock should be held.
+func (mset *Stream) checkMsgTTL(hdr []byte) error {
+	ttl, err := getMessageTTL(hdr)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 && !mset.config.AllowMsgTTL {
+		return fmt.Errorf("per message TTL not allowed for stream")
+	}
+	return nil
+}
+
+// checkExpectedHeaders will make sure any expectations set by the publisher
+// in the headers match our current state, returning an error if not.
+// Lock should be held.
+func (mset *Stream) checkExpectedHeaders(subject string, hdr []byte) error {
+	if sname := getExpectedStream(hdr); sname != _EMPTY_ && sname != mset.config.Name {
+		return fmt.Errorf("expected stream does not match")
+	}
+	if lmsgId := getExpectedLastMsgId(hdr); lmsgId != _EMPTY_ && lmsgId != mset.lmsgId {
+		return fmt.Errorf("wrong last msg id: %s", mset.lmsgId)
+	}
+	seq, err := getExpectedSeq(JSExpectedLastSeq, hdr)
+	if err != nil {
+		return err
+	}
+	if seq >= 0 {
+		if lseq := mset.store.State().LastSeq; uint64(seq) != lseq {
+			return fmt.Errorf("wrong last sequence: %d", lseq)
+		}
+	}
+	if seq, err = getExpectedSeq(JSExpectedLastSubjSeq, hdr); err != nil {
+		return err
+	}
+	if seq >= 0 {
+		lseq, lhdr, _, _, err := mset.store.LoadLastMsg(subject)
+		if err != nil && err != ErrStoreMsgNotFound {
+			return err
+		}
+		// For key/value buckets a deleted key can be created again.
+		if seq == 0 && kvIsDeleted(lhdr) && kvBucket(&mset.config) != _EMPTY_ {
+			lseq = 0
+		}
+		if uint64(seq) != lseq {
+			return fmt.Errorf("wrong last sequence for subject: %d", lseq)
+		}
+	}
+	return nil
+}
+
+// processInboundJetStreamMsg handles processing messages bound for a stream.
+func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subject, reply string, msg []byte) {
+	// Split off any headers.
+	var hdr []byte
+	if pc != nil && pc.pa.hdr > 0 {
+		hdr, msg = msg[:pc.pa.hdr], msg[pc.pa.hdr:]
+	}
+	// Only we set the stream source header when storing messages from our sources,
+	// so we do not trust it from publishers.
+	if len(hdr) > 0 && len(getHdrVal(JSStreamSource, hdr)) > 0 {
+		hdr = removeHeader(JSStreamSource, hdr)
+	}
+
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+
+	// If we are clustered the leader will propose the message to the group and
+	// it will be stored once committed. Followers receive it through the group.
+	if node != nil {
+		if !node.Leader() {
+			return
+		}
+		if err := node.Propose(encodeStreamMsg(subject, reply, hdr, msg)); err != nil {
+			mset.mu.RLock()
+			doAck, sendq := !mset.config.NoAck, mset.sendq
+			mset.mu.RUnlock()
+			if doAck && len(reply) > 0 && sendq != nil {
+				response := []byte(fmt.Sprintf("-ERR '%v'", err))
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+			}
+		}
+		return
+	}
+
+	mset.processJetStreamMsg(subject, reply, hdr, msg)
+}
+
+// Will store a message that did not come from a publisher, e.g. a dead letter from
+// a consumer of another stream. If we are clustered the message is proposed to our
+// group, which needs us to be the leader.
+func (mset *Stream) storeDirect(subject string, hdr, msg []byte) error {
+	mset.mu.RLock()
+	node := mset.node
+	mset.mu.RUnlock()
+
+	if node != nil {
+		return node.Propose(encodeStreamMsg(subject, _EMPTY_, hdr, msg))
+	}
+	return mset.processJetStreamMsg(subject, _EMPTY_, hdr, msg)
+}
+
+// processJetStreamMsg will store the message and send the PubAck if needed.
+// When clustered this is called once the message has been committed by the group.
+// Will return an error if the message could not be stored.
+func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte) error {
+	mset.pmu.Lock()
+	defer mset.pmu.Unlock()
+
+	mset.mu.Lock()
+	store := mset.store
+	c := mset.client
+	var accName string
+	if c != nil && c.acc != nil {
+		accName = c.acc.Name
+	}
+	doAck := !mset.config.NoAck
+	pubAck := mset.pubAck
+	jsa := mset.jsa
+	stype := mset.config.Storage
+	name := mset.config.Name
+	isKV := kvBucket(&mset.config) != _EMPTY_
+	allowRollup := mset.config.AllowRollup
+	allowSchedules := mset.config.AllowMsgSchedules
+	hasSources := len(mset.sources) > 0
+	maxMsgSize := int(mset.config.MaxMsgSize)
+	numConsumers := len(mset.consumers)
+	interestRetention := mset.config.Retention == InterestPolicy
+	// Only the leader responds when we are clustered.
+	if mset.node != nil && !mset.node.Leader() {
+		doAck = false
+	}
+
+	// A sealed stream does not accept any new messages.
+	if mset.config.Sealed {
+		err := fmt.Errorf("stream is sealed")
+		if doAck && len(reply) > 0 {
+			response := []byte(fmt.Sprintf("-ERR '%v'", err))
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		mset.mu.Unlock()
+		return err
+	}
+
+	// Process msgId if we have headers.
+	var msgId string
+	if len(hdr) > 0 {
+		msgId = getMsgId(hdr)
+		if dde := mset.checkMsgId(msgId); dde != nil {
+			if doAck && len(reply) > 0 {
+				response := append(pubAck, strconv.FormatUint(dde.seq, 10)...)
+				response = append(response, ", \"duplicate\": true}"...)
+				mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+			}
+			mset.mu.Unlock()
+			return nil
+		}
+		// Messages from our sources can be redelivered when we recreate the consumer,
+		// and when clustered these may be proposed before the prior ones were applied.
+		if hasSources {
+			if iname, sseq := getStreamSource(hdr); iname != _EMPTY_ {
+				if si := mset.sources[iname]; si != nil && sseq <= si.sseq {
+					mset.mu.Unlock()
+					return nil
+				}
+			}
+		}
+		// Check any expectations the publisher may have set and the per message TTL.
+		// These do not apply to messages we received from our sources.
+		if !hasSources || len(getHdrVal(JSStreamSource, hdr)) == 0 {
+			err := mset.checkExpectedHeaders(subject, hdr)
+			if err == nil {
+				err = mset.checkMsgTTL(hdr)
+			}
+			if err == nil {
+				err = mset.checkRollup(hdr)
+			}
+			if err == nil {
+				err = mset.checkMsgSchedule(hdr)
+			}
+			if err != nil {
+				if doAck && len(reply) > 0 {
+					response := []byte(fmt.Sprintf("-ERR '%v'", err))
+					mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+				}
+				mset.mu.Unlock()
+				return err
+			}
+		}
+	}
+	mset.mu.Unlock()
+
+	if c == nil {
+		return ErrStoreClosed
+	}
+
+	// Response Ack.
+	var (
+		response []byte
+		seq      uint64
+		err      error
+		ts       int64
+		held     bool
+	)
+
+	// Check to see if we are over the max msg size.
+	if maxMsgSize >= 0 && len(hdr)+len(msg) > maxMsgSize {
+		err = fmt.Errorf("message size exceeds maximum allowed")
+		response = []byte(fmt.Sprintf("-ERR '%v'", err))
+		if doAck && len(reply) > 0 {
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		return err
+	}
+
+	// If we are interest based retention and have no consumers then skip.
+	if interestRetention && numConsumers == 0 {
+		seq = store.SkipMsg()
+		mset.lmsgId = msgId
+		if doAck && len(reply) > 0 {
+			response = append(pubAck, strconv.FormatUint(seq, 10)...)
+			response = append(response, '}')
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+		}
+		// If we have a msgId make sure to save.
+		if msgId != "" {
+			mset.storeMsgId(&ddentry{msgId, seq, time.Now().UnixNano()})
+		}
+		return nil
+	}
+
+	// If here we will attempt to store the message.
+	seq, ts, err = store.StoreMsg(subject, hdr, msg)
+	if err != nil {
+		if err != ErrStoreClosed {
+			c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
+		}
+		response = []byte(fmt.Sprintf("-ERR '%v'", err))
+	} else if jsa.limitsExceeded(stype) {
+		c.Warnf("JetStream resource limits exceeded for account: %q", accName)
+		err = fmt.Errorf("resource limits exceeded for account")
+		response = []byte(fmt.Sprintf("-ERR '%v'", err))
+		store.RemoveMsg(seq)
+		seq = 0
+	} else {
+		mset.lmsgId = msgId
+		// Track our progress for our sources.
+		if len(hdr) > 0 && hasSources {
+			mset.mu.Lock()
+			mset.updateSourceSeq(hdr)
+			mset.mu.Unlock()
+		}
+		// Held messages only take effect once they are due.
+		if held = allowSchedules && isScheduledMsg(hdr); held {
+			mset.mu.Lock()
+			mset.resetScheduleTimer()
+			mset.mu.Unlock()
+		}
+		// A purge marker for a key/value bucket removes the prior revisions.
+		if len(hdr) > 0 && getKVOperation(hdr) == KVOperationPurge && isKV && !held {
+			mset.purgeKVKey(subject, seq)
+		}
+		// A rollup replaces all prior messages for the subject or the stream.
+		if len(hdr) > 0 && allowRollup && !held {
+			switch getRollup(hdr) {
+			case JSMsgRollupSubject:
+				mset.purge(&JSApiStreamPurgeRequest{Subject: subject, Sequence: seq})
+			case JSMsgRollupAll:
+				mset.purge(&JSApiStreamPurgeRequest{Sequence: seq})
+			}
+		}
+		if doAck && len(reply) > 0 {
+			response = append(pubAck, strconv.FormatUint(seq, 10)...)
+			response = append(response, '}')
+		}
+		// If we have a msgId make sure to save.
+		if msgId != "" {
+			mset.storeMsgId(&ddentry{msgId, seq, ts})
+		}
+	}
+
+	// Send response here.
+	if doAck && len(reply) > 0 {
+		mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+	}
+
+	if err == nil && seq > 0 && !held {
+		mset.republish(subject, hdr, msg, seq)
+		if numConsumers > 0 {
+			mset.notifyConsumers(subject, hdr, msg, seq, ts)
+		}
+	}
+
+	return err
+}
+
+// Will republish a newly stored message if the subject matches our republish
+// source. When clustered only the leader will republish.
+func (mset *Stream) republish(subject string, hdr, msg []byte, seq uint64) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	tr := mset.tr
+	if tr == nil || (mset.node != nil && !mset.node.Leader()) {
+		return
+	}
+	dsubj, err := tr.match(subject)
+	if err != nil {
+		return
+	}
+	hdr = setHeader(JSStream, mset.config.Name, hdr)
+	hdr = setHeader(JSSequence, strconv.FormatUint(seq, 10), hdr)
+	if mset.config.RePublish.HeadersOnly {
+		hdr = setHeader(JSMsgSize, strconv.Itoa(len(msg)), hdr)
+		msg = nil
+	}
+	mset.sendq <- &jsPubMsg{dsubj, dsubj, _EMPTY_, hdr, msg, nil, 0}
+}
+
+// Will let our consumers know about a newly stored message.
+func (mset *Stream) notifyConsumers(subject string, hdr, msg []byte, seq uint64, ts int64) {
+	var needSignal bool
+	mset.mu.Lock()
+	for _, o := range mset.consumers {
+		if !o.deliverCurrentMsg(subject, hdr, msg, seq, ts) {
+			needSignal = true
+		}
+	}
+	mset.mu.Unlock()
+
+	if needSignal {
+		mset.signalConsumers()
+	}
+}
+
+// Will signal all waiting consumers.
+func (mset *Stream) signalConsumers() {
+	mset.mu.Lock()
+	if mset.sgw > 0 {
+		mset.sg.Broadcast()
+	}
+	mset.mu.Unlock()
+}
+
+// Will reset the timer for our held messages to fire when the next one is due.
+// Lock should be held.
+func (mset *Stream) resetScheduleTimer() {
+	if mset.store == nil || mset.client == nil {
+		return
+	}
+	_, next := mset.store.ScheduledState()
+	if next == 0 {
+		if mset.schedTmr != nil {
+			mset.schedTmr.Stop()
+			mset.schedTmr = nil
+		}
+		return
+	}
+	fireIn := time.Duration(next - time.Now().UnixNano())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	if mset.schedTmr != nil {
+		mset.schedTmr.Reset(fireIn)
+	} else {
+		mset.schedTmr = time.AfterFunc(fireIn, mset.processSchedules)
+	}
+}
+
+// Will make held messages that are due visible. Each one is only handled once,
+// so a message that could not be stored again stays held. When clustered only
+// the leader will do this, through the group so all replicas do the same.
+func (mset *Stream) processSchedules() {
+	mset.mu.Lock()
+	store, node, c := mset.store, mset.node, mset.client
+	if c == nil || store == nil || (node != nil && !node.Leader()) {
+		mset.mu.Unlock()
+		return
+	}
+	mset.mu.Unlock()
+
+	for _, seq := range store.DueMsgs(time.Now().UnixNano()) {
+		if node == nil {
+			mset.processScheduledMsg(seq)
+		} else {
+			mset.propose(scheduleMsgOp, &streamMsgScheduleOp{Seq: seq})
+		}
+	}
+
+	mset.mu.Lock()
+	mset.resetScheduleTimer()
+	mset.mu.Unlock()
+}
+
+// Will have all held messages that are due handled again, e.g. when we became the
+// leader and proposals from the old leader may not have made it.
+func (mset *Stream) resetSchedules() {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if mset.store == nil {
+		return
+	}
+	mset.store.ResetDueMsgs()
+	mset.resetScheduleTimer()
+}
+
+// Will store the held message at seq again without its schedule and remove the held
+// message. If the message is no longer held, e.g. this was already done, this is a no-op.
+func (mset *Stream) processScheduledMsg(seq uint64) error {
+	mset.mu.RLock()
+	store, c := mset.store, mset.client
+	mset.mu.RUnlock()
+	if c == nil || store == nil {
+		return ErrStoreClosed
+	}
+	subj, hdr, msg, _, err := store.LoadMsg(seq)
+	if err != nil || !isScheduledMsg(hdr) {
+		return nil
+	}
+	// The due copy is our own message, even if the held one came from a source.
+	hdr = removeHeader(JSStreamSource, removeScheduleHeaders(hdr))
+	// Store the due copy before we remove the held message so it is never lost.
+	if err := mset.processJetStreamMsg(subj, _EMPTY_, hdr, msg); err != nil {
+		c.Warnf("JetStream failed to store a scheduled msg on account: %q stream: %q -  %v", c.acc.Name, mset.Name(), err)
+		return err
+	}
+	store.RemoveMsg(seq)
+	return nil
+}
+
+const (
+	// Default prefixes used to reach a stream source in our own account.
+	jsDefaultApiPrefix     = "$JS.API"
+	jsDefaultDeliverPrefix = "$JS.M"
+)
+
+// How often we check on the consumers for our mirror or sources and update the lag,
+// how soon we retry when we could not create a consumer, and how often the origin
+// sends heartbeats so we notice a consumer that stopped delivering.
+var (
+	sourceHealthCheckInterval = 5 * time.Second
+	sourceRetryInterval       = time.Second
+	sourceHeartbeatInterval   = time.Second
+)
+
+// sourceInfo tracks the internal consumer we use to receive messages from
+// our mirror or a source, and what we know about the origin's state.
+type sourceInfo struct {
+	iname    string
+	cfg      *StreamSource
+	isMirror bool
+	cname    string
+	sub      *subscription
+	rsubj    string
+	sseq     uint64
+	dseq     uint64
+	olast    uint64
+	ocreated time.Time
+	last     time.Time
+	tmr      *time.Timer
+}
+
+// Name used to index a source. Sources from other accounts include the API prefix.
+func (ss *StreamSource) indexName() string {
+	if ss.External != nil {
+		return ss.Name + ":" + ss.External.ApiPrefix
+	}
+	return ss.Name
+}
+
+// Returns the API and deliver prefixes for the source.
+func (ss *StreamSource) prefixes() (string, string) {
+	if ext := ss.External; ext != nil {
+		return ext.ApiPrefix, ext.DeliverPrefix
+	}
+	return jsDefaultApiPrefix, jsDefaultDeliverPrefix
+}
+
+// Will setup our mirror or sources. The internal consumers on the origins
+// are created by the health checks, which will also recreate them as needed.
+// Lock should be held.
+func (mset *Stream) setupSources() error {
+	if mirror := mset.config.Mirror; mirror != nil {
+		si, err := mset.newSourceInfo(mirror, true)
+		if err != nil {
+			return err
+		}
+		si.sseq = mset.store.State().LastSeq
+		mset.mirror = si
+		return nil
+	}
+	if len(mset.config.Sources) == 0 {
+		return nil
+	}
+	mset.sources = make(map[string]*sourceInfo, len(mset.config.Sources))
+	for _, ss := range mset.config.Sources {
+		si, err := mset.newSourceInfo(ss, false)
+		if err != nil {
+			return err
+		}
+		mset.sources[si.iname] = si
+	}
+	mset.recoverSourceSeqs()
+	return nil
+}
+
+// Lock should be held.
+func (mset *Stream) newSourceInfo(ss *StreamSource, isMirror bool) (*sourceInfo, error) {
+	si := &sourceInfo{iname: ss.indexName(), cfg: ss, isMirror: isMirror}
+	si.rsubj = fmt.Sprintf("%s.R.%s", jsDefaultDeliverPrefix, nuid.Next())
+	_, err := mset.subscribeInternal(si.rsubj, func(_ *subscription, _ *client, _, _ string, msg []byte) {
+		mset.processSourceResponse(si, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	si.tmr = time.AfterFunc(0, func() { mset.checkSource(si) })
+	return si, nil
+}
+
+// Will scan our messages backwards for the last sequence we stored from each
+// source, which we keep in the stream source header of the message.
+// Lock should be held.
+func (mset *Stream) recoverSourceSeqs() {
+	found := make(map[string]struct{}, len(mset.sources))
+	state := mset.store.State()
+	for seq := state.LastSeq; seq >= state.FirstSeq && seq > 0 && len(found) < len(mset.sources); seq-- {
+		_, hdr, _, _, err := mset.store.LoadMsg(seq)
+		if err != nil || len(hdr) == 0 {
+			continue
+		}
+		iname, sseq := getStreamSource(hdr)
+		if si := mset.sources[iname]; si != nil {
+			if _, ok := found[iname]; !ok {
+				si.sseq, si.olast = sseq, sseq
+				found[iname] = struct{}{}
 			}
 		}
+	}
+}
+
+// Will update our progress for a source once a message from it has been stored.
+// Lock should be held.
+func (mset *Stream) updateSourceSeq(hdr []byte) {
+	iname, sseq := getStreamSource(hdr)
+	if si := mset.sources[iname]; si != nil && sseq > si.sseq {
+		si.sseq = sseq
+	}
+}
+
+// Lock should be held.
+func (mset *Stream) isActiveSource(si *sourceInfo) bool {
+	return mset.client != nil && (mset.mirror == si || mset.sources[si.iname] == si)
+}
+
+// Will run the health checks for our mirror or sources now.
+// Used when our leadership changes.
+func (mset *Stream) checkSources() {
+	mset.mu.RLock()
+	sis := make([]*sourceInfo, 0, len(mset.sources)+1)
+	if mset.mirror != nil {
+		sis = append(sis, mset.mirror)
+	}
+	for _, si := range mset.sources {
+		sis = append(sis, si)
+	}
+	mset.mu.RUnlock()
+
+	for _, si := range sis {
+		mset.checkSource(si)
+	}
+}
+
+// checkSource is our health check. It will create the consumer on the origin if
+// we do not have one and otherwise ask for the origin's state to update our lag.
+// When clustered only the leader runs the consumers.
+func (mset *Stream) checkSource(si *sourceInfo) {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	if !mset.isActiveSource(si) {
+		return
+	}
+	si.tmr.Reset(sourceHealthCheckInterval)
+
+	if mset.node != nil && !mset.node.Leader() {
+		mset.cancelSourceConsumer(si)
+		return
+	}
+	if si.sub == nil {
+		mset.createSourceConsumer(si)
+		return
+	}
+	// We should at least get heartbeats, so recreate a consumer that went quiet.
+	if si.cname != _EMPTY_ && time.Since(si.last) > sourceHealthCheckInterval {
+		mset.recreateSourceConsumer(si)
+		return
+	}
+	apiPre, _ := si.cfg.prefixes()
+	subj := fmt.Sprintf("%s.STREAM.INFO.%s", apiPre, si.cfg.Name)
+	mset.sendq <- &jsPubMsg{subj, subj, si.rsubj, nil, nil, nil, 0}
+}
+
+// Will drop our consumer on the origin. The origin will remove it once
+// it notices there is no more interest in the deliver subject.
+// Lock should be held.
+func (mset *Stream) cancelSourceConsumer(si *sourceInfo) {
+	if si.sub != nil {
+		mset.unsubscribe(si.sub)
+		si.sub, si.cname = nil, _EMPTY_
+	}
+}
+
+// Will drop our consumer on the origin and create a new one right away, picking up
+// after the last message we stored from it.
+// Lock should be held.
+func (mset *Stream) recreateSourceConsumer(si *sourceInfo) {
+	mset.cancelSourceConsumer(si)
+	if mset.node == nil || mset.node.Leader() {
+		mset.createSourceConsumer(si)
+	}
+}
+
+// Will send the request to create our consumer on the origin, picking up after
+// the last message we have from it. The consumer uses heartbeats, and flow control
+// for origins in our own account since its replies are not imported otherwise.
+// Lock should be held.
+func (mset *Stream) createSourceConsumer(si *sourceInfo) {
+	apiPre, deliverPre := si.cfg.prefixes()
+
+	dsubj := fmt.Sprintf("%s.%s", deliverPre, nuid.Next())
+	sub, err := mset.subscribeInternal(dsubj, func(sub *subscription, pc *client, subject, reply string, msg []byte) {
+		mset.processSourceMsg(si, sub, pc, subject, reply, msg)
+	})
+	if err != nil {
+		return
+	}
+	si.sub, si.dseq = sub, 0
+
+	req := &CreateConsumerRequest{
+		Stream: si.cfg.Name,
+		Config: ConsumerConfig{
+			DeliverSubject: dsubj,
+			AckPolicy:      AckNone,
+			FilterSubject:  si.cfg.FilterSubject,
+			FlowControl:    si.cfg.External == nil,
+			Heartbeat:      sourceHeartbeatInterval,
+		},
+	}
+	if si.sseq > 0 {
+		req.Config.DeliverPolicy, req.Config.OptStartSeq = DeliverByStartSequence, si.sseq+1
+	} else if si.cfg.OptStartSeq > 0 {
+		req.Config.DeliverPolicy, req.Config.OptStartSeq = DeliverByStartSequence, si.cfg.OptStartSeq
+	} else if si.cfg.OptStartTime != nil {
+		req.Config.DeliverPolicy, req.Config.OptStartTime = DeliverByStartTime, si.cfg.OptStartTime
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	subj := fmt.Sprintf("%s.CONSUMER.CREATE.%s", apiPre, si.cfg.Name)
+	mset.sendq <- &jsPubMsg{subj, subj, si.rsubj, nil, b, nil, 0}
+}
+
+// Process the responses to our consumer create and stream info requests.
+func (mset *Stream) processSourceResponse(si *sourceInfo, msg []byte) {
+	var resp ApiResponse
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		return
+	}
+
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	if !mset.isActiveSource(si) || si.sub == nil {
+		return
+	}
+	switch resp.Type {
+	case JSApiConsumerCreateResponseType:
+		var ccResp JSApiConsumerCreateResponse
+		if err := json.Unmarshal(msg, &ccResp); err != nil || ccResp.Error != nil || ccResp.ConsumerInfo == nil {
+			// The origin may not be there yet, so retry soon.
+			mset.cancelSourceConsumer(si)
+			si.tmr.Reset(sourceRetryInterval)
+			return
+		}
+		si.cname, si.last = ccResp.Name, time.Now()
+		si.tmr.Reset(0)
+	case JSApiStreamInfoResponseType:
+		var siResp JSApiStreamInfoResponse
+		if err := json.Unmarshal(msg, &siResp); err != nil || siResp.Error != nil || siResp.StreamInfo == nil {
+			mset.cancelSourceConsumer(si)
+			return
+		}
+		// If the origin was recreated our consumer is gone.
+		if !si.ocreated.IsZero() && !si.ocreated.Equal(siResp.Created) {
+			mset.cancelSourceConsumer(si)
+		}
+		si.ocreated = siResp.Created
+		if lseq := siResp.State.LastSeq; lseq > si.olast {
+			si.olast = lseq
+		}
+	}
+}
+
+// processSourceMsg handles messages delivered from the origin of our mirror or a source.
+// The reply subject holds the origin sequence. Mirrors preserve it, sources record
+// it in the stream source header so we can pick up where we left off. If we miss a
+// delivery, or can not store one, we recreate the consumer to pick up from the last
+// message we stored so nothing is lost.
+func (mset *Stream) processSourceMsg(si *sourceInfo, sub *subscription, pc *client, subject, reply string, msg []byte) {
+	// Split off any headers.
+	var hdr []byte
+	if pc != nil && pc.pa.hdr > 0 {
+		hdr, msg = msg[:pc.pa.hdr], msg[pc.pa.hdr:]
+	}
+
+	mset.mu.Lock()
+	if !mset.isActiveSource(si) || sub != si.sub {
+		mset.mu.Unlock()
+		return
+	}
+	si.last = time.Now()
+
+	// Flow control requests and heartbeats from the origin.
+	if len(msg) == 0 && bytes.HasPrefix(hdr, []byte(jsFlowControlHdr[:len(jsFlowControlHdr)-4])) {
+		if reply != _EMPTY_ {
+			mset.sendq <- &jsPubMsg{reply, reply, _EMPTY_, nil, nil, nil, 0}
+		}
+		mset.mu.Unlock()
+		return
+	}
+	if len(msg) == 0 && bytes.HasPrefix(hdr, []byte(jsIdleHeartbeatHdr)) {
+		if lseq := parseInt64(getHdrVal(JSLastConsumerSeq, hdr)); lseq > 0 && uint64(lseq) > si.dseq {
+			mset.recreateSourceConsumer(si)
+		} else if fc := string(getHdrVal(JSConsumerStalled, hdr)); fc != _EMPTY_ {
+			mset.sendq <- &jsPubMsg{fc, fc, _EMPTY_, nil, nil, nil, 0}
+		}
+		mset.mu.Unlock()
+		return
+	}
+
+	// The reply is $JS.ACK.<stream>.<consumer>.<delivered>.<sseq>.<dseq>.<ts>.
+	tokens := strings.Split(reply, tsep)
+	if len(tokens) != 8 {
+		mset.mu.Unlock()
+		return
+	}
+	sseq, dseq := parseInt64([]byte(tokens[5])), parseInt64([]byte(tokens[6]))
+	if sseq <= 0 || dseq <= 0 {
+		mset.mu.Unlock()
+		return
+	}
+	// Make sure we did not miss a delivery.
+	if uint64(dseq) != si.dseq+1 {
+		if uint64(dseq) > si.dseq {
+			mset.recreateSourceConsumer(si)
+		}
+		mset.mu.Unlock()
+		return
+	}
+	si.dseq = uint64(dseq)
+	if uint64(sseq) > si.olast {
+		si.olast = uint64(sseq)
+	}
+	// Sources may see redeliveries when the consumer was recreated.
+	if !si.isMirror && uint64(sseq) <= si.sseq {
 		mset.mu.Unlock()
+		return
+	}
+	node := mset.node
+	mset.mu.Unlock()
 
-		if needSignal {
-			mset.signalConsumers()
+	// If we are clustered the leader will propose the message to the group.
+	var err error
+	if si.isMirror {
+		if node == nil {
+			err = mset.processMirrorStore(uint64(sseq), subject, hdr, msg)
+		} else if node.Leader() {
+			err = node.Propose(encodeMirrorMsg(uint64(sseq), subject, hdr, msg))
+		}
+	} else {
+		hdr = setHeader(JSStreamSource, fmt.Sprintf("%s %d", si.iname, sseq), hdr)
+		if node == nil {
+			err = mset.processJetStreamMsg(subject, _EMPTY_, hdr, msg)
+		} else if node.Leader() {
+			err = node.Propose(encodeStreamMsg(subject, _EMPTY_, hdr, msg))
+		}
+	}
+	if err != nil {
+		mset.mu.Lock()
+		if mset.isActiveSource(si) && sub == si.sub {
+			mset.retrySourceConsumer(si)
 		}
+		mset.mu.Unlock()
 	}
 }
 
-// Will signal all waiting consumers.
-func (mset *Stream) signalConsumers() {
+// Will drop our consumer after we could not store a message from it, and have the
+// health check recreate it soon, picking up after the last message we stored.
+// Lock should be held.
+func (mset *Stream) retrySourceConsumer(si *sourceInfo) {
+	mset.cancelSourceConsumer(si)
+	si.tmr.Reset(sourceRetryInterval)
+}
+
+// Will retry the consumer for our mirror after we could not store a message.
+func (mset *Stream) retryMirror() {
 	mset.mu.Lock()
-	if mset.sgw > 0 {
-		mset.sg.Broadcast()
+	if si := mset.mirror; si != nil && mset.isActiveSource(si) {
+		mset.retrySourceConsumer(si)
+	}
+	mset.mu.Unlock()
+}
+
+// Will retry the consumer for the source of a message we could not store.
+func (mset *Stream) retrySource(hdr []byte) {
+	iname, _ := getStreamSource(hdr)
+	if iname == _EMPTY_ {
+		return
+	}
+	mset.mu.Lock()
+	if si := mset.sources[iname]; si != nil && mset.isActiveSource(si) {
+		mset.retrySourceConsumer(si)
+	}
+	mset.mu.Unlock()
+}
+
+// processMirrorStore will store a message from the origin at the same sequence,
+// skipping any gaps so our sequences stay aligned with the origin. Our mirror
+// position only moves once the message is stored, so a failure is retried.
+func (mset *Stream) processMirrorStore(sseq uint64, subject string, hdr, msg []byte) error {
+	mset.pmu.Lock()
+	defer mset.pmu.Unlock()
+
+	mset.mu.Lock()
+	if mset.config.Sealed {
+		mset.mu.Unlock()
+		return fmt.Errorf("stream is sealed")
+	}
+	store, c, jsa := mset.store, mset.client, mset.jsa
+	stype, numConsumers := mset.config.Storage, len(mset.consumers)
+	if mirror := mset.mirror; mirror != nil && sseq > mirror.olast {
+		mirror.olast = sseq
+	}
+	mset.mu.Unlock()
+
+	if c == nil {
+		return ErrStoreClosed
+	}
+	state := store.State()
+	lseq := state.LastSeq
+	if sseq <= lseq {
+		// Already have it.
+		return nil
+	}
+	if lseq+1 < sseq {
+		if state.Msgs == 0 {
+			// Nothing to keep, so jump our first sequence to the origin's.
+			if _, err := store.Compact(sseq); err != nil {
+				return err
+			}
+		} else {
+			store.SkipMsgs(sseq - lseq - 1)
+		}
+	}
+	seq, ts, err := store.StoreMsg(subject, hdr, msg)
+	if err != nil {
+		if err != ErrStoreClosed {
+			c.Errorf("JetStream failed to store a mirror msg on account: %q stream: %q -  %v", c.acc.Name, mset.Name(), err)
+		}
+		return err
+	}
+	if jsa.limitsExceeded(stype) {
+		c.Warnf("JetStream resource limits exceeded for account: %q", c.acc.Name)
+		store.RemoveMsg(seq)
+		return fmt.Errorf("resource limits exceeded for account")
+	}
+	// Only track our progress once stored, we will pick up from here if we need a new consumer.
+	mset.mu.Lock()
+	if mirror := mset.mirror; mirror != nil {
+		mirror.sseq = sseq
 	}
 	mset.mu.Unlock()
+
+	mset.republish(subject, hdr, msg, seq)
+	if numConsumers > 0 {
+		mset.notifyConsumers(subject, hdr, msg, seq, ts)
+	}
+	return nil
+}
+
+// Returns the public information for a mirror or source.
+// Lock should be held.
+func (si *sourceInfo) info() *StreamSourceInfo {
+	ssi := &StreamSourceInfo{Name: si.cfg.Name, Active: -1}
+	if si.olast > si.sseq {
+		ssi.Lag = si.olast - si.sseq
+	}
+	if !si.last.IsZero() {
+		ssi.Active = time.Since(si.last)
+	}
+	return ssi
+}
+
+// Info returns our current config, state and any mirror or sources information.
+// The lag for a source with a filter subject also counts origin messages that do not match.
+func (mset *Stream) Info() *StreamInfo {
+	mset.mu.RLock()
+	var mirror *StreamSourceInfo
+	if mset.mirror != nil {
+		mirror = mset.mirror.info()
+	}
+	var sources []*StreamSourceInfo
+	for _, si := range mset.sources {
+		sources = append(sources, si.info())
+	}
+	var scheduled uint64
+	if mset.store != nil {
+		scheduled, _ = mset.store.ScheduledState()
+	}
+	mset.mu.RUnlock()
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Mirror: mirror, Sources: sources, Scheduled: scheduled}
 }
 
 // Internal message for use by jetstream subsystem.
@@ -1006,7 +2280,8 @@ func (mset *Stream) stop(delete bool) error {
 	mset.sg.Broadcast()
 
 	// Send stream delete advisory after the consumers.
-	if delete {
+	// When clustered the meta leader will send this.
+	if delete && mset.node == nil {
 		mset.sendDeleteAdvisoryLocked()
 	}
 
@@ -1021,6 +2296,22 @@ func (mset *Stream) stop(delete bool) error {
 		return nil
 	}
 
+	// Stop our mirror and sources health checks.
+	if mset.mirror != nil {
+		mset.mirror.tmr.Stop()
+		mset.mirror = nil
+	}
+	for _, si := range mset.sources {
+		si.tmr.Stop()
+	}
+	mset.sources = nil
+
+	// Stop checking on held messages.
+	if mset.schedTmr != nil {
+		mset.schedTmr.Stop()
+		mset.schedTmr = nil
+	}
+
 	// Cleanup duplicate timer if running.
 	if mset.ddtmr != nil {
 		mset.ddtmr.Stop()
@@ -1123,15 +2414,19 @@ func (mset *Stream) waitForMsgs() {
 	mset.mu.Unlock()
 }
 
-// Determines if the new proposed partition is unique amongst all observables.
+// Determines if the new proposed partitions are unique amongst all observables.
 // Lock should be held.
-func (mset *Stream) partitionUnique(partition string) bool {
+func (mset *Stream) partitionUnique(partitions []string) bool {
 	for _, o := range mset.consumers {
-		if o.config.FilterSubject == _EMPTY_ {
+		if !o.isFiltered() {
 			return false
 		}
-		if subjectIsSubsetMatch(partition, o.config.FilterSubject) {
-			return false
+		for _, partition := range partitions {
+			for _, filter := range o.filters {
+				if subjectIsSubsetMatch(partition, filter) {
+					return false
+				}
+			}
 		}
 	}
 	return true
@@ -1190,6 +2485,15 @@ const snapsDir = "__snapshots__"
 
 // RestoreStream will restore a stream from a snapshot.
 func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
+	return a.restoreStream(stream, r, nil)
+}
+
+// RestoreStreamWithStorage will restore a stream from a snapshot into the given storage type.
+func (a *Account) RestoreStreamWithStorage(stream string, r io.Reader, storage StorageType) (*Stream, error) {
+	return a.restoreStream(stream, r, &storage)
+}
+
+func (a *Account) restoreStream(stream string, r io.Reader, storage *StorageType) (*Stream, error) {
 	_, jsa, err := a.checkForJetStream()
 	if err != nil {
 		return nil, err
@@ -1260,10 +2564,35 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 	if _, err := a.LookupStream(cfg.Name); err == nil {
 		return nil, fmt.Errorf("stream [%q] already exists", cfg.Name)
 	}
-	// Move into the correct place here.
-	ndir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
-	if err := os.Rename(sdir, ndir); err != nil {
-		return nil, err
+	// Check if we are changing the storage type.
+	if storage != nil && *storage != cfg.Storage {
+		cfg.Storage = *storage
+		if cfg.Storage == MemoryStorage {
+			cfg.Compression = NoCompression
+		}
+		// Rewrite our meta data to reflect this.
+		b, err := json.MarshalIndent(&cfg, _EMPTY_, "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path.Join(sdir, JetStreamMetaFile), b, 0644); err != nil {
+			return nil, err
+		}
+		checksum := metaChecksum(cfg.Name, b)
+		if err := ioutil.WriteFile(path.Join(sdir, JetStreamMetaFileSum), []byte(checksum), 0644); err != nil {
+			return nil, err
+		}
+	}
+	isMemory := cfg.Storage == MemoryStorage
+
+	// Memory based streams will load directly from the snapshot directory.
+	ndir := sdir
+	if !isMemory {
+		// Move into the correct place here.
+		ndir = path.Join(jsa.storeDir, streamsDir, cfg.Name)
+		if err := os.Rename(sdir, ndir); err != nil {
+			return nil, err
+		}
 	}
 	if cfg.Template != _EMPTY_ {
 		if err := jsa.addStreamNameToTemplate(cfg.Template, cfg.Name); err != nil {
@@ -1277,6 +2606,12 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 	if !cfg.Created.IsZero() {
 		mset.setCreated(cfg.Created)
 	}
+	if isMemory {
+		if err := mset.loadSnapshotMsgs(ndir); err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring messages: %v", err)
+		}
+	}
 
 	// Now do consumers.
 	odir := path.Join(ndir, consumerDir)
@@ -1319,6 +2654,13 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 		if !cfg.Created.IsZero() {
 			obs.setCreated(cfg.Created)
 		}
+		// Memory based consumers need their state loaded from the snapshot.
+		if isMemory {
+			if err := loadConsumerSnapshotState(obs, path.Join(odir, ofi.Name(), consumerState)); err != nil {
+				mset.Delete()
+				return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+			}
+		}
 		if err := obs.readStoredState(); err != nil {
 			mset.Delete()
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
@@ -1326,3 +2668,42 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 	}
 	return mset, nil
 }
+
+// Will load the consumer state from a restored snapshot into the consumer's store.
+func loadConsumerSnapshotState(o *Consumer, sfile string) error {
+	buf, err := ioutil.ReadFile(sfile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	state, err := decodeConsumerState(buf)
+	if err != nil {
+		return err
+	}
+	return o.store.Update(state)
+}
+
+// Will load the messages from a restored snapshot into a memory based stream.
+func (mset *Stream) loadSnapshotMsgs(sdir string) error {
+	mset.mu.RLock()
+	ms, ok := mset.store.(*memStore)
+	cfg := mset.config
+	mset.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("stream is not memory based")
+	}
+	cfg.Storage = FileStorage
+	fs, err := newFileStore(FileStoreConfig{StoreDir: sdir}, cfg)
+	if err != nil {
+		return err
+	}
+	defer fs.Stop()
+
+	if err := ms.loadMsgs(fs); err != nil {
+		return err
+	}
+	mset.rebuildDedupe()
+	return nil
+}
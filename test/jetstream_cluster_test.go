@@ -0,0 +1,938 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Create a cluster of JetStream enabled servers on loopback.
+func createJetStreamCluster(t *testing.T, numServers int) []*server.Server {
+	t.Helper()
+	var servers []*server.Server
+	var routes string
+	for i := 0; i < numServers; i++ {
+		sd, err := ioutil.TempDir("", "jsc-")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		opts := DefaultTestOptions
+		opts.Port = -1
+		opts.ServerName = fmt.Sprintf("S-%d", i+1)
+		opts.JetStream = true
+		opts.StoreDir = sd
+		opts.Cluster.Name = "JSC"
+		opts.Cluster.Host = "127.0.0.1"
+		opts.Cluster.Port = -1
+		if routes != "" {
+			opts.Routes = server.RoutesFromStr(routes)
+		}
+		s := RunServer(&opts)
+		if routes == "" {
+			routes = fmt.Sprintf("nats://%s", s.ClusterAddr())
+		}
+		servers = append(servers, s)
+	}
+	checkClusterFormed(t, servers...)
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			if s.JetStreamIsLeader() {
+				return nil
+			}
+		}
+		return fmt.Errorf("no metadata leader")
+	})
+	return servers
+}
+
+func shutdownJetStreamCluster(servers []*server.Server) {
+	for _, s := range servers {
+		var sd string
+		if config := s.JetStreamConfig(); config != nil {
+			sd = config.StoreDir
+		}
+		s.Shutdown()
+		if sd != "" {
+			os.RemoveAll(sd)
+		}
+	}
+}
+
+func jsClusterStreamLeader(servers []*server.Server, stream string) *server.Server {
+	for _, s := range servers {
+		if s.JetStreamIsStreamLeader(server.DEFAULT_GLOBAL_ACCOUNT, stream) {
+			return s
+		}
+	}
+	return nil
+}
+
+func jsClusterConsumerLeader(servers []*server.Server, stream, consumer string) *server.Server {
+	for _, s := range servers {
+		if s.JetStreamIsConsumerLeader(server.DEFAULT_GLOBAL_ACCOUNT, stream, consumer) {
+			return s
+		}
+	}
+	return nil
+}
+
+func jsClusterCreateStream(t *testing.T, nc *nats.Conn, cfg *server.StreamConfig) *server.JSApiStreamCreateResponse {
+	t.Helper()
+	req, _ := json.Marshal(cfg)
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &scResp
+}
+
+// Publish with retries since we may be in the middle of a leader election.
+func jsClusterPublish(t *testing.T, nc *nats.Conn, subj, msg string) {
+	t.Helper()
+	checkFor(t, 10*time.Second, 50*time.Millisecond, func() error {
+		resp, err := nc.Request(subj, []byte(msg), 500*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(resp.Data), "+OK") {
+			return fmt.Errorf("unexpected response: %q", resp.Data)
+		}
+		return nil
+	})
+}
+
+func checkJetStreamClusterMsgs(t *testing.T, servers []*server.Server, stream string, expected uint64) {
+	t.Helper()
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			mset, err := s.GlobalAccount().LookupStream(stream)
+			if err != nil {
+				return err
+			}
+			if state := mset.State(); state.Msgs != expected {
+				return fmt.Errorf("expected %d msgs on %q, got %d", expected, s.Name(), state.Msgs)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterStreamReplicatedAndFailover(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: server.FileStorage, Replicas: 3}
+	scResp := jsClusterCreateStream(t, nc, cfg)
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	if scResp.StreamInfo == nil || scResp.StreamInfo.Config.Replicas != 3 {
+		t.Fatalf("Unexpected stream info: %+v", scResp.StreamInfo)
+	}
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		jsClusterPublish(t, nc, "foo", "Hello JSC")
+	}
+	// All servers should have the messages.
+	checkJetStreamClusterMsgs(t, servers, "TEST", uint64(toSend))
+
+	// Now shutdown the stream leader.
+	leader := jsClusterStreamLeader(servers, "TEST")
+	if leader == nil {
+		t.Fatalf("Expected a stream leader")
+	}
+	leader.Shutdown()
+
+	var remaining []*server.Server
+	for _, s := range servers {
+		if s != leader {
+			remaining = append(remaining, s)
+		}
+	}
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		if jsClusterStreamLeader(remaining, "TEST") == nil {
+			return fmt.Errorf("no new stream leader")
+		}
+		return nil
+	})
+
+	nc2 := clientConnectToServer(t, remaining[0])
+	defer nc2.Close()
+
+	for i := 0; i < toSend; i++ {
+		jsClusterPublish(t, nc2, "foo", "Hello JSC")
+	}
+	checkJetStreamClusterMsgs(t, remaining, "TEST", uint64(2*toSend))
+
+	// Stream info should be answered by the new leader.
+	resp, err := nc2.Request(fmt.Sprintf(server.JSApiStreamInfoT, "TEST"), nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var siResp server.JSApiStreamInfoResponse
+	if err := json.Unmarshal(resp.Data, &siResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if siResp.StreamInfo == nil || siResp.StreamInfo.State.Msgs != uint64(2*toSend) {
+		t.Fatalf("Unexpected stream info: %+v", siResp)
+	}
+}
+
+func TestJetStreamClusterInsufficientResources(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[1])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "TEST", Storage: server.MemoryStorage, Replicas: 5}
+	scResp := jsClusterCreateStream(t, nc, cfg)
+	if scResp.Error == nil || !strings.Contains(scResp.Error.Description, "insufficient resources") {
+		t.Fatalf("Expected insufficient resources error, got %+v", scResp.Error)
+	}
+}
+
+func TestJetStreamClusterDurableConsumerFailover(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[2])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.FileStorage, Replicas: 3}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		jsClusterPublish(t, nc, "orders.new", fmt.Sprintf("ORDER-%d", i+1))
+	}
+
+	req, _ := json.Marshal(&server.CreateConsumerRequest{
+		Stream: "ORDERS",
+		Config: server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit},
+	})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", ccResp)
+	}
+
+	next := fmt.Sprintf(server.JSApiRequestNextT, "ORDERS", "dlc")
+	fetchAndAck := func(nc *nats.Conn, expected string) {
+		t.Helper()
+		var m *nats.Msg
+		checkFor(t, 10*time.Second, 50*time.Millisecond, func() error {
+			var err error
+			m, err = nc.Request(next, nil, 500*time.Millisecond)
+			return err
+		})
+		if string(m.Data) != expected {
+			t.Fatalf("Expected %q, got %q", expected, m.Data)
+		}
+		if _, err := nc.Request(m.Reply, nil, 2*time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		fetchAndAck(nc, fmt.Sprintf("ORDER-%d", i+1))
+	}
+
+	// Wait for the ack state to be replicated to the followers.
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range servers {
+			mset, err := s.GlobalAccount().LookupStream("ORDERS")
+			if err != nil {
+				return err
+			}
+			o := mset.LookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("no consumer on %q", s.Name())
+			}
+			if info := o.Info(); info.AckFloor.StreamSeq != 5 {
+				return fmt.Errorf("expected ack floor of 5 on %q, got %d", s.Name(), info.AckFloor.StreamSeq)
+			}
+		}
+		return nil
+	})
+
+	// Shutdown the consumer leader.
+	leader := jsClusterConsumerLeader(servers, "ORDERS", "dlc")
+	if leader == nil {
+		t.Fatalf("Expected a consumer leader")
+	}
+	leader.Shutdown()
+
+	var remaining []*server.Server
+	for _, s := range servers {
+		if s != leader {
+			remaining = append(remaining, s)
+		}
+	}
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		if jsClusterConsumerLeader(remaining, "ORDERS", "dlc") == nil {
+			return fmt.Errorf("no new consumer leader")
+		}
+		return nil
+	})
+
+	nc2 := clientConnectToServer(t, remaining[0])
+	defer nc2.Close()
+
+	// We should pick up where we left off.
+	fetchAndAck(nc2, "ORDER-6")
+}
+
+func TestJetStreamClusterMirror(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "S", Subjects: []string{"foo"}, Storage: server.FileStorage, Replicas: 3}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		jsClusterPublish(t, nc, "foo", "Hello JSC")
+	}
+
+	cfg = &server.StreamConfig{Name: "M", Storage: server.FileStorage, Replicas: 3, Mirror: &server.StreamSource{Name: "S"}}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	// All servers should have the mirrored messages.
+	checkJetStreamClusterMsgs(t, servers, "M", uint64(toSend))
+
+	for i := 0; i < toSend; i++ {
+		jsClusterPublish(t, nc, "foo", "Hello JSC")
+	}
+	checkJetStreamClusterMsgs(t, servers, "M", uint64(2*toSend))
+}
+
+func TestJetStreamClusterConsumerUpdate(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[1])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.FileStorage, Replicas: 3}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	ccfg := server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit, MaxDeliver: 5}
+	req, _ := json.Marshal(&server.CreateConsumerRequest{Stream: "ORDERS", Config: ccfg})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", ccResp)
+	}
+
+	ccfg = ccResp.Config
+	ccfg.MaxDeliver = 20
+	ccfg.Description = "updated"
+	req, _ = json.Marshal(&server.CreateConsumerRequest{Stream: "ORDERS", Config: ccfg})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerUpdateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var cuResp server.JSApiConsumerUpdateResponse
+	if err := json.Unmarshal(resp.Data, &cuResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cuResp.Error != nil || cuResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", cuResp)
+	}
+	if cuResp.Config.MaxDeliver != 20 || cuResp.Config.Description != "updated" {
+		t.Fatalf("Expected the updated config, got %+v", cuResp.Config)
+	}
+
+	// All replicas should have the new config.
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range servers {
+			mset, err := s.GlobalAccount().LookupStream("ORDERS")
+			if err != nil {
+				return err
+			}
+			o := mset.LookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("consumer not found on %s", s.Name())
+			}
+			if ocfg := o.Config(); ocfg.MaxDeliver != 20 {
+				return fmt.Errorf("expected max deliver of 20 on %s, got %d", s.Name(), ocfg.MaxDeliver)
+			}
+		}
+		return nil
+	})
+
+	// An update that changes nothing should still get an update response.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerUpdateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cuResp = server.JSApiConsumerUpdateResponse{}
+	if err := json.Unmarshal(resp.Data, &cuResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cuResp.Type != server.JSApiConsumerUpdateResponseType || cuResp.Error != nil || cuResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", cuResp)
+	}
+
+	// Immutable fields are rejected by the meta leader.
+	ccfg.AckPolicy = server.AckAll
+	req, _ = json.Marshal(&server.CreateConsumerRequest{Stream: "ORDERS", Config: ccfg})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerUpdateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cuResp = server.JSApiConsumerUpdateResponse{}
+	if err := json.Unmarshal(resp.Data, &cuResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cuResp.Error == nil {
+		t.Fatalf("Expected an error updating the ack policy")
+	}
+}
+
+func TestJetStreamClusterConsumerPauseAndSeek(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.FileStorage, Replicas: 3}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	for i := 0; i < 10; i++ {
+		jsClusterPublish(t, nc, "orders.new", fmt.Sprintf("ORDER-%d", i+1))
+	}
+
+	req, _ := json.Marshal(&server.CreateConsumerRequest{
+		Stream: "ORDERS",
+		Config: server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit},
+	})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", ccResp)
+	}
+
+	checkReplicas := func(check func(info *server.ConsumerInfo) error) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			for _, s := range servers {
+				mset, err := s.GlobalAccount().LookupStream("ORDERS")
+				if err != nil {
+					return err
+				}
+				o := mset.LookupConsumer("dlc")
+				if o == nil {
+					return fmt.Errorf("consumer not found on %s", s.Name())
+				}
+				if err := check(o.Info()); err != nil {
+					return fmt.Errorf("%s: %v", s.Name(), err)
+				}
+			}
+			return nil
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		m, err := nc.Request(fmt.Sprintf(server.JSApiRequestNextT, "ORDERS", "dlc"), nil, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		m.Respond(nil)
+	}
+	checkReplicas(func(info *server.ConsumerInfo) error {
+		if info.Delivered.ConsumerSeq != 3 || info.AckFloor.ConsumerSeq != 3 {
+			return fmt.Errorf("expected delivered consumer sequence of 3, got %+v", info.Delivered)
+		}
+		return nil
+	})
+
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerPauseT, "ORDERS", "dlc"), nil, time.Second)
+		return err
+	})
+	var pResp server.JSApiConsumerPauseResponse
+	if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pResp.Error != nil || pResp.ConsumerInfo == nil || !pResp.Paused {
+		t.Fatalf("Unexpected response: %+v", pResp)
+	}
+	checkReplicas(func(info *server.ConsumerInfo) error {
+		if !info.Paused {
+			return fmt.Errorf("expected consumer to be paused")
+		}
+		return nil
+	})
+
+	req, _ = json.Marshal(&server.JSApiConsumerSeekRequest{Seq: 6})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerSeekT, "ORDERS", "dlc"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var sResp server.JSApiConsumerSeekResponse
+	if err := json.Unmarshal(resp.Data, &sResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sResp.Error != nil || sResp.ConsumerInfo == nil || sResp.Delivered.StreamSeq != 5 {
+		t.Fatalf("Unexpected response: %+v", sResp)
+	}
+	checkReplicas(func(info *server.ConsumerInfo) error {
+		if info.Delivered.StreamSeq != 5 || info.AckFloor.StreamSeq != 5 {
+			return fmt.Errorf("expected delivered stream sequence of 5, got %+v", info.Delivered)
+		}
+		if info.Delivered.ConsumerSeq != 0 || info.AckFloor.ConsumerSeq != 0 {
+			return fmt.Errorf("expected the consumer sequence to be reset, got %+v", info.Delivered)
+		}
+		return nil
+	})
+
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerResumeT, "ORDERS", "dlc"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkReplicas(func(info *server.ConsumerInfo) error {
+		if info.Paused {
+			return fmt.Errorf("expected consumer to be resumed")
+		}
+		return nil
+	})
+
+	m, err := nc.Request(fmt.Sprintf(server.JSApiRequestNextT, "ORDERS", "dlc"), nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(m.Data) != "ORDER-6" {
+		t.Fatalf("Expected %q, got %q", "ORDER-6", m.Data)
+	}
+}
+
+func TestJetStreamClusterConsumerInactiveThreshold(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[2])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.FileStorage, Replicas: 3}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	adv, _ := nc.SubscribeSync(server.JSAdvisoryConsumerInactivePre + ".>")
+	defer adv.Unsubscribe()
+	nc.Flush()
+
+	req, _ := json.Marshal(&server.CreateConsumerRequest{
+		Stream: "ORDERS",
+		Config: server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit, InactiveThreshold: 500 * time.Millisecond},
+	})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, "ORDERS", "dlc"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ConsumerInfo == nil {
+		t.Fatalf("Unexpected response: %+v", ccResp)
+	}
+
+	// The consumer should be removed from all servers.
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			mset, err := s.GlobalAccount().LookupStream("ORDERS")
+			if err != nil {
+				return err
+			}
+			if mset.LookupConsumer("dlc") != nil {
+				return fmt.Errorf("consumer still exists on %s", s.Name())
+			}
+		}
+		return nil
+	})
+	if _, err := adv.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected an inactive advisory: %v", err)
+	}
+	if _, err := adv.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected only one inactive advisory")
+	}
+}
+
+func TestJetStreamClusterMsgSchedules(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	cfg := &server.StreamConfig{Name: "SCHED", Subjects: []string{"foo"}, Storage: server.FileStorage, Replicas: 3, AllowMsgSchedules: true}
+	if scResp := jsClusterCreateStream(t, nc, cfg); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+
+	toSend := 5
+	for i := 0; i < toSend; i++ {
+		checkFor(t, 10*time.Second, 50*time.Millisecond, func() error {
+			m := nats.NewMsg("foo")
+			m.Header[server.JSDelay] = []string{"250ms"}
+			m.Data = []byte("LATER")
+			resp, err := nc.RequestMsg(m, 500*time.Millisecond)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(string(resp.Data), "+OK") {
+				return fmt.Errorf("unexpected response: %q", resp.Data)
+			}
+			return nil
+		})
+	}
+
+	// Every replica should make each held message visible exactly once.
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			mset, err := s.GlobalAccount().LookupStream("SCHED")
+			if err != nil {
+				return err
+			}
+			if scheduled := mset.Info().Scheduled; scheduled != 0 {
+				return fmt.Errorf("expected no scheduled msgs on %q, got %d", s.Name(), scheduled)
+			}
+			state := mset.State()
+			if state.Msgs != uint64(toSend) || state.FirstSeq != uint64(toSend+1) || state.LastSeq != uint64(2*toSend) {
+				return fmt.Errorf("unexpected state on %q: %+v", s.Name(), state)
+			}
+		}
+		return nil
+	})
+	// Make sure no more copies show up later.
+	time.Sleep(250 * time.Millisecond)
+	checkJetStreamClusterMsgs(t, servers, "SCHED", uint64(toSend))
+	for _, s := range servers {
+		mset, _ := s.GlobalAccount().LookupStream("SCHED")
+		if state := mset.State(); state.LastSeq != uint64(2*toSend) {
+			t.Fatalf("Unexpected state on %q: %+v", s.Name(), state)
+		}
+	}
+}
+
+func checkJetStreamClusterSubPending(t *testing.T, sub *nats.Subscription, expected int) {
+	t.Helper()
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		if nmsgs, _, _ := sub.Pending(); nmsgs != expected {
+			return fmt.Errorf("expected %d msgs pending, got %d", expected, nmsgs)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterKeyValue(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	req, _ := json.Marshal(&server.KVConfig{Bucket: "TEST", History: 5, Storage: server.FileStorage, Replicas: 3})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiKVCreateT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiKVCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", ccResp.Error)
+	}
+	if ccResp.KVBucketInfo == nil || ccResp.Config.Bucket != "TEST" || ccResp.Config.Replicas != 3 {
+		t.Fatalf("Unexpected bucket info: %+v", ccResp.KVBucketInfo)
+	}
+
+	// Watch the bucket, the watcher should see every revision.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+	req, _ = json.Marshal(&server.JSApiKVWatchRequest{DeliverSubject: sub.Subject})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiKVWatchT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var wResp server.JSApiKVWatchResponse
+	if err := json.Unmarshal(resp.Data, &wResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if wResp.Error != nil || wResp.Consumer == "" {
+		t.Fatalf("Unexpected watch response: %+v", wResp)
+	}
+
+	for i := 0; i < 3; i++ {
+		jsClusterPublish(t, nc, "$KV.TEST.name", fmt.Sprintf("derek-%d", i))
+	}
+	jsClusterPublish(t, nc, "$KV.TEST.age", "22")
+	checkJetStreamClusterMsgs(t, servers, "KV_TEST", 4)
+	checkJetStreamClusterSubPending(t, sub, 4)
+
+	// A purge of the key should remove its prior revisions on every replica.
+	checkFor(t, 10*time.Second, 50*time.Millisecond, func() error {
+		m := nats.NewMsg("$KV.TEST.name")
+		m.Header[server.KVOperation] = []string{server.KVOperationPurge}
+		resp, err := nc.RequestMsg(m, 500*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(resp.Data), "+OK") {
+			return fmt.Errorf("unexpected response: %q", resp.Data)
+		}
+		return nil
+	})
+	checkJetStreamClusterMsgs(t, servers, "KV_TEST", 2)
+	for _, s := range servers {
+		mset, err := s.GlobalAccount().LookupKeyValue("TEST")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, err := mset.KeyValueGet("name", 0); err != server.ErrKVKeyNotFound {
+			t.Fatalf("Expected key to be purged on %q, got %v", s.Name(), err)
+		}
+		if e, err := mset.KeyValueGet("age", 0); err != nil || string(e.Value) != "22" {
+			t.Fatalf("Unexpected entry on %q: %+v %v", s.Name(), e, err)
+		}
+	}
+	checkJetStreamClusterSubPending(t, sub, 5)
+
+	// Delete the bucket.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiKVDeleteT, "TEST"), nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var dResp server.JSApiKVDeleteResponse
+	if err := json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Unexpected delete response: %+v", dResp)
+	}
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			if _, err := s.GlobalAccount().LookupKeyValue("TEST"); err == nil {
+				return fmt.Errorf("bucket still present on %q", s.Name())
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterObjectStore(t *testing.T) {
+	servers := createJetStreamCluster(t, 3)
+	defer shutdownJetStreamCluster(servers)
+
+	nc := clientConnectToServer(t, servers[0])
+	defer nc.Close()
+
+	req, _ := json.Marshal(&server.ObjectStoreConfig{Bucket: "TEST", Storage: server.FileStorage, Replicas: 3})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectStoreCreateT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiObjectStoreCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ObjectStoreInfo == nil || ccResp.Config.Replicas != 3 {
+		t.Fatalf("Unexpected response: %+v %+v", ccResp.Error, ccResp.ObjectStoreInfo)
+	}
+
+	// Publish the chunks and then request the put.
+	data := []byte("Hello Clustered Objects")
+	id := nuid.Next()
+	for i := 0; i < len(data); i += 8 {
+		end := i + 8
+		if end > len(data) {
+			end = len(data)
+		}
+		jsClusterPublish(t, nc, fmt.Sprintf(server.ObjChunkSubjectT, "TEST", id), string(data[i:end]))
+	}
+	req, _ = json.Marshal(&server.JSApiObjectPutRequest{ObjectInfo: server.ObjectInfo{Name: "a", NUID: id, Size: uint64(len(data)), Chunks: 3}})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectPutT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var pResp server.JSApiObjectPutResponse
+	if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pResp.Error != nil || pResp.Info == nil || pResp.Info.Digest == "" {
+		t.Fatalf("Unexpected response: %+v %+v", pResp.Error, pResp.Info)
+	}
+
+	// Every replica should have the same metadata.
+	checkObjects := func(names ...string) {
+		t.Helper()
+		checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+			for _, s := range servers {
+				mset, err := s.GlobalAccount().LookupObjectStore("TEST")
+				if err != nil {
+					return err
+				}
+				objs, err := mset.ListObjects()
+				if err != nil {
+					return err
+				}
+				if len(objs) != len(names) {
+					return fmt.Errorf("expected %d objects on %q, got %d", len(names), s.Name(), len(objs))
+				}
+				for i, info := range objs {
+					if info.Name != names[i] {
+						return fmt.Errorf("expected object %q on %q, got %q", names[i], s.Name(), info.Name)
+					}
+					if info.Name == "a" && !info.ModTime.Equal(pResp.Info.ModTime) {
+						return fmt.Errorf("unexpected mod time on %q: %v", s.Name(), info.ModTime)
+					}
+				}
+			}
+			return nil
+		})
+	}
+	checkObjects("a")
+
+	// Link to the object and get it through the link.
+	req, _ = json.Marshal(&server.JSApiObjectLinkRequest{Name: "b", Link: &server.ObjectLink{Bucket: "TEST", Name: "a"}})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectLinkT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var lResp server.JSApiObjectLinkResponse
+	if err := json.Unmarshal(resp.Data, &lResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if lResp.Error != nil || lResp.Info == nil || lResp.Info.Link == nil {
+		t.Fatalf("Unexpected response: %+v %+v", lResp.Error, lResp.Info)
+	}
+	checkObjects("a", "b")
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+	req, _ = json.Marshal(&server.JSApiObjectGetRequest{Name: "b", DeliverSubject: sub.Subject})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectGetT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var gResp server.JSApiObjectGetResponse
+	if err := json.Unmarshal(resp.Data, &gResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if gResp.Error != nil || gResp.Info == nil || gResp.Info.Chunks != 3 {
+		t.Fatalf("Unexpected response: %+v %+v", gResp.Error, gResp.Info)
+	}
+	var got []byte
+	for i := 0; i < 3; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		got = append(got, m.Data...)
+	}
+	if string(got) != string(data) {
+		t.Fatalf("Expected %q, got %q", data, got)
+	}
+
+	// Remove the object, its chunks should be removed on every replica.
+	req, _ = json.Marshal(&server.JSApiObjectRemoveRequest{Name: "a"})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectRemoveT, "TEST"), req, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var rResp server.JSApiObjectRemoveResponse
+	if err := json.Unmarshal(resp.Data, &rResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !rResp.Success || rResp.Error != nil {
+		t.Fatalf("Unexpected response: %+v", rResp)
+	}
+	checkObjects("b")
+	// The metadata for the deleted object and the link.
+	checkJetStreamClusterMsgs(t, servers, "OBJ_TEST", 2)
+
+	// Delete the bucket.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectStoreDeleteT, "TEST"), nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var dResp server.JSApiObjectStoreDeleteResponse
+	if err := json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Unexpected response: %+v", dResp)
+	}
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range servers {
+			if _, err := s.GlobalAccount().LookupObjectStore("TEST"); err == nil {
+				return fmt.Errorf("bucket still present on %q", s.Name())
+			}
+		}
+		return nil
+	})
+}
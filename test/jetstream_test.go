@@ -303,6 +303,61 @@ func TestJetStreamAddStreamDiscardNew(t *testing.T) {
 	}
 }
 
+func TestJetStreamMaxMsgsPerSubject(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, MaxMsgsPer: 2, Storage: server.MemoryStorage}},
+		{"FileStore", &server.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, MaxMsgsPer: 2, Storage: server.FileStorage}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 5; i++ {
+				sendStreamMsg(t, nc, "kv.foo", fmt.Sprintf("FOO: %d", i+1))
+				sendStreamMsg(t, nc, "kv.bar", fmt.Sprintf("BAR: %d", i+1))
+			}
+			if state := mset.State(); state.Msgs != 4 || state.FirstSeq != 7 {
+				t.Fatalf("Expected 4 msgs starting at 7, got %d at %d", state.Msgs, state.FirstSeq)
+			}
+
+			// Now switch to discard new and make sure we reject when a subject is full.
+			cfg := mset.Config()
+			cfg.Discard = server.DiscardNew
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			resp, _ := nc.Request("kv.foo", []byte("discard me"), 100*time.Millisecond)
+			if resp == nil {
+				t.Fatalf("No response, possible timeout?")
+			}
+			if string(resp.Data) != "-ERR 'maximum messages per subject exceeded'" {
+				t.Fatalf("Expected to get an error about maximum messages per subject, got %q", resp.Data)
+			}
+			sendStreamMsg(t, nc, "kv.baz", "BAZ")
+			if state := mset.State(); state.Msgs != 5 {
+				t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+			}
+		})
+	}
+}
+
 func TestJetStreamPubAck(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -2902,6 +2957,85 @@ func TestJetStreamPublishDeDupe(t *testing.T) {
 	nmids(0)
 }
 
+func TestJetStreamPublishExpectations(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.MemoryStorage}},
+		{"FileStore", &server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: server.FileStorage}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sendMsg := func(subj string, hdrs ...string) string {
+				t.Helper()
+				m := nats.NewMsg(subj)
+				for i := 0; i < len(hdrs); i += 2 {
+					m.Header.Add(hdrs[i], hdrs[i+1])
+				}
+				m.Data = []byte("OK")
+				resp, _ := nc.RequestMsg(m, 100*time.Millisecond)
+				if resp == nil {
+					t.Fatalf("No response, possible timeout?")
+				}
+				return string(resp.Data)
+			}
+			expectOK := func(resp string) {
+				t.Helper()
+				if !strings.HasPrefix(resp, "+OK {") {
+					t.Fatalf("Expected a JetStreamPubAck, got %q", resp)
+				}
+			}
+			expectErr := func(resp, expected string) {
+				t.Helper()
+				if resp != fmt.Sprintf("-ERR '%s'", expected) {
+					t.Fatalf("Expected error %q, got %q", expected, resp)
+				}
+			}
+
+			// Stream name.
+			expectOK(sendMsg("orders.1", server.JSExpectedStream, "ORDERS"))
+			expectErr(sendMsg("orders.1", server.JSExpectedStream, "FOO"), "expected stream does not match")
+
+			// Last sequence for the stream.
+			expectOK(sendMsg("orders.2", server.JSExpectedLastSeq, "1"))
+			expectErr(sendMsg("orders.2", server.JSExpectedLastSeq, "1"), "wrong last sequence: 2")
+			expectErr(sendMsg("orders.2", server.JSExpectedLastSeq, "bad"), "invalid Nats-Expected-Last-Sequence header")
+
+			// Last sequence for the subject.
+			expectOK(sendMsg("orders.1", server.JSExpectedLastSubjSeq, "1"))
+			expectErr(sendMsg("orders.1", server.JSExpectedLastSubjSeq, "1"), "wrong last sequence for subject: 3")
+			expectOK(sendMsg("orders.3", server.JSExpectedLastSubjSeq, "0"))
+			expectErr(sendMsg("orders.4", server.JSExpectedLastSubjSeq, "4"), "wrong last sequence for subject: 0")
+
+			// Last msg id, make sure we do not confuse the expected header with the msg id itself.
+			expectOK(sendMsg("orders.1", server.JSPubId, "AA"))
+			expectOK(sendMsg("orders.1", server.JSExpectedLastMsgId, "AA", server.JSPubId, "BB"))
+			expectErr(sendMsg("orders.1", server.JSExpectedLastMsgId, "AA", server.JSPubId, "CC"), "wrong last msg id: BB")
+
+			if state := mset.State(); state.Msgs != 6 {
+				t.Fatalf("Expected %d messages, got %d", 6, state.Msgs)
+			}
+		})
+	}
+}
+
 func TestJetStreamPullConsumerRemoveInterest(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -3609,6 +3743,142 @@ func TestJetStreamSnapshots(t *testing.T) {
 	}
 }
 
+func TestJetStreamMemorySnapshots(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "MEM-STREAM"
+	cfg := server.StreamConfig{
+		Name:     mname,
+		Storage:  server.MemoryStorage,
+		Subjects: []string{"foo"},
+	}
+
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 100
+	for i := 1; i <= toSend; i++ {
+		sendStreamMsg(t, nc, "foo", fmt.Sprintf("Hello World %d", i))
+	}
+	// Create some interior gaps.
+	for _, seq := range []uint64{10, 11, 50} {
+		mset.DeleteMsg(seq)
+	}
+
+	o, err := mset.AddConsumer(workerModeConfig("WQ"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	toReceive := 22
+	for r := 0; r < toReceive; r++ {
+		resp, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Respond(nil)
+	}
+	nc.Flush()
+
+	state, nextSeq := mset.State(), o.NextSeq()
+
+	sr, err := mset.Snapshot(5*time.Second, false, true)
+	if err != nil {
+		t.Fatalf("Error getting snapshot: %v", err)
+	}
+	snapshot, err := ioutil.ReadAll(sr.Reader)
+	if err != nil {
+		t.Fatalf("Error reading snapshot")
+	}
+	pusage := acc.JetStreamUsage()
+	mset.Delete()
+
+	checkRestored := func(mset *server.Stream, storage server.StorageType) {
+		t.Helper()
+		if rstate := mset.State(); rstate.Msgs != state.Msgs || rstate.FirstSeq != state.FirstSeq ||
+			rstate.LastSeq != state.LastSeq || rstate.Consumers != 1 {
+			t.Fatalf("State does not match: %+v vs %+v", rstate, state)
+		}
+		if cfg := mset.Config(); cfg.Storage != storage {
+			t.Fatalf("Expected %v storage, got %v", storage, cfg.Storage)
+		}
+		o := mset.LookupConsumer("WQ")
+		if o == nil {
+			t.Fatalf("Expected to get a consumer")
+		}
+		if o.NextSeq() != nextSeq {
+			t.Fatalf("Consumer next seq is not correct: %d vs %d", o.NextSeq(), nextSeq)
+		}
+	}
+
+	// Restore back into memory.
+	mset, err = acc.RestoreStream(mname, bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkRestored(mset, server.MemoryStorage)
+	if nusage := acc.JetStreamUsage(); nusage != pusage {
+		t.Fatalf("Usage does not match after restore: %+v vs %+v", nusage, pusage)
+	}
+	if _, err := mset.GetMsg(10); err == nil {
+		t.Fatalf("Expected deleted msg to stay deleted")
+	}
+	if sm, err := mset.GetMsg(12); err != nil || string(sm.Data) != "Hello World 12" {
+		t.Fatalf("Unexpected msg or error: %+v %v", sm, err)
+	}
+	// Consumer should pick up where we left off.
+	o = mset.LookupConsumer("WQ")
+	m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error getting next message: %v", err)
+	}
+	// We skip over the deleted messages.
+	if sseq, dseq, _, _ := o.ReplyInfo(m.Reply); sseq != uint64(toReceive+3) || dseq != nextSeq {
+		t.Fatalf("Unexpected sequences for next message: %d %d", sseq, dseq)
+	}
+
+	// Now restore into file storage on a different server.
+	s2 := RunBasicJetStreamServer()
+	defer s2.Shutdown()
+
+	if config := s2.JetStreamConfig(); config != nil && config.StoreDir != "" {
+		defer os.RemoveAll(config.StoreDir)
+	}
+	mset, err = s2.GlobalAccount().RestoreStreamWithStorage(mname, bytes.NewReader(snapshot), server.FileStorage)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkRestored(mset, server.FileStorage)
+	if sm, err := mset.GetMsg(100); err != nil || string(sm.Data) != "Hello World 100" {
+		t.Fatalf("Unexpected msg or error: %+v %v", sm, err)
+	}
+
+	// And a snapshot of the file based stream back into memory.
+	sr, err = mset.Snapshot(5*time.Second, true, true)
+	if err != nil {
+		t.Fatalf("Error getting snapshot: %v", err)
+	}
+	if snapshot, err = ioutil.ReadAll(sr.Reader); err != nil {
+		t.Fatalf("Error reading snapshot")
+	}
+	mset.Delete()
+	mset, err = s2.GlobalAccount().RestoreStreamWithStorage(mname, bytes.NewReader(snapshot), server.MemoryStorage)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkRestored(mset, server.MemoryStorage)
+}
+
 func TestJetStreamSnapshotsAPI(t *testing.T) {
 	lopts := DefaultTestOptions
 	lopts.ServerName = "LS"
@@ -4754,6 +5024,90 @@ func TestJetStreamMetadata(t *testing.T) {
 		})
 	}
 }
+
+func TestJetStreamMsgGetLastBySubject(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, Storage: server.MemoryStorage}},
+		{"FileStore", &server.StreamConfig{Name: "KV", Subjects: []string{"kv.>"}, Storage: server.FileStorage}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 1; i <= 10; i++ {
+				subj := fmt.Sprintf("kv.%d", i%2)
+				if _, err := nc.Request(subj, []byte(fmt.Sprintf("v%d", i)), time.Second); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			getMsg := func(mreq *server.JSApiMsgGetRequest) *server.JSApiMsgGetResponse {
+				t.Helper()
+				req, _ := json.Marshal(mreq)
+				rmsg, err := nc.Request(fmt.Sprintf(server.JSApiMsgGetT, c.mconfig.Name), req, time.Second)
+				if err != nil {
+					t.Fatalf("Could not retrieve stream message: %v", err)
+				}
+				var resp server.JSApiMsgGetResponse
+				if err := json.Unmarshal(rmsg.Data, &resp); err != nil {
+					t.Fatalf("Could not parse stream message: %v", err)
+				}
+				return &resp
+			}
+
+			resp := getMsg(&server.JSApiMsgGetRequest{LastFor: "kv.1"})
+			if resp.Error != nil || resp.Message == nil {
+				t.Fatalf("Did not receive correct response: %+v", resp.Error)
+			}
+			if sm := resp.Message; sm.Sequence != 9 || sm.Subject != "kv.1" || string(sm.Data) != "v9" {
+				t.Fatalf("Unexpected message: %+v", sm)
+			}
+
+			// Remove the last one and make sure we get the previous.
+			if removed, err := mset.RemoveMsg(10); err != nil || !removed {
+				t.Fatalf("Unexpected remove result: %v %v", removed, err)
+			}
+			resp = getMsg(&server.JSApiMsgGetRequest{LastFor: "kv.0"})
+			if resp.Error != nil || resp.Message == nil || resp.Message.Sequence != 8 {
+				t.Fatalf("Did not receive correct response: %+v %+v", resp.Error, resp.Message)
+			}
+
+			// Unknown subject.
+			resp = getMsg(&server.JSApiMsgGetRequest{LastFor: "kv.22"})
+			if resp.Error == nil || resp.Error.Code != 500 || resp.Error.Description != "no message found" {
+				t.Fatalf("Did not get correct error response: %+v", resp.Error)
+			}
+			// Wildcards are not allowed.
+			resp = getMsg(&server.JSApiMsgGetRequest{LastFor: "kv.*"})
+			if resp.Error == nil || resp.Error.Code != 400 {
+				t.Fatalf("Did not get correct error response: %+v", resp.Error)
+			}
+			// Can not have both.
+			resp = getMsg(&server.JSApiMsgGetRequest{Seq: 1, LastFor: "kv.1"})
+			if resp.Error == nil || resp.Error.Code != 400 {
+				t.Fatalf("Did not get correct error response: %+v", resp.Error)
+			}
+		})
+	}
+}
+
 func TestJetStreamRedeliverCount(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -8336,3 +8690,2818 @@ func TestJetStreamAckExplicitMsgRemoval(t *testing.T) {
 		})
 	}
 }
+
+func TestJetStreamEncryptedFileStore(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", server.JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, key: "s3cr3t", cipher: aes}
+	`, storeDir)))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config == nil || config.Key != "s3cr3t" || config.Cipher != server.AES {
+		t.Fatalf("Expected an encrypted JetStream config, got %+v", config)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ES", Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 100
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "ES", "TOP SECRET")
+	}
+	next := fmt.Sprintf(server.JSApiRequestNextT, "ES", "dlc")
+	for i := 0; i < 10; i++ {
+		m, err := nc.Request(next, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		m.Respond(nil)
+	}
+	nc.Flush()
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if info := o.Info(); info.AckFloor.StreamSeq != 10 {
+			return fmt.Errorf("expected ack floor of 10, got %d", info.AckFloor.StreamSeq)
+		}
+		return nil
+	})
+	nc.Close()
+	s.Shutdown()
+
+	// Make sure nothing we stored is on disk in plaintext.
+	filepath.Walk(storeDir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if buf, _ := ioutil.ReadFile(fpath); bytes.Contains(buf, []byte("TOP SECRET")) {
+			t.Fatalf("Found plaintext in %q", fpath)
+		}
+		return nil
+	})
+
+	// Restart and make sure we recover the stream and consumer.
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream("ES")
+	if err != nil {
+		t.Fatalf("Expected to find the stream: %v", err)
+	}
+	if state := mset.State(); state.Msgs != uint64(toSend) {
+		t.Fatalf("Expected %d msgs, got %d", toSend, state.Msgs)
+	}
+	if sm, err := mset.GetMsg(22); err != nil || string(sm.Data) != "TOP SECRET" {
+		t.Fatalf("Unexpected msg or error: %+v %v", sm, err)
+	}
+	if o = mset.LookupConsumer("dlc"); o == nil {
+		t.Fatalf("Expected to find the consumer")
+	}
+	if info := o.Info(); info.AckFloor.StreamSeq != 10 {
+		t.Fatalf("Expected ack floor of 10, got %d", info.AckFloor.StreamSeq)
+	}
+}
+
+func TestJetStreamKeyValue(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Create the bucket.
+	req, _ := json.Marshal(&server.KVConfig{Bucket: "TEST", History: 3, Storage: server.FileStorage})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiKVCreateT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiKVCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.KVBucketInfo == nil || ccResp.Config.History != 3 {
+		t.Fatalf("Unexpected response: %+v %+v", ccResp.Error, ccResp.KVBucketInfo)
+	}
+
+	put := func(key, value string, hdrs ...string) string {
+		t.Helper()
+		m := nats.NewMsg(fmt.Sprintf(server.KVSubjectT, "TEST", key))
+		for i := 0; i < len(hdrs); i += 2 {
+			// Set directly to avoid canonical form of the KV header.
+			m.Header[hdrs[i]] = []string{hdrs[i+1]}
+		}
+		m.Data = []byte(value)
+		resp, _ := nc.RequestMsg(m, time.Second)
+		if resp == nil {
+			t.Fatalf("No response, possible timeout?")
+		}
+		return string(resp.Data)
+	}
+	expectRevision := func(resp string, rev uint64) {
+		t.Helper()
+		if !strings.HasPrefix(resp, "+OK {") {
+			t.Fatalf("Expected a JetStreamPubAck, got %q", resp)
+		}
+		var pubAck server.PubAck
+		if err := json.Unmarshal([]byte(resp[3:]), &pubAck); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if pubAck.Seq != rev {
+			t.Fatalf("Expected revision %d, got %d", rev, pubAck.Seq)
+		}
+	}
+	expectErr := func(resp string) {
+		t.Helper()
+		if !strings.HasPrefix(resp, "-ERR") {
+			t.Fatalf("Expected an error, got %q", resp)
+		}
+	}
+	get := func(key string, rev uint64) (*server.KVEntry, *server.ApiError) {
+		t.Helper()
+		req, _ := json.Marshal(&server.JSApiKVGetRequest{Key: key, Revision: rev})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiKVGetT, "TEST"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var gResp server.JSApiKVGetResponse
+		if err := json.Unmarshal(resp.Data, &gResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return gResp.Entry, gResp.Error
+	}
+	expectValue := func(key, value string, rev uint64) {
+		t.Helper()
+		entry, apiErr := get(key, 0)
+		if apiErr != nil {
+			t.Fatalf("Unexpected error: %+v", apiErr)
+		}
+		if entry.Key != key || string(entry.Value) != value || entry.Revision != rev {
+			t.Fatalf("Unexpected entry: %+v", entry)
+		}
+	}
+	expectNotFound := func(key string, rev uint64) {
+		t.Helper()
+		if _, apiErr := get(key, rev); apiErr == nil || apiErr.Code != 404 {
+			t.Fatalf("Expected a not found error, got %+v", apiErr)
+		}
+	}
+
+	// Put and get.
+	expectRevision(put("name", "derek"), 1)
+	expectValue("name", "derek", 1)
+	expectNotFound("age", 0)
+
+	// Update only if at a given revision.
+	expectRevision(put("name", "ivan", server.JSExpectedLastSubjSeq, "1"), 2)
+	expectErr(put("name", "waldemar", server.JSExpectedLastSubjSeq, "1"))
+	expectValue("name", "ivan", 2)
+
+	// Create only if it does not exist.
+	expectErr(put("name", "waldemar", server.JSExpectedLastSubjSeq, "0"))
+	expectRevision(put("age", "22", server.JSExpectedLastSubjSeq, "0"), 3)
+
+	// Delete keeps history, but allows a create again.
+	expectRevision(put("age", "", server.KVOperation, server.KVOperationDel), 4)
+	expectNotFound("age", 0)
+	if entry, _ := get("age", 3); entry == nil || string(entry.Value) != "22" {
+		t.Fatalf("Expected to get the prior revision, got %+v", entry)
+	}
+	expectRevision(put("age", "33", server.JSExpectedLastSubjSeq, "0"), 5)
+	expectValue("age", "33", 5)
+
+	// History is limited per key.
+	for i := 0; i < 3; i++ {
+		put("name", fmt.Sprintf("name-%d", i))
+	}
+	expectValue("name", "name-2", 8)
+	expectNotFound("name", 2)
+	if entry, _ := get("name", 6); entry == nil || string(entry.Value) != "name-0" {
+		t.Fatalf("Expected to get the prior revision, got %+v", entry)
+	}
+
+	// Purge removes all history.
+	expectRevision(put("age", "", server.KVOperation, server.KVOperationPurge), 9)
+	expectNotFound("age", 0)
+	expectNotFound("age", 3)
+	expectNotFound("age", 5)
+
+	// Info.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiKVInfoT, "TEST"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var iResp server.JSApiKVInfoResponse
+	if err := json.Unmarshal(resp.Data, &iResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 3 revisions for name and the purge marker for age.
+	if iResp.Error != nil || iResp.KVBucketInfo == nil || iResp.Values != 4 {
+		t.Fatalf("Unexpected response: %+v %+v", iResp.Error, iResp.KVBucketInfo)
+	}
+
+	// Watch.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	req, _ = json.Marshal(&server.JSApiKVWatchRequest{Key: "name", DeliverSubject: sub.Subject})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiKVWatchT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var wResp server.JSApiKVWatchResponse
+	if err := json.Unmarshal(resp.Data, &wResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if wResp.Error != nil || wResp.Consumer == "" {
+		t.Fatalf("Unexpected response: %+v", wResp)
+	}
+	put("name", "name-3")
+	for _, value := range []string{"name-0", "name-1", "name-2", "name-3"} {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(m.Data) != value {
+			t.Fatalf("Expected %q, got %q", value, m.Data)
+		}
+	}
+
+	// Delete the bucket.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiKVDeleteT, "TEST"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var dResp server.JSApiKVDeleteResponse
+	if err := json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Unexpected response: %+v", dResp)
+	}
+	expectNotFound("name", 0)
+}
+
+func TestJetStreamObjectStore(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Create the bucket.
+	req, _ := json.Marshal(&server.ObjectStoreConfig{Bucket: "TEST", Storage: server.FileStorage})
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectStoreCreateT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiObjectStoreCreateResponse
+	if err := json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.Error != nil || ccResp.ObjectStoreInfo == nil || ccResp.Config.Bucket != "TEST" {
+		t.Fatalf("Unexpected response: %+v %+v", ccResp.Error, ccResp.ObjectStoreInfo)
+	}
+
+	const chunkSize = 1024
+
+	// Publish the chunks and then request the put.
+	put := func(name string, data []byte, digest string) (*server.ObjectInfo, *server.ApiError) {
+		t.Helper()
+		id := nuid.Next()
+		info := server.ObjectInfo{Name: name, NUID: id, Size: uint64(len(data)), Digest: digest}
+		for i := 0; i < len(data); i += chunkSize {
+			end := i + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			resp, err := nc.Request(fmt.Sprintf(server.ObjChunkSubjectT, "TEST", id), data[i:end], time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(string(resp.Data), "+OK") {
+				t.Fatalf("Unexpected response: %q", resp.Data)
+			}
+			info.Chunks++
+		}
+		req, _ := json.Marshal(&server.JSApiObjectPutRequest{ObjectInfo: info})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectPutT, "TEST"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pResp server.JSApiObjectPutResponse
+		if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return pResp.Info, pResp.Error
+	}
+	get := func(name string) ([]byte, *server.ApiError) {
+		t.Helper()
+		inbox := nats.NewInbox()
+		sub, _ := nc.SubscribeSync(inbox)
+		defer sub.Unsubscribe()
+		nc.Flush()
+
+		req, _ := json.Marshal(&server.JSApiObjectGetRequest{Name: name, DeliverSubject: inbox})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectGetT, "TEST"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var gResp server.JSApiObjectGetResponse
+		if err := json.Unmarshal(resp.Data, &gResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if gResp.Error != nil {
+			return nil, gResp.Error
+		}
+		var data []byte
+		for i := uint32(0); i < gResp.Info.Chunks; {
+			m, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Respond to flow control requests, a status in place of a chunk is an error.
+			if len(m.Data) == 0 && m.Reply != "" {
+				m.Respond(nil)
+				continue
+			}
+			if status := m.Header.Get("Status"); status != "" {
+				return nil, &server.ApiError{Code: 500, Description: m.Header.Get("Description")}
+			}
+			data = append(data, m.Data...)
+			i++
+		}
+		if uint64(len(data)) != gResp.Info.Size {
+			t.Fatalf("Expected %d bytes, got %d", gResp.Info.Size, len(data))
+		}
+		return data, nil
+	}
+	list := func() []*server.ObjectInfo {
+		t.Helper()
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectListT, "TEST"), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var lResp server.JSApiObjectListResponse
+		if err := json.Unmarshal(resp.Data, &lResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if lResp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", lResp.Error)
+		}
+		return lResp.Objects
+	}
+	expectNotFound := func(name string) {
+		t.Helper()
+		if _, apiErr := get(name); apiErr == nil || apiErr.Code != 404 {
+			t.Fatalf("Expected a not found error, got %+v", apiErr)
+		}
+	}
+
+	a := make([]byte, 2500)
+	rand.Read(a)
+	info, apiErr := put("a", a, "")
+	if apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	if info.Chunks != 3 || info.Size != 2500 || !strings.HasPrefix(info.Digest, "SHA-256=") {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	if data, apiErr := get("a"); apiErr != nil || !bytes.Equal(data, a) {
+		t.Fatalf("Unexpected get result: %+v", apiErr)
+	}
+
+	// A wrong digest or size should be rejected.
+	if _, apiErr := put("bad", a, "SHA-256=bad"); apiErr == nil {
+		t.Fatalf("Expected an error for a digest mismatch")
+	}
+	expectNotFound("bad")
+
+	b := []byte("Hello Objects")
+	if _, apiErr := put("b", b, ""); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	if objs := list(); len(objs) != 2 || objs[0].Name != "a" || objs[1].Name != "b" {
+		t.Fatalf("Unexpected list: %+v", objs)
+	}
+
+	// Replace "a", which should remove the prior version's chunks.
+	a = a[:1500]
+	if _, apiErr := put("a", a, ""); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	if data, apiErr := get("a"); apiErr != nil || !bytes.Equal(data, a) {
+		t.Fatalf("Unexpected get result: %+v", apiErr)
+	}
+	mset, err := s.GlobalAccount().LookupObjectStore("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// 2 chunks and meta for "a", 1 chunk and meta for "b", and the 3 orphaned chunks for "bad".
+	if state := mset.State(); state.Msgs != 8 {
+		t.Fatalf("Expected 8 msgs, got %d", state.Msgs)
+	}
+
+	// Links.
+	link := func(name string, target *server.ObjectLink) *server.ApiError {
+		t.Helper()
+		req, _ := json.Marshal(&server.JSApiObjectLinkRequest{Name: name, Link: target})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiObjectLinkT, "TEST"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var lResp server.JSApiObjectLinkResponse
+		if err := json.Unmarshal(resp.Data, &lResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return lResp.Error
+	}
+	if apiErr := link("c", &server.ObjectLink{Bucket: "TEST", Name: "b"}); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	if data, apiErr := get("c"); apiErr != nil || !bytes.Equal(data, b) {
+		t.Fatalf("Unexpected get result: %+v", apiErr)
+	}
+	if apiErr := link("d", &server.ObjectLink{Bucket: "TEST", Name: "c"}); apiErr == nil {
+		t.Fatalf("Expected an error linking to a link")
+	}
+	if apiErr := link("d", &server.ObjectLink{Bucket: "TEST", Name: "zzz"}); apiErr == nil || apiErr.Code != 404 {
+		t.Fatalf("Expected a not found error, got %+v", apiErr)
+	}
+
+	// Delete "b", the link should no longer resolve.
+	req, _ = json.Marshal(&server.JSApiObjectRemoveRequest{Name: "b"})
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiObjectRemoveT, "TEST"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var rResp server.JSApiObjectRemoveResponse
+	if err := json.Unmarshal(resp.Data, &rResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !rResp.Success || rResp.Error != nil {
+		t.Fatalf("Unexpected response: %+v", rResp)
+	}
+	expectNotFound("b")
+	expectNotFound("c")
+	if objs := list(); len(objs) != 2 || objs[0].Name != "a" || objs[1].Name != "c" {
+		t.Fatalf("Unexpected list: %+v", objs)
+	}
+
+	// Now remove a chunk from "a" underneath of the object store.
+	info, err = mset.ObjectInfo("a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	chunkSubj := fmt.Sprintf(server.ObjChunkSubjectT, "TEST", info.NUID)
+	for seq := mset.State().FirstSeq; ; seq++ {
+		if sm, err := mset.GetMsg(seq); err == nil && sm.Subject == chunkSubj {
+			if _, err := mset.DeleteMsg(seq); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			break
+		}
+	}
+	if _, apiErr := get("a"); apiErr == nil || apiErr.Description != "object digest mismatch" {
+		t.Fatalf("Expected a digest mismatch error, got %+v", apiErr)
+	}
+
+	// Replace the chunk with different data, this is only caught as the chunks are delivered.
+	if _, err := nc.Request(chunkSubj, []byte("bad"), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, apiErr := get("a"); apiErr == nil || apiErr.Description != "Object Digest Mismatch" {
+		t.Fatalf("Expected a digest mismatch status, got %+v", apiErr)
+	}
+
+	// Large objects are paced with flow control.
+	big := make([]byte, 3*server.JsFlowControlWindow)
+	rand.Read(big)
+	if _, apiErr := put("big", big, ""); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+	if data, apiErr := get("big"); apiErr != nil || !bytes.Equal(data, big) {
+		t.Fatalf("Unexpected get result: %+v", apiErr)
+	}
+
+	// Without a response to the flow control request delivery stalls.
+	inbox := nats.NewInbox()
+	sub, _ := nc.SubscribeSync(inbox)
+	defer sub.Unsubscribe()
+	nc.Flush()
+	req, _ = json.Marshal(&server.JSApiObjectGetRequest{Name: "big", DeliverSubject: inbox})
+	if _, err := nc.Request(fmt.Sprintf(server.JSApiObjectGetT, "TEST"), req, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	chunks := server.JsFlowControlWindow / chunkSize
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if nmsgs, _, _ := sub.Pending(); nmsgs != chunks+1 {
+			return fmt.Errorf("expected %d msgs pending, got %d", chunks+1, nmsgs)
+		}
+		return nil
+	})
+	time.Sleep(100 * time.Millisecond)
+	if nmsgs, _, _ := sub.Pending(); nmsgs != chunks+1 {
+		t.Fatalf("Expected delivery to stall at %d msgs, got %d", chunks+1, nmsgs)
+	}
+}
+
+func TestJetStreamObjectStoreConcurrentPuts(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddObjectStore(&server.ObjectStoreConfig{Bucket: "TEST", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Store the chunks for a number of versions of the same object.
+	var infos []*server.ObjectInfo
+	for i := 0; i < 20; i++ {
+		id := nuid.Next()
+		if _, err := nc.Request(fmt.Sprintf(server.ObjChunkSubjectT, "TEST", id), []byte("ok"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		infos = append(infos, &server.ObjectInfo{Name: "a", NUID: id, Size: 2, Chunks: 1})
+	}
+
+	// Put them all at once, we should be left with only one version.
+	var wg sync.WaitGroup
+	for _, info := range infos {
+		wg.Add(1)
+		go func(info *server.ObjectInfo) {
+			defer wg.Done()
+			if _, err := mset.PutObject(info); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}(info)
+	}
+	wg.Wait()
+
+	if state := mset.State(); state.Msgs != 2 {
+		t.Fatalf("Expected a single chunk and metadata message, got %d msgs", state.Msgs)
+	}
+	if objs, err := mset.ListObjects(); err != nil || len(objs) != 1 {
+		t.Fatalf("Expected a single object, got %d %v", len(objs), err)
+	}
+}
+
+func TestJetStreamMirror(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	origin, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "S", Subjects: []string{"foo"}, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer origin.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "foo", fmt.Sprintf("MSG: %d", i+1))
+	}
+	// Create a gap, the mirror should keep the same sequences.
+	if _, err := origin.DeleteMsg(5); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	createStream := func(cfg *server.StreamConfig) *server.JSApiStreamCreateResponse {
+		t.Helper()
+		req, _ := json.Marshal(cfg)
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var scResp server.JSApiStreamCreateResponse
+		if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &scResp
+	}
+	checkState := func(name string, msgs, first, last uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			mset, err := s.GlobalAccount().LookupStream(name)
+			if err != nil {
+				return err
+			}
+			if state := mset.State(); state.Msgs != msgs || state.FirstSeq != first || state.LastSeq != last {
+				return fmt.Errorf("expected %d msgs from %d to %d, got %+v", msgs, first, last, state)
+			}
+			return nil
+		})
+	}
+
+	// Mirrors can not have subjects.
+	if scResp := createStream(&server.StreamConfig{Name: "M", Subjects: []string{"bar"}, Mirror: &server.StreamSource{Name: "S"}}); scResp.Error == nil {
+		t.Fatalf("Expected an error for a mirror with subjects")
+	}
+	scResp := createStream(&server.StreamConfig{Name: "M", Storage: server.MemoryStorage, Mirror: &server.StreamSource{Name: "S"}})
+	if scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	if len(scResp.Config.Subjects) != 0 {
+		t.Fatalf("Expected no subjects for a mirror, got %v", scResp.Config.Subjects)
+	}
+	checkState("M", 9, 1, 10)
+
+	mirror, err := s.GlobalAccount().LookupStream("M")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := mirror.GetMsg(5); err == nil {
+		t.Fatalf("Expected sequence 5 to be missing in the mirror")
+	}
+	if sm, err := mirror.GetMsg(6); err != nil || sm.Subject != "foo" || string(sm.Data) != "MSG: 6" {
+		t.Fatalf("Unexpected msg: %+v %v", sm, err)
+	}
+
+	// New messages should flow through.
+	for i := 10; i < 15; i++ {
+		sendStreamMsg(t, nc, "foo", fmt.Sprintf("MSG: %d", i+1))
+	}
+	checkState("M", 14, 1, 15)
+
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, "M"), nil, time.Second)
+		if err != nil {
+			return err
+		}
+		var siResp server.JSApiStreamInfoResponse
+		if err := json.Unmarshal(resp.Data, &siResp); err != nil {
+			return err
+		}
+		mi := siResp.Mirror
+		if mi == nil || mi.Name != "S" {
+			return fmt.Errorf("unexpected mirror info: %+v", mi)
+		}
+		if mi.Lag != 0 || mi.Active < 0 {
+			return fmt.Errorf("expected no lag and to be active, got %+v", mi)
+		}
+		return nil
+	})
+
+	// Can not change the mirror.
+	cfg := mirror.Config()
+	cfg.Mirror = &server.StreamSource{Name: "X"}
+	if err := mirror.Update(&cfg); err == nil {
+		t.Fatalf("Expected an error changing the mirror")
+	}
+
+	// A mirror that starts at a given sequence.
+	if scResp := createStream(&server.StreamConfig{Name: "M2", Mirror: &server.StreamSource{Name: "S", OptStartSeq: 12}}); scResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", scResp.Error)
+	}
+	checkState("M2", 4, 12, 15)
+}
+
+func TestJetStreamSources(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "ORDERS_EU", Subjects: []string{"orders.eu.*"}, Storage: server.FileStorage},
+		{Name: "ORDERS_US", Subjects: []string{"orders.us.*"}, Storage: server.FileStorage},
+	} {
+		if _, err := s.GlobalAccount().AddStream(cfg); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "orders.eu.new", fmt.Sprintf("EU: %d", i+1))
+		sendStreamMsg(t, nc, "orders.us.new", fmt.Sprintf("US: %d", i+1))
+		sendStreamMsg(t, nc, "orders.us.cancel", fmt.Sprintf("US: %d", i+1))
+	}
+
+	// Sources have to be unique.
+	if _, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:    "ORDERS_ALL",
+		Sources: []*server.StreamSource{{Name: "ORDERS_EU"}, {Name: "ORDERS_EU"}},
+	}); err == nil {
+		t.Fatalf("Expected an error for duplicate sources")
+	}
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:    "ORDERS_ALL",
+		Storage: server.FileStorage,
+		Sources: []*server.StreamSource{
+			{Name: "ORDERS_EU"},
+			{Name: "ORDERS_US", FilterSubject: "orders.us.new"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if cfg := mset.Config(); len(cfg.Subjects) != 0 {
+		t.Fatalf("Expected no subjects, got %v", cfg.Subjects)
+	}
+
+	checkMsgs := func(mset *server.Stream, expected uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if state := mset.State(); state.Msgs != expected {
+				return fmt.Errorf("expected %d msgs, got %d", expected, state.Msgs)
+			}
+			return nil
+		})
+	}
+	checkMsgs(mset, 10)
+
+	// Each message records where it came from.
+	counts := make(map[string]int)
+	for seq := uint64(1); seq <= 10; seq++ {
+		sm, err := mset.GetMsg(seq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sm.Subject == "orders.us.cancel" {
+			t.Fatalf("Did not expect a filtered out message")
+		}
+		if !bytes.Contains(sm.Header, []byte(server.JSStreamSource+": ORDERS_")) {
+			t.Fatalf("Expected a stream source header, got %q", sm.Header)
+		}
+		counts[strings.Split(sm.Subject, ".")[1]]++
+	}
+	if counts["eu"] != 5 || counts["us"] != 5 {
+		t.Fatalf("Unexpected counts: %+v", counts)
+	}
+
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, "ORDERS_ALL"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var siResp server.JSApiStreamInfoResponse
+	if err := json.Unmarshal(resp.Data, &siResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(siResp.Sources) != 2 || siResp.Sources[0].Name != "ORDERS_EU" || siResp.Sources[1].Name != "ORDERS_US" {
+		t.Fatalf("Unexpected sources info: %+v", siResp.Sources)
+	}
+
+	// Restart, we should pick up where we left off without duplicates.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, "orders.eu.new", "EU: 6")
+	sendStreamMsg(t, nc, "orders.us.new", "US: 6")
+
+	if mset, err = s.GlobalAccount().LookupStream("ORDERS_ALL"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkMsgs(mset, 12)
+	// Make sure nothing else shows up.
+	time.Sleep(250 * time.Millisecond)
+	checkMsgs(mset, 12)
+}
+
+func TestJetStreamSourcesForgedHeader(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	if _, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ORIGIN", Subjects: []string{"origin"}, Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:     "AGG",
+		Subjects: []string{"agg"},
+		Storage:  server.MemoryStorage,
+		Sources:  []*server.StreamSource{{Name: "ORIGIN"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	checkMsgs := func(expected uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if state := mset.State(); state.Msgs != expected {
+				return fmt.Errorf("expected %d msgs, got %d", expected, state.Msgs)
+			}
+			return nil
+		})
+	}
+
+	sendStreamMsg(t, nc, "origin", "1")
+	checkMsgs(1)
+
+	// A publisher can not claim a message came from a source.
+	m := nats.NewMsg("agg")
+	m.Header.Set(server.JSStreamSource, "ORIGIN 1000")
+	m.Data = []byte("FORGED")
+	if _, err := nc.RequestMsg(m, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkMsgs(2)
+	sm, err := mset.GetMsg(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if bytes.Contains(sm.Header, []byte(server.JSStreamSource)) {
+		t.Fatalf("Expected the stream source header to be removed, got %q", sm.Header)
+	}
+
+	// Messages from the origin should still flow.
+	sendStreamMsg(t, nc, "origin", "2")
+	checkMsgs(3)
+}
+
+func TestJetStreamSourcesRetryAfterStoreError(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	if _, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ORIGIN", Subjects: []string{"origin"}, Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		sendStreamMsg(t, nc, "origin", fmt.Sprintf("MSG: %d", i+1))
+	}
+
+	// We can only store 2 of them.
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:    "AGG",
+		Storage: server.MemoryStorage,
+		MaxMsgs: 2,
+		Discard: server.DiscardNew,
+		Sources: []*server.StreamSource{{Name: "ORIGIN"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	checkMsgs := func(expected, last uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if state := mset.State(); state.Msgs != expected || state.LastSeq != last {
+				return fmt.Errorf("expected %d msgs up to %d, got %+v", expected, last, state)
+			}
+			return nil
+		})
+	}
+	checkMsgs(2, 2)
+
+	// Once there is room the message we could not store should be picked up.
+	mset.Purge()
+	checkMsgs(1, 3)
+	sm, err := mset.GetMsg(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(sm.Data) != "MSG: 3" {
+		t.Fatalf("Unexpected msg: %q", sm.Data)
+	}
+}
+
+func TestJetStreamMirrorRetryAfterStoreError(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	if _, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ORIGIN", Subjects: []string{"origin"}, Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		sendStreamMsg(t, nc, "origin", fmt.Sprintf("MSG: %d", i+1))
+	}
+
+	// We can only store 2 of them.
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:    "M",
+		Storage: server.FileStorage,
+		MaxMsgs: 2,
+		Discard: server.DiscardNew,
+		Mirror:  &server.StreamSource{Name: "ORIGIN"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	checkMsgs := func(expected, last uint64) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			if state := mset.State(); state.Msgs != expected || state.LastSeq != last {
+				return fmt.Errorf("expected %d msgs up to %d, got %+v", expected, last, state)
+			}
+			return nil
+		})
+	}
+	checkMsgs(2, 2)
+
+	// Once there is room the message we could not store should be picked up, not skipped.
+	mset.Purge()
+	checkMsgs(1, 3)
+	sm, err := mset.GetMsg(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(sm.Data) != "MSG: 3" {
+		t.Fatalf("Unexpected msg: %q", sm.Data)
+	}
+}
+
+func TestJetStreamRePublish(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	// The destination can not be captured by the stream itself.
+	if _, err := acc.AddStream(&server.StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo.>"},
+		RePublish: &server.RePublish{Source: "foo.>", Destination: "foo.rp.>"},
+	}); err == nil {
+		t.Fatalf("Expected an error for a republish destination that overlaps the stream")
+	}
+	// The transform needs to be valid.
+	if _, err := acc.AddStream(&server.StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo.>"},
+		RePublish: &server.RePublish{Source: "foo.*", Destination: "rp.$2"},
+	}); err == nil {
+		t.Fatalf("Expected an error for an invalid republish transform")
+	}
+	// The source needs to overlap the stream subjects.
+	if _, err := acc.AddStream(&server.StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo.>"},
+		RePublish: &server.RePublish{Source: "bar.*", Destination: "rp.$1"},
+	}); err == nil {
+		t.Fatalf("Expected an error for a republish source that does not overlap the stream")
+	}
+
+	mset, err := acc.AddStream(&server.StreamConfig{
+		Name:      "RP",
+		Subjects:  []string{"foo.>"},
+		Storage:   server.MemoryStorage,
+		RePublish: &server.RePublish{Source: "foo.*", Destination: "rp.$1"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sub, _ := nc.SubscribeSync("rp.>")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	sendStreamMsg(t, nc, "foo.a", "HELLO")
+	// Does not match the republish source.
+	sendStreamMsg(t, nc, "foo.b.c", "SKIP")
+	sendStreamMsg(t, nc, "foo.b", "WORLD")
+
+	checkRePublished := func(subj, stream, seq, data string) *nats.Msg {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.Subject != subj {
+			t.Fatalf("Expected subject %q, got %q", subj, m.Subject)
+		}
+		if v := m.Header.Get("Nats-Stream"); v != stream {
+			t.Fatalf("Expected stream header %q, got %q", stream, v)
+		}
+		if v := m.Header.Get("Nats-Sequence"); v != seq {
+			t.Fatalf("Expected sequence header %q, got %q", seq, v)
+		}
+		if string(m.Data) != data {
+			t.Fatalf("Expected data %q, got %q", data, m.Data)
+		}
+		return m
+	}
+	checkRePublished("rp.a", "RP", "1", "HELLO")
+	checkRePublished("rp.b", "RP", "3", "WORLD")
+
+	// Switch to headers only.
+	cfg := mset.Config()
+	cfg.RePublish = &server.RePublish{Destination: "hdrs.>", HeadersOnly: true}
+	if err := mset.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hsub, _ := nc.SubscribeSync("hdrs.>")
+	defer hsub.Unsubscribe()
+	nc.Flush()
+
+	sendStreamMsg(t, nc, "foo.b.c", "HELLO WORLD")
+
+	m, err := hsub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Subject != "hdrs.foo.b.c" {
+		t.Fatalf("Expected subject %q, got %q", "hdrs.foo.b.c", m.Subject)
+	}
+	if len(m.Data) != 0 {
+		t.Fatalf("Expected no payload, got %q", m.Data)
+	}
+	if v := m.Header.Get("Nats-Sequence"); v != "4" {
+		t.Fatalf("Expected sequence header of 4, got %q", v)
+	}
+	if v := m.Header.Get("Nats-Msg-Size"); v != "11" {
+		t.Fatalf("Expected msg size header of 11, got %q", v)
+	}
+	if _, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Did not expect a message on the old republish destination")
+	}
+}
+
+func TestJetStreamMsgTTL(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "TTL", Subjects: []string{"foo.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sendTTLMsg := func(subj, ttl string) (*server.PubAck, string) {
+				t.Helper()
+				m := nats.NewMsg(subj)
+				m.Header["Nats-TTL"] = []string{ttl}
+				m.Data = []byte("TOKEN")
+				resp, err := nc.RequestMsg(m, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if !strings.HasPrefix(string(resp.Data), "+OK ") {
+					return nil, string(resp.Data)
+				}
+				var pa server.PubAck
+				if err := json.Unmarshal(resp.Data[3:], &pa); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return &pa, ""
+			}
+
+			// Not allowed by default.
+			if _, errStr := sendTTLMsg("foo.a", "100ms"); !strings.Contains(errStr, "not allowed") {
+				t.Fatalf("Expected an error for a TTL that is not allowed, got %q", errStr)
+			}
+
+			cfg := mset.Config()
+			cfg.AllowMsgTTL = true
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, errStr := sendTTLMsg("foo.a", "soon"); !strings.Contains(errStr, "invalid per message TTL") {
+				t.Fatalf("Expected an error for an invalid TTL, got %q", errStr)
+			}
+
+			sendStreamMsg(t, nc, "foo.a", "KEEP")
+			if pa, errStr := sendTTLMsg("foo.b", "100ms"); pa == nil || pa.Seq != 2 {
+				t.Fatalf("Expected a pub ack for seq 2, got %+v %q", pa, errStr)
+			}
+			sendStreamMsg(t, nc, "foo.c", "KEEP")
+
+			if state := mset.State(); state.Msgs != 3 {
+				t.Fatalf("Expected 3 msgs, got %d", state.Msgs)
+			}
+			checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+				if state := mset.State(); state.Msgs != 2 || state.FirstSeq != 1 || state.LastSeq != 3 || state.Expired != 1 {
+					return fmt.Errorf("Expected the TTL msg to be expired, got %+v", state)
+				}
+				return nil
+			})
+			if _, err := mset.GetMsg(2); err == nil {
+				t.Fatalf("Expected msg 2 to be gone")
+			}
+		})
+	}
+}
+
+func TestJetStreamPurgeEx(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "P", Subjects: []string{"foo.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 10; i++ {
+				sendStreamMsg(t, nc, fmt.Sprintf("foo.%d", i%2), "OK")
+			}
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			// Leave the first 3 pending.
+			for i := 0; i < 3; i++ {
+				if _, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			purge := func(preq *server.JSApiStreamPurgeRequest) *server.JSApiStreamPurgeResponse {
+				t.Helper()
+				req, _ := json.Marshal(preq)
+				resp, err := nc.Request(fmt.Sprintf(server.JSApiStreamPurgeT, "P"), req, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				var pResp server.JSApiStreamPurgeResponse
+				if err = json.Unmarshal(resp.Data, &pResp); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return &pResp
+			}
+
+			if pResp := purge(&server.JSApiStreamPurgeRequest{Sequence: 5, Keep: 1}); pResp.Error == nil {
+				t.Fatalf("Expected an error with both sequence and keep")
+			}
+
+			// Purge everything below 5, the consumer should move past those.
+			if pResp := purge(&server.JSApiStreamPurgeRequest{Sequence: 5}); !pResp.Success || pResp.Purged != 4 {
+				t.Fatalf("Got a bad response %+v", pResp)
+			}
+			info := o.Info()
+			if info.AckFloor.StreamSeq != 4 || info.NumPending != 0 {
+				t.Fatalf("Expected ack floor of 4 and no pending, got %+v", info)
+			}
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sseq := o.StreamSeqFromReply(m.Reply); sseq != 5 {
+				t.Fatalf("Expected next msg to be 5, got %d", sseq)
+			}
+
+			// Keep only the last foo.1 message, which is 10, so removes 6 and 8.
+			if pResp := purge(&server.JSApiStreamPurgeRequest{Subject: "foo.1", Keep: 1}); !pResp.Success || pResp.Purged != 2 {
+				t.Fatalf("Got a bad response %+v", pResp)
+			}
+			if state := mset.State(); state.Msgs != 4 || state.FirstSeq != 5 {
+				t.Fatalf("Unexpected state %+v", state)
+			}
+			// The consumer should skip over the purged ones.
+			m, err = nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sseq := o.StreamSeqFromReply(m.Reply); sseq != 7 {
+				t.Fatalf("Expected next msg to be 7, got %d", sseq)
+			}
+
+			// Purge all foo.0 messages.
+			if pResp := purge(&server.JSApiStreamPurgeRequest{Subject: "foo.0"}); !pResp.Success || pResp.Purged != 3 {
+				t.Fatalf("Got a bad response %+v", pResp)
+			}
+			if state := mset.State(); state.Msgs != 1 || state.FirstSeq != 10 {
+				t.Fatalf("Unexpected state %+v", state)
+			}
+			info = o.Info()
+			if info.AckFloor.StreamSeq != 9 || info.NumPending != 0 {
+				t.Fatalf("Expected ack floor of 9 and no pending, got %+v", info)
+			}
+		})
+	}
+}
+
+func TestJetStreamSealedAndDenyDeletePurge(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:       "AUDIT",
+		Subjects:   []string{"audit.>"},
+		Storage:    server.FileStorage,
+		DenyDelete: true,
+		DenyPurge:  true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "audit.log", "ENTRY")
+	}
+
+	checkAPIError := func(subj string, req []byte, expected string) {
+		t.Helper()
+		resp, err := nc.Request(subj, req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var apiResp server.ApiResponse
+		if err := json.Unmarshal(resp.Data, &apiResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if apiResp.Error == nil || !strings.Contains(apiResp.Error.Description, expected) {
+			t.Fatalf("Expected an error containing %q, got %+v", expected, apiResp.Error)
+		}
+	}
+
+	dreq, _ := json.Marshal(&server.JSApiMsgDeleteRequest{Seq: 2})
+	checkAPIError(fmt.Sprintf(server.JSApiMsgDeleteT, "AUDIT"), dreq, "message delete not permitted")
+	checkAPIError(fmt.Sprintf(server.JSApiStreamPurgeT, "AUDIT"), nil, "stream purge not permitted")
+	if state := mset.State(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+
+	// Can not remove the protections.
+	cfg := mset.Config()
+	cfg.DenyDelete = false
+	if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "deny message deletes") {
+		t.Fatalf("Expected an error removing deny delete, got %v", err)
+	}
+	cfg = mset.Config()
+	cfg.DenyPurge = false
+	if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "deny purge") {
+		t.Fatalf("Expected an error removing deny purge, got %v", err)
+	}
+
+	// Now seal the stream.
+	cfg = mset.Config()
+	cfg.Sealed = true
+	if err := mset.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := nc.Request("audit.log", []byte("LATE"), time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(string(resp.Data), "stream is sealed") {
+		t.Fatalf("Expected an error publishing to a sealed stream, got %q", resp.Data)
+	}
+	if state := mset.State(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+
+	// No further changes are allowed.
+	cfg = mset.Config()
+	cfg.MaxMsgs = 100
+	req, _ := json.Marshal(&cfg)
+	checkAPIError(fmt.Sprintf(server.JSApiStreamUpdateT, "AUDIT"), req, "sealed stream")
+	cfg = mset.Config()
+	cfg.Sealed = false
+	if err := mset.Update(&cfg); err == nil {
+		t.Fatalf("Expected an error unsealing the stream")
+	}
+
+	// Make sure this is all still true after a restart.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream("AUDIT")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := mset.Config(); !cfg.Sealed || !cfg.DenyDelete || !cfg.DenyPurge {
+		t.Fatalf("Expected protections to be restored, got %+v", cfg)
+	}
+	if state := mset.State(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+}
+
+func TestJetStreamRollup(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "R", Subjects: []string{"agg.*"}, AllowRollup: true, DenyPurge: true}); err == nil {
+		t.Fatalf("Expected an error allowing rollups and denying purge")
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := acc.AddStream(&server.StreamConfig{Name: "R", Subjects: []string{"agg.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sendRollup := func(subj, rollup string) string {
+				t.Helper()
+				m := nats.NewMsg(subj)
+				m.Header[server.JSMsgRollup] = []string{rollup}
+				m.Data = []byte("SNAPSHOT")
+				resp, err := nc.RequestMsg(m, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return string(resp.Data)
+			}
+
+			for i := 0; i < 10; i++ {
+				sendStreamMsg(t, nc, fmt.Sprintf("agg.%d", i%2), "DELTA")
+			}
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			// Not allowed by default.
+			if resp := sendRollup("agg.0", server.JSMsgRollupSubject); !strings.Contains(resp, "rollup not permitted") {
+				t.Fatalf("Expected an error for a rollup that is not allowed, got %q", resp)
+			}
+
+			cfg := mset.Config()
+			cfg.AllowRollup = true
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp := sendRollup("agg.0", "bad"); !strings.Contains(resp, "invalid rollup") {
+				t.Fatalf("Expected an error for an invalid rollup, got %q", resp)
+			}
+
+			// Rollup agg.0, the 5 prior messages for it should be gone.
+			if resp := sendRollup("agg.0", server.JSMsgRollupSubject); !strings.HasPrefix(resp, "+OK") {
+				t.Fatalf("Unexpected response: %q", resp)
+			}
+			if state := mset.State(); state.Msgs != 6 || state.FirstSeq != 2 || state.LastSeq != 11 {
+				t.Fatalf("Unexpected state %+v", state)
+			}
+			if _, err := mset.GetMsg(9); err == nil {
+				t.Fatalf("Expected msg 9 to be rolled up")
+			}
+
+			// Now rollup the whole stream.
+			if resp := sendRollup("agg.1", server.JSMsgRollupAll); !strings.HasPrefix(resp, "+OK") {
+				t.Fatalf("Unexpected response: %q", resp)
+			}
+			if state := mset.State(); state.Msgs != 1 || state.FirstSeq != 12 || state.LastSeq != 12 {
+				t.Fatalf("Unexpected state %+v", state)
+			}
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sseq := o.StreamSeqFromReply(m.Reply); sseq != 12 {
+				t.Fatalf("Expected the consumer to move to the rollup msg 12, got %d", sseq)
+			}
+			if string(m.Data) != "SNAPSHOT" {
+				t.Fatalf("Unexpected msg data: %q", m.Data)
+			}
+		})
+	}
+}
+
+func TestJetStreamMsgSchedules(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "SCHED", Subjects: []string{"foo.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sendScheduled := func(subj, key, val string) string {
+				t.Helper()
+				m := nats.NewMsg(subj)
+				m.Header[key] = []string{val}
+				m.Data = []byte("LATER")
+				resp, err := nc.RequestMsg(m, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return string(resp.Data)
+			}
+
+			// Not allowed by default.
+			if resp := sendScheduled("foo.a", server.JSDelay, "100ms"); !strings.Contains(resp, "not permitted") {
+				t.Fatalf("Expected an error for a schedule that is not allowed, got %q", resp)
+			}
+
+			cfg := mset.Config()
+			cfg.AllowMsgSchedules = true
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp := sendScheduled("foo.a", server.JSDelay, "soon"); !strings.Contains(resp, "invalid message schedule") {
+				t.Fatalf("Expected an error for an invalid delay, got %q", resp)
+			}
+			if resp := sendScheduled("foo.a", server.JSScheduleAt, "tomorrow"); !strings.Contains(resp, "invalid message schedule") {
+				t.Fatalf("Expected an error for an invalid time, got %q", resp)
+			}
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			if resp := sendScheduled("foo.a", server.JSDelay, "250ms"); !strings.HasPrefix(resp, "+OK") {
+				t.Fatalf("Unexpected response: %q", resp)
+			}
+			at := time.Now().Add(250 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+			if resp := sendScheduled("foo.b", server.JSScheduleAt, at); !strings.HasPrefix(resp, "+OK") {
+				t.Fatalf("Unexpected response: %q", resp)
+			}
+			sendStreamMsg(t, nc, "foo.c", "NOW")
+
+			if scheduled := mset.Info().Scheduled; scheduled != 2 {
+				t.Fatalf("Expected 2 scheduled msgs, got %d", scheduled)
+			}
+
+			// The unscheduled message should be delivered first.
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(m.Data) != "NOW" {
+				t.Fatalf("Expected the unscheduled msg first, got %q", m.Data)
+			}
+			m.Respond(nil)
+
+			for i := 0; i < 2; i++ {
+				m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if string(m.Data) != "LATER" {
+					t.Fatalf("Unexpected msg data: %q", m.Data)
+				}
+				if sseq := o.StreamSeqFromReply(m.Reply); sseq < 4 {
+					t.Fatalf("Expected the due msg to be stored again, got seq %d", sseq)
+				}
+				if len(m.Header.Get(server.JSDelay)) > 0 || len(m.Header.Get(server.JSScheduleAt)) > 0 {
+					t.Fatalf("Expected the schedule headers to be removed, got %+v", m.Header)
+				}
+				m.Respond(nil)
+			}
+
+			if scheduled := mset.Info().Scheduled; scheduled != 0 {
+				t.Fatalf("Expected no scheduled msgs, got %d", scheduled)
+			}
+			if state := mset.State(); state.Msgs != 3 || state.FirstSeq != 3 || state.LastSeq != 5 {
+				t.Fatalf("Unexpected state %+v", state)
+			}
+		})
+	}
+}
+
+func TestJetStreamMsgSchedulesNotAllowed(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "SCHED", Subjects: []string{"foo"}, AllowMsgSchedules: true})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	m := nats.NewMsg("foo")
+	m.Header[server.JSDelay] = []string{"1h"}
+	m.Data = []byte("LATER")
+	if resp, err := nc.RequestMsg(m, time.Second); err != nil || !strings.HasPrefix(string(resp.Data), "+OK") {
+		t.Fatalf("Unexpected response: %v %v", resp, err)
+	}
+	if _, err := nc.Request(o.RequestNextMsgSubject(), nil, 250*time.Millisecond); err == nil {
+		t.Fatalf("Expected the held msg to not be delivered")
+	}
+
+	o2, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D2", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o2.Delete()
+
+	// Once the stream does not allow schedules the message is not held and delivered as is.
+	cfg := mset.Config()
+	cfg.AllowMsgSchedules = false
+	if err := mset.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	m, err = nc.Request(o2.RequestNextMsgSubject(), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(m.Data) != "LATER" || m.Header.Get(server.JSDelay) != "1h" {
+		t.Fatalf("Unexpected msg: %q %+v", m.Data, m.Header)
+	}
+}
+
+func TestJetStreamMsgSchedulesServerRestart(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "SCHED"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage, AllowMsgSchedules: true})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	m := nats.NewMsg(mname)
+	m.Header[server.JSDelay] = []string{"500ms"}
+	m.Data = []byte("LATER")
+	if resp, err := nc.RequestMsg(m, time.Second); err != nil || !strings.HasPrefix(string(resp.Data), "+OK") {
+		t.Fatalf("Unexpected response: %v %v", resp, err)
+	}
+	nc.Close()
+
+	if scheduled := mset.Info().Scheduled; scheduled != 1 {
+		t.Fatalf("Expected 1 scheduled msg, got %d", scheduled)
+	}
+
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+
+	// Restart, the held message should be recovered and delivered when due.
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream(mname)
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", mname)
+	}
+	if scheduled := mset.Info().Scheduled; scheduled > 1 {
+		t.Fatalf("Expected at most 1 scheduled msg, got %d", scheduled)
+	}
+	checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+		if scheduled := mset.Info().Scheduled; scheduled != 0 {
+			return fmt.Errorf("Expected no scheduled msgs, got %d", scheduled)
+		}
+		if state := mset.State(); state.Msgs != 1 || state.LastSeq != 2 {
+			return fmt.Errorf("Expected the due msg to be stored again, got %+v", state)
+		}
+		return nil
+	})
+	sm, err := mset.GetMsg(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(sm.Data) != "LATER" {
+		t.Fatalf("Unexpected msg data: %q", sm.Data)
+	}
+}
+
+func TestJetStreamConsumerDeadLetter(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			// Dead letters can name a stream that does not capture that name as a subject.
+			dlq, err := acc.AddStream(&server.StreamConfig{Name: "DLQ", Subjects: []string{"dlq.>"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer dlq.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			sub, _ := nc.SubscribeSync(nats.NewInbox())
+			defer sub.Unsubscribe()
+			nc.Flush()
+
+			for _, dl := range []string{"DLQ.*", "orders.dlq", "ORDERS"} {
+				if _, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckExplicit, DeadLetter: dl}); err == nil {
+					t.Fatalf("Expected an error for dead letter %q", dl)
+				}
+			}
+			if _, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckNone, DeadLetter: "DLQ"}); err == nil {
+				t.Fatalf("Expected an error for dead letter subject with no ack policy")
+			}
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{
+				DeliverSubject: sub.Subject,
+				AckPolicy:      server.AckExplicit,
+				AckWait:        25 * time.Millisecond,
+				MaxDeliver:     2,
+				DeadLetter:     "DLQ",
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			// Headers processed when the message was stored should not be copied.
+			m := nats.NewMsg("orders.a")
+			m.Header.Set(server.JSPubId, "A")
+			m.Data = []byte("POISON")
+			if _, err := nc.RequestMsg(m, time.Second); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			sendStreamMsg(t, nc, "orders.b", "BAD")
+
+			// Never ack the first one and terminate the second.
+			for i := 0; i < 3; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if string(m.Data) == "BAD" {
+					m.Respond(server.AckTerm)
+				}
+			}
+			checkFor(t, time.Second, 25*time.Millisecond, func() error {
+				if state := dlq.State(); state.Msgs != 2 {
+					return fmt.Errorf("Expected 2 msgs in the dead letter stream, got %d", state.Msgs)
+				}
+				return nil
+			})
+
+			expected := map[string]string{
+				"POISON": server.JSDeadLetterMaxDeliveries,
+				"BAD":    server.JSDeadLetterTerminated,
+			}
+			for seq := uint64(1); seq <= 2; seq++ {
+				sm, err := dlq.GetMsg(seq)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				reason, ok := expected[string(sm.Data)]
+				if !ok {
+					t.Fatalf("Unexpected dead letter %q", sm.Data)
+				}
+				delete(expected, string(sm.Data))
+				if sm.Subject != "DLQ" {
+					t.Fatalf("Expected dead letter subject of %q, got %q", "DLQ", sm.Subject)
+				}
+				sseq, subj, dcount := "1", "orders.a", "2"
+				if reason == server.JSDeadLetterTerminated {
+					sseq, subj, dcount = "2", "orders.b", "1"
+				}
+				for _, hdr := range []string{
+					server.JSDeadLetterStream + ": ORDERS\r\n",
+					server.JSDeadLetterConsumer + ": " + o.Name() + "\r\n",
+					server.JSDeadLetterSubject + ": " + subj + "\r\n",
+					server.JSDeadLetterSequence + ": " + sseq + "\r\n",
+					server.JSDeadLetterDeliveries + ": " + dcount + "\r\n",
+					server.JSDeadLetterReason + ": " + reason + "\r\n",
+				} {
+					if !bytes.Contains(sm.Header, []byte(hdr)) {
+						t.Fatalf("Expected dead letter header %q, got %q", hdr, sm.Header)
+					}
+				}
+				if bytes.Contains(sm.Header, []byte(server.JSPubId)) {
+					t.Fatalf("Expected the msg id header to be removed, got %q", sm.Header)
+				}
+			}
+
+			// A dead letter subject needs to be captured by a stream, until then
+			// we keep the message pending and retry.
+			o2, err := mset.AddConsumer(&server.ConsumerConfig{
+				DeliverSubject: sub.Subject,
+				AckPolicy:      server.AckExplicit,
+				AckWait:        25 * time.Millisecond,
+				DeadLetter:     "later.dlq",
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o2.Delete()
+
+			for i := 0; i < 2; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				m.Respond(server.AckTerm)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if info := o2.Info(); info.AckFloor.StreamSeq != 0 {
+				t.Fatalf("Expected terminated msgs to still be pending, got %+v", info.AckFloor)
+			}
+			// They should not be redelivered.
+			if m, err := sub.NextMsg(50 * time.Millisecond); err == nil {
+				t.Fatalf("Unexpected redelivery of %q", m.Data)
+			}
+
+			later, err := acc.AddStream(&server.StreamConfig{Name: "LATER", Subjects: []string{"later.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer later.Delete()
+
+			checkFor(t, time.Second, 25*time.Millisecond, func() error {
+				if state := later.State(); state.Msgs != 2 {
+					return fmt.Errorf("Expected 2 msgs in the dead letter stream, got %d", state.Msgs)
+				}
+				if info := o2.Info(); info.AckFloor.StreamSeq != 2 {
+					return fmt.Errorf("Expected terminated msgs to be acked, got %+v", info.AckFloor)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestJetStreamConsumerBackOff(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "BO", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckExplicit, BackOff: []time.Duration{time.Second, 0}}); err == nil {
+		t.Fatalf("Expected an error for a backoff value that is not positive")
+	}
+
+	backoff := []time.Duration{50 * time.Millisecond, 150 * time.Millisecond, 300 * time.Millisecond}
+	o, err := mset.AddConsumer(&server.ConsumerConfig{
+		DeliverSubject: sub.Subject,
+		AckPolicy:      server.AckExplicit,
+		MaxDeliver:     5,
+		BackOff:        backoff,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Delete()
+
+	if cfg := o.Config(); cfg.AckWait != backoff[0] {
+		t.Fatalf("Expected the ack wait to be the first backoff value, got %v", cfg.AckWait)
+	}
+
+	// An explicit ack wait should be kept.
+	o2, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:   "D",
+		AckPolicy: server.AckExplicit,
+		AckWait:   time.Minute,
+		BackOff:   backoff,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := o2.Config(); cfg.AckWait != time.Minute {
+		t.Fatalf("Expected the ack wait to be kept, got %v", cfg.AckWait)
+	}
+	o2.Delete()
+
+	sendStreamMsg(t, nc, "BO", "FAIL")
+
+	// The last backoff value is used for deliveries past the schedule.
+	waits := append(backoff, backoff[2])
+
+	var last time.Time
+	for i := 0; i <= len(waits); i++ {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Unexpected error on delivery %d: %v", i+1, err)
+		}
+		now := time.Now()
+		if i > 0 {
+			if elapsed := now.Sub(last); elapsed < waits[i-1]-10*time.Millisecond {
+				t.Fatalf("Expected redelivery %d to wait %v, got %v", i, waits[i-1], elapsed)
+			}
+		}
+		last = now
+	}
+	if _, err := sub.NextMsg(400 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no more deliveries past max deliver")
+	}
+}
+
+func TestJetStreamConsumerNakDelay(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "NAK", Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, AckWait: 10 * time.Second})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+
+			sendStreamMsg(t, nc, "NAK", "RETRY")
+
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for _, nak := range []string{`-NAK {"delay":"250ms"}`, `-NAK {"delay":250000000}`} {
+				start := time.Now()
+				m.Respond([]byte(nak))
+
+				// Should not be redelivered before the delay.
+				if _, err := nc.Request(o.RequestNextMsgSubject(), nil, 100*time.Millisecond); err == nil {
+					t.Fatalf("Expected no redelivery before the delay for %q", nak)
+				}
+				m, err = nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if elapsed := time.Since(start); elapsed < 240*time.Millisecond {
+					t.Fatalf("Expected redelivery after the delay for %q, got %v", nak, elapsed)
+				}
+				if string(m.Data) != "RETRY" {
+					t.Fatalf("Unexpected msg data: %q", m.Data)
+				}
+			}
+			// Anything else starting with a NAK is not one.
+			m.Respond([]byte("-NAKX"))
+			if _, err := nc.Request(o.RequestNextMsgSubject(), nil, 100*time.Millisecond); err == nil {
+				t.Fatalf("Expected no redelivery for an unknown ack")
+			}
+			// A plain NAK is redelivered right away.
+			m.Respond(server.AckNak)
+			if _, err := nc.Request(o.RequestNextMsgSubject(), nil, 100*time.Millisecond); err != nil {
+				t.Fatalf("Expected the msg to be redelivered, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJetStreamConsumerMultipleFilterSubjects(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}, Storage: st})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for _, cfg := range []*server.ConsumerConfig{
+				{Durable: "D", AckPolicy: server.AckExplicit, FilterSubject: "orders.created", FilterSubjects: []string{"orders.cancelled"}},
+				{Durable: "D", AckPolicy: server.AckExplicit, FilterSubjects: []string{"orders.*", "orders.created"}},
+				{Durable: "D", AckPolicy: server.AckExplicit, FilterSubjects: []string{"orders.created", "foo"}},
+			} {
+				if _, err := mset.AddConsumer(cfg); err == nil {
+					t.Fatalf("Expected an error for filter subjects %+v", cfg)
+				}
+			}
+
+			for _, subj := range []string{"created", "shipped", "cancelled", "created", "shipped", "cancelled", "shipped"} {
+				sendStreamMsg(t, nc, "orders."+subj, subj)
+			}
+
+			checkDelivered := func(o *server.Consumer, expected ...uint64) {
+				t.Helper()
+				for _, seq := range expected {
+					m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					if sseq := o.StreamSeqFromReply(m.Reply); sseq != seq {
+						t.Fatalf("Expected stream seq %d, got %d", seq, sseq)
+					}
+					m.Respond(nil)
+				}
+				if m, err := nc.Request(o.RequestNextMsgSubject(), nil, 100*time.Millisecond); err == nil {
+					t.Fatalf("Expected no more msgs, got %q", m.Data)
+				}
+			}
+
+			filters := []string{"orders.created", "orders.cancelled"}
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "ALL", AckPolicy: server.AckExplicit, FilterSubjects: filters})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+			checkDelivered(o, 1, 3, 4, 6)
+
+			// Deliver last should start with the most recent message across the filter subjects.
+			o, err = mset.AddConsumer(&server.ConsumerConfig{Durable: "LAST", AckPolicy: server.AckExplicit, DeliverPolicy: server.DeliverLast, FilterSubjects: filters})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+			checkDelivered(o, 6)
+
+			// Older messages for one filter should not be replayed because another filter is behind.
+			for i := 0; i < 3; i++ {
+				sendStreamMsg(t, nc, "orders.created", "created")
+			}
+			o, err = mset.AddConsumer(&server.ConsumerConfig{Durable: "LAST2", AckPolicy: server.AckExplicit, DeliverPolicy: server.DeliverLast, FilterSubjects: filters})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer o.Delete()
+			checkDelivered(o, 10)
+		})
+	}
+}
+
+func TestJetStreamConsumerFlowControl(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "FC", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, FlowControl: true}); err == nil {
+		t.Fatalf("Expected an error for flow control in pull mode")
+	}
+
+	msize := 8 * 1024
+	toSend := 100
+	data := strings.Repeat("Z", msize)
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "FC", data)
+	}
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckNone, FlowControl: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Delete()
+
+	window := server.JsFlowControlWindow / msize
+	received := 0
+	for received < toSend {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error after %d msgs: %v", received, err)
+		}
+		if m.Header.Get("Status") != "100" {
+			received++
+			continue
+		}
+		if m.Header.Get("Description") != "FlowControl Request" || m.Reply == "" {
+			t.Fatalf("Unexpected status msg %+v", m.Header)
+		}
+		if received%window != 0 {
+			t.Fatalf("Expected a flow control request after %d msgs, got one after %d", window, received)
+		}
+		// Delivery should stall until we respond.
+		if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Expected delivery to be stalled, got %+v", m.Header)
+		}
+		m.Respond(nil)
+	}
+}
+
+func TestJetStreamConsumerIdleHeartbeat(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "HB", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, Heartbeat: time.Second}); err == nil {
+		t.Fatalf("Expected an error for idle heartbeat in pull mode")
+	}
+
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	hb := 100 * time.Millisecond
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckNone, Heartbeat: hb})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Delete()
+
+	checkHeartbeat := func(lseq string) {
+		t.Helper()
+		start := time.Now()
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.Header.Get("Status") != "100" || m.Header.Get("Description") != "Idle Heartbeat" {
+			t.Fatalf("Expected an idle heartbeat, got %+v %q", m.Header, m.Data)
+		}
+		if elapsed := time.Since(start); elapsed < hb/2 {
+			t.Fatalf("Expected the heartbeat after being idle, got it after %v", elapsed)
+		}
+		if m.Header.Get(server.JSLastConsumerSeq) != lseq || m.Header.Get(server.JSLastStreamSeq) != lseq {
+			t.Fatalf("Expected last sequences of %s, got %+v", lseq, m.Header)
+		}
+	}
+	checkHeartbeat("0")
+
+	sendStreamMsg(t, nc, "HB", "OK")
+	sendStreamMsg(t, nc, "HB", "OK")
+	for i := 0; i < 2; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if string(m.Data) != "OK" {
+			t.Fatalf("Unexpected msg %+v %q", m.Header, m.Data)
+		}
+	}
+	checkHeartbeat("2")
+}
+
+func TestJetStreamConsumerUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "UPD"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, AckWait: time.Second, MaxDeliver: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendStreamMsg(t, nc, mname, "1")
+	sendStreamMsg(t, nc, mname, "2")
+	if _, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	sub, _ := nc.SubscribeSync(server.JSAdvisoryConsumerUpdatedPre + ".>")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	updateConsumer := func(stream string, cfg server.ConsumerConfig) *server.JSApiConsumerUpdateResponse {
+		t.Helper()
+		req, _ := json.Marshal(&server.CreateConsumerRequest{Stream: stream, Config: cfg})
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumerUpdateT, stream, cfg.Durable), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var cuResp server.JSApiConsumerUpdateResponse
+		if err := json.Unmarshal(resp.Data, &cuResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &cuResp
+	}
+
+	cfg := o.Config()
+	cfg.DeliverPolicy = server.DeliverNew
+	if resp := updateConsumer(mname, cfg); resp.Error == nil || !strings.Contains(resp.Error.Description, "deliver policy can not be updated") {
+		t.Fatalf("Expected an error updating the deliver policy, got %+v", resp.Error)
+	}
+	cfg = o.Config()
+	cfg.Durable = "NONE"
+	if resp := updateConsumer(mname, cfg); resp.Error == nil || resp.Error.Code != 404 {
+		t.Fatalf("Expected a not found error, got %+v", resp.Error)
+	}
+
+	cfg = o.Config()
+	cfg.Description = "updated"
+	cfg.AckWait = 2 * time.Second
+	cfg.MaxDeliver = 10
+	cfg.MaxWaiting = 10
+	resp := updateConsumer(mname, cfg)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	// Our state should be kept.
+	if resp.ConsumerInfo.NumPending != 1 || resp.Delivered.StreamSeq != 1 {
+		t.Fatalf("Expected the consumer state to be kept, got %+v", resp.ConsumerInfo)
+	}
+	if !reflect.DeepEqual(resp.Config, cfg) {
+		t.Fatalf("Expected config %+v, got %+v", cfg, resp.Config)
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var adv server.JSConsumerActionAdvisory
+	if err := json.Unmarshal(m.Data, &adv); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if adv.Action != server.ModifyEvent || adv.Consumer != "D" {
+		t.Fatalf("Unexpected advisory %+v", adv)
+	}
+
+	// The update should survive a restart.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream(mname)
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", mname)
+	}
+	if o = mset.LookupConsumer("D"); o == nil {
+		t.Fatalf("Expected to find the consumer")
+	}
+	if ncfg := o.Config(); !reflect.DeepEqual(ncfg, cfg) {
+		t.Fatalf("Expected config %+v after restart, got %+v", cfg, ncfg)
+	}
+}
+
+func TestJetStreamConsumerMaxAckPending(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "MAP", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckNone, MaxAckPending: 10}); err == nil {
+		t.Fatalf("Expected an error for max ack pending without an ack policy")
+	}
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, MaxAckPending: -1}); err == nil {
+		t.Fatalf("Expected an error for a negative max ack pending")
+	}
+
+	toSend := 50
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "MAP", "Hello World!")
+	}
+
+	adv, _ := nc.SubscribeSync(server.JSAdvisoryConsumerMaxAckPendingPre + ".>")
+	defer adv.Unsubscribe()
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	maxAckPending := 10
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckExplicit, MaxAckPending: maxAckPending})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Delete()
+
+	checkStalled := func() {
+		t.Helper()
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if nmsgs, _, _ := sub.Pending(); nmsgs != maxAckPending {
+				return fmt.Errorf("Expected %d msgs, got %d", maxAckPending, nmsgs)
+			}
+			return nil
+		})
+		// Make sure we do not get more.
+		time.Sleep(100 * time.Millisecond)
+		if nmsgs, _, _ := sub.Pending(); nmsgs != maxAckPending {
+			t.Fatalf("Expected delivery to stop at %d msgs, got %d", maxAckPending, nmsgs)
+		}
+		if info := o.Info(); !info.AckStalled || info.NumPending != maxAckPending {
+			t.Fatalf("Expected the consumer to be stalled, got %+v", info)
+		}
+	}
+	checkStalled()
+
+	m, err := adv.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var am server.JSConsumerMaxAckPendingAdvisory
+	if err := json.Unmarshal(m.Data, &am); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if am.Consumer != o.Name() || am.MaxAckPending != maxAckPending || am.NumPending != maxAckPending {
+		t.Fatalf("Unexpected advisory %+v", am)
+	}
+
+	// Ack half of them, should get those back.
+	for i := 0; i < maxAckPending/2; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		m.Respond(nil)
+	}
+	nc.Flush()
+	checkStalled()
+
+	// We should get an advisory each time we stall.
+	if _, err := adv.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected a second advisory: %v", err)
+	}
+
+	// Pull consumers with no wait should get a status when stalled.
+	po, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "P", AckPolicy: server.AckExplicit, MaxAckPending: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer po.Delete()
+	if _, err := nc.Request(po.RequestNextMsgSubject(), nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	req, _ := json.Marshal(&server.JSApiConsumerGetNextRequest{Batch: 1, NoWait: true})
+	m, err = nc.Request(po.RequestNextMsgSubject(), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if status := m.Header.Get("Status"); status != "409" {
+		t.Fatalf("Expected a 409 status, got %q", status)
+	}
+}
+
+func TestJetStreamConsumerMaxAckPendingAccountLimit(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	gacc := s.GlobalAccount()
+	al := &server.JetStreamAccountLimits{
+		MaxMemory:     -1,
+		MaxStore:      -1,
+		MaxStreams:    -1,
+		MaxConsumers:  -1,
+		MaxAckPending: 100,
+	}
+	if err := gacc.UpdateJetStreamLimits(al); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
+	}
+
+	mset, err := gacc.AddStream(&server.StreamConfig{Name: "MAP", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, MaxAckPending: 200}); err == nil {
+		t.Fatalf("Expected an error for max ack pending over the account limit")
+	}
+	// The account limit is the default.
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := o.Config(); cfg.MaxAckPending != 100 {
+		t.Fatalf("Expected max ack pending of 100, got %d", cfg.MaxAckPending)
+	}
+	// Adding the same durable again is ok.
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := o.Config()
+	cfg.MaxAckPending = 200
+	if err := o.Update(&cfg); err == nil {
+		t.Fatalf("Expected an error updating max ack pending over the account limit")
+	}
+	cfg.MaxAckPending = 50
+	if err := o.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := o.Config(); cfg.MaxAckPending != 50 {
+		t.Fatalf("Expected max ack pending of 50, got %d", cfg.MaxAckPending)
+	}
+}
+
+func TestJetStreamConsumerMaxAckPendingAccountLimitConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			A: {
+				jetstream: {max_mem: 1GB, max_store: 1TB, max_ack_pending: 10k}
+				users: [ {user: ua, password: pwd} ]
+			},
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	nc := clientConnectToServerWithUP(t, opts, "ua", "pwd")
+	defer nc.Close()
+
+	resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Limits.MaxAckPending != 10000 {
+		t.Fatalf("Expected MaxAckPending of %d, got %d", 10000, info.Limits.MaxAckPending)
+	}
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "MAP", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	// The account limit is the default.
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := o.Config(); cfg.MaxAckPending != 10000 {
+		t.Fatalf("Expected max ack pending of 10000, got %d", cfg.MaxAckPending)
+	}
+}
+
+func TestJetStreamConsumerPauseResumeSeek(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "PRS"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, mname, fmt.Sprintf("MSG-%d", i+1))
+	}
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fetch := func(expected uint64) {
+		t.Helper()
+		m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sseq := o.StreamSeqFromReply(m.Reply); sseq != expected {
+			t.Fatalf("Expected stream sequence %d, got %d", expected, sseq)
+		}
+	}
+	fetchNoWait := func() *nats.Msg {
+		t.Helper()
+		req, _ := json.Marshal(&server.JSApiConsumerGetNextRequest{Batch: 1, NoWait: true})
+		m, err := nc.Request(o.RequestNextMsgSubject(), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return m
+	}
+	apiRequest := func(subjT string, req []byte) *server.ConsumerInfo {
+		t.Helper()
+		resp, err := nc.Request(fmt.Sprintf(subjT, mname, "D"), req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var apiResp struct {
+			server.ApiResponse
+			*server.ConsumerInfo
+		}
+		if err := json.Unmarshal(resp.Data, &apiResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if apiResp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", apiResp.Error)
+		}
+		return apiResp.ConsumerInfo
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		fetch(seq)
+	}
+
+	// Pause, should not get any messages.
+	if info := apiRequest(server.JSApiConsumerPauseT, nil); !info.Paused {
+		t.Fatalf("Expected the consumer to be paused")
+	}
+	if m := fetchNoWait(); m.Header.Get("Status") != "409" {
+		t.Fatalf("Expected a 409 status while paused, got %q", m.Header.Get("Status"))
+	}
+	if !o.Info().Paused {
+		t.Fatalf("Expected the consumer info to report paused")
+	}
+
+	// Resume and continue where we left off.
+	if info := apiRequest(server.JSApiConsumerResumeT, nil); info.Paused {
+		t.Fatalf("Expected the consumer to not be paused")
+	}
+	fetch(4)
+
+	// Seek back, should drop pending.
+	req, _ := json.Marshal(&server.JSApiConsumerSeekRequest{Seq: 2})
+	info := apiRequest(server.JSApiConsumerSeekT, req)
+	if info.NumPending != 0 || info.NumRedelivered != 0 {
+		t.Fatalf("Expected no pending after seek, got %+v", info)
+	}
+	if info.Delivered.StreamSeq != 1 || info.AckFloor.StreamSeq != 1 {
+		t.Fatalf("Expected delivered and ack floor stream sequence of 1, got %+v", info)
+	}
+	// The consumer sequence starts over.
+	if info.Delivered.ConsumerSeq != 0 || info.AckFloor.ConsumerSeq != 0 {
+		t.Fatalf("Expected delivered and ack floor consumer sequence of 0, got %+v", info)
+	}
+	fetch(2)
+	if info := o.Info(); info.Delivered.ConsumerSeq != 1 {
+		t.Fatalf("Expected delivered consumer sequence of 1, got %+v", info.Delivered)
+	}
+
+	// Seek by time.
+	sm, err := mset.GetMsg(7)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	req, _ = json.Marshal(&server.JSApiConsumerSeekRequest{Time: &sm.Time})
+	apiRequest(server.JSApiConsumerSeekT, req)
+	fetch(7)
+
+	// Past the end we will wait for new messages.
+	req, _ = json.Marshal(&server.JSApiConsumerSeekRequest{Seq: 100})
+	if info := apiRequest(server.JSApiConsumerSeekT, req); info.Delivered.StreamSeq != uint64(toSend) {
+		t.Fatalf("Expected delivered stream sequence of %d, got %d", toSend, info.Delivered.StreamSeq)
+	}
+	if m := fetchNoWait(); m.Header.Get("Status") != "404" {
+		t.Fatalf("Expected a 404 status, got %q", m.Header.Get("Status"))
+	}
+	req, _ = json.Marshal(&server.JSApiConsumerSeekRequest{Seq: 5})
+	apiRequest(server.JSApiConsumerSeekT, req)
+
+	// Bad requests.
+	for _, req := range []string{"", "{}", `{"seq":1,"time":"2021-01-01T00:00:00Z"}`} {
+		resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumerSeekT, mname, "D"), []byte(req), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var sResp server.JSApiConsumerSeekResponse
+		if err := json.Unmarshal(resp.Data, &sResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sResp.Error == nil || sResp.Error.Code != 400 {
+			t.Fatalf("Expected a bad request error for %q, got %+v", req, sResp.Error)
+		}
+	}
+	resp, err := nc.Request(fmt.Sprintf(server.JSApiConsumerPauseT, mname, "NONE"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var pResp server.JSApiConsumerPauseResponse
+	if err := json.Unmarshal(resp.Data, &pResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pResp.Error == nil || pResp.Error.Code != 404 {
+		t.Fatalf("Expected a not found error, got %+v", pResp.Error)
+	}
+
+	// The seek and pause should have been persisted.
+	apiRequest(server.JSApiConsumerPauseT, nil)
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream(mname)
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", mname)
+	}
+	if o = mset.LookupConsumer("D"); o == nil {
+		t.Fatalf("Expected to find the consumer")
+	}
+	if info := o.Info(); info.Delivered.StreamSeq != 4 || info.NumPending != 0 || !info.Paused {
+		t.Fatalf("Expected the seek and pause to be persisted, got %+v", info)
+	}
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+	if m := fetchNoWait(); m.Header.Get("Status") != "409" {
+		t.Fatalf("Expected a 409 status while paused, got %q", m.Header.Get("Status"))
+	}
+	if err := o.Resume(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fetch(5)
+
+	// Seeking is not allowed when acks remove messages.
+	wq, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "WQ", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer wq.Delete()
+	wo, err := wq.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := wo.Seek(1); err == nil {
+		t.Fatalf("Expected an error seeking on a work queue stream")
+	}
+}
+
+func TestJetStreamConsumerInactiveThreshold(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "IT"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, mname, "Hello World!")
+
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit, InactiveThreshold: -1}); err == nil {
+		t.Fatalf("Expected an error for a negative inactive threshold")
+	}
+
+	adv, _ := nc.SubscribeSync(server.JSAdvisoryConsumerInactivePre + ".>")
+	defer adv.Unsubscribe()
+	nc.Flush()
+
+	thresh := 250 * time.Millisecond
+
+	checkDeleted := func(name string) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			if o := mset.LookupConsumer(name); o != nil {
+				return fmt.Errorf("Consumer %q still exists", name)
+			}
+			return nil
+		})
+		m, err := adv.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Expected an inactive advisory: %v", err)
+		}
+		var am server.JSConsumerInactiveAdvisory
+		if err := json.Unmarshal(m.Data, &am); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if am.Stream != mname || am.Consumer != name || am.InactiveThreshold != thresh {
+			t.Fatalf("Unexpected advisory %+v", am)
+		}
+	}
+
+	// Pull requests and acks keep a pull consumer around.
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "PULL", AckPolicy: server.AckExplicit, InactiveThreshold: thresh})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(thresh / 2)
+		m.Respond(nil)
+		nc.Flush()
+	}
+	if mset.LookupConsumer("PULL") == nil {
+		t.Fatalf("Expected the consumer to still exist")
+	}
+	checkDeleted("PULL")
+
+	// Push consumers are active while they have interest.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	nc.Flush()
+	if _, err = mset.AddConsumer(&server.ConsumerConfig{Durable: "PUSH", DeliverSubject: sub.Subject, AckPolicy: server.AckNone, InactiveThreshold: thresh}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	time.Sleep(3 * thresh)
+	if mset.LookupConsumer("PUSH") == nil {
+		t.Fatalf("Expected the consumer to still exist")
+	}
+	sub.Unsubscribe()
+	checkDeleted("PUSH")
+
+	// Paused consumers are kept.
+	o, err = mset.AddConsumer(&server.ConsumerConfig{Durable: "PAUSED", AckPolicy: server.AckExplicit, InactiveThreshold: thresh})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.Pause()
+	time.Sleep(3 * thresh)
+	if mset.LookupConsumer("PAUSED") == nil {
+		t.Fatalf("Expected the consumer to still exist")
+	}
+	o.Resume()
+	checkDeleted("PAUSED")
+
+	// The threshold can be set on an existing consumer.
+	o, err = mset.AddConsumer(&server.ConsumerConfig{Durable: "UPDATED", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := o.Config()
+	cfg.InactiveThreshold = thresh
+	if err := o.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkDeleted("UPDATED")
+}